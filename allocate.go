@@ -0,0 +1,115 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const allocateUsage = "allocate --deposit <id> --amount <pennies> [--bank-reference ref] [--value-date YYYY-MM-DD] [--preview] [--json]"
+
+// allocate runs `allocate --deposit 1 --amount 10000`, which receipts the amount against the deposit
+// and allocates it as the API does, or with --preview shows where it would go without recording it
+func allocate(c *cli, args []string) error {
+	flags := flag.NewFlagSet("allocate", flag.ContinueOnError)
+	depositID := flags.Uint("deposit", 0, "deposit the money was received for")
+	amount := flags.Uint("amount", 0, "amount received, in pennies")
+	bankReference := flags.String("bank-reference", "", "the bank's reference for the payment, so it is only receipted once")
+	valueDate := flags.String("value-date", "", "when the bank credited the payment, YYYY-MM-DD")
+	preview := flags.Bool("preview", false, "show where the receipt would go without recording anything")
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args, allocateUsage)
+	if err != nil {
+		return err
+	}
+	if *depositID == 0 || *amount == 0 || len(rest) > 0 {
+		return usageError{usage: allocateUsage}
+	}
+
+	receipt := &models.Receipt{Amount: *amount}
+	if *bankReference != "" {
+		receipt.BankReference = bankReference
+	}
+	if *valueDate != "" {
+		date, err := time.Parse("2006-01-02", *valueDate)
+		if err != nil {
+			return usageError{usage: allocateUsage, err: errors.Wrap(err, "invalid --value-date")}
+		}
+		receipt.ValueDate = &date
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+	store := repository.NewGorm(cfg.Database.DB)
+
+	deposit, err := store.Deposits().Get(*depositID)
+	if err != nil {
+		return errors.Wrapf(err, "deposit %d", *depositID)
+	}
+	receipt.DepositID = deposit.ID
+
+	allocationService := service.NewAllocationService(store, serviceOptions(cfg))
+	run := allocationService.AllocateReceipt
+	if *preview {
+		run = allocationService.PreviewReceipt
+	}
+
+	result, err := run(receipt, deposit)
+	if errors.Is(err, service.ErrDuplicateReceipt) {
+		// the payment was already receipted, so a script retrying it can carry on
+		existing, getErr := store.Receipts().Get(receipt.ID)
+		if getErr != nil {
+			return getErr
+		}
+		duplicate := map[string]interface{}{"status": "duplicate", "message": err.Error(), "receipt_id": existing.ID, "receipt": existing}
+		return output(*asJSON, duplicate, func() {
+			fmt.Printf("Already receipted as receipt %d: %v\n", existing.ID, err)
+		})
+	}
+	if errors.Is(err, service.ErrOverFunded) && !*preview { // the rejected receipt is still recorded
+		return errors.Wrapf(err, "receipt %d", receipt.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return output(*asJSON, result, func() {
+		printAllocation(result, deposit.ID, *preview)
+	})
+}
+
+func printAllocation(result *service.AllocationResult, depositID uint, preview bool) {
+	if preview {
+		fmt.Printf("Preview of %d against deposit %d, nothing recorded: %s\n", result.Amount, depositID, result.FundingDecision)
+	} else {
+		fmt.Printf("Receipt %d of %d against deposit %d: %s\n", result.ReceiptID, result.Amount, depositID, result.FundingDecision)
+	}
+	if result.ExcessAmount > 0 {
+		fmt.Printf("Excess over the deposit: %d, held in suspense: %d\n", result.ExcessAmount, result.SuspenseAmount)
+	}
+
+	for _, allocation := range result.Allocations {
+		account := fmt.Sprintf("account %d", allocation.AccountID)
+		if allocation.NewAccount {
+			account = "new account"
+		}
+		fmt.Printf("  %-4s %s in pot %d: %d", allocation.Wrapper, account, allocation.PotID, allocation.Amount)
+		if allocation.FromOverflow {
+			fmt.Print(", from overflow")
+		}
+		if allocation.Overflow > 0 {
+			fmt.Printf(", %d over to %s (%s)", allocation.Overflow, allocation.OverflowTo, allocation.Reason)
+		}
+		fmt.Println()
+	}
+
+	if result.NeedsReview {
+		fmt.Printf("Flagged for review: %s\n", result.ReviewReason)
+	}
+}
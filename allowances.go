@@ -0,0 +1,60 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const allowancesUsage = "allowances show --client <id> [--tax-year 2024] [--json]"
+
+// showAllowances runs `allowances show --client 1`, which shows how much of each wrapper's limit the
+// client has left this tax year, or in the tax year starting in --tax-year
+func showAllowances(c *cli, args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return usageError{usage: allowancesUsage}
+	}
+
+	flags := flag.NewFlagSet("allowances show", flag.ContinueOnError)
+	clientID := flags.Uint("client", 0, "client to show the allowances of")
+	taxYear := flags.Int("tax-year", 0, "tax year, e.g. 2024 for 2024/25, the current one by default")
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args[1:], allowancesUsage)
+	if err != nil {
+		return err
+	}
+	if *clientID == 0 || len(rest) > 0 {
+		return usageError{usage: allowancesUsage}
+	}
+
+	now := time.Now()
+	year := models.TaxYear(*taxYear)
+	if *taxYear == 0 {
+		year = models.TaxYearOf(now)
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+
+	statement, err := service.ClientAllowances(repository.NewGorm(cfg.Database.DB), *clientID, year, now)
+	if err != nil {
+		return errors.Wrapf(err, "client %d", *clientID)
+	}
+
+	return output(*asJSON, statement, func() {
+		fmt.Printf("Client %d allowances for %s\n", statement.ClientID, statement.TaxYear)
+		for _, allowance := range statement.Allowances {
+			fmt.Printf("  %-4s limit %9d  used %9d  remaining %9d", allowance.Wrapper, allowance.Limit, allowance.Used, allowance.Remaining)
+			if allowance.Basis != "" {
+				fmt.Printf("  (%s)", allowance.Basis)
+			}
+			fmt.Println()
+		}
+	})
+}
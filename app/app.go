@@ -6,9 +6,9 @@ import (
 
 var Http *config.AppConfig
 
-func Load(configFile string) {
+func Load(configFile string) error {
 	Http = &config.AppConfig{ConfigFile: configFile}
 
-	Http.Setup()
+	return Http.Setup()
 
 }
@@ -1,17 +1,42 @@
 package app
 
 import (
-	"flag"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// shippedConfig is config.yml pointing at a port nothing listens on, trying twice a millisecond apart
+func shippedConfig(t *testing.T) string {
+	shipped, err := os.ReadFile("../config.yml")
+	if err != nil {
+		t.Fatalf("Unable to read config.yml: %v", err)
+	}
+	yaml := strings.NewReplacer(
+		"host: localhost", "host: 127.0.0.1",
+		"port: 5432", "port: 1",
+		"attempts: 5", "attempts: 2",
+		"initial_backoff: 1s", "initial_backoff: 1ms",
+	).Replace(string(shipped))
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, []byte(yaml), 0o644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	return file
+}
+
 func TestLoad(t *testing.T) {
-	configFile := flag.String("config", "../config.yml", "User Config file from user")
+	configFile := shippedConfig(t)
 
-	Load(*configFile)
+	err := Load(configFile)
 
-	assert.NotNil(t, Http)
+	assert.ErrorContains(t, err, "connecting to database breezy on 127.0.0.1:1 after 2 attempts")
+	assert.ErrorContains(t, err, "connection refused")
 
-	assert.Equal(t, configFile, &Http.ConfigFile)
+	assert.NotNil(t, Http)
+	assert.Equal(t, configFile, Http.ConfigFile)
+	assert.Equal(t, 2, Http.Database.Retry.Attempts)
 }
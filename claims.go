@@ -0,0 +1,81 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const claimsUsage = "claims generate --month YYYY-MM [--out file] [--json]"
+
+// runClaims runs `claims generate --month 2026-09`, which claims the month's SIPP relief at source
+// and writes the HMRC interim claim file
+func runClaims(c *cli, args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return usageError{usage: claimsUsage}
+	}
+
+	flags := flag.NewFlagSet("claims generate", flag.ContinueOnError)
+	month := flags.String("month", "", "month to claim relief for, e.g. 2026-09")
+	out := flags.String("out", "", "claim file to write, relief-claim-<month>.csv by default")
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args[1:], claimsUsage)
+	if err != nil {
+		return err
+	}
+	if *month == "" || len(rest) > 0 {
+		return usageError{usage: claimsUsage}
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("relief-claim-%s.csv", *month)
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+
+	claim, err := service.GenerateReliefClaim(repository.NewGorm(cfg.Database.DB), *month, time.Now(), func(claim *service.ReliefClaimFile) error {
+		return writeClaim(claim, *out)
+	})
+	if err != nil {
+		return err
+	}
+
+	result := map[string]interface{}{
+		"claim":        claim,
+		"file":         *out,
+		"totals":       claim.Totals(),
+		"unreconciled": claim.Unreconciled(),
+	}
+	return output(*asJSON, result, func() {
+		totals := claim.Totals()
+		fmt.Printf("Relief claim for %s written to %s\n", claim.Period, *out)
+		fmt.Printf("Clients: %d, contributions: %d, newly claimed: %d\n", len(claim.Lines), totals.Contributions, claim.NewlyClaimed)
+		fmt.Printf("Net: %d, relief: %d, gross: %d (pennies)\n", totals.NetAmount, totals.ReliefAmount, totals.GrossAmount)
+		for _, line := range claim.Unreconciled() {
+			fmt.Printf("Warning: client %d net %d plus relief %d does not match gross %d\n", line.ClientID, line.NetAmount, line.ReliefAmount, line.GrossAmount)
+		}
+	})
+}
+
+// writeClaim writes the claim file, removing what was written if it can't be finished so a half
+// written claim isn't mistaken for one that was made
+func writeClaim(claim *service.ReliefClaimFile, out string) error {
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	err = claim.WriteCSV(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
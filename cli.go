@@ -0,0 +1,220 @@
+package main
+
+import (
+	"ajbell.co.uk/app"
+	"ajbell.co.uk/config"
+	"ajbell.co.uk/migrations"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+// exit statuses, so scripts can tell why a command failed
+const (
+	exitOK           = 0
+	exitFailure      = 1 // anything unexpected, e.g. the database is unreachable
+	exitUsage        = 2 // the arguments or config file can't be used
+	exitNotFound     = 3 // e.g. the deposit or client doesn't exist
+	exitRefused      = 4 // the rules refused it, e.g. a receipt over a wrapper limit
+	exitConflict     = 5 // e.g. a bank reference already receipted against another deposit
+	exitUnreconciled = 6 // reconcile found receipts whose allocations don't add up
+	exitSchemaBehind = 7 // the database is missing migrations
+)
+
+const usage = `usage: main [-config config.yml] <command> [arguments]
+
+Commands, all reading the same config file:
+  ` + serveUsage + `                 starts the API, the default when no command is given
+  help                  shows this
+  ` + migrateUsage + `
+  ` + allocateUsage + `
+  ` + depositsUsage + `
+  ` + allowancesUsage + `
+  ` + reconcileUsage + `
+  ` + claimsUsage + `
+
+--json writes the result as JSON for scripts. Errors are written to stderr and the exit status is
+0 on success, 1 on an unexpected failure, 2 for bad arguments, 3 when something isn't found, 4 when
+the rules refuse it, 5 on a conflict, 6 when reconcile finds discrepancies and 7 when the database
+is missing migrations.`
+
+// commands are the binary's subcommands, each run with the arguments after its name
+var commands = map[string]func(c *cli, args []string) error{
+	"serve":      serve,
+	"migrate":    runMigrate,
+	"allocate":   allocate,
+	"deposits":   showDeposit,
+	"allowances": showAllowances,
+	"reconcile":  reconcile,
+	"claims":     runClaims,
+}
+
+// cli is what every command shares, the config is only loaded by commands that need it
+type cli struct {
+	configFile string
+	cfg        *config.AppConfig // once loaded
+}
+
+// load reads the config file and connects to the database
+func (c *cli) load() (*config.AppConfig, error) {
+	if err := app.Load(c.configFile); err != nil {
+		return nil, err
+	}
+	c.cfg = app.Http
+	if err := checkConfig(c.cfg); err != nil {
+		return nil, err
+	}
+	return c.cfg, nil
+}
+
+// checkConfig returns config.ErrInvalidConfig when the config names a receipt policy that doesn't exist
+func checkConfig(cfg *config.AppConfig) error {
+	if err := serviceOptions(cfg).Validate(); err != nil {
+		return errors.Wrap(config.ErrInvalidConfig, err.Error())
+	}
+	return nil
+}
+
+// close closes the database pool, if a command connected to the database
+func (c *cli) close() error {
+	if c.cfg == nil {
+		return nil
+	}
+	return c.cfg.Database.Close()
+}
+
+// loadCurrent loads the config, as long as the database has every migration applied, and brings
+// the wrapper limits into line with it
+func (c *cli) loadCurrent() (*config.AppConfig, error) {
+	cfg, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSchema(cfg.Database.DB); err != nil {
+		return nil, err
+	}
+	if err := migrations.SyncLimits(cfg.Database.DB, cfg.Limits); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// run runs the command named by the first argument, serve when there isn't one, and returns the
+// status to exit with
+func run(c *cli, args []string) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		fmt.Println(usage)
+		return exitOK
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", name, usage)
+		return exitUsage
+	}
+
+	err := command(c, args)
+	if closeErr := c.close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Println(err)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	var usageErr usageError
+	switch {
+	case err == nil || errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr), errors.Is(err, config.ErrInvalidConfig):
+		return exitUsage
+	case errors.Is(err, repository.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, service.ErrLimitExceeded), errors.Is(err, service.ErrNotEligible),
+		errors.Is(err, service.ErrAccountClosed), errors.Is(err, service.ErrOverFunded),
+		errors.Is(err, service.ErrClaimPeriodOpen):
+		return exitRefused
+	case errors.Is(err, service.ErrBankReferenceInUse), errors.Is(err, repository.ErrConflict):
+		return exitConflict
+	case errors.Is(err, errUnreconciled):
+		return exitUnreconciled
+	case errors.Is(err, migrations.ErrSchemaBehind):
+		return exitSchemaBehind
+	default:
+		return exitFailure
+	}
+}
+
+// usageError is returned when a command can't run with its arguments, and prints the command's usage
+type usageError struct {
+	usage string
+	err   error // why the arguments can't be used, if there is more to say than the usage
+}
+
+func (e usageError) Error() string {
+	if e.err == nil || errors.Is(e.err, flag.ErrHelp) {
+		return "usage: " + e.usage
+	}
+	return e.err.Error() + "\nusage: " + e.usage
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
+// parseFlags parses the command's flags wherever they come in the arguments, e.g. both
+// `deposits show --json 1` and `deposits show 1 --json`, and returns the other arguments
+func parseFlags(flags *flag.FlagSet, args []string, usage string) ([]string, error) {
+	flags.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, usageError{usage: usage, err: err}
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func jsonFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("json", false, "write the result as JSON")
+}
+
+// output writes v as JSON when asJSON, otherwise calls text to write it for people to read
+func output(asJSON bool, v interface{}, text func()) error {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	text()
+	return nil
+}
+
+// serviceOptions are how the config says receipts and reversals are handled
+func serviceOptions(cfg *config.AppConfig) service.Options {
+	return service.Options{
+		OverFunding:   cfg.Receipts.OverFunding,
+		Apportionment: cfg.Receipts.Apportionment,
+		ReversalOrder: cfg.Reversal.Order,
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"ajbell.co.uk/config"
+	"ajbell.co.uk/migrations"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"flag"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	for _, args := range [][]string{{"show", "1", "--json"}, {"--json", "show", "1"}, {"show", "--json", "1"}} {
+		flags := flag.NewFlagSet("deposits", flag.ContinueOnError)
+		asJSON := jsonFlag(flags)
+
+		rest, err := parseFlags(flags, args, depositsUsage)
+
+		assert.NoError(t, err)
+		assert.True(t, *asJSON, "%v", args)
+		assert.Equal(t, []string{"show", "1"}, rest)
+	}
+}
+
+func TestParseFlagsUnknownFlag(t *testing.T) {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+
+	_, err := parseFlags(flags, []string{"--verbose"}, reconcileUsage)
+
+	assert.EqualError(t, err, "flag provided but not defined: -verbose\nusage: "+reconcileUsage)
+	assert.Equal(t, exitUsage, exitCode(err))
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{usageError{usage: reconcileUsage, err: flag.ErrHelp}, exitOK},
+		{usageError{usage: reconcileUsage}, exitUsage},
+		{errors.Wrap(repository.ErrNotFound, "deposit 9"), exitNotFound},
+		{errors.Wrap(service.ErrLimitExceeded, "JISA"), exitRefused},
+		{errors.Wrap(service.ErrOverFunded, "receipt 3"), exitRefused},
+		{service.ErrBankReferenceInUse, exitConflict},
+		{errors.Wrap(errUnreconciled, "1 of 4 receipts"), exitUnreconciled},
+		{errors.Wrap(migrations.ErrSchemaBehind, "0004_integrity_constraints"), exitSchemaBehind},
+		{errors.New("connection refused"), exitFailure},
+		{errors.Wrap(errors.New("connection refused"), "syncing the wrapper limits"), exitFailure},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, exitCode(tt.err), "%v", tt.err)
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	assert.Equal(t, exitUsage, run(&cli{}, []string{"deploy"}))
+	assert.Equal(t, exitUsage, run(&cli{}, []string{"deposits", "list"}))
+	assert.Equal(t, exitOK, run(&cli{}, []string{"help"}))
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		receipts config.ReceiptConfig
+		err      string
+	}{
+		{name: "Defaults"},
+		{name: "Known", receipts: config.ReceiptConfig{OverFunding: service.OverFundingSuspense, Apportionment: service.ApportionToGIA}},
+		{name: "UnknownOverFunding", receipts: config.ReceiptConfig{OverFunding: "refund"}, err: `"refund": unknown over-funding policy: invalid config`},
+		{name: "UnknownApportionment", receipts: config.ReceiptConfig{Apportionment: "smallest_split"}, err: `"smallest_split": unknown apportionment strategy: invalid config`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkConfig(&config.AppConfig{Receipts: tt.receipts})
+
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+			assert.Equal(t, exitUsage, exitCode(err))
+		})
+	}
+}
@@ -1,16 +1,58 @@
 package config
 
 import (
-	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/ilyakaznacheev/cleanenv"
-	"os"
+	"github.com/pkg/errors"
+	"time"
 )
 
+// ErrInvalidConfig is returned when the config file can't be read
+var ErrInvalidConfig = errors.New("invalid config")
+
 type AppConfig struct {
-	Database   DatabaseConfig `yaml:"db"`
-	Server     ServerConfig
-	ConfigFile string
+	Database DatabaseConfig `yaml:"db"`
+	Server   ServerConfig   `yaml:"server"`
+	Limits   []LimitConfig  `yaml:"limits"`
+	Reversal ReversalConfig `yaml:"reversal"`
+	Receipts ReceiptConfig  `yaml:"receipts"`
+	// Idempotency configures the idempotency keys that make retried requests safe
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	ConfigFile  string
+}
+
+// LimitConfig is a yearly wrapper limit, applied from the effective tax year onwards
+type LimitConfig struct {
+	Wrapper       string `yaml:"wrapper"`
+	EffectiveFrom int    `yaml:"effective_from"` // tax year, e.g. 2024 for 2024/25
+	Amount        uint   `yaml:"amount"`         // amount is always in pennies
+}
+
+// ReversalConfig sets the order reversals take money back out of a receipt's accounts
+type ReversalConfig struct {
+	// Order lists tiers of wrappers, emptied one tier at a time and in proportion to what was
+	// allocated within a tier. Wrappers left out come last.
+	Order [][]string `yaml:"order"`
+}
+
+// ReceiptConfig sets how receipts are handled against their deposit
+type ReceiptConfig struct {
+	// OverFunding is what to do with a receipt that would take a deposit over its amount: "reject" it,
+	// park the excess in "suspense" or "allocate" it with the deposit's split, which is the default
+	OverFunding string `yaml:"over_funding"`
+	// Apportionment is the strategy for the pennies lost rounding a receipt's split down, for deposits
+	// that don't choose one: "largest_remainder", the default, "gia", "largest_split" or "first_account"
+	Apportionment string `yaml:"apportionment"`
+}
+
+// IdempotencyConfig sets the header clients send an idempotency key in and how long a key is kept
+type IdempotencyConfig struct {
+	KeyHeader string        `yaml:"key_header" env-default:"X-Idempotency-Key"`
+	Lifetime  time.Duration `yaml:"lifetime" env-default:"30m"`
+	// LockConnections is how many of the database pool's connections the keys' locks may hold at once,
+	// and LockTimeout how long a request waits for one and for its key before it is turned away
+	LockConnections int           `yaml:"lock_connections" env-default:"20"`
+	LockTimeout     time.Duration `yaml:"lock_timeout" env-default:"30s"`
 }
 
 func (cfg *AppConfig) Route404() {
@@ -19,17 +61,17 @@ func (cfg *AppConfig) Route404() {
 	})
 }
 
-func (cfg *AppConfig) Setup() {
+// Setup reads the config file, returning ErrInvalidConfig when it can't be used, and connects to the database
+func (cfg *AppConfig) Setup() error {
 	if err := cleanenv.ReadConfig(cfg.ConfigFile, cfg); err != nil {
-		fmt.Println(err)
-		os.Exit(2)
+		return errors.Wrap(ErrInvalidConfig, err.Error())
 	}
 
 	cfg.Server.Setup()
-	cfg.LoadComponents()
+	return cfg.LoadComponents()
 
 }
 
-func (cfg *AppConfig) LoadComponents() {
-	cfg.Database.Setup()
+func (cfg *AppConfig) LoadComponents() error {
+	return cfg.Database.Setup()
 }
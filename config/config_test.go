@@ -0,0 +1,42 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, []byte(yaml), 0o644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	return file
+}
+
+func TestAppConfigSetup(t *testing.T) {
+	connectAfter(t, 0)
+	cfg := &AppConfig{ConfigFile: writeConfig(t, "server:\n  address: \"127.0.0.1:8080\"\n  shutdown_timeout: 10s\n")}
+
+	err := cfg.Setup()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8080", cfg.Server.Address)
+	assert.Equal(t, 10*time.Second, cfg.Server.ShutdownTimeout)
+	// what isn't configured is defaulted
+	assert.Equal(t, 30*time.Second, cfg.Server.ReadTimeout)
+	assert.Equal(t, 4*1024*1024, cfg.Server.BodyLimit)
+	assert.Equal(t, 5, cfg.Database.Retry.Attempts)
+	assert.Equal(t, 4*1024*1024, cfg.Server.App.Config().BodyLimit)
+	assert.NoError(t, cfg.Database.Close())
+}
+
+func TestAppConfigSetupMissingFile(t *testing.T) {
+	cfg := &AppConfig{ConfigFile: filepath.Join(t.TempDir(), "missing.yml")}
+
+	err := cfg.Setup()
+
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
@@ -2,45 +2,90 @@ package config
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/plugin/dbresolver"
+	"log"
 	"time"
 )
 
 type DatabaseDriver struct {
-	Host     string `yaml:"host" env:"DB_HOST" env-default:"5432"`
-	Username string `yaml:"username" env:"DB_USER" env-default:"localhost"`
+	Host     string `yaml:"host" env:"DB_HOST" env-default:"localhost"`
+	Username string `yaml:"username" env:"DB_USER" env-default:"postgres"`
 	Password string `yaml:"password" env:"DB_PASS" env-default:"postgres"`
 	DBName   string `yaml:"db_name" env:"DB_NAME" env-default:"breezy"`
-	Port     int    `yaml:"port" env:"DB_PORT" env-default:"postgres"`
+	Port     int    `yaml:"port" env:"DB_PORT" env-default:"5432"`
+}
+
+// RetryConfig sets how often connecting to the database is tried at start up, waiting twice as long
+// after each failure up to the max backoff
+type RetryConfig struct {
+	Attempts       int           `yaml:"attempts" env-default:"5"`
+	InitialBackoff time.Duration `yaml:"initial_backoff" env-default:"1s"`
+	MaxBackoff     time.Duration `yaml:"max_backoff" env-default:"30s"`
 }
 
 type DatabaseConfig struct {
 	*gorm.DB
 	Driver DatabaseDriver `yaml:"postgres"`
+	Retry  RetryConfig    `yaml:"retry"`
 }
 
-func (d *DatabaseConfig) Setup() {
-	var err error
+// openDatabase and sleep are replaced by the tests
+var (
+	openDatabase = func(dsn string) (*gorm.DB, error) {
+		return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	}
+	sleep = time.Sleep
+)
 
+// Setup connects to the database, retrying with backoff while it can't, e.g. while the database is
+// still starting alongside the app
+func (d *DatabaseConfig) Setup() error {
 	connectionString := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s", d.Driver.Host, d.Driver.Port, d.Driver.Username, d.Driver.DBName, d.Driver.Password)
-	d.DB, err = gorm.Open(postgres.Open(connectionString), &gorm.Config{
-		DisableForeignKeyConstraintWhenMigrating: true,
-	})
 
-	if err != nil {
-		fmt.Println(d.Driver)
-		panic(err)
+	attempts := d.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := d.Retry.InitialBackoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		d.DB, err = openDatabase(connectionString)
+		if err == nil {
+			break
+		}
+		if attempt == attempts {
+			return errors.Wrapf(err, "connecting to database %s on %s:%d after %d attempts", d.Driver.DBName, d.Driver.Host, d.Driver.Port, attempts)
+		}
+
+		log.Printf("Unable to connect to database, retrying in %s: %v\n", backoff, err)
+		sleep(backoff)
+		backoff *= 2
+		if d.Retry.MaxBackoff > 0 && backoff > d.Retry.MaxBackoff {
+			backoff = d.Retry.MaxBackoff
+		}
 	}
+
 	err = d.DB.Use(
 		dbresolver.Register(dbresolver.Config{}).
 			SetConnMaxLifetime(24 * time.Hour).
 			SetMaxIdleConns(100).
 			SetMaxOpenConns(100),
 	)
+	return errors.Wrap(err, "configuring the database pool")
+}
+
+// Close closes the database's connections, once nothing is using them
+func (d *DatabaseConfig) Close() error {
+	if d.DB == nil {
+		return nil
+	}
+	sqlDB, err := d.DB.DB()
 	if err != nil {
-		fmt.Println(d.Driver)
-		panic(err)
+		return err
 	}
+	return sqlDB.Close()
 }
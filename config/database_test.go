@@ -0,0 +1,62 @@
+package config
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// connectAfter makes connecting to the database fail the given number of times before it works, and
+// records the backoff slept between attempts
+func connectAfter(t *testing.T, failures int) *[]time.Duration {
+	originalOpen, originalSleep := openDatabase, sleep
+	t.Cleanup(func() {
+		openDatabase, sleep = originalOpen, originalSleep
+	})
+
+	var slept []time.Duration
+	attempts := 0
+	openDatabase = func(dsn string) (*gorm.DB, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, errors.New("connection refused")
+		}
+		testDB, mock, _ := sqlmock.New()
+		mock.ExpectClose()
+		return gorm.Open(postgres.New(postgres.Config{Conn: testDB}), &gorm.Config{})
+	}
+	sleep = func(d time.Duration) {
+		slept = append(slept, d)
+	}
+	return &slept
+}
+
+func TestDatabaseSetupRetries(t *testing.T) {
+	slept := connectAfter(t, 2)
+	database := &DatabaseConfig{Retry: RetryConfig{Attempts: 5, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}}
+
+	err := database.Setup()
+
+	assert.NoError(t, err)
+	assert.NotNil(t, database.DB)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *slept)
+	assert.NoError(t, database.Close())
+}
+
+func TestDatabaseSetupGivesUp(t *testing.T) {
+	slept := connectAfter(t, 10)
+	database := &DatabaseConfig{
+		Driver: DatabaseDriver{Host: "db", Port: 5432, DBName: "breezy"},
+		Retry:  RetryConfig{Attempts: 4, InitialBackoff: 10 * time.Second, MaxBackoff: 15 * time.Second},
+	}
+
+	err := database.Setup()
+
+	assert.EqualError(t, err, "connecting to database breezy on db:5432 after 4 attempts: connection refused")
+	// the backoff doubles up to the max
+	assert.Equal(t, []time.Duration{10 * time.Second, 15 * time.Second, 15 * time.Second}, *slept)
+}
@@ -1,13 +1,64 @@
 package config
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"time"
+)
 
 type ServerConfig struct {
 	*fiber.App
+	Address string `yaml:"address" env:"SERVER_ADDRESS" env-default:":3000"`
+	// ReadTimeout, WriteTimeout and IdleTimeout bound how long a connection can take over reading a
+	// request, writing the response and waiting for the next request
+	ReadTimeout  time.Duration `yaml:"read_timeout" env-default:"30s"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env-default:"30s"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	BodyLimit    int           `yaml:"body_limit" env-default:"4194304"` // largest request body accepted, in bytes
+	// ShutdownTimeout is how long requests in flight, e.g. allocations, are given to finish on shut
+	// down before their connections are closed
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"30s"`
 }
 
 func (s *ServerConfig) Setup() {
 	s.App = fiber.New(fiber.Config{
-		Concurrency: 256 * 1024 * 1024,
+		Concurrency:  256 * 1024 * 1024,
+		ReadTimeout:  s.ReadTimeout,
+		WriteTimeout: s.WriteTimeout,
+		IdleTimeout:  s.IdleTimeout,
+		BodyLimit:    s.BodyLimit,
 	})
 }
+
+// Serve listens on the address until ctx is done, then stops accepting requests and waits up to
+// the shutdown timeout for those in flight to finish
+func (s *ServerConfig) Serve(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %s", s.Address)
+	}
+	return s.serve(ctx, listener)
+}
+
+func (s *ServerConfig) serve(ctx context.Context, listener net.Listener) error {
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.App.Listener(listener)
+	}()
+
+	select {
+	case err := <-stopped: // the server failed before being asked to stop
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for requests in flight\n", s.ShutdownTimeout)
+	shutdownErr := s.App.ShutdownWithTimeout(s.ShutdownTimeout)
+	if err := <-stopped; err != nil {
+		return err
+	}
+	return errors.Wrap(shutdownErr, "shutting down")
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"context"
+	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func TestServerConfig_Setup(t *testing.T) {
@@ -15,3 +21,58 @@ func TestServerConfig_Setup(t *testing.T) {
 	assert.NotNil(t, serverConfig.App)
 
 }
+
+// serveSlowly serves a request that takes the given time, closing started once it has started
+func serveSlowly(t *testing.T, serverConfig *ServerConfig, takes time.Duration) (started chan struct{}, responses chan string, served chan error, stop context.CancelFunc) {
+	serverConfig.Setup()
+
+	started = make(chan struct{})
+	serverConfig.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		time.Sleep(takes)
+		return c.SendString("done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	served = make(chan error, 1)
+	go func() {
+		served <- serverConfig.serve(ctx, listener)
+	}()
+
+	responses = make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	return started, responses, served, stop
+}
+
+func TestServeDrainsRequestsInFlight(t *testing.T) {
+	started, responses, served, stop := serveSlowly(t, &ServerConfig{ShutdownTimeout: 5 * time.Second}, 200*time.Millisecond)
+
+	<-started
+	stop()
+
+	assert.Equal(t, "done", <-responses)
+	assert.NoError(t, <-served)
+}
+
+func TestServeShutdownDeadline(t *testing.T) {
+	started, _, served, stop := serveSlowly(t, &ServerConfig{ShutdownTimeout: 50 * time.Millisecond}, time.Second)
+
+	<-started
+	stop()
+
+	assert.ErrorIs(t, <-served, context.DeadlineExceeded)
+}
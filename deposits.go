@@ -0,0 +1,78 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+const depositsUsage = "deposits show <id> [--json]"
+
+// showDeposit runs `deposits show 1`, which shows the deposit's funding with its receipts, where
+// each was allocated and what was reversed, as GET /deposit/:id does
+func showDeposit(c *cli, args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return usageError{usage: depositsUsage}
+	}
+
+	flags := flag.NewFlagSet("deposits show", flag.ContinueOnError)
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args[1:], depositsUsage)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usageError{usage: depositsUsage}
+	}
+	id, err := strconv.ParseUint(rest[0], 10, 64)
+	if err != nil {
+		return usageError{usage: depositsUsage, err: errors.Errorf("invalid deposit id %q", rest[0])}
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+
+	deposit, err := repository.NewGorm(cfg.Database.DB).Deposits().GetWithReceipts(uint(id))
+	if err != nil {
+		return errors.Wrapf(err, "deposit %d", id)
+	}
+	deposit.Received, deposit.Status = deposit.Funding()
+	// want an empty an array instead of null within the json
+	if deposit.Receipts == nil {
+		deposit.Receipts = make([]models.Receipt, 0)
+	}
+
+	return output(*asJSON, deposit, func() {
+		printDeposit(deposit)
+	})
+}
+
+func printDeposit(deposit *models.Deposit) {
+	fmt.Printf("Deposit %d for client %d: %d, received %d, %s\n", deposit.ID, deposit.ClientID, deposit.Amount, deposit.Received, deposit.Status)
+
+	for _, receipt := range deposit.Receipts {
+		fmt.Printf("  receipt %d of %d on %s, %s", receipt.ID, receipt.Amount, receipt.ReceivedOn().Format("2006-01-02"), receipt.FundingDecision)
+		if receipt.SuspenseAmount > 0 {
+			fmt.Printf(", %d in suspense", receipt.SuspenseAmount)
+		}
+		if receipt.BankReference != nil {
+			fmt.Printf(", bank reference %s", *receipt.BankReference)
+		}
+		if receipt.NeedsReview {
+			fmt.Printf(", needs review: %s", receipt.ReviewReason)
+		}
+		fmt.Println()
+
+		for _, allocation := range receipt.Allocations {
+			fmt.Printf("    account %d: %d in %s\n", allocation.AccountID, allocation.Amount, allocation.TaxYear)
+		}
+		for _, reversal := range receipt.Reversals {
+			fmt.Printf("    reversed %d: %s\n", reversal.Amount, reversal.Reason)
+		}
+	}
+}
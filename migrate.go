@@ -0,0 +1,167 @@
+package main
+
+import (
+	"ajbell.co.uk/migrations"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"time"
+)
+
+const migrateUsage = `migrate up|down|status [--json]
+  migrate create <name> [--dir migrations/sql]`
+
+// migrationResult is a migration as --json writes it
+type migrationResult struct {
+	Version   uint       `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// runMigrate runs `migrate up`, `migrate down` or `migrate status` against the database, or
+// `migrate create`, which doesn't need it
+func runMigrate(c *cli, args []string) error {
+	if len(args) == 0 {
+		return usageError{usage: migrateUsage}
+	}
+	if args[0] == "create" {
+		return createMigration(args[1:])
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args[1:], migrateUsage)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return usageError{usage: migrateUsage}
+	}
+
+	var migrate func(db *gorm.DB, asJSON bool) error
+	switch args[0] {
+	case "up":
+		migrate = migrateUp
+	case "down":
+		migrate = migrateDown
+	case "status":
+		migrate = migrateStatus
+	default:
+		return usageError{usage: migrateUsage}
+	}
+
+	cfg, err := c.load()
+	if err != nil {
+		return err
+	}
+	return migrate(cfg.Database.DB, *asJSON)
+}
+
+// createMigration runs `migrate create add_receipt_notes`, which writes the next pair of up and
+// down files
+func createMigration(args []string) error {
+	flags := flag.NewFlagSet("migrate create", flag.ContinueOnError)
+	dir := flags.String("dir", "migrations/sql", "directory the migration files are kept in")
+	rest, err := parseFlags(flags, args, migrateUsage)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usageError{usage: migrateUsage}
+	}
+
+	up, down, err := migrations.Create(*dir, rest[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s and %s, rebuild the binary to include them\n", up, down)
+	return nil
+}
+
+func migrateUp(db *gorm.DB, asJSON bool) error {
+	migrator, err := embeddedMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up()
+	if err != nil {
+		return err
+	}
+
+	results := make([]migrationResult, 0, len(applied))
+	for _, migration := range applied {
+		results = append(results, migrationResult{Version: migration.Version, Name: migration.Name})
+	}
+	return output(asJSON, map[string]interface{}{"applied": results}, func() {
+		fmt.Printf("Applied %d migrations\n", len(applied))
+	})
+}
+
+func migrateDown(db *gorm.DB, asJSON bool) error {
+	migrator, err := embeddedMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	rolledBack, err := migrator.Down()
+	if err != nil {
+		return err
+	}
+
+	var result *migrationResult
+	if rolledBack != nil {
+		result = &migrationResult{Version: rolledBack.Version, Name: rolledBack.Name}
+	}
+	return output(asJSON, map[string]interface{}{"rolled_back": result}, func() {
+		if rolledBack == nil {
+			fmt.Println("No migrations to roll back")
+			return
+		}
+		fmt.Printf("Rolled back %04d_%s\n", rolledBack.Version, rolledBack.Name)
+	})
+}
+
+func migrateStatus(db *gorm.DB, asJSON bool) error {
+	migrator, err := embeddedMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	status, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	results := make([]migrationResult, 0, len(status))
+	for _, entry := range status {
+		results = append(results, migrationResult{Version: entry.Version, Name: entry.Name, AppliedAt: entry.AppliedAt})
+	}
+	return output(asJSON, results, func() {
+		for _, entry := range status {
+			appliedAt := "pending"
+			if entry.AppliedAt != nil {
+				appliedAt = "applied " + entry.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", entry.Version, entry.Name, appliedAt)
+		}
+	})
+}
+
+func embeddedMigrator(db *gorm.DB) (*migrations.Migrator, error) {
+	embedded, err := migrations.Embedded()
+	if err != nil {
+		return nil, err
+	}
+	return migrations.NewMigrator(db, embedded), nil
+}
+
+// checkSchema stops commands running against a database that is missing migrations, which
+// are only ever applied by `migrate up`
+func checkSchema(db *gorm.DB) error {
+	migrator, err := embeddedMigrator(db)
+	if err != nil {
+		return err
+	}
+	return migrator.CheckCurrent()
+}
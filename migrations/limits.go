@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"ajbell.co.uk/config"
+	"ajbell.co.uk/pkg/models"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+)
+
+// SyncLimits upserts the wrapper limits from config into the wrapper_limits table. Rows
+// already in the table but missing from config are left alone so history is kept.
+func SyncLimits(db *gorm.DB, limits []config.LimitConfig) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	rows := make([]models.WrapperLimit, 0, len(limits))
+	for _, limit := range limits {
+		rows = append(rows, models.WrapperLimit{
+			Wrapper:       limit.Wrapper,
+			EffectiveFrom: models.TaxYear(limit.EffectiveFrom),
+			Amount:        limit.Amount,
+		})
+	}
+
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "wrapper"}, {Name: "effective_from"}},
+		DoUpdates: clause.AssignmentColumns([]string{"amount", "updated_at"}),
+	}).Create(&rows).Error
+	if err != nil {
+		return errors.Wrap(err, "syncing the wrapper limits")
+	}
+	log.Printf("Synced %d wrapper limits\n", len(rows))
+	return nil
+}
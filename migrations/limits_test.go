@@ -0,0 +1,84 @@
+package migrations
+
+import (
+	"ajbell.co.uk/config"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestSyncLimits(t *testing.T) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Error creating GORM DB: %v", err)
+	}
+
+	idRows := sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"wrapper_limits\"(.*)ON CONFLICT \\(\"wrapper\",\"effective_from\"\\) DO UPDATE(.*)").WillReturnRows(idRows)
+	mock.ExpectCommit()
+
+	err = SyncLimits(db, []config.LimitConfig{
+		{Wrapper: "ISA", EffectiveFrom: 2017, Amount: 2000000},
+		{Wrapper: "SIPP", EffectiveFrom: 2023, Amount: 6000000},
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncLimitsFails(t *testing.T) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Error creating GORM DB: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"wrapper_limits\"(.*)").WillReturnError(errors.New("connection refused"))
+	mock.ExpectRollback()
+
+	err = SyncLimits(db, []config.LimitConfig{{Wrapper: "ISA", EffectiveFrom: 2017, Amount: 2000000}})
+
+	assert.ErrorContains(t, err, "connection refused")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSyncLimitsNothingConfigured(t *testing.T) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Error creating GORM DB: %v", err)
+	}
+
+	assert.NoError(t, SyncLimits(db, nil))
+
+	// no queries should have been run
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,24 +1,329 @@
 package migrations
 
 import (
-	"ajbell.co.uk/pkg/models"
+	"embed"
+	"fmt"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func Migrate(db *gorm.DB) {
-	log.Println("Initiating migration...")
-	err := db.Migrator().AutoMigrate(
-		&models.Client{},
-		&models.Pot{},
-		&models.Account{},
-		&models.Deposit{},
-		&models.Receipt{},
-		&models.ProposedAllocation{},
-		&models.Allocation{},
-	)
-	if err != nil {
-		panic(err)
-	}
-	log.Println("Migration Completed...")
+//go:embed sql/*.sql
+var files embed.FS
+
+// ErrSchemaBehind is returned when the database hasn't had every migration applied
+var ErrSchemaBehind = errors.New("database schema is behind")
+
+// fileName is NNNN_name.up.sql or NNNN_name.down.sql
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var migrationName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Migration is one versioned change to the schema, with the SQL to apply it and to undo it
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, nil if it hasn't been
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version   uint
+	Name      string
+	AppliedAt time.Time
+}
+
+// Embedded is the migrations built into the binary from the sql directory
+func Embedded() ([]Migration, error) {
+	dir, err := fs.Sub(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+	return Load(dir)
+}
+
+// Load reads the migrations in a directory in version order. Every version needs both an up and
+// a down file.
+func Load(dir fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, errors.Errorf("%s is not named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s has an invalid version", entry.Name())
+		}
+		sql, err := fs.ReadFile(dir, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, errors.Errorf("version %d is used by both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(sql)
+		} else {
+			migration.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, errors.Errorf("migration %04d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Create writes an empty pair of up and down files for the next version into dir, returning their paths
+func Create(dir string, name string) (string, string, error) {
+	if !migrationName.MatchString(name) {
+		return "", "", errors.Errorf("migration name %q must be lower case letters, digits and underscores", name)
+	}
+
+	existing, err := Load(os.DirFS(dir))
+	if err != nil {
+		return "", "", err
+	}
+	var version uint = 1
+	if len(existing) > 0 {
+		version = existing[len(existing)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%04d_%s", version, name))
+	up, down := base+".up.sql", base+".down.sql"
+	if err := os.WriteFile(up, []byte(fmt.Sprintf("-- %04d_%s up\n", version, name)), 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(down, []byte(fmt.Sprintf("-- %04d_%s down\n", version, name)), 0644); err != nil {
+		return "", "", err
+	}
+	return up, down, nil
+}
+
+// lockID is the advisory lock held while migrating, so instances started together, e.g. by a
+// deployment, apply each migration once. The number is arbitrary but must never change.
+const lockID = 4210519377
+
+// Migrator applies and rolls back migrations, recording the applied versions in schema_migrations
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *gorm.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Up applies every pending migration in version order, each in its own transaction, and returns
+// those it applied. It waits for any other instance migrating to finish first.
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(func(m *Migrator) (err error) {
+		applied, err = m.up()
+		return err
+	})
+	return applied, err
+}
+
+func (m *Migrator) up() ([]Migration, error) {
+	err := m.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations " +
+		"(version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL)").Error
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0, len(pending))
+	for _, migration := range pending {
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := execute(tx, migration.Up); err != nil {
+				return err
+			}
+			return tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				migration.Version, migration.Name, time.Now()).Error
+		})
+		if err != nil {
+			return applied, errors.Wrapf(err, "applying %04d_%s", migration.Version, migration.Name)
+		}
+		log.Printf("Applied migration %04d_%s\n", migration.Version, migration.Name)
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// Down rolls back the latest applied migration, returning nil when none have been applied. It
+// waits for any other instance migrating to finish first.
+func (m *Migrator) Down() (*Migration, error) {
+	var rolledBack *Migration
+	err := m.locked(func(m *Migrator) (err error) {
+		rolledBack, err = m.down()
+		return err
+	})
+	return rolledBack, err
+}
+
+func (m *Migrator) down() (*Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	latest := applied[len(applied)-1]
+	migration := m.find(latest.Version)
+	if migration == nil {
+		return nil, errors.Errorf("migration %04d_%s was applied but isn't in this binary", latest.Version, latest.Name)
+	}
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := execute(tx, migration.Down); err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version).Error
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "rolling back %04d_%s", migration.Version, migration.Name)
+	}
+	log.Printf("Rolled back migration %04d_%s\n", migration.Version, migration.Name)
+	return migration, nil
+}
+
+// locked calls fc with a migrator holding the advisory lock. The lock belongs to the database
+// session, so everything fc does runs on the one connection that took it.
+func (m *Migrator) locked(fc func(m *Migrator) error) error {
+	return m.db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", lockID).Error; err != nil {
+			return errors.Wrap(err, "taking the migration lock")
+		}
+		err := fc(&Migrator{db: conn, migrations: m.migrations})
+		if unlockErr := conn.Exec("SELECT pg_advisory_unlock(?)", lockID).Error; err == nil && unlockErr != nil {
+			err = errors.Wrap(unlockErr, "releasing the migration lock")
+		}
+		return err
+	})
+}
+
+// Status lists every migration with when it was applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[uint]time.Time, len(applied))
+	for _, migration := range applied {
+		appliedAt[migration.Version] = migration.AppliedAt
+	}
+
+	status := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		entry := MigrationStatus{Migration: migration}
+		if at, ok := appliedAt[migration.Version]; ok {
+			entry.AppliedAt = &at
+		}
+		status = append(status, entry)
+	}
+	return status, nil
+}
+
+// Pending is the migrations not yet applied, in version order
+func (m *Migrator) Pending() ([]Migration, error) {
+	status, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+	for _, entry := range status {
+		if entry.AppliedAt == nil {
+			pending = append(pending, entry.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// CheckCurrent returns ErrSchemaBehind when any migration is still to be applied
+func (m *Migrator) CheckCurrent() error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.Wrapf(ErrSchemaBehind, "%d migrations pending, the first is %04d_%s, run migrate up",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+// applied is the migrations recorded in schema_migrations, none before the table is created
+func (m *Migrator) applied() ([]appliedMigration, error) {
+	applied := make([]appliedMigration, 0)
+	if !m.db.Migrator().HasTable("schema_migrations") {
+		return applied, nil
+	}
+	err := m.db.Raw("SELECT version, name, applied_at FROM schema_migrations ORDER BY version").Scan(&applied).Error
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (m *Migrator) find(version uint) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// execute runs a migration's SQL, skipping files that only hold comments
+func execute(tx *gorm.DB, sql string) error {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return tx.Exec(sql).Error
+		}
+	}
+	return nil
 }
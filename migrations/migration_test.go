@@ -1,19 +1,23 @@
 package migrations
 
 import (
-	"gorm.io/driver/postgres"
-	"testing"
-
+	"ajbell.co.uk/pkg/models"
+	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
 )
 
-func TestMigrate(t *testing.T) {
-	// Create a new GORM DB connected to the mock database
-	testDB, _, _ := sqlmock.New()
-	//handle error
+func mockMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	testDB, mock, _ := sqlmock.New()
 
-	// uses "gorm.io/driver/postgres" library
 	dialector := postgres.New(postgres.Config{
 		DSN:                  "sqlmock_db_0",
 		DriverName:           "postgres",
@@ -25,13 +29,336 @@ func TestMigrate(t *testing.T) {
 		t.Fatalf("Error creating GORM DB: %v", err)
 	}
 
-	// ensure the panic is not run
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic")
-		}
-	}()
+	return NewMigrator(db, []Migration{
+		{Version: 1, Name: "create_things", Up: "CREATE TABLE things (id bigint)", Down: "DROP TABLE things"},
+		{Version: 2, Name: "add_colour", Up: "ALTER TABLE things ADD colour text", Down: "ALTER TABLE things DROP colour"},
+	}), mock
+}
+
+// expectApplied expects schema_migrations to be read, holding the versions
+func expectApplied(mock sqlmock.Sqlmock, versions ...uint) {
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM information_schema.tables(.*)").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+	for _, version := range versions {
+		rows.AddRow(version, "migration", time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC))
+	}
+	mock.ExpectQuery("^SELECT version, name, applied_at FROM schema_migrations ORDER BY version$").WillReturnRows(rows)
+}
+
+// expectLocked expects the migration lock to be taken, then released once the expectations added
+// by migrate have been met
+func expectLocked(mock sqlmock.Sqlmock, migrate func()) {
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	migrate()
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(\\$1\\)$").WithArgs(lockID).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := Embedded()
+
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(migrations), 2)
+	for i, migration := range migrations {
+		assert.Equal(t, uint(i+1), migration.Version, "versions run on from 1 with no gaps")
+		assert.NotEmpty(t, migration.Up)
+		assert.NotEmpty(t, migration.Down)
+	}
+	assert.Equal(t, "initial_schema", migrations[0].Name)
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Ordered by version", func(t *testing.T) {
+		migrations, err := Load(fstest.MapFS{
+			"0010_later.up.sql":     {Data: []byte("SELECT 10")},
+			"0010_later.down.sql":   {Data: []byte("SELECT -10")},
+			"0002_earlier.up.sql":   {Data: []byte("SELECT 2")},
+			"0002_earlier.down.sql": {Data: []byte("SELECT -2")},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []Migration{
+			{Version: 2, Name: "earlier", Up: "SELECT 2", Down: "SELECT -2"},
+			{Version: 10, Name: "later", Up: "SELECT 10", Down: "SELECT -10"},
+		}, migrations)
+	})
+
+	t.Run("Missing down file", func(t *testing.T) {
+		_, err := Load(fstest.MapFS{"0001_things.up.sql": {Data: []byte("SELECT 1")}})
+		assert.Error(t, err)
+	})
+
+	t.Run("Version used twice", func(t *testing.T) {
+		_, err := Load(fstest.MapFS{
+			"0001_things.up.sql":   {Data: []byte("SELECT 1")},
+			"0001_things.down.sql": {Data: []byte("SELECT 1")},
+			"0001_others.up.sql":   {Data: []byte("SELECT 1")},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Badly named file", func(t *testing.T) {
+		_, err := Load(fstest.MapFS{"things.sql": {Data: []byte("SELECT 1")}})
+		assert.Error(t, err)
+	})
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	up, down, err := Create(dir, "create_things")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "0001_create_things.up.sql"), up)
+	assert.Equal(t, filepath.Join(dir, "0001_create_things.down.sql"), down)
+
+	up, _, err = Create(dir, "add_colour")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "0002_add_colour.up.sql"), up)
+
+	_, err = os.Stat(up)
+	assert.NoError(t, err)
+
+	_, _, err = Create(dir, "Add colour")
+	assert.Error(t, err)
+}
+
+func TestUp(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	expectLocked(mock, func() {
+		mock.ExpectExec("^CREATE TABLE IF NOT EXISTS schema_migrations(.*)").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectApplied(mock, 1)
+		mock.ExpectBegin()
+		mock.ExpectExec("^ALTER TABLE things ADD colour text$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^INSERT INTO schema_migrations \\(version, name, applied_at\\) VALUES \\(\\$1, \\$2, \\$3\\)$").
+			WithArgs(2, "add_colour", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	})
+
+	applied, err := migrator.Up()
+
+	assert.NoError(t, err)
+	assert.Len(t, applied, 1)
+	assert.Equal(t, uint(2), applied[0].Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpStopsAtFailure(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	// the lock is released even though a migration failed
+	expectLocked(mock, func() {
+		mock.ExpectExec("^CREATE TABLE IF NOT EXISTS schema_migrations(.*)").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectApplied(mock)
+		mock.ExpectBegin()
+		mock.ExpectExec("^CREATE TABLE things").WillReturnError(gorm.ErrInvalidDB)
+		mock.ExpectRollback()
+	})
+
+	applied, err := migrator.Up()
+
+	assert.ErrorIs(t, err, gorm.ErrInvalidDB)
+	assert.Empty(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDown(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	expectLocked(mock, func() {
+		expectApplied(mock, 1, 2)
+		mock.ExpectBegin()
+		mock.ExpectExec("^ALTER TABLE things DROP colour$").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("^DELETE FROM schema_migrations WHERE version = \\$1$").WithArgs(2).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	})
+	expectLocked(mock, func() { expectApplied(mock) })
+
+	rolledBack, err := migrator.Down()
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), rolledBack.Version)
+
+	rolledBack, err = migrator.Down()
+	assert.NoError(t, err)
+	assert.Nil(t, rolledBack, "nothing left to roll back")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDownUnknownMigration(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	expectLocked(mock, func() { expectApplied(mock, 1, 2, 3) })
+
+	_, err := migrator.Down()
+
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStatus(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	expectApplied(mock, 1)
+
+	status, err := migrator.Status()
+
+	assert.NoError(t, err)
+	assert.Len(t, status, 2)
+	assert.NotNil(t, status[0].AppliedAt)
+	assert.Nil(t, status[1].AppliedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckCurrent(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	// a database that has never been migrated has no schema_migrations table
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM information_schema.tables(.*)").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	expectApplied(mock, 1)
+	expectApplied(mock, 1, 2)
+
+	assert.ErrorIs(t, migrator.CheckCurrent(), ErrSchemaBehind)
+	assert.ErrorIs(t, migrator.CheckCurrent(), ErrSchemaBehind)
+	assert.NoError(t, migrator.CheckCurrent())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteSkipsComments(t *testing.T) {
+	migrator, mock := mockMigrator(t)
+
+	assert.NoError(t, execute(migrator.db, "-- nothing to undo\n\n"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// the models as they were when AutoMigrate built the schema, before migrations
+type baselineClient struct {
+	gorm.Model
+	Name string
+}
+
+type baselinePot struct {
+	gorm.Model
+	ClientID uint
+	Name     string
+}
+
+type baselineAccount struct {
+	gorm.Model
+	PotID   uint
+	Wrapper string
+}
+
+type baselineDeposit struct {
+	gorm.Model
+	ClientID uint
+	Amount   uint
+}
+
+type baselineReceipt struct {
+	gorm.Model
+	DepositID uint
+	Amount    uint
+	DeletedAt gorm.DeletedAt
+}
+
+type baselineProposedAllocation struct {
+	gorm.Model
+	AccountID uint
+	Split     float32
+	DepositID uint
+}
+
+type baselineAllocation struct {
+	gorm.Model
+	ReceiptID uint
+	AccountID uint
+	Amount    uint
+}
+
+func (baselineClient) TableName() string             { return "clients" }
+func (baselinePot) TableName() string                { return "pots" }
+func (baselineAccount) TableName() string            { return "accounts" }
+func (baselineDeposit) TableName() string            { return "deposits" }
+func (baselineReceipt) TableName() string            { return "receipts" }
+func (baselineProposedAllocation) TableName() string { return "proposed_allocations" }
+func (baselineAllocation) TableName() string         { return "allocations" }
+
+// TestUpFromBaseline migrates a database AutoMigrate built before there were migrations, holding
+// rows written then, so it only runs with a disposable database to create a schema in, e.g.
+// TEST_DATABASE_DSN="host=localhost port=5432 user=postgres password=postgres dbname=breezy_test"
+func TestUpFromBaseline(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	quiet := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent), DisableForeignKeyConstraintWhenMigrating: true}
+	admin, err := gorm.Open(postgres.Open(dsn), quiet)
+	if err != nil {
+		t.Fatalf("Error connecting to %s: %v", dsn, err)
+	}
+	schema := fmt.Sprintf("baseline_%d", time.Now().UnixNano())
+	assert.NoError(t, admin.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), quiet)
+	if err != nil {
+		t.Fatalf("Error connecting to %s: %v", schema, err)
+	}
+	assert.NoError(t, db.AutoMigrate(&baselineClient{}, &baselinePot{}, &baselineAccount{}, &baselineDeposit{},
+		&baselineReceipt{}, &baselineProposedAllocation{}, &baselineAllocation{}))
+
+	legacy := time.Date(2020, time.January, 15, 12, 0, 0, 0, time.UTC) // tax year 2019
+	client := baselineClient{Name: "Legacy client"}
+	assert.NoError(t, db.Create(&client).Error)
+	pot := baselinePot{ClientID: client.ID, Name: "Retirement"}
+	assert.NoError(t, db.Create(&pot).Error)
+	sipp := baselineAccount{PotID: pot.ID, Wrapper: models.WrapperSIPP}
+	assert.NoError(t, db.Create(&sipp).Error)
+	deposit := baselineDeposit{ClientID: client.ID, Amount: 10000}
+	assert.NoError(t, db.Create(&deposit).Error)
+	assert.NoError(t, db.Create(&baselineProposedAllocation{AccountID: sipp.ID, Split: 1, DepositID: deposit.ID}).Error)
+	receipt := baselineReceipt{DepositID: deposit.ID, Amount: 10000}
+	assert.NoError(t, db.Create(&receipt).Error)
+	allocation := baselineAllocation{ReceiptID: receipt.ID, AccountID: sipp.ID, Amount: 10000}
+	allocation.CreatedAt = legacy
+	assert.NoError(t, db.Create(&allocation).Error)
+
+	embedded, err := Embedded()
+	assert.NoError(t, err)
+	migrator := NewMigrator(db, embedded)
+	applied, err := migrator.Up()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, applied, len(embedded))
+	assert.NoError(t, migrator.CheckCurrent())
+
+	// the legacy rows read back through today's models, backfilled
+	var migratedReceipt models.Receipt
+	assert.NoError(t, db.First(&migratedReceipt, receipt.ID).Error)
+	assert.Equal(t, int64(0), migratedReceipt.SuspenseAmount)
+	var proposed models.ProposedAllocation
+	assert.NoError(t, db.Where("deposit_id = ?", deposit.ID).First(&proposed).Error)
+	assert.Equal(t, models.WholeSplit, proposed.Split)
+	var migratedAllocation models.Allocation
+	assert.NoError(t, db.First(&migratedAllocation, allocation.ID).Error)
+	assert.Equal(t, models.TaxYear(2019), migratedAllocation.TaxYear)
+	var usage models.AllowanceUsage
+	assert.NoError(t, db.Where("allocation_id = ?", allocation.ID).First(&usage).Error)
+	assert.Equal(t, models.TaxYear(2019), usage.TaxYear)
 
-	// ideal world would check the table creation
-	Migrate(db)
+	// and rolling back to the initial schema leaves the baseline one
+	for range embedded[1:] {
+		_, err := migrator.Down()
+		assert.NoError(t, err)
+	}
+	assert.True(t, db.Migrator().HasColumn("receipts", "amount"))
+	assert.False(t, db.Migrator().HasColumn("receipts", "bank_reference"))
+	assert.False(t, db.Migrator().HasTable("allowance_usages"))
 }
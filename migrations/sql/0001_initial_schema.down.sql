@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS allocations;
+DROP TABLE IF EXISTS proposed_allocations;
+DROP TABLE IF EXISTS receipts;
+DROP TABLE IF EXISTS deposits;
+DROP TABLE IF EXISTS accounts;
+DROP TABLE IF EXISTS pots;
+DROP TABLE IF EXISTS clients;
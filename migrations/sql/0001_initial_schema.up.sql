@@ -0,0 +1,74 @@
+-- the schema exactly as AutoMigrate left it before migrations, so databases it created can be
+-- brought under migrations without being rebuilt. Later changes are made by the migrations after
+-- this one, never by editing it.
+
+CREATE TABLE IF NOT EXISTS clients (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    name text
+);
+CREATE INDEX IF NOT EXISTS idx_clients_deleted_at ON clients (deleted_at);
+
+CREATE TABLE IF NOT EXISTS pots (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    client_id bigint,
+    name text
+);
+CREATE INDEX IF NOT EXISTS idx_pots_deleted_at ON pots (deleted_at);
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    pot_id bigint,
+    wrapper text
+);
+CREATE INDEX IF NOT EXISTS idx_accounts_deleted_at ON accounts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS deposits (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    client_id bigint,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_deposits_deleted_at ON deposits (deleted_at);
+
+-- receipts redeclared DeletedAt without the index tag, so AutoMigrate didn't index it
+CREATE TABLE IF NOT EXISTS receipts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    deposit_id bigint,
+    amount bigint
+);
+
+CREATE TABLE IF NOT EXISTS proposed_allocations (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    account_id bigint,
+    split decimal,
+    deposit_id bigint
+);
+CREATE INDEX IF NOT EXISTS idx_proposed_allocations_deleted_at ON proposed_allocations (deleted_at);
+
+CREATE TABLE IF NOT EXISTS allocations (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    receipt_id bigint,
+    account_id bigint,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_allocations_deleted_at ON allocations (deleted_at);
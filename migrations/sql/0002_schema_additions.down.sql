@@ -0,0 +1,35 @@
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS reversals;
+DROP TABLE IF EXISTS relief_claims;
+DROP TABLE IF EXISTS allowance_usages;
+DROP TABLE IF EXISTS bonus_claims;
+DROP TABLE IF EXISTS wrapper_limits;
+DROP TABLE IF EXISTS pension_allowance_audits;
+DROP TABLE IF EXISTS tapered_allowances;
+
+ALTER TABLE allocations DROP COLUMN IF EXISTS reverses_id;
+ALTER TABLE allocations DROP COLUMN IF EXISTS reversal_id;
+ALTER TABLE allocations DROP COLUMN IF EXISTS settled_at;
+ALTER TABLE allocations DROP COLUMN IF EXISTS tax_year;
+
+ALTER TABLE proposed_allocations DROP COLUMN IF EXISTS split_bps;
+
+ALTER TABLE receipts DROP COLUMN IF EXISTS reviewed_at;
+ALTER TABLE receipts DROP COLUMN IF EXISTS review_reason;
+ALTER TABLE receipts DROP COLUMN IF EXISTS needs_review;
+ALTER TABLE receipts DROP COLUMN IF EXISTS value_date;
+ALTER TABLE receipts DROP COLUMN IF EXISTS bank_reference;
+ALTER TABLE receipts DROP COLUMN IF EXISTS suspense_amount;
+ALTER TABLE receipts DROP COLUMN IF EXISTS excess_amount;
+ALTER TABLE receipts DROP COLUMN IF EXISTS funding_decision;
+
+ALTER TABLE deposits DROP COLUMN IF EXISTS apportionment;
+
+ALTER TABLE accounts DROP COLUMN IF EXISTS closed_at;
+
+ALTER TABLE pots DROP COLUMN IF EXISTS closed_at;
+
+ALTER TABLE clients DROP COLUMN IF EXISTS closed_at;
+ALTER TABLE clients DROP COLUMN IF EXISTS mpaa_triggered_at;
+ALTER TABLE clients DROP COLUMN IF EXISTS registered_contact_id;
+ALTER TABLE clients DROP COLUMN IF EXISTS date_of_birth;
@@ -0,0 +1,135 @@
+-- the columns and tables added since the initial schema. Databases AutoMigrate created after some
+-- of them were added already have those, hence IF NOT EXISTS throughout.
+
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS date_of_birth timestamptz;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS registered_contact_id bigint;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS mpaa_triggered_at timestamptz;
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS closed_at timestamptz;
+
+ALTER TABLE pots ADD COLUMN IF NOT EXISTS closed_at timestamptz;
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS closed_at timestamptz;
+
+ALTER TABLE deposits ADD COLUMN IF NOT EXISTS apportionment text;
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS funding_decision text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS excess_amount bigint;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS suspense_amount bigint;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS bank_reference text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS value_date timestamptz;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS needs_review boolean;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS review_reason text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS reviewed_at timestamptz;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_receipts_bank_reference ON receipts (bank_reference);
+CREATE INDEX IF NOT EXISTS idx_receipts_needs_review ON receipts (needs_review);
+
+ALTER TABLE proposed_allocations ADD COLUMN IF NOT EXISTS split_bps bigint;
+
+ALTER TABLE allocations ADD COLUMN IF NOT EXISTS tax_year bigint;
+ALTER TABLE allocations ADD COLUMN IF NOT EXISTS settled_at timestamptz;
+ALTER TABLE allocations ADD COLUMN IF NOT EXISTS reversal_id bigint;
+ALTER TABLE allocations ADD COLUMN IF NOT EXISTS reverses_id bigint;
+CREATE INDEX IF NOT EXISTS idx_allocations_tax_year ON allocations (tax_year);
+CREATE INDEX IF NOT EXISTS idx_allocations_reversal_id ON allocations (reversal_id);
+CREATE INDEX IF NOT EXISTS idx_allocations_reverses_id ON allocations (reverses_id);
+
+CREATE TABLE IF NOT EXISTS tapered_allowances (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    client_id bigint,
+    tax_year bigint,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_tapered_allowances_deleted_at ON tapered_allowances (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_client_tapered_year ON tapered_allowances (client_id, tax_year);
+
+CREATE TABLE IF NOT EXISTS pension_allowance_audits (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    client_id bigint,
+    field text,
+    old_value text,
+    new_value text,
+    changed_by text
+);
+CREATE INDEX IF NOT EXISTS idx_pension_allowance_audits_deleted_at ON pension_allowance_audits (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_pension_allowance_audits_client_id ON pension_allowance_audits (client_id);
+
+CREATE TABLE IF NOT EXISTS wrapper_limits (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    wrapper text,
+    effective_from bigint,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_wrapper_limits_deleted_at ON wrapper_limits (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_wrapper_limit ON wrapper_limits (wrapper, effective_from);
+
+CREATE TABLE IF NOT EXISTS bonus_claims (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    allocation_id bigint,
+    amount bigint,
+    status text
+);
+CREATE INDEX IF NOT EXISTS idx_bonus_claims_deleted_at ON bonus_claims (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_bonus_claims_allocation_id ON bonus_claims (allocation_id);
+
+CREATE TABLE IF NOT EXISTS allowance_usages (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    allocation_id bigint,
+    tax_year bigint,
+    amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_allowance_usages_deleted_at ON allowance_usages (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_allowance_usages_allocation_id ON allowance_usages (allocation_id);
+CREATE INDEX IF NOT EXISTS idx_allowance_usages_tax_year ON allowance_usages (tax_year);
+
+CREATE TABLE IF NOT EXISTS relief_claims (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    allocation_id bigint,
+    gross_amount bigint,
+    relief_amount bigint,
+    status text,
+    claim_period text,
+    claimed_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_relief_claims_deleted_at ON relief_claims (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_relief_claims_allocation_id ON relief_claims (allocation_id);
+CREATE INDEX IF NOT EXISTS idx_relief_claims_status ON relief_claims (status);
+CREATE INDEX IF NOT EXISTS idx_relief_claims_claim_period ON relief_claims (claim_period);
+
+CREATE TABLE IF NOT EXISTS reversals (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    receipt_id bigint,
+    amount bigint,
+    reason text
+);
+CREATE INDEX IF NOT EXISTS idx_reversals_deleted_at ON reversals (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_reversals_receipt_id ON reversals (receipt_id);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text PRIMARY KEY,
+    value bytea,
+    expires_at timestamptz,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
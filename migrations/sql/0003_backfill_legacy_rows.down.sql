@@ -0,0 +1 @@
+-- the backfilled rows can't be told apart from later ones, so they are left in place
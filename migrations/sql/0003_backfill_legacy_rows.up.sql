@@ -0,0 +1,23 @@
+-- allocations made before tax years were tracked have none, so attribute them to the tax year
+-- they were created in (6 April, UK time, is the first day)
+UPDATE allocations SET tax_year = EXTRACT(YEAR FROM
+    (created_at AT TIME ZONE 'Europe/London') - INTERVAL '3 months 5 days')
+WHERE tax_year = 0 OR tax_year IS NULL;
+
+-- receipts from before over funding and reviews were handled had nothing held back and nothing
+-- to review
+UPDATE receipts SET excess_amount = 0 WHERE excess_amount IS NULL;
+UPDATE receipts SET suspense_amount = 0 WHERE suspense_amount IS NULL;
+UPDATE receipts SET needs_review = false WHERE needs_review IS NULL;
+
+-- SIPP allocations made before carry forward was tracked used their own tax year's allowance
+INSERT INTO allowance_usages (created_at, updated_at, allocation_id, tax_year, amount)
+SELECT NOW(), NOW(), al.id, al.tax_year, al.amount FROM allocations al
+JOIN accounts a ON a.id = al.account_id
+WHERE a.wrapper = 'SIPP' AND al.deleted_at IS NULL
+AND NOT EXISTS (SELECT 1 FROM allowance_usages u WHERE u.allocation_id = al.id);
+
+-- splits were stored as a float fraction before basis points, the old column is kept until the
+-- float form of the API is withdrawn
+UPDATE proposed_allocations SET split_bps = ROUND(split::numeric * 10000)
+WHERE (split_bps IS NULL OR split_bps = 0) AND split IS NOT NULL;
@@ -0,0 +1,28 @@
+ALTER TABLE proposed_allocations DROP CONSTRAINT IF EXISTS chk_proposed_allocations_split_bps;
+ALTER TABLE tapered_allowances DROP CONSTRAINT IF EXISTS chk_tapered_allowances_amount;
+ALTER TABLE wrapper_limits DROP CONSTRAINT IF EXISTS chk_wrapper_limits_amount;
+ALTER TABLE reversals DROP CONSTRAINT IF EXISTS chk_reversals_amount;
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS chk_receipts_suspense_amount;
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS chk_receipts_excess_amount;
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS chk_receipts_amount;
+ALTER TABLE deposits DROP CONSTRAINT IF EXISTS chk_deposits_amount;
+
+DROP INDEX IF EXISTS idx_accounts_open_gia;
+
+ALTER TABLE allowance_usages DROP CONSTRAINT IF EXISTS fk_allowance_usages_allocation;
+ALTER TABLE relief_claims DROP CONSTRAINT IF EXISTS fk_relief_claims_allocation;
+ALTER TABLE bonus_claims DROP CONSTRAINT IF EXISTS fk_bonus_claims_allocation;
+ALTER TABLE allocations DROP CONSTRAINT IF EXISTS fk_allocations_reverses;
+ALTER TABLE allocations DROP CONSTRAINT IF EXISTS fk_allocations_reversal;
+ALTER TABLE allocations DROP CONSTRAINT IF EXISTS fk_allocations_account;
+ALTER TABLE allocations DROP CONSTRAINT IF EXISTS fk_allocations_receipt;
+ALTER TABLE reversals DROP CONSTRAINT IF EXISTS fk_reversals_receipt;
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS fk_receipts_deposit;
+ALTER TABLE proposed_allocations DROP CONSTRAINT IF EXISTS fk_proposed_allocations_account;
+ALTER TABLE proposed_allocations DROP CONSTRAINT IF EXISTS fk_proposed_allocations_deposit;
+ALTER TABLE deposits DROP CONSTRAINT IF EXISTS fk_deposits_client;
+ALTER TABLE accounts DROP CONSTRAINT IF EXISTS fk_accounts_pot;
+ALTER TABLE pots DROP CONSTRAINT IF EXISTS fk_pots_client;
+ALTER TABLE pension_allowance_audits DROP CONSTRAINT IF EXISTS fk_pension_allowance_audits_client;
+ALTER TABLE tapered_allowances DROP CONSTRAINT IF EXISTS fk_tapered_allowances_client;
+ALTER TABLE clients DROP CONSTRAINT IF EXISTS fk_clients_registered_contact;
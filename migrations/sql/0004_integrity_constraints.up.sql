@@ -0,0 +1,32 @@
+-- rows that break these need putting right by hand before the migration will apply
+
+ALTER TABLE clients ADD CONSTRAINT fk_clients_registered_contact FOREIGN KEY (registered_contact_id) REFERENCES clients (id);
+ALTER TABLE tapered_allowances ADD CONSTRAINT fk_tapered_allowances_client FOREIGN KEY (client_id) REFERENCES clients (id);
+ALTER TABLE pension_allowance_audits ADD CONSTRAINT fk_pension_allowance_audits_client FOREIGN KEY (client_id) REFERENCES clients (id);
+ALTER TABLE pots ADD CONSTRAINT fk_pots_client FOREIGN KEY (client_id) REFERENCES clients (id);
+ALTER TABLE accounts ADD CONSTRAINT fk_accounts_pot FOREIGN KEY (pot_id) REFERENCES pots (id);
+ALTER TABLE deposits ADD CONSTRAINT fk_deposits_client FOREIGN KEY (client_id) REFERENCES clients (id);
+ALTER TABLE proposed_allocations ADD CONSTRAINT fk_proposed_allocations_deposit FOREIGN KEY (deposit_id) REFERENCES deposits (id);
+ALTER TABLE proposed_allocations ADD CONSTRAINT fk_proposed_allocations_account FOREIGN KEY (account_id) REFERENCES accounts (id);
+ALTER TABLE receipts ADD CONSTRAINT fk_receipts_deposit FOREIGN KEY (deposit_id) REFERENCES deposits (id);
+ALTER TABLE reversals ADD CONSTRAINT fk_reversals_receipt FOREIGN KEY (receipt_id) REFERENCES receipts (id);
+ALTER TABLE allocations ADD CONSTRAINT fk_allocations_receipt FOREIGN KEY (receipt_id) REFERENCES receipts (id);
+ALTER TABLE allocations ADD CONSTRAINT fk_allocations_account FOREIGN KEY (account_id) REFERENCES accounts (id);
+ALTER TABLE allocations ADD CONSTRAINT fk_allocations_reversal FOREIGN KEY (reversal_id) REFERENCES reversals (id);
+ALTER TABLE allocations ADD CONSTRAINT fk_allocations_reverses FOREIGN KEY (reverses_id) REFERENCES allocations (id);
+ALTER TABLE bonus_claims ADD CONSTRAINT fk_bonus_claims_allocation FOREIGN KEY (allocation_id) REFERENCES allocations (id);
+ALTER TABLE relief_claims ADD CONSTRAINT fk_relief_claims_allocation FOREIGN KEY (allocation_id) REFERENCES allocations (id);
+ALTER TABLE allowance_usages ADD CONSTRAINT fk_allowance_usages_allocation FOREIGN KEY (allocation_id) REFERENCES allocations (id);
+
+-- a pot has one open GIA, which stops two receipts overflowing at once each creating one
+CREATE UNIQUE INDEX idx_accounts_open_gia ON accounts (pot_id, wrapper) WHERE wrapper = 'GIA' AND closed_at IS NULL AND deleted_at IS NULL;
+
+-- amounts are in pennies, allocations and claims go negative when reversed so aren't checked
+ALTER TABLE deposits ADD CONSTRAINT chk_deposits_amount CHECK (amount > 0);
+ALTER TABLE receipts ADD CONSTRAINT chk_receipts_amount CHECK (amount > 0);
+ALTER TABLE receipts ADD CONSTRAINT chk_receipts_excess_amount CHECK (excess_amount >= 0);
+ALTER TABLE receipts ADD CONSTRAINT chk_receipts_suspense_amount CHECK (suspense_amount >= 0 AND suspense_amount <= amount);
+ALTER TABLE reversals ADD CONSTRAINT chk_reversals_amount CHECK (amount > 0);
+ALTER TABLE wrapper_limits ADD CONSTRAINT chk_wrapper_limits_amount CHECK (amount >= 0);
+ALTER TABLE tapered_allowances ADD CONSTRAINT chk_tapered_allowances_amount CHECK (amount >= 0);
+ALTER TABLE proposed_allocations ADD CONSTRAINT chk_proposed_allocations_split_bps CHECK (split_bps > 0 AND split_bps <= 10000);
@@ -3,26 +3,92 @@ package models
 import (
 	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
+	"time"
 )
 
 type Client struct {
 	gorm.Model
-	Name     string
-	Pots     []Pot     `gorm:"foreignKey:ClientID"`
-	Deposits []Deposit `gorm:"foreignKey:ClientID"`
+	Name                string             `json:"name" validate:"required"`
+	DateOfBirth         *time.Time         `json:"date_of_birth"`
+	RegisteredContactID *uint              `json:"registered_contact_id"` // the adult who manages a child's Junior ISA
+	MpaaTriggeredAt     *time.Time         `json:"-"`                     // when the client first flexibly accessed a pension
+	ClosedAt            *time.Time         `json:"closed_at"`
+	TaperedAllowances   []TaperedAllowance `json:"-" gorm:"foreignKey:ClientID"`
+	Children            []Client           `json:"-" gorm:"foreignKey:RegisteredContactID"`
+	Pots                []Pot              `json:"pots,omitempty" gorm:"foreignKey:ClientID"`
+	Deposits            []Deposit          `json:"-" gorm:"foreignKey:ClientID"`
+}
+
+// TaperedAllowance is a high earner's reduced pension annual allowance for a tax year
+type TaperedAllowance struct {
+	gorm.Model
+	ClientID uint    `json:"-" gorm:"uniqueIndex:idx_client_tapered_year"`
+	TaxYear  TaxYear `json:"tax_year" gorm:"uniqueIndex:idx_client_tapered_year"`
+	Amount   uint    `json:"amount"` // amount is always in pennies
+}
+
+// PensionAllowanceAudit records a change to a client's pension allowance attributes
+type PensionAllowanceAudit struct {
+	gorm.Model
+	ClientID  uint   `json:"client_id" gorm:"index"`
+	Field     string `json:"field"`
+	OldValue  string `json:"old_value"`
+	NewValue  string `json:"new_value"`
+	ChangedBy string `json:"changed_by"`
+}
+
+// MpaaAppliesAt reports whether the Money Purchase Annual Allowance applies to contributions made at t
+func (c *Client) MpaaAppliesAt(t time.Time) bool {
+	return c.MpaaTriggeredAt != nil && !t.Before(*c.MpaaTriggeredAt)
+}
+
+// TaperedAllowanceFor returns the client's tapered annual allowance for the tax year, if they have one
+func (c *Client) TaperedAllowanceFor(year TaxYear) (uint, bool) {
+	for _, tapered := range c.TaperedAllowances {
+		if tapered.TaxYear == year {
+			return tapered.Amount, true
+		}
+	}
+	return 0, false
+}
+
+// AgeAt returns the client's age in whole years at the given time, or false if their date of birth isn't known
+func (c *Client) AgeAt(t time.Time) (int, bool) {
+	if c.DateOfBirth == nil {
+		return 0, false
+	}
+	dob := c.DateOfBirth.In(t.Location())
+	age := t.Year() - dob.Year()
+	if t.Month() < dob.Month() || (t.Month() == dob.Month() && t.Day() < dob.Day()) {
+		age--
+	}
+	return age, true
 }
 
 type Pot struct {
 	gorm.Model
-	ClientID uint
-	Name     string
-	Accounts []Account `gorm:"foreignKey:PotID"`
+	ClientID uint       `json:"client_id"` // the pot's owner, who is the child for a Junior ISA pot
+	Name     string     `json:"name" validate:"required"`
+	ClosedAt *time.Time `json:"closed_at"`
+	Accounts []Account  `json:"accounts,omitempty" gorm:"foreignKey:PotID"`
 }
 
+// LimitMPAA is the wrapper_limits key for the Money Purchase Annual Allowance
+const LimitMPAA = "MPAA"
+
+const (
+	WrapperGIA  = "GIA"
+	WrapperISA  = "ISA"
+	WrapperJISA = "JISA"
+	WrapperLISA = "LISA"
+	WrapperSIPP = "SIPP"
+)
+
 type Account struct {
 	gorm.Model
-	PotID   uint
-	Wrapper string // SIPP, GIA, ISA
+	PotID    uint       `json:"pot_id"`
+	Wrapper  string     `json:"wrapper" validate:"required,oneof=SIPP GIA ISA LISA JISA"`
+	ClosedAt *time.Time `json:"closed_at"` // closed accounts are kept so their subscriptions still count
 }
 
 type Deposit struct {
@@ -31,28 +97,168 @@ type Deposit struct {
 	Amount             uint                 `json:"amount" validate:"required"` // amount is always in pennies
 	Receipts           []Receipt            `json:"receipts" gorm:"foreignKey:DepositID"`
 	ProposedAllocation []ProposedAllocation `json:"proposed_allocation,omitempty" gorm:"foreignKey:DepositID" validate:"required,dive,required"`
+	// Apportionment is how the pennies lost rounding the split down are handed out, the configured
+	// strategy when empty
+	Apportionment string `json:"apportionment,omitempty" validate:"omitempty,oneof=largest_remainder gia largest_split first_account"`
+	Received      int64  `json:"received" gorm:"-"` // worked out from the receipts by Funding
+	Status        string `json:"status" gorm:"-"`   // worked out from the receipts by Funding
+}
+
+const (
+	DepositAwaitingFunds   = "awaiting_funds"
+	DepositPartiallyFunded = "partially_funded"
+	DepositFunded          = "funded"
+	DepositOverFunded      = "over_funded"
+)
+
+// Funding totals what has been received against the deposit, leaving out rejected receipts and
+// anything since reversed, and returns it with the deposit's funding status. Receipts must be
+// loaded with their reversals.
+func (d *Deposit) Funding() (int64, string) {
+	var received int64
+	for _, receipt := range d.Receipts {
+		if receipt.FundingDecision == FundingRejected {
+			continue
+		}
+		received += int64(receipt.Amount)
+		for _, reversal := range receipt.Reversals {
+			received -= reversal.Amount
+		}
+	}
+
+	switch {
+	case received <= 0:
+		return received, DepositAwaitingFunds
+	case received < int64(d.Amount):
+		return received, DepositPartiallyFunded
+	case received == int64(d.Amount):
+		return received, DepositFunded
+	default:
+		return received, DepositOverFunded
+	}
 }
 
+const (
+	FundingAccepted  = "accepted"  // the receipt was within what was left to fund of the deposit
+	FundingRejected  = "rejected"  // the receipt would have over-funded the deposit and nothing was allocated
+	FundingSuspense  = "suspense"  // the excess over the deposit was parked in suspense
+	FundingAllocated = "allocated" // the excess over the deposit was allocated with the deposit's split
+)
+
 type Receipt struct {
 	gorm.Model
 	DepositID   uint
 	Amount      uint           `json:"amount" validate:"required"` // amount is always in pennies
 	DeletedAt   gorm.DeletedAt `json:"-"`
 	Allocations []Allocation   `gorm:"foreignKey:ReceiptID"`
+	Reversals   []Reversal     `json:"reversals,omitempty" gorm:"foreignKey:ReceiptID"`
+	// FundingDecision records how the receipt was handled against the deposit amount
+	FundingDecision string `json:"funding_decision"`
+	ExcessAmount    int64  `json:"excess_amount"`   // amount over what was left to fund of the deposit, in pennies
+	SuspenseAmount  int64  `json:"suspense_amount"` // excess held in suspense rather than allocated, in pennies
+	// BankReference is the bank's transaction reference, so the same payment is only ever receipted once
+	BankReference *string    `json:"bank_reference" gorm:"uniqueIndex"`
+	ValueDate     *time.Time `json:"value_date"` // when the bank credited the payment
+	// NeedsReview flags a receipt to check by hand, e.g. one that may duplicate another receipt
+	NeedsReview  bool       `json:"needs_review" gorm:"index"`
+	ReviewReason string     `json:"review_reason,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at"`
+}
+
+// ReceivedOn is the time the payment was received, its value date when the bank gave one
+func (r *Receipt) ReceivedOn() time.Time {
+	if r.ValueDate != nil {
+		return *r.ValueDate
+	}
+	return r.CreatedAt
 }
 
 type ProposedAllocation struct {
 	gorm.Model
-	AccountID uint    `json:"account_id" validate:"required"`
-	Split     float32 `json:"split" validate:"required"`
+	AccountID uint        `json:"account_id" validate:"required"`
+	Split     BasisPoints `json:"split_bps" gorm:"column:split_bps" validate:"required,max=10000"`
 	DepositID uint
 }
 
 type Allocation struct {
 	gorm.Model
-	ReceiptID uint
-	AccountID uint
-	Amount    uint
+	ReceiptID  uint
+	AccountID  uint
+	Amount     int64       // amount is always in pennies, negative when reversing an earlier allocation
+	TaxYear    TaxYear     `gorm:"index"` // tax year the receipt was received in
+	SettledAt  *time.Time  // when the money was invested, the account can't be closed until then
+	ReversalID *uint       `gorm:"index"` // the reversal a compensating allocation was made by
+	ReversesID *uint       `gorm:"index"` // the original allocation a compensating allocation reverses
+	BonusClaim *BonusClaim `gorm:"foreignKey:AllocationID"`
+	// ReliefClaim is the basic rate tax relief to claim from HMRC on a SIPP contribution
+	ReliefClaim *ReliefClaim `gorm:"foreignKey:AllocationID"`
+	// AllowanceUsed is which tax years' allowance a SIPP allocation used, which includes earlier
+	// years' when unused allowance is carried forward
+	AllowanceUsed []AllowanceUsage `gorm:"foreignKey:AllocationID"`
+}
+
+// Reversal takes money allocated from a receipt back out of the accounts it was allocated to, e.g.
+// when the bank recalls the funds or the client is refunded. The original allocations are kept and
+// the reversal makes a compensating allocation, with a negative amount, against each one it reverses.
+type Reversal struct {
+	gorm.Model
+	ReceiptID   uint         `json:"receipt_id" gorm:"index"`
+	Amount      int64        `json:"amount"` // amount is always in pennies
+	Reason      string       `json:"reason"`
+	Allocations []Allocation `json:"allocations" gorm:"foreignKey:ReversalID"`
+}
+
+// ReliefClaim is the relief at source owed on a net SIPP contribution. The pension annual
+// allowance is tested against the gross amount, which is the contribution plus the relief.
+type ReliefClaim struct {
+	gorm.Model
+	AllocationID uint   `json:"allocation_id" gorm:"uniqueIndex"`
+	GrossAmount  int64  `json:"gross_amount"`        // amount is always in pennies, negative when reversed
+	ReliefAmount int64  `json:"relief_amount"`       // amount is always in pennies, negative when reversed
+	Status       string `json:"status" gorm:"index"` // pending, claimed
+	// ClaimPeriod is the "2006-01" month of the HMRC interim claim the relief was claimed in
+	ClaimPeriod string     `json:"claim_period,omitempty" gorm:"index"`
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty"`
+}
+
+// AllowanceUsage is the part of an allocation counted against a single tax year's allowance
+type AllowanceUsage struct {
+	gorm.Model
+	AllocationID uint    `gorm:"index"`
+	TaxYear      TaxYear `gorm:"index"`
+	Amount       int64   // amount is always in pennies, negative when allowance is restored
+}
+
+const (
+	ClaimStatusPending = "pending"
+	ClaimStatusClaimed = "claimed"
+)
+
+// BonusClaim is the government bonus expected on a Lifetime ISA allocation
+type BonusClaim struct {
+	gorm.Model
+	AllocationID uint   `gorm:"uniqueIndex"`
+	Amount       int64  // amount is always in pennies, negative when reversed
+	Status       string // pending, claimed
+}
+
+// WrapperLimit is the yearly subscription limit for a wrapper, in force from
+// the EffectiveFrom tax year until superseded by a later row.
+type WrapperLimit struct {
+	gorm.Model
+	Wrapper       string  `gorm:"uniqueIndex:idx_wrapper_limit"`
+	EffectiveFrom TaxYear `gorm:"uniqueIndex:idx_wrapper_limit"`
+	Amount        uint    // amount is always in pennies
+}
+
+// IdempotencyKey is a value stored against an idempotency key, e.g. the response to a request
+// that may be retried, shared by every instance of the API until it expires
+type IdempotencyKey struct {
+	Key       string `gorm:"primaryKey"`
+	Value     []byte
+	ExpiresAt *time.Time `gorm:"index"` // kept until deleted when nil
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 var validate = validator.New()
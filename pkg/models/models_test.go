@@ -3,6 +3,7 @@ package models
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 type ExampleStruct struct {
@@ -28,3 +29,67 @@ func TestValidateStruct(t *testing.T) {
 	assert.Equal(t, "email", errors[1].Tag)
 	assert.Empty(t, errors[1].Value)
 }
+
+func TestClientAgeAt(t *testing.T) {
+	client := Client{}
+
+	_, ok := client.AgeAt(time.Now())
+	assert.False(t, ok, "age should be unknown without a date of birth")
+
+	dob := time.Date(1990, time.June, 15, 0, 0, 0, 0, time.UTC)
+	client.DateOfBirth = &dob
+
+	age, ok := client.AgeAt(time.Date(2020, time.June, 14, 0, 0, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, 29, age)
+
+	age, _ = client.AgeAt(time.Date(2020, time.June, 15, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 30, age)
+}
+
+func TestClientPensionAllowance(t *testing.T) {
+	triggered := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+	client := Client{
+		MpaaTriggeredAt:   &triggered,
+		TaperedAllowances: []TaperedAllowance{{TaxYear: 2024, Amount: 1000000}},
+	}
+
+	assert.False(t, client.MpaaAppliesAt(triggered.Add(-time.Second)))
+	assert.True(t, client.MpaaAppliesAt(triggered))
+
+	amount, ok := client.TaperedAllowanceFor(2024)
+	assert.True(t, ok)
+	assert.Equal(t, uint(1000000), amount)
+
+	_, ok = client.TaperedAllowanceFor(2023)
+	assert.False(t, ok)
+}
+
+func TestDepositFunding(t *testing.T) {
+	deposit := Deposit{Amount: 10000}
+
+	received, status := deposit.Funding()
+	assert.Equal(t, int64(0), received)
+	assert.Equal(t, DepositAwaitingFunds, status)
+
+	deposit.Receipts = []Receipt{
+		{Amount: 6000, FundingDecision: FundingAccepted},
+		{Amount: 7000, FundingDecision: FundingRejected},
+	}
+	received, status = deposit.Funding()
+	assert.Equal(t, int64(6000), received, "rejected receipts aren't counted")
+	assert.Equal(t, DepositPartiallyFunded, status)
+
+	deposit.Receipts = append(deposit.Receipts, Receipt{Amount: 4000, FundingDecision: FundingAccepted})
+	_, status = deposit.Funding()
+	assert.Equal(t, DepositFunded, status)
+
+	deposit.Receipts = append(deposit.Receipts, Receipt{Amount: 500, FundingDecision: FundingSuspense, ExcessAmount: 500, SuspenseAmount: 500})
+	_, status = deposit.Funding()
+	assert.Equal(t, DepositOverFunded, status)
+
+	deposit.Receipts[0].Reversals = []Reversal{{Amount: 2000}}
+	received, status = deposit.Funding()
+	assert.Equal(t, int64(8500), received, "reversals aren't counted")
+	assert.Equal(t, DepositPartiallyFunded, status)
+}
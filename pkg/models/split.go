@@ -0,0 +1,79 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+)
+
+// BasisPoints is an exact share of an amount in hundredths of a percent, so 2500 is 25%.
+type BasisPoints uint
+
+// WholeSplit is all of an amount
+const WholeSplit BasisPoints = 10000
+
+// ParseSplit converts a fraction such as "0.25" to basis points, failing if it can't be
+// represented exactly
+func ParseSplit(fraction string) (BasisPoints, error) {
+	d, err := decimal.NewFromString(fraction)
+	if err != nil {
+		return 0, fmt.Errorf("split %q is not a number", fraction)
+	}
+	bps := d.Shift(4)
+	if !bps.IsInteger() || bps.IsNegative() || bps.GreaterThan(decimal.NewFromInt(int64(WholeSplit))) {
+		return 0, fmt.Errorf("split %q must be between 0 and 1 with at most 4 decimal places", fraction)
+	}
+	return BasisPoints(bps.IntPart()), nil
+}
+
+// Fraction is the share as a fraction of one, e.g. 0.25
+func (b BasisPoints) Fraction() decimal.Decimal {
+	return decimal.New(int64(b), -4)
+}
+
+// UnmarshalJSON takes the split in basis points as split_bps, or as a fraction of one in the
+// deprecated split field, e.g. 0.25 or "0.25", but not both
+func (p *ProposedAllocation) UnmarshalJSON(data []byte) error {
+	type plain ProposedAllocation
+	aux := struct {
+		*plain
+		SplitBps *BasisPoints    `json:"split_bps"`
+		Split    json.RawMessage `json:"split"` // Deprecated: use split_bps
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	legacy := len(aux.Split) > 0 && !bytes.Equal(aux.Split, []byte("null"))
+	if aux.SplitBps != nil && legacy {
+		return fmt.Errorf("account %d has both split_bps and the deprecated split, send only split_bps", p.AccountID)
+	}
+	if aux.SplitBps != nil {
+		p.Split = *aux.SplitBps
+		return nil
+	}
+	if !legacy {
+		return nil
+	}
+
+	// the fraction is read from the JSON text rather than through a float, so 0.1 stays exact
+	split, err := ParseSplit(string(bytes.Trim(aux.Split, `"`)))
+	if err != nil {
+		return err
+	}
+	p.Split = split
+	return nil
+}
+
+// MarshalJSON writes the split as split_bps and, while clients move over, as the deprecated split
+func (p ProposedAllocation) MarshalJSON() ([]byte, error) {
+	type plain ProposedAllocation
+	return json.Marshal(struct {
+		plain
+		Split json.Number `json:"split"` // Deprecated: use split_bps
+	}{
+		plain: plain(p),
+		Split: json.Number(p.Split.Fraction().String()),
+	})
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSplit(t *testing.T) {
+	tests := []struct {
+		fraction string
+		expected BasisPoints
+		wantErr  bool
+	}{
+		{"0.25", 2500, false},
+		{"0.1", 1000, false},
+		{"1", 10000, false},
+		{"0.0001", 1, false},
+		{"0.00005", 0, true},
+		{"1.01", 0, true},
+		{"-0.5", 0, true},
+		{"half", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fraction, func(t *testing.T) {
+			split, err := ParseSplit(tt.fraction)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, split)
+		})
+	}
+}
+
+func TestProposedAllocationUnmarshalJSON(t *testing.T) {
+	var deposit Deposit
+	body := `{"client_id":1,"amount":1000,"proposed_allocation":[
+		{"account_id":1,"split":0.1},
+		{"account_id":2,"split":"0.2"},
+		{"account_id":3,"split_bps":7000}]}`
+
+	assert.NoError(t, json.Unmarshal([]byte(body), &deposit))
+
+	var total BasisPoints
+	for _, allocation := range deposit.ProposedAllocation {
+		total += allocation.Split
+	}
+	assert.Equal(t, BasisPoints(1000), deposit.ProposedAllocation[0].Split)
+	assert.Equal(t, BasisPoints(2000), deposit.ProposedAllocation[1].Split)
+	assert.Equal(t, BasisPoints(7000), deposit.ProposedAllocation[2].Split)
+	assert.Equal(t, WholeSplit, total)
+}
+
+func TestProposedAllocationUnmarshalJSONInexactSplit(t *testing.T) {
+	var allocation ProposedAllocation
+	assert.Error(t, json.Unmarshal([]byte(`{"account_id":1,"split":0.333333}`), &allocation))
+}
+
+func TestProposedAllocationUnmarshalJSONBothSplits(t *testing.T) {
+	var allocation ProposedAllocation
+	err := json.Unmarshal([]byte(`{"account_id":1,"split_bps":2500,"split":0.25}`), &allocation)
+	assert.EqualError(t, err, "account 1 has both split_bps and the deprecated split, send only split_bps")
+}
+
+func TestProposedAllocationMarshalJSON(t *testing.T) {
+	raw, err := json.Marshal(ProposedAllocation{AccountID: 1, Split: 2500})
+	assert.NoError(t, err)
+
+	var fields map[string]interface{}
+	assert.NoError(t, json.Unmarshal(raw, &fields))
+	assert.Equal(t, float64(2500), fields["split_bps"])
+	assert.Equal(t, 0.25, fields["split"])
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // tax years turn over on UK local time
+)
+
+// TaxYear identifies a UK tax year by the calendar year it starts in, so 2026
+// is the year running from 6 April 2026 to 5 April 2027.
+type TaxYear int
+
+var ukLocation = loadUkLocation()
+
+func loadUkLocation() *time.Location {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// TaxYearOf returns the tax year the given instant falls in.
+func TaxYearOf(t time.Time) TaxYear {
+	local := t.In(ukLocation)
+	year := local.Year()
+	if local.Before(time.Date(year, time.April, 6, 0, 0, 0, 0, ukLocation)) {
+		year--
+	}
+	return TaxYear(year)
+}
+
+// Start returns the first instant of the tax year.
+func (y TaxYear) Start() time.Time {
+	return time.Date(int(y), time.April, 6, 0, 0, 0, 0, ukLocation)
+}
+
+// End returns the first instant of the following tax year.
+func (y TaxYear) End() time.Time {
+	return (y + 1).Start()
+}
+
+func (y TaxYear) String() string {
+	return fmt.Sprintf("%d/%02d", int(y), (int(y)+1)%100)
+}
+
+// ParseMonth parses a "2006-01" month and returns its first instant and the first instant of the
+// following month, in UK time
+func ParseMonth(month string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, ukLocation)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// DayOf returns the first instant of the UK calendar day the given instant falls in and the first
+// instant of the following day
+func DayOf(t time.Time) (time.Time, time.Time) {
+	local := t.In(ukLocation)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, ukLocation)
+	return start, start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTaxYearOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected TaxYear
+	}{
+		{"FirstDayOfTaxYear", time.Date(2024, time.April, 6, 0, 0, 0, 0, ukLocation), 2024},
+		{"LastDayOfTaxYear", time.Date(2025, time.April, 5, 23, 59, 59, 0, ukLocation), 2024},
+		{"January", time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC), 2024},
+		{"December", time.Date(2024, time.December, 31, 12, 0, 0, 0, time.UTC), 2024},
+		// 23:30 UTC on 5 April is already 6 April in British Summer Time
+		{"UtcLateOnFifthApril", time.Date(2024, time.April, 5, 23, 30, 0, 0, time.UTC), 2024},
+		{"UtcEarlyOnFifthApril", time.Date(2024, time.April, 5, 22, 30, 0, 0, time.UTC), 2023},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, TaxYearOf(tt.at))
+		})
+	}
+}
+
+func TestTaxYearBounds(t *testing.T) {
+	year := TaxYear(2026)
+
+	assert.Equal(t, "2026/27", year.String())
+	assert.Equal(t, year, TaxYearOf(year.Start()))
+	assert.Equal(t, year+1, TaxYearOf(year.End()))
+	assert.Equal(t, year, TaxYearOf(year.End().Add(-time.Second)))
+}
+
+func TestDayOf(t *testing.T) {
+	// 23:30 UTC on 1 September is already 2 September in British Summer Time
+	start, end := DayOf(time.Date(2024, time.September, 1, 23, 30, 0, 0, time.UTC))
+
+	assert.Equal(t, time.Date(2024, time.September, 2, 0, 0, 0, 0, ukLocation), start)
+	assert.Equal(t, time.Date(2024, time.September, 3, 0, 0, 0, 0, ukLocation), end)
+}
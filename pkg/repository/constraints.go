@@ -0,0 +1,26 @@
+package repository
+
+import (
+	"github.com/pkg/errors"
+)
+
+// constraintErrors are the Postgres error codes for a broken constraint
+var constraintErrors = map[string]error{
+	"23505": ErrConflict,         // unique_violation
+	"23503": ErrMissingReference, // foreign_key_violation
+	"23514": ErrInvalidValue,     // check_violation
+}
+
+// TranslateError turns the database refusing a write because of a constraint into ErrConflict,
+// ErrMissingReference or ErrInvalidValue, keeping the database's message, which names the
+// constraint. Other errors are returned as they are.
+func TranslateError(err error) error {
+	var coded interface{ SQLState() string }
+	if err == nil || !errors.As(err, &coded) {
+		return err
+	}
+	if kind, ok := constraintErrors[coded.SQLState()]; ok {
+		return errors.Wrap(kind, err.Error())
+	}
+	return err
+}
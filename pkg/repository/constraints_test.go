@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// pgError stands in for the driver's error, which reports its SQLSTATE code
+type pgError struct {
+	code    string
+	message string
+}
+
+func (e *pgError) Error() string    { return e.message }
+func (e *pgError) SQLState() string { return e.code }
+
+func TestTranslateError(t *testing.T) {
+	duplicate := &pgError{code: "23505", message: `duplicate key value violates unique constraint "idx_accounts_open_gia"`}
+
+	err := TranslateError(errors.Wrap(duplicate, "failed to create account"))
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Contains(t, err.Error(), "idx_accounts_open_gia")
+
+	assert.ErrorIs(t, TranslateError(&pgError{code: "23503"}), ErrMissingReference)
+	assert.ErrorIs(t, TranslateError(&pgError{code: "23514"}), ErrInvalidValue)
+
+	// anything else is left alone
+	syntax := &pgError{code: "42601"}
+	assert.Same(t, syntax, TranslateError(syntax))
+	assert.Same(t, ErrNotFound, TranslateError(ErrNotFound))
+	assert.NoError(t, TranslateError(nil))
+}
@@ -0,0 +1,537 @@
+package repository
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Gorm keeps the repositories in the database through gorm. Writes the database refuses because of
+// a constraint return ErrConflict, ErrMissingReference or ErrInvalidValue.
+type Gorm struct {
+	db *gorm.DB
+}
+
+func NewGorm(db *gorm.DB) *Gorm {
+	return &Gorm{db: db}
+}
+
+func (g *Gorm) Transaction(fn func(tx Repositories) error) error {
+	return g.db.Transaction(func(tx *gorm.DB) error {
+		return fn(NewGorm(tx))
+	})
+}
+
+func (g *Gorm) Deposits() DepositRepository {
+	return &gormDeposits{db: g.db}
+}
+
+func (g *Gorm) Receipts() ReceiptRepository {
+	return &gormReceipts{db: g.db}
+}
+
+func (g *Gorm) Accounts() AccountRepository {
+	return &gormAccounts{db: g.db}
+}
+
+func (g *Gorm) Allocations() AllocationRepository {
+	return &gormAllocations{db: g.db}
+}
+
+func (g *Gorm) Clients() ClientRepository {
+	return &gormClients{db: g.db}
+}
+
+func (g *Gorm) Pots() PotRepository {
+	return &gormPots{db: g.db}
+}
+
+func (g *Gorm) Limits() LimitRepository {
+	return &gormLimits{db: g.db}
+}
+
+func (g *Gorm) ReliefClaims() ReliefClaimRepository {
+	return &gormReliefClaims{db: g.db}
+}
+
+type gormDeposits struct {
+	db *gorm.DB
+}
+
+func (r *gormDeposits) Create(deposit *models.Deposit) error {
+	return TranslateError(r.db.Create(deposit).Error)
+}
+
+func (r *gormDeposits) Get(id uint) (*models.Deposit, error) {
+	var deposit models.Deposit
+	if err := r.db.Preload("ProposedAllocation").First(&deposit, id).Error; err != nil {
+		return nil, err
+	}
+	return &deposit, nil
+}
+
+func (r *gormDeposits) GetWithReceipts(id uint) (*models.Deposit, error) {
+	var deposit models.Deposit
+	if err := r.db.Preload("Receipts.Allocations").Preload("Receipts.Reversals").First(&deposit, id).Error; err != nil {
+		return nil, err
+	}
+	return &deposit, nil
+}
+
+func (r *gormDeposits) Received(id uint) (int64, error) {
+	var received int64
+	result := r.db.Raw("SELECT COALESCE(SUM(r.amount), 0) - COALESCE((SELECT SUM(v.amount) FROM reversals v "+
+		"JOIN receipts rv ON rv.id = v.receipt_id "+
+		"WHERE rv.deposit_id = ? AND rv.funding_decision IS DISTINCT FROM ? "+
+		"AND v.deleted_at IS NULL AND rv.deleted_at IS NULL), 0) FROM receipts r "+
+		"WHERE r.deposit_id = ? AND r.funding_decision IS DISTINCT FROM ? AND r.deleted_at IS NULL",
+		id, models.FundingRejected, id, models.FundingRejected)
+
+	if err := result.Scan(&received).Error; err != nil {
+		return 0, err
+	}
+	return received, nil
+}
+
+func (r *gormDeposits) AllocatedBefore(id uint, receiptID uint) ([]uint, error) {
+	allocated := make([]uint, 0)
+	result := r.db.Raw("SELECT r.amount - COALESCE(r.suspense_amount, 0) - COALESCE((SELECT SUM(v.amount) FROM reversals v "+
+		"WHERE v.receipt_id = r.id AND v.deleted_at IS NULL), 0) FROM receipts r "+
+		"WHERE r.deposit_id = ? AND r.id < ? AND r.funding_decision IS DISTINCT FROM ? AND r.deleted_at IS NULL "+
+		"ORDER BY r.id", id, receiptID, models.FundingRejected)
+
+	if err := result.Scan(&allocated).Error; err != nil {
+		return nil, err
+	}
+	return allocated, nil
+}
+
+type gormReceipts struct {
+	db *gorm.DB
+}
+
+func (r *gormReceipts) Create(receipt *models.Receipt) error {
+	return TranslateError(r.db.Create(receipt).Error)
+}
+
+func (r *gormReceipts) Get(id uint) (*models.Receipt, error) {
+	var receipt models.Receipt
+	if err := r.db.Preload("Allocations").First(&receipt, id).Error; err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (r *gormReceipts) Lock(id uint) (*models.Receipt, error) {
+	var receipt models.Receipt
+	if err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&receipt, id).Error; err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (r *gormReceipts) FindByBankReference(reference string) (*models.Receipt, error) {
+	var existing []models.Receipt
+	if err := r.db.Where("bank_reference = ?", reference).Limit(1).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, nil
+	}
+	return &existing[0], nil
+}
+
+func (r *gormReceipts) FindSimilar(depositID uint, amount uint, from time.Time, to time.Time) (*models.Receipt, error) {
+	var similar []models.Receipt
+	err := r.db.Where("deposit_id = ? AND amount = ? AND funding_decision IS DISTINCT FROM ? "+
+		"AND COALESCE(value_date, created_at) >= ? AND COALESCE(value_date, created_at) < ?",
+		depositID, amount, models.FundingRejected, from, to).
+		Order("id").Limit(1).Find(&similar).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(similar) == 0 {
+		return nil, nil
+	}
+	return &similar[0], nil
+}
+
+func (r *gormReceipts) ForReview() ([]models.Receipt, error) {
+	receipts := make([]models.Receipt, 0)
+	if err := r.db.Where("needs_review = ?", true).Order("id").Find(&receipts).Error; err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+func (r *gormReceipts) MarkReviewed(receipt *models.Receipt, at time.Time) error {
+	err := r.db.Model(receipt).Updates(map[string]interface{}{"needs_review": false, "reviewed_at": at}).Error
+	if err != nil {
+		return TranslateError(err)
+	}
+	receipt.NeedsReview = false
+	receipt.ReviewedAt = &at
+	return nil
+}
+
+func (r *gormReceipts) CreateReversal(reversal *models.Reversal) error {
+	return TranslateError(r.db.Create(reversal).Error)
+}
+
+func (r *gormReceipts) Balances() ([]ReceiptBalance, error) {
+	balances := make([]ReceiptBalance, 0)
+	err := r.db.Raw("SELECT r.id AS receipt_id, r.deposit_id, r.amount, r.funding_decision, r.suspense_amount, " +
+		"COALESCE(rv.reversed, 0) AS reversed, COALESCE(al.allocated, 0) AS allocated FROM receipts r " +
+		"LEFT JOIN (SELECT receipt_id, SUM(amount) AS reversed FROM reversals WHERE deleted_at IS NULL GROUP BY receipt_id) rv ON rv.receipt_id = r.id " +
+		"LEFT JOIN (SELECT receipt_id, SUM(amount) AS allocated FROM allocations WHERE deleted_at IS NULL GROUP BY receipt_id) al ON al.receipt_id = r.id " +
+		"WHERE r.deleted_at IS NULL ORDER BY r.id").
+		Scan(&balances).Error
+	if err != nil {
+		return nil, err
+	}
+	return balances, nil
+}
+
+type gormAccounts struct {
+	db *gorm.DB
+}
+
+func (r *gormAccounts) Get(id uint) (*models.Account, error) {
+	var account models.Account
+	if err := r.db.First(&account, id).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (r *gormAccounts) Find(ids []uint) ([]models.Account, error) {
+	var accounts []models.Account
+	if err := r.db.Find(&accounts, ids).Error; err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (r *gormAccounts) FindOpen(potID uint, wrapper string) (*models.Account, error) {
+	var account models.Account
+	if err := r.db.First(&account, "pot_id = ? and wrapper = ? and closed_at IS NULL", potID, wrapper).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (r *gormAccounts) Create(account *models.Account) error {
+	return TranslateError(r.db.Create(account).Error)
+}
+
+func (r *gormAccounts) ChangeWrapper(account *models.Account, wrapper string) error {
+	if err := r.db.Model(account).Update("wrapper", wrapper).Error; err != nil {
+		return TranslateError(err)
+	}
+	account.Wrapper = wrapper
+	return nil
+}
+
+func (r *gormAccounts) Close(account *models.Account, at time.Time) error {
+	if err := r.db.Model(account).Update("closed_at", at).Error; err != nil {
+		return TranslateError(err)
+	}
+	account.ClosedAt = &at
+	return nil
+}
+
+func (r *gormAccounts) CountAllocations(id uint, unsettled bool) (int64, error) {
+	query := r.db.Model(&models.Allocation{}).Where("account_id = ?", id)
+	if unsettled {
+		query = query.Where("settled_at IS NULL")
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+type gormAllocations struct {
+	db *gorm.DB
+}
+
+func (r *gormAllocations) Create(allocation *models.Allocation) error {
+	return TranslateError(r.db.Create(allocation).Error)
+}
+
+func (r *gormAllocations) ForReceipt(receiptID uint) ([]models.Allocation, error) {
+	var allocations []models.Allocation
+	err := r.db.Preload("BonusClaim").Preload("ReliefClaim").
+		Preload("AllowanceUsed", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("receipt_id = ?", receiptID).Order("id").Find(&allocations).Error
+	if err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+func (r *gormAllocations) Allocated(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error) {
+	var allocated int64
+	result := r.db.Raw("SELECT COALESCE(SUM(al.amount), 0) FROM clients c "+
+		"LEFT JOIN pots p ON p.client_id = c.id "+
+		"LEFT JOIN accounts a ON a.pot_id = p.id "+
+		"LEFT JOIN allocations al ON al.account_id = a.id "+
+		"WHERE a.wrapper = ? AND a.deleted_at IS NULL "+
+		"AND al.deleted_at IS NULL AND p.deleted_at IS NULL"+
+		" AND c.id = ? AND al.tax_year = ?", wrapper, clientID, taxYear)
+
+	if err := result.Scan(&allocated).Error; err != nil {
+		return 0, err
+	}
+	return allocated, nil
+}
+
+func (r *gormAllocations) AllowanceUsed(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error) {
+	var allowanceUsed int64
+	result := r.db.Raw("SELECT COALESCE(SUM(u.amount), 0) FROM clients c "+
+		"LEFT JOIN pots p ON p.client_id = c.id "+
+		"LEFT JOIN accounts a ON a.pot_id = p.id "+
+		"LEFT JOIN allocations al ON al.account_id = a.id "+
+		"LEFT JOIN allowance_usages u ON u.allocation_id = al.id "+
+		"WHERE a.wrapper = ? AND a.deleted_at IS NULL "+
+		"AND al.deleted_at IS NULL AND p.deleted_at IS NULL AND u.deleted_at IS NULL"+
+		" AND c.id = ? AND u.tax_year = ?", wrapper, clientID, taxYear)
+
+	if err := result.Scan(&allowanceUsed).Error; err != nil {
+		return 0, err
+	}
+	return allowanceUsed, nil
+}
+
+func (r *gormAllocations) Get(id uint) (*models.Allocation, error) {
+	var allocation models.Allocation
+	if err := r.db.First(&allocation, id).Error; err != nil {
+		return nil, err
+	}
+	return &allocation, nil
+}
+
+func (r *gormAllocations) Settle(allocation *models.Allocation, at time.Time) error {
+	if err := r.db.Model(allocation).Update("settled_at", at).Error; err != nil {
+		return TranslateError(err)
+	}
+	allocation.SettledAt = &at
+	return nil
+}
+
+type gormClients struct {
+	db *gorm.DB
+}
+
+func (r *gormClients) Create(client *models.Client) error {
+	return TranslateError(r.db.Create(client).Error)
+}
+
+func (r *gormClients) Get(id uint) (*models.Client, error) {
+	var client models.Client
+	if err := r.db.Preload("TaperedAllowances").First(&client, id).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *gormClients) GetWithPots(id uint) (*models.Client, error) {
+	var client models.Client
+	if err := r.db.Preload("Pots.Accounts").First(&client, id).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *gormClients) GetPot(id uint) (*models.Pot, error) {
+	var pot models.Pot
+	if err := r.db.First(&pot, id).Error; err != nil {
+		return nil, err
+	}
+	return &pot, nil
+}
+
+// Lock takes row locks in ID order, so two transactions locking the same clients can't deadlock
+func (r *gormClients) Lock(clientID uint, accountIDs []uint) error {
+	locked := make([]uint, 0)
+	result := r.db.Raw("SELECT id FROM clients WHERE id = ? OR id IN "+
+		"(SELECT p.client_id FROM pots p JOIN accounts a ON a.pot_id = p.id WHERE a.id IN ?) "+
+		"ORDER BY id FOR UPDATE", clientID, accountIDs)
+
+	return result.Scan(&locked).Error
+}
+
+func (r *gormClients) Update(client *models.Client) error {
+	return TranslateError(r.db.Model(client).Select("Name", "DateOfBirth", "RegisteredContactID").Updates(client).Error)
+}
+
+func (r *gormClients) Close(client *models.Client, at time.Time) error {
+	if err := r.db.Model(client).Update("closed_at", at).Error; err != nil {
+		return TranslateError(err)
+	}
+	client.ClosedAt = &at
+	return nil
+}
+
+func (r *gormClients) CountOpenPots(id uint) (int64, error) {
+	var count int64
+	if err := r.db.Model(&models.Pot{}).Where("client_id = ? AND closed_at IS NULL", id).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *gormClients) SetMpaa(client *models.Client, at *time.Time) error {
+	if err := r.db.Model(client).Update("mpaa_triggered_at", at).Error; err != nil {
+		return TranslateError(err)
+	}
+	client.MpaaTriggeredAt = at
+	return nil
+}
+
+// SetTaperedAllowance hard deletes a removed allowance, so the year can be tapered again without
+// breaking the unique index
+func (r *gormClients) SetTaperedAllowance(clientID uint, taxYear models.TaxYear, amount *uint) error {
+	if amount == nil {
+		err := r.db.Unscoped().Where("client_id = ? AND tax_year = ?", clientID, taxYear).Delete(&models.TaperedAllowance{}).Error
+		return TranslateError(err)
+	}
+
+	tapered := models.TaperedAllowance{ClientID: clientID, TaxYear: taxYear, Amount: *amount}
+	return TranslateError(r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "client_id"}, {Name: "tax_year"}},
+		DoUpdates: clause.AssignmentColumns([]string{"amount", "updated_at", "deleted_at"}),
+	}).Create(&tapered).Error)
+}
+
+func (r *gormClients) Audit(clientID uint) ([]models.PensionAllowanceAudit, error) {
+	audit := make([]models.PensionAllowanceAudit, 0)
+	if err := r.db.Where("client_id = ?", clientID).Order("id").Find(&audit).Error; err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (r *gormClients) RecordAudit(audit []models.PensionAllowanceAudit) error {
+	if len(audit) == 0 {
+		return nil
+	}
+	return TranslateError(r.db.Create(&audit).Error)
+}
+
+type gormPots struct {
+	db *gorm.DB
+}
+
+func (r *gormPots) Create(pot *models.Pot) error {
+	return TranslateError(r.db.Create(pot).Error)
+}
+
+func (r *gormPots) Get(id uint) (*models.Pot, error) {
+	var pot models.Pot
+	if err := r.db.Preload("Accounts").First(&pot, id).Error; err != nil {
+		return nil, err
+	}
+	return &pot, nil
+}
+
+func (r *gormPots) Rename(pot *models.Pot, name string) error {
+	if err := r.db.Model(pot).Update("name", name).Error; err != nil {
+		return TranslateError(err)
+	}
+	pot.Name = name
+	return nil
+}
+
+func (r *gormPots) Close(pot *models.Pot, at time.Time) error {
+	if err := r.db.Model(pot).Update("closed_at", at).Error; err != nil {
+		return TranslateError(err)
+	}
+	pot.ClosedAt = &at
+	return nil
+}
+
+func (r *gormPots) CountOpenAccounts(id uint) (int64, error) {
+	var count int64
+	if err := r.db.Model(&models.Account{}).Where("pot_id = ? AND closed_at IS NULL", id).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+type gormLimits struct {
+	db *gorm.DB
+}
+
+func (r *gormLimits) InForce(wrapper string, taxYear models.TaxYear) (*models.WrapperLimit, error) {
+	var limit models.WrapperLimit
+	err := r.db.Where("wrapper = ? AND effective_from <= ?", wrapper, taxYear).
+		Order("effective_from DESC").
+		First(&limit).Error
+	if err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+type gormReliefClaims struct {
+	db *gorm.DB
+}
+
+// receivedBetween is the relief claims on contributions the bank received from until to, by the
+// receipt's value date or when it was received without one, as the claim is made for that month
+const receivedBetween = "allocation_id IN (SELECT a.id FROM allocations a JOIN receipts r ON r.id = a.receipt_id " +
+	"WHERE COALESCE(r.value_date, r.created_at) >= ? AND COALESCE(r.value_date, r.created_at) < ?)"
+
+func (r *gormReliefClaims) List(status string, from time.Time, to time.Time) ([]models.ReliefClaim, error) {
+	claims := make([]models.ReliefClaim, 0)
+	err := r.db.Where("status = ? AND "+receivedBetween, status, from, to).
+		Order("id").
+		Find(&claims).Error
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (r *gormReliefClaims) CountInPeriod(period string) (int64, error) {
+	var count int64
+	if err := r.db.Model(&models.ReliefClaim{}).Where("claim_period = ?", period).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *gormReliefClaims) Claim(period string, before time.Time, at time.Time) (int64, error) {
+	result := r.db.Model(&models.ReliefClaim{}).
+		Where("status = ? AND "+receivedBetween, models.ClaimStatusPending, time.Time{}, before).
+		Updates(map[string]interface{}{
+			"status":       models.ClaimStatusClaimed,
+			"claim_period": period,
+			"claimed_at":   at,
+		})
+	if result.Error != nil {
+		return 0, TranslateError(result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+func (r *gormReliefClaims) Totals(period string) ([]ReliefTotal, error) {
+	totals := make([]ReliefTotal, 0)
+	err := r.db.Raw("SELECT c.id AS client_id, c.name AS client_name, COUNT(rc.id) AS contributions, "+
+		"COALESCE(SUM(al.amount), 0) AS net_amount, COALESCE(SUM(rc.relief_amount), 0) AS relief_amount, "+
+		"COALESCE(SUM(rc.gross_amount), 0) AS gross_amount FROM relief_claims rc "+
+		"JOIN allocations al ON al.id = rc.allocation_id "+
+		"JOIN accounts a ON a.id = al.account_id "+
+		"JOIN pots p ON p.id = a.pot_id "+
+		"JOIN clients c ON c.id = p.client_id "+
+		"WHERE rc.claim_period = ? AND rc.deleted_at IS NULL "+
+		"GROUP BY c.id, c.name ORDER BY c.id", period).
+		Scan(&totals).Error
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func mockGorm(t *testing.T) (*Gorm, sqlmock.Sqlmock) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Unable to create mock db: %v", err)
+	}
+	return NewGorm(db), mock
+}
+
+func TestGormAllocated(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT COALESCE\\(SUM\\(al\\.amount\\), 0\\) FROM clients c .*").
+		WithArgs("SIPP", 1, 2024).
+		WillReturnRows(sqlmock.NewRows([]string{"COALESCE"}).AddRow(0))
+
+	result, err := store.Allocations().Allocated("SIPP", 1, models.TaxYear(2024))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormAllowanceUsed(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT COALESCE\\(SUM\\(u\\.amount\\), 0\\) FROM clients c .*LEFT JOIN allowance_usages u.*").
+		WithArgs("SIPP", 1, 2022).
+		WillReturnRows(sqlmock.NewRows([]string{"COALESCE"}).AddRow(250000))
+
+	result, err := store.Allocations().AllowanceUsed("SIPP", 1, models.TaxYear(2022))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(250000), result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormLimitInForce(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	limitRow := sqlmock.NewRows([]string{"id", "wrapper", "effective_from", "amount"}).AddRow("2", "SIPP", 2023, 6000000)
+
+	mock.ExpectQuery("SELECT \\* FROM \"wrapper_limits\" WHERE \\(wrapper = \\$1 AND effective_from <= \\$2\\)(.*)ORDER BY effective_from DESC(.*)").
+		WithArgs("SIPP", 2024, 1).
+		WillReturnRows(limitRow)
+
+	mock.ExpectQuery("SELECT \\* FROM \"wrapper_limits\"(.*)").
+		WithArgs("ISA", 2010, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	t.Run("Limit in force", func(t *testing.T) {
+		limit, err := store.Limits().InForce("SIPP", models.TaxYear(2024))
+
+		assert.NoError(t, err)
+		assert.Equal(t, uint(6000000), limit.Amount)
+		assert.Equal(t, models.TaxYear(2023), limit.EffectiveFrom)
+	})
+
+	t.Run("No limit in force", func(t *testing.T) {
+		_, err := store.Limits().InForce("ISA", models.TaxYear(2010))
+
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormLockClients(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT id FROM clients WHERE id = \\$1 OR id IN \\(SELECT p\\.client_id FROM pots p JOIN accounts a ON a\\.pot_id = p\\.id WHERE a\\.id IN \\(\\$2,\\$3\\)\\) ORDER BY id FOR UPDATE$").
+		WithArgs(1, 4, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+
+	assert.NoError(t, store.Clients().Lock(1, []uint{4, 5}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormAllocatedBefore(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT r\\.amount - COALESCE\\(r\\.suspense_amount, 0\\) - COALESCE\\(\\(SELECT SUM\\(v\\.amount\\) FROM reversals v "+
+		"WHERE v\\.receipt_id = r\\.id(.*)FROM receipts r(.*)ORDER BY r\\.id").
+		WithArgs(1, 4, models.FundingRejected).
+		WillReturnRows(sqlmock.NewRows([]string{"allocated"}).AddRow(1000).AddRow(250))
+
+	allocated, err := store.Deposits().AllocatedBefore(1, 4)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{1000, 250}, allocated)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormFindByBankReference(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT \\* FROM \"receipts\" WHERE bank_reference = \\$1(.*)").
+		WithArgs("FP-123", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "deposit_id", "amount", "bank_reference"}).AddRow(7, 1, 100000, "FP-123"))
+	mock.ExpectQuery("^SELECT \\* FROM \"receipts\" WHERE bank_reference = \\$1(.*)").
+		WithArgs("FP-456", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	existing, err := store.Receipts().FindByBankReference("FP-123")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(7), existing.ID)
+
+	missing, err := store.Receipts().FindByBankReference("FP-456")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormTransactionRollsBack(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT id FROM clients WHERE (.*) ORDER BY id FOR UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectRollback()
+
+	err := store.Transaction(func(tx Repositories) error {
+		if err := tx.Clients().Lock(1, []uint{4}); err != nil {
+			return err
+		}
+		return ErrNotFound
+	})
+
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormCreateTranslatesConstraintErrors(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"accounts\"(.*)").
+		WillReturnError(&pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint \"idx_accounts_open_gia\""})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"receipts\"(.*)").
+		WillReturnError(&pgconn.PgError{Code: "23503", Message: "insert or update on table \"receipts\" violates foreign key constraint \"fk_receipts_deposit\""})
+	mock.ExpectRollback()
+
+	err := store.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperGIA})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Contains(t, err.Error(), "idx_accounts_open_gia")
+
+	err = store.Receipts().Create(&models.Receipt{DepositID: 10, Amount: 100})
+	assert.ErrorIs(t, err, ErrMissingReference)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormReceiptBalances(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectQuery("^SELECT r.id AS receipt_id(.*)FROM receipts r(.*)WHERE r.deleted_at IS NULL ORDER BY r.id").
+		WillReturnRows(sqlmock.NewRows([]string{"receipt_id", "deposit_id", "amount", "funding_decision", "suspense_amount", "reversed", "allocated"}).
+			AddRow(2, 1, 50000, models.FundingSuspense, 20000, 10000, 20000))
+
+	balances, err := store.Receipts().Balances()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []ReceiptBalance{{ReceiptID: 2, DepositID: 1, Amount: 50000, FundingDecision: models.FundingSuspense,
+		SuspenseAmount: 20000, Reversed: 10000, Allocated: 20000}}, balances)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormReliefClaims(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	now := time.Date(2024, time.October, 3, 9, 0, 0, 0, time.UTC)
+	_, end, _ := models.ParseMonth("2024-09")
+
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM \"relief_claims\" WHERE claim_period = \\$1(.*)").
+		WithArgs("2024-09").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE \"relief_claims\" SET (.*) WHERE \\(status = \\$5 AND allocation_id IN \\(SELECT a.id FROM allocations a JOIN receipts r (.*)"+
+		"WHERE COALESCE\\(r.value_date, r.created_at\\) >= \\$6 AND COALESCE\\(r.value_date, r.created_at\\) < \\$7\\)\\)(.*)").
+		WithArgs("2024-09", now, models.ClaimStatusClaimed, sqlmock.AnyArg(), models.ClaimStatusPending, time.Time{}, end).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+	mock.ExpectQuery("^SELECT c.id AS client_id(.*)FROM relief_claims rc(.*)WHERE rc.claim_period = \\$1(.*)").
+		WithArgs("2024-09").
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "client_name", "contributions", "net_amount", "relief_amount", "gross_amount"}).
+			AddRow(1, "Jane", 2, 2000, 500, 2500))
+
+	count, err := store.ReliefClaims().CountInPeriod("2024-09")
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	claimed, err := store.ReliefClaims().Claim("2024-09", end, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), claimed)
+
+	totals, err := store.ReliefClaims().Totals("2024-09")
+	assert.NoError(t, err)
+	assert.Equal(t, []ReliefTotal{{ClientID: 1, ClientName: "Jane", Contributions: 2, NetAmount: 2000, ReliefAmount: 500, GrossAmount: 2500}}, totals)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormSetTaperedAllowance(t *testing.T) {
+	store, mock := mockGorm(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO \"tapered_allowances\"(.*)ON CONFLICT \\(\"client_id\",\"tax_year\"\\) DO UPDATE SET \"amount\"=\"excluded\".\"amount\"(.*)").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	// a hard delete, so the year can be tapered again without breaking the unique index
+	mock.ExpectExec("^DELETE FROM \"tapered_allowances\" WHERE client_id = \\$1 AND tax_year = \\$2$").
+		WithArgs(1, 2024).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	amount := uint(2500000)
+	assert.NoError(t, store.Clients().SetTaperedAllowance(1, models.TaxYear(2024), &amount))
+	assert.NoError(t, store.Clients().SetTaperedAllowance(1, models.TaxYear(2024), nil))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
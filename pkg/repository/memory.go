@@ -0,0 +1,1227 @@
+package repository
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory keeps the repositories in memory, so the service can run without a database, e.g. in
+// tests. Transactions run side by side and roll back by undoing their writes, and like the database
+// they only keep out of each other's way by locking rows, which are held until the transaction ends.
+// Unlike the database a transaction sees the others' writes before they commit. Records are copied
+// in and out, as they would be by a database, and writes are refused with the errors Gorm returns
+// for the database's constraints.
+type Memory struct {
+	mu   sync.Mutex // held by each call, for as long as it reads or writes the records
+	data *memoryData
+	rows map[rowKey]*sync.Mutex // the row locks, taken by transactions and held until they end
+}
+
+// rowKey names the record a row lock is on
+type rowKey struct {
+	kind string
+	id   uint
+}
+
+// memoryTx is a transaction's row locks and how to undo its writes
+type memoryTx struct {
+	locks map[rowKey]*sync.Mutex
+	undo  []func() // the most recent write's last
+}
+
+// onUndo records how to undo a write, there being nothing to undo outside a transaction
+func (tx *memoryTx) onUndo(undo func()) {
+	if tx != nil {
+		tx.undo = append(tx.undo, undo)
+	}
+}
+
+type memoryData struct {
+	ids             map[string]uint // the highest ID used for each kind of record
+	clients         map[uint]models.Client
+	pots            map[uint]models.Pot
+	accounts        map[uint]models.Account
+	limits          map[uint]models.WrapperLimit
+	deposits        map[uint]models.Deposit
+	proposed        map[uint]models.ProposedAllocation
+	receipts        map[uint]models.Receipt
+	reversals       map[uint]models.Reversal
+	allocations     map[uint]models.Allocation
+	bonusClaims     map[uint]models.BonusClaim
+	reliefClaims    map[uint]models.ReliefClaim
+	allowanceUsages map[uint]models.AllowanceUsage
+	audits          map[uint]models.PensionAllowanceAudit
+}
+
+func NewMemory() *Memory {
+	return &Memory{rows: make(map[rowKey]*sync.Mutex), data: &memoryData{
+		ids:             make(map[string]uint),
+		clients:         make(map[uint]models.Client),
+		pots:            make(map[uint]models.Pot),
+		accounts:        make(map[uint]models.Account),
+		limits:          make(map[uint]models.WrapperLimit),
+		deposits:        make(map[uint]models.Deposit),
+		proposed:        make(map[uint]models.ProposedAllocation),
+		receipts:        make(map[uint]models.Receipt),
+		reversals:       make(map[uint]models.Reversal),
+		allocations:     make(map[uint]models.Allocation),
+		bonusClaims:     make(map[uint]models.BonusClaim),
+		reliefClaims:    make(map[uint]models.ReliefClaim),
+		allowanceUsages: make(map[uint]models.AllowanceUsage),
+		audits:          make(map[uint]models.PensionAllowanceAudit),
+	}}
+}
+
+func (m *Memory) Transaction(fn func(tx Repositories) error) error {
+	tx := &memoryTx{locks: make(map[rowKey]*sync.Mutex)}
+	defer m.release(tx)
+	defer func() {
+		if r := recover(); r != nil {
+			m.rollback(tx)
+			panic(r)
+		}
+	}()
+
+	if err := fn(&memoryRepos{m: m, tx: tx}); err != nil {
+		m.rollback(tx)
+		return err
+	}
+	return nil
+}
+
+// rollback undoes the transaction's writes, newest first
+func (m *Memory) rollback(tx *memoryTx) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+// release lets go of the transaction's row locks
+func (m *Memory) release(tx *memoryTx) {
+	for _, row := range tx.locks {
+		row.Unlock()
+	}
+}
+
+func (m *Memory) Deposits() DepositRepository {
+	return (&memoryRepos{m: m}).Deposits()
+}
+
+func (m *Memory) Receipts() ReceiptRepository {
+	return (&memoryRepos{m: m}).Receipts()
+}
+
+func (m *Memory) Accounts() AccountRepository {
+	return (&memoryRepos{m: m}).Accounts()
+}
+
+func (m *Memory) Allocations() AllocationRepository {
+	return (&memoryRepos{m: m}).Allocations()
+}
+
+func (m *Memory) Clients() ClientRepository {
+	return (&memoryRepos{m: m}).Clients()
+}
+
+func (m *Memory) Pots() PotRepository {
+	return (&memoryRepos{m: m}).Pots()
+}
+
+func (m *Memory) Limits() LimitRepository {
+	return (&memoryRepos{m: m}).Limits()
+}
+
+func (m *Memory) ReliefClaims() ReliefClaimRepository {
+	return (&memoryRepos{m: m}).ReliefClaims()
+}
+
+// Seed adds clients, pots, accounts, wrapper limits, deposits, receipts and allocations, keeping
+// any IDs they already have, e.g. to set up a test. The records they refer to aren't checked, so a
+// test only needs to seed what it uses.
+func (m *Memory) Seed(records ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.data
+	for _, record := range records {
+		var err error
+		switch record := record.(type) {
+		case *models.Client:
+			err = insert(nil, d, d.clients, "client", &record.Model, func() models.Client {
+				stored := *record
+				stored.TaperedAllowances = append([]models.TaperedAllowance(nil), record.TaperedAllowances...)
+				stored.Children, stored.Pots, stored.Deposits = nil, nil, nil
+				return stored
+			})
+		case *models.Pot:
+			err = insert(nil, d, d.pots, "pot", &record.Model, func() models.Pot {
+				stored := *record
+				stored.Accounts = nil
+				return stored
+			})
+		case *models.Account:
+			err = insert(nil, d, d.accounts, "account", &record.Model, func() models.Account { return *record })
+		case *models.WrapperLimit:
+			err = insert(nil, d, d.limits, "wrapper limit", &record.Model, func() models.WrapperLimit { return *record })
+		case *models.Deposit:
+			err = d.createDeposit(nil, record)
+		case *models.Receipt:
+			err = d.createReceipt(nil, record)
+		case *models.Allocation:
+			err = d.createAllocation(nil, record)
+		default:
+			err = errors.Errorf("cannot seed a %T", record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryRepos are the repositories over the store's records, within the transaction when tx is set
+type memoryRepos struct {
+	m  *Memory
+	tx *memoryTx
+}
+
+// lock holds the store's lock for the call, returning the function that releases it
+func (r *memoryRepos) lock() func() {
+	r.m.mu.Lock()
+	return r.m.mu.Unlock
+}
+
+// lockRows takes the row locks on the records in the order given, holding them until the transaction
+// ends. Outside a transaction there is nothing to hold them for.
+func (r *memoryRepos) lockRows(kind string, ids ...uint) {
+	if r.tx == nil {
+		return
+	}
+	for _, id := range ids {
+		key := rowKey{kind: kind, id: id}
+		if _, held := r.tx.locks[key]; held {
+			continue
+		}
+
+		r.m.mu.Lock()
+		row, ok := r.m.rows[key]
+		if !ok {
+			row = &sync.Mutex{}
+			r.m.rows[key] = row
+		}
+		r.m.mu.Unlock()
+
+		row.Lock()
+		r.tx.locks[key] = row
+	}
+}
+
+func (r *memoryRepos) Deposits() DepositRepository {
+	return &memoryDeposits{r}
+}
+
+func (r *memoryRepos) Receipts() ReceiptRepository {
+	return &memoryReceipts{r}
+}
+
+func (r *memoryRepos) Accounts() AccountRepository {
+	return &memoryAccounts{r}
+}
+
+func (r *memoryRepos) Allocations() AllocationRepository {
+	return &memoryAllocations{r}
+}
+
+func (r *memoryRepos) Clients() ClientRepository {
+	return &memoryClients{r}
+}
+
+func (r *memoryRepos) Pots() PotRepository {
+	return &memoryPots{r}
+}
+
+func (r *memoryRepos) Limits() LimitRepository {
+	return &memoryLimits{r}
+}
+
+func (r *memoryRepos) ReliefClaims() ReliefClaimRepository {
+	return &memoryReliefClaims{r}
+}
+
+type memoryDeposits struct {
+	*memoryRepos
+}
+
+func (r *memoryDeposits) Create(deposit *models.Deposit) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if err := d.checkDeposit(deposit); err != nil {
+		return err
+	}
+	return d.createDeposit(r.tx, deposit)
+}
+
+func (r *memoryDeposits) Get(id uint) (*models.Deposit, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	deposit, ok := d.deposits[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	deposit.ProposedAllocation = sorted(d.proposed, func(p models.ProposedAllocation) bool { return p.DepositID == id })
+	return &deposit, nil
+}
+
+func (r *memoryDeposits) GetWithReceipts(id uint) (*models.Deposit, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	deposit, ok := d.deposits[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	deposit.Receipts = d.depositReceipts(id)
+	for i := range deposit.Receipts {
+		receiptID := deposit.Receipts[i].ID
+		deposit.Receipts[i].Allocations = sorted(d.allocations, func(a models.Allocation) bool { return a.ReceiptID == receiptID })
+		deposit.Receipts[i].Reversals = sorted(d.reversals, func(v models.Reversal) bool { return v.ReceiptID == receiptID })
+	}
+	return &deposit, nil
+}
+
+func (r *memoryDeposits) Received(id uint) (int64, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	var received int64
+	for _, receipt := range d.depositReceipts(id) {
+		if receipt.FundingDecision == models.FundingRejected {
+			continue
+		}
+		received += int64(receipt.Amount)
+		for _, reversal := range d.reversals {
+			if reversal.ReceiptID == receipt.ID {
+				received -= reversal.Amount
+			}
+		}
+	}
+	return received, nil
+}
+
+func (r *memoryDeposits) AllocatedBefore(id uint, receiptID uint) ([]uint, error) {
+	defer r.lock()()
+
+	d := r.m.data
+
+	allocated := make([]uint, 0)
+	for _, receipt := range d.depositReceipts(id) {
+		if receipt.ID >= receiptID || receipt.FundingDecision == models.FundingRejected {
+			continue
+		}
+		amount := int64(receipt.Amount) - receipt.SuspenseAmount
+		for _, reversal := range d.reversals {
+			if reversal.ReceiptID == receipt.ID {
+				amount -= reversal.Amount
+			}
+		}
+		allocated = append(allocated, uint(amount))
+	}
+	return allocated, nil
+}
+
+type memoryReceipts struct {
+	*memoryRepos
+}
+
+func (r *memoryReceipts) Create(receipt *models.Receipt) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if err := d.checkReceipt(receipt); err != nil {
+		return err
+	}
+	return d.createReceipt(r.tx, receipt)
+}
+
+func (r *memoryReceipts) Get(id uint) (*models.Receipt, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	receipt, ok := d.receipts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	receipt.Allocations = sorted(d.allocations, func(a models.Allocation) bool { return a.ReceiptID == id })
+	return &receipt, nil
+}
+
+func (r *memoryReceipts) Lock(id uint) (*models.Receipt, error) {
+	r.lockRows("receipt", id)
+	defer r.lock()()
+
+	receipt, ok := r.m.data.receipts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &receipt, nil
+}
+
+func (r *memoryReceipts) FindByBankReference(reference string) (*models.Receipt, error) {
+	defer r.lock()()
+
+	return first(r.m.data.receipts, func(receipt models.Receipt) bool {
+		return receipt.BankReference != nil && *receipt.BankReference == reference
+	}), nil
+}
+
+func (r *memoryReceipts) FindSimilar(depositID uint, amount uint, from time.Time, to time.Time) (*models.Receipt, error) {
+	defer r.lock()()
+
+	return first(r.m.data.receipts, func(receipt models.Receipt) bool {
+		received := receipt.ReceivedOn()
+		return receipt.DepositID == depositID && receipt.Amount == amount &&
+			receipt.FundingDecision != models.FundingRejected &&
+			!received.Before(from) && received.Before(to)
+	}), nil
+}
+
+func (r *memoryReceipts) ForReview() ([]models.Receipt, error) {
+	defer r.lock()()
+
+	return sorted(r.m.data.receipts, func(receipt models.Receipt) bool { return receipt.NeedsReview }), nil
+}
+
+func (r *memoryReceipts) MarkReviewed(receipt *models.Receipt, at time.Time) error {
+	defer r.lock()()
+	d := r.m.data
+
+	err := update(r.tx, d.receipts, receipt.ID, func(stored *models.Receipt) *gorm.Model {
+		stored.NeedsReview = false
+		stored.ReviewedAt = &at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+
+	receipt.NeedsReview = false
+	receipt.ReviewedAt = &at
+	return nil
+}
+
+func (r *memoryReceipts) CreateReversal(reversal *models.Reversal) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if _, ok := d.receipts[reversal.ReceiptID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "reversal of receipt %d", reversal.ReceiptID)
+	}
+	if reversal.Amount <= 0 {
+		return errors.Wrapf(ErrInvalidValue, "reversal amount %d must be positive", reversal.Amount)
+	}
+	err := insert(r.tx, d, d.reversals, "reversal", &reversal.Model, func() models.Reversal {
+		stored := *reversal
+		stored.Allocations = nil
+		return stored
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range reversal.Allocations {
+		reversalID := reversal.ID
+		reversal.Allocations[i].ReversalID = &reversalID
+		if err := d.checkAllocation(&reversal.Allocations[i]); err != nil {
+			return err
+		}
+		if err := d.createAllocation(r.tx, &reversal.Allocations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryReceipts) Balances() ([]ReceiptBalance, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	balances := make([]ReceiptBalance, 0)
+	for _, receipt := range sorted(d.receipts, func(models.Receipt) bool { return true }) {
+		balance := ReceiptBalance{
+			ReceiptID:       receipt.ID,
+			DepositID:       receipt.DepositID,
+			Amount:          int64(receipt.Amount),
+			FundingDecision: receipt.FundingDecision,
+			SuspenseAmount:  receipt.SuspenseAmount,
+		}
+		for _, reversal := range d.reversals {
+			if reversal.ReceiptID == receipt.ID {
+				balance.Reversed += reversal.Amount
+			}
+		}
+		for _, allocation := range d.allocations {
+			if allocation.ReceiptID == receipt.ID {
+				balance.Allocated += allocation.Amount
+			}
+		}
+		balances = append(balances, balance)
+	}
+	return balances, nil
+}
+
+type memoryAccounts struct {
+	*memoryRepos
+}
+
+func (r *memoryAccounts) Get(id uint) (*models.Account, error) {
+	defer r.lock()()
+
+	account, ok := r.m.data.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &account, nil
+}
+
+func (r *memoryAccounts) Find(ids []uint) ([]models.Account, error) {
+	defer r.lock()()
+
+	wanted := make(map[uint]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	return sorted(r.m.data.accounts, func(account models.Account) bool { return wanted[account.ID] }), nil
+}
+
+func (r *memoryAccounts) FindOpen(potID uint, wrapper string) (*models.Account, error) {
+	defer r.lock()()
+
+	account := first(r.m.data.accounts, func(account models.Account) bool {
+		return account.PotID == potID && account.Wrapper == wrapper && account.ClosedAt == nil
+	})
+	if account == nil {
+		return nil, ErrNotFound
+	}
+	return account, nil
+}
+
+func (r *memoryAccounts) Create(account *models.Account) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if _, ok := d.pots[account.PotID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "account pot %d", account.PotID)
+	}
+	if open := d.openGIA(account.PotID, account.ID); account.Wrapper == models.WrapperGIA && open != nil && account.ClosedAt == nil {
+		return errors.Wrapf(ErrConflict, "pot %d already has open GIA %d", account.PotID, open.ID)
+	}
+	return insert(r.tx, d, d.accounts, "account", &account.Model, func() models.Account { return *account })
+}
+
+func (r *memoryAccounts) ChangeWrapper(account *models.Account, wrapper string) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if open := d.openGIA(account.PotID, account.ID); wrapper == models.WrapperGIA && open != nil && account.ClosedAt == nil {
+		return errors.Wrapf(ErrConflict, "pot %d already has open GIA %d", account.PotID, open.ID)
+	}
+	err := update(r.tx, d.accounts, account.ID, func(stored *models.Account) *gorm.Model {
+		stored.Wrapper = wrapper
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	account.Wrapper = wrapper
+	return nil
+}
+
+func (r *memoryAccounts) Close(account *models.Account, at time.Time) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.accounts, account.ID, func(stored *models.Account) *gorm.Model {
+		stored.ClosedAt = &at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	account.ClosedAt = &at
+	return nil
+}
+
+func (r *memoryAccounts) CountAllocations(id uint, unsettled bool) (int64, error) {
+	defer r.lock()()
+
+	allocations := sorted(r.m.data.allocations, func(allocation models.Allocation) bool {
+		return allocation.AccountID == id && (!unsettled || allocation.SettledAt == nil)
+	})
+	return int64(len(allocations)), nil
+}
+
+type memoryAllocations struct {
+	*memoryRepos
+}
+
+func (r *memoryAllocations) Create(allocation *models.Allocation) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if err := d.checkAllocation(allocation); err != nil {
+		return err
+	}
+	return d.createAllocation(r.tx, allocation)
+}
+
+func (r *memoryAllocations) ForReceipt(receiptID uint) ([]models.Allocation, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	allocations := sorted(d.allocations, func(a models.Allocation) bool { return a.ReceiptID == receiptID })
+	for i := range allocations {
+		allocationID := allocations[i].ID
+		allocations[i].BonusClaim = first(d.bonusClaims, func(c models.BonusClaim) bool { return c.AllocationID == allocationID })
+		allocations[i].ReliefClaim = first(d.reliefClaims, func(c models.ReliefClaim) bool { return c.AllocationID == allocationID })
+		allocations[i].AllowanceUsed = sorted(d.allowanceUsages, func(u models.AllowanceUsage) bool { return u.AllocationID == allocationID })
+	}
+	return allocations, nil
+}
+
+func (r *memoryAllocations) Allocated(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	var allocated int64
+	for _, allocation := range d.allocations {
+		if allocation.TaxYear == taxYear && d.heldBy(allocation.AccountID, wrapper, clientID) {
+			allocated += allocation.Amount
+		}
+	}
+	return allocated, nil
+}
+
+func (r *memoryAllocations) AllowanceUsed(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	var used int64
+	for _, usage := range d.allowanceUsages {
+		allocation, ok := d.allocations[usage.AllocationID]
+		if ok && usage.TaxYear == taxYear && d.heldBy(allocation.AccountID, wrapper, clientID) {
+			used += usage.Amount
+		}
+	}
+	return used, nil
+}
+
+func (r *memoryAllocations) Get(id uint) (*models.Allocation, error) {
+	defer r.lock()()
+
+	allocation, ok := r.m.data.allocations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &allocation, nil
+}
+
+func (r *memoryAllocations) Settle(allocation *models.Allocation, at time.Time) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.allocations, allocation.ID, func(stored *models.Allocation) *gorm.Model {
+		stored.SettledAt = &at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	allocation.SettledAt = &at
+	return nil
+}
+
+type memoryClients struct {
+	*memoryRepos
+}
+
+func (r *memoryClients) Create(client *models.Client) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if err := d.checkClient(client); err != nil {
+		return err
+	}
+	return insert(r.tx, d, d.clients, "client", &client.Model, func() models.Client {
+		stored := *client
+		stored.TaperedAllowances, stored.Children, stored.Pots, stored.Deposits = nil, nil, nil, nil
+		return stored
+	})
+}
+
+func (r *memoryClients) Get(id uint) (*models.Client, error) {
+	defer r.lock()()
+
+	client, ok := r.m.data.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	client.TaperedAllowances = append([]models.TaperedAllowance(nil), client.TaperedAllowances...)
+	return &client, nil
+}
+
+func (r *memoryClients) GetWithPots(id uint) (*models.Client, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	client, ok := d.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	client.TaperedAllowances = append([]models.TaperedAllowance(nil), client.TaperedAllowances...)
+	client.Pots = sorted(d.pots, func(pot models.Pot) bool { return pot.ClientID == id })
+	for i := range client.Pots {
+		client.Pots[i].Accounts = d.potAccounts(client.Pots[i].ID)
+	}
+	return &client, nil
+}
+
+func (r *memoryClients) GetPot(id uint) (*models.Pot, error) {
+	defer r.lock()()
+
+	pot, ok := r.m.data.pots[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &pot, nil
+}
+
+// Lock takes the row locks in ID order, as the database does, so two transactions locking the same
+// clients can't deadlock
+func (r *memoryClients) Lock(clientID uint, accountIDs []uint) error {
+	unlock := r.lock()
+	d := r.m.data
+	clients := map[uint]bool{clientID: true}
+	for _, id := range accountIDs {
+		if account, ok := d.accounts[id]; ok {
+			if pot, ok := d.pots[account.PotID]; ok {
+				clients[pot.ClientID] = true
+			}
+		}
+	}
+	unlock()
+
+	ids := make([]uint, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	r.lockRows("client", ids...)
+	return nil
+}
+
+func (r *memoryClients) Update(client *models.Client) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if err := d.checkClient(client); err != nil {
+		return err
+	}
+	return update(r.tx, d.clients, client.ID, func(stored *models.Client) *gorm.Model {
+		stored.Name, stored.DateOfBirth, stored.RegisteredContactID = client.Name, client.DateOfBirth, client.RegisteredContactID
+		return &stored.Model
+	})
+}
+
+func (r *memoryClients) Close(client *models.Client, at time.Time) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.clients, client.ID, func(stored *models.Client) *gorm.Model {
+		stored.ClosedAt = &at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	client.ClosedAt = &at
+	return nil
+}
+
+func (r *memoryClients) CountOpenPots(id uint) (int64, error) {
+	defer r.lock()()
+
+	pots := sorted(r.m.data.pots, func(pot models.Pot) bool { return pot.ClientID == id && pot.ClosedAt == nil })
+	return int64(len(pots)), nil
+}
+
+func (r *memoryClients) SetMpaa(client *models.Client, at *time.Time) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.clients, client.ID, func(stored *models.Client) *gorm.Model {
+		stored.MpaaTriggeredAt = at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	client.MpaaTriggeredAt = at
+	return nil
+}
+
+// SetTaperedAllowance replaces the client's allowances rather than changing them in place, as the
+// record a rollback restores shares the old ones
+func (r *memoryClients) SetTaperedAllowance(clientID uint, taxYear models.TaxYear, amount *uint) error {
+	defer r.lock()()
+
+	return update(r.tx, r.m.data.clients, clientID, func(stored *models.Client) *gorm.Model {
+		tapered := make([]models.TaperedAllowance, 0, len(stored.TaperedAllowances)+1)
+		found := false
+		for _, existing := range stored.TaperedAllowances {
+			if existing.TaxYear != taxYear {
+				tapered = append(tapered, existing)
+				continue
+			}
+			found = true
+			if amount != nil {
+				existing.Amount = *amount
+				existing.UpdatedAt = time.Now()
+				tapered = append(tapered, existing)
+			}
+		}
+		if !found && amount != nil {
+			added := models.TaperedAllowance{ClientID: clientID, TaxYear: taxYear, Amount: *amount}
+			added.CreatedAt, added.UpdatedAt = time.Now(), time.Now()
+			tapered = append(tapered, added)
+		}
+		stored.TaperedAllowances = tapered
+		return &stored.Model
+	})
+}
+
+func (r *memoryClients) Audit(clientID uint) ([]models.PensionAllowanceAudit, error) {
+	defer r.lock()()
+
+	return sorted(r.m.data.audits, func(audit models.PensionAllowanceAudit) bool { return audit.ClientID == clientID }), nil
+}
+
+func (r *memoryClients) RecordAudit(audit []models.PensionAllowanceAudit) error {
+	defer r.lock()()
+	d := r.m.data
+
+	for i := range audit {
+		entry := &audit[i]
+		if _, ok := d.clients[entry.ClientID]; !ok {
+			return errors.Wrapf(ErrMissingReference, "pension allowance audit client %d", entry.ClientID)
+		}
+		if err := insert(r.tx, d, d.audits, "pension allowance audit", &entry.Model, func() models.PensionAllowanceAudit { return *entry }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memoryPots struct {
+	*memoryRepos
+}
+
+func (r *memoryPots) Create(pot *models.Pot) error {
+	defer r.lock()()
+	d := r.m.data
+
+	if _, ok := d.clients[pot.ClientID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "pot client %d", pot.ClientID)
+	}
+	return insert(r.tx, d, d.pots, "pot", &pot.Model, func() models.Pot {
+		stored := *pot
+		stored.Accounts = nil
+		return stored
+	})
+}
+
+func (r *memoryPots) Get(id uint) (*models.Pot, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	pot, ok := d.pots[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	pot.Accounts = d.potAccounts(id)
+	return &pot, nil
+}
+
+func (r *memoryPots) Rename(pot *models.Pot, name string) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.pots, pot.ID, func(stored *models.Pot) *gorm.Model {
+		stored.Name = name
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	pot.Name = name
+	return nil
+}
+
+func (r *memoryPots) Close(pot *models.Pot, at time.Time) error {
+	defer r.lock()()
+
+	err := update(r.tx, r.m.data.pots, pot.ID, func(stored *models.Pot) *gorm.Model {
+		stored.ClosedAt = &at
+		return &stored.Model
+	})
+	if err != nil {
+		return err
+	}
+	pot.ClosedAt = &at
+	return nil
+}
+
+func (r *memoryPots) CountOpenAccounts(id uint) (int64, error) {
+	defer r.lock()()
+
+	accounts := sorted(r.m.data.accounts, func(account models.Account) bool { return account.PotID == id && account.ClosedAt == nil })
+	return int64(len(accounts)), nil
+}
+
+type memoryLimits struct {
+	*memoryRepos
+}
+
+func (r *memoryLimits) InForce(wrapper string, taxYear models.TaxYear) (*models.WrapperLimit, error) {
+	defer r.lock()()
+
+	var inForce *models.WrapperLimit
+	for _, limit := range r.m.data.limits {
+		if limit.Wrapper != wrapper || limit.EffectiveFrom > taxYear {
+			continue
+		}
+		if inForce == nil || limit.EffectiveFrom > inForce.EffectiveFrom {
+			limit := limit
+			inForce = &limit
+		}
+	}
+	if inForce == nil {
+		return nil, ErrNotFound
+	}
+	return inForce, nil
+}
+
+type memoryReliefClaims struct {
+	*memoryRepos
+}
+
+func (r *memoryReliefClaims) List(status string, from time.Time, to time.Time) ([]models.ReliefClaim, error) {
+	defer r.lock()()
+
+	d := r.m.data
+	return sorted(d.reliefClaims, func(claim models.ReliefClaim) bool {
+		received := d.claimReceived(claim)
+		return claim.Status == status && !received.Before(from) && received.Before(to)
+	}), nil
+}
+
+func (r *memoryReliefClaims) CountInPeriod(period string) (int64, error) {
+	defer r.lock()()
+
+	claims := sorted(r.m.data.reliefClaims, func(claim models.ReliefClaim) bool { return claim.ClaimPeriod == period })
+	return int64(len(claims)), nil
+}
+
+func (r *memoryReliefClaims) Claim(period string, before time.Time, at time.Time) (int64, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	pending := sorted(d.reliefClaims, func(claim models.ReliefClaim) bool {
+		return claim.Status == models.ClaimStatusPending && d.claimReceived(claim).Before(before)
+	})
+	for _, claim := range pending {
+		err := update(r.tx, d.reliefClaims, claim.ID, func(stored *models.ReliefClaim) *gorm.Model {
+			stored.Status, stored.ClaimPeriod, stored.ClaimedAt = models.ClaimStatusClaimed, period, &at
+			return &stored.Model
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(pending)), nil
+}
+
+func (r *memoryReliefClaims) Totals(period string) ([]ReliefTotal, error) {
+	defer r.lock()()
+	d := r.m.data
+
+	byClient := make(map[uint]*ReliefTotal)
+	for _, claim := range d.reliefClaims {
+		if claim.ClaimPeriod != period {
+			continue
+		}
+		allocation, ok := d.allocations[claim.AllocationID]
+		if !ok {
+			continue
+		}
+		client, ok := d.clients[d.pots[d.accounts[allocation.AccountID].PotID].ClientID]
+		if !ok {
+			continue
+		}
+		total, ok := byClient[client.ID]
+		if !ok {
+			total = &ReliefTotal{ClientID: client.ID, ClientName: client.Name}
+			byClient[client.ID] = total
+		}
+		total.Contributions++
+		total.NetAmount += allocation.Amount
+		total.ReliefAmount += claim.ReliefAmount
+		total.GrossAmount += claim.GrossAmount
+	}
+
+	totals := make([]ReliefTotal, 0, len(byClient))
+	for _, total := range byClient {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].ClientID < totals[j].ClientID })
+	return totals, nil
+}
+
+func (d *memoryData) createDeposit(tx *memoryTx, deposit *models.Deposit) error {
+	err := insert(tx, d, d.deposits, "deposit", &deposit.Model, func() models.Deposit {
+		stored := *deposit
+		stored.Receipts, stored.ProposedAllocation = nil, nil
+		return stored
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range deposit.ProposedAllocation {
+		proposed := &deposit.ProposedAllocation[i]
+		proposed.DepositID = deposit.ID
+		if err := insert(tx, d, d.proposed, "proposed allocation", &proposed.Model, func() models.ProposedAllocation { return *proposed }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *memoryData) createReceipt(tx *memoryTx, receipt *models.Receipt) error {
+	if receipt.BankReference != nil {
+		for _, existing := range d.receipts {
+			if existing.BankReference != nil && *existing.BankReference == *receipt.BankReference {
+				return errors.Wrapf(ErrConflict, "bank reference %s is already used by receipt %d", *receipt.BankReference, existing.ID)
+			}
+		}
+	}
+
+	return insert(tx, d, d.receipts, "receipt", &receipt.Model, func() models.Receipt {
+		stored := *receipt
+		stored.Allocations, stored.Reversals = nil, nil
+		return stored
+	})
+}
+
+func (d *memoryData) createAllocation(tx *memoryTx, allocation *models.Allocation) error {
+	err := insert(tx, d, d.allocations, "allocation", &allocation.Model, func() models.Allocation {
+		stored := *allocation
+		stored.BonusClaim, stored.ReliefClaim, stored.AllowanceUsed = nil, nil, nil
+		return stored
+	})
+	if err != nil {
+		return err
+	}
+
+	if claim := allocation.BonusClaim; claim != nil {
+		claim.AllocationID = allocation.ID
+		if err := insert(tx, d, d.bonusClaims, "bonus claim", &claim.Model, func() models.BonusClaim { return *claim }); err != nil {
+			return err
+		}
+	}
+	if claim := allocation.ReliefClaim; claim != nil {
+		claim.AllocationID = allocation.ID
+		if err := insert(tx, d, d.reliefClaims, "relief claim", &claim.Model, func() models.ReliefClaim { return *claim }); err != nil {
+			return err
+		}
+	}
+	for i := range allocation.AllowanceUsed {
+		usage := &allocation.AllowanceUsed[i]
+		usage.AllocationID = allocation.ID
+		if err := insert(tx, d, d.allowanceUsages, "allowance usage", &usage.Model, func() models.AllowanceUsage { return *usage }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkClient refuses a client the database's foreign keys would
+func (d *memoryData) checkClient(client *models.Client) error {
+	if client.RegisteredContactID != nil {
+		if _, ok := d.clients[*client.RegisteredContactID]; !ok {
+			return errors.Wrapf(ErrMissingReference, "client registered contact %d", *client.RegisteredContactID)
+		}
+	}
+	return nil
+}
+
+// checkDeposit refuses a deposit the database's foreign keys and checks would
+func (d *memoryData) checkDeposit(deposit *models.Deposit) error {
+	if _, ok := d.clients[deposit.ClientID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "deposit client %d", deposit.ClientID)
+	}
+	if deposit.Amount == 0 {
+		return errors.Wrap(ErrInvalidValue, "deposit amount must be positive")
+	}
+	for _, proposed := range deposit.ProposedAllocation {
+		if _, ok := d.accounts[proposed.AccountID]; !ok {
+			return errors.Wrapf(ErrMissingReference, "proposed allocation account %d", proposed.AccountID)
+		}
+		if proposed.Split == 0 || proposed.Split > models.WholeSplit {
+			return errors.Wrapf(ErrInvalidValue, "split of %d basis points", proposed.Split)
+		}
+	}
+	return nil
+}
+
+// checkReceipt refuses a receipt the database's foreign keys and checks would
+func (d *memoryData) checkReceipt(receipt *models.Receipt) error {
+	if _, ok := d.deposits[receipt.DepositID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "receipt deposit %d", receipt.DepositID)
+	}
+	if receipt.Amount == 0 {
+		return errors.Wrap(ErrInvalidValue, "receipt amount must be positive")
+	}
+	if receipt.ExcessAmount < 0 || receipt.SuspenseAmount < 0 || receipt.SuspenseAmount > int64(receipt.Amount) {
+		return errors.Wrapf(ErrInvalidValue, "receipt of %d with %d excess and %d in suspense", receipt.Amount, receipt.ExcessAmount, receipt.SuspenseAmount)
+	}
+	return nil
+}
+
+// checkAllocation refuses an allocation the database's foreign keys would
+func (d *memoryData) checkAllocation(allocation *models.Allocation) error {
+	if _, ok := d.receipts[allocation.ReceiptID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "allocation receipt %d", allocation.ReceiptID)
+	}
+	if _, ok := d.accounts[allocation.AccountID]; !ok {
+		return errors.Wrapf(ErrMissingReference, "allocation account %d", allocation.AccountID)
+	}
+	if allocation.ReversalID != nil {
+		if _, ok := d.reversals[*allocation.ReversalID]; !ok {
+			return errors.Wrapf(ErrMissingReference, "allocation reversal %d", *allocation.ReversalID)
+		}
+	}
+	if allocation.ReversesID != nil {
+		if _, ok := d.allocations[*allocation.ReversesID]; !ok {
+			return errors.Wrapf(ErrMissingReference, "reversed allocation %d", *allocation.ReversesID)
+		}
+	}
+	return nil
+}
+
+// claimReceived is when the bank received the contribution the relief is claimed on
+func (d *memoryData) claimReceived(claim models.ReliefClaim) time.Time {
+	receipt := d.receipts[d.allocations[claim.AllocationID].ReceiptID]
+	return receipt.ReceivedOn()
+}
+
+func (d *memoryData) depositReceipts(depositID uint) []models.Receipt {
+	return sorted(d.receipts, func(receipt models.Receipt) bool { return receipt.DepositID == depositID })
+}
+
+// openGIA is the pot's open GIA other than the account, which the database's unique index allows one of
+func (d *memoryData) openGIA(potID uint, accountID uint) *models.Account {
+	return first(d.accounts, func(existing models.Account) bool {
+		return existing.ID != accountID && existing.PotID == potID && existing.Wrapper == models.WrapperGIA && existing.ClosedAt == nil
+	})
+}
+
+func (d *memoryData) potAccounts(potID uint) []models.Account {
+	return sorted(d.accounts, func(account models.Account) bool { return account.PotID == potID })
+}
+
+// heldBy reports whether the account is a wrapper account in one of the client's pots
+func (d *memoryData) heldBy(accountID uint, wrapper string, clientID uint) bool {
+	account, ok := d.accounts[accountID]
+	if !ok || account.Wrapper != wrapper {
+		return false
+	}
+	pot, ok := d.pots[account.PotID]
+	return ok && pot.ClientID == clientID
+}
+
+// insert gives the record an ID, unless it already has one, and its timestamps, then stores the
+// copy made by stored
+func insert[V any](tx *memoryTx, d *memoryData, table map[uint]V, kind string, model *gorm.Model, stored func() V) error {
+	highest := d.ids[kind]
+	if model.ID == 0 {
+		model.ID = d.ids[kind] + 1
+	} else if _, ok := table[model.ID]; ok {
+		return errors.Errorf("%s %d already exists", kind, model.ID)
+	}
+	if model.ID > d.ids[kind] {
+		d.ids[kind] = model.ID
+	}
+
+	now := time.Now()
+	if model.CreatedAt.IsZero() {
+		model.CreatedAt = now
+	}
+	if model.UpdatedAt.IsZero() {
+		model.UpdatedAt = now
+	}
+
+	table[model.ID] = stored()
+	id := model.ID
+	tx.onUndo(func() {
+		delete(table, id)
+		if d.ids[kind] == id { // the ID is given out again, unless a later one has been since
+			d.ids[kind] = highest
+		}
+	})
+	return nil
+}
+
+// update changes the stored record with the ID, change returning the record's model so it can be
+// timestamped, or returns ErrNotFound when there isn't one
+func update[V any](tx *memoryTx, table map[uint]V, id uint, change func(record *V) *gorm.Model) error {
+	record, ok := table[id]
+	if !ok {
+		return ErrNotFound
+	}
+	before := record
+	change(&record).UpdatedAt = time.Now()
+	table[id] = record
+	tx.onUndo(func() { table[id] = before })
+	return nil
+}
+
+// sorted returns the records that match, in ID order
+func sorted[V any](table map[uint]V, match func(V) bool) []V {
+	ids := make([]uint, 0)
+	for id, record := range table {
+		if match(record) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	records := make([]V, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, table[id])
+	}
+	return records
+}
+
+// first returns the matching record with the lowest ID, or nil if none match
+func first[V any](table map[uint]V, match func(V) bool) *V {
+	records := sorted(table, match)
+	if len(records) == 0 {
+		return nil
+	}
+	return &records[0]
+}
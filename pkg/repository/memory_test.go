@@ -0,0 +1,342 @@
+package repository
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// seededMemory holds client 1 with pot 1 holding an ISA (account 1) and a SIPP (account 2), and
+// deposit 1 split evenly between them
+func seededMemory(t *testing.T) *Memory {
+	client := &models.Client{Name: "Client"}
+	client.ID = 1
+	pot := &models.Pot{ClientID: 1, Name: "Pot"}
+	pot.ID = 1
+	isa := &models.Account{PotID: 1, Wrapper: models.WrapperISA}
+	isa.ID = 1
+	sipp := &models.Account{PotID: 1, Wrapper: models.WrapperSIPP}
+	sipp.ID = 2
+	deposit := &models.Deposit{ClientID: 1, Amount: 100000, ProposedAllocation: []models.ProposedAllocation{
+		{AccountID: 1, Split: 5000},
+		{AccountID: 2, Split: 5000},
+	}}
+
+	store := NewMemory()
+	if err := store.Seed(client, pot, isa, sipp, deposit); err != nil {
+		t.Fatalf("Unable to seed memory store: %v", err)
+	}
+	return store
+}
+
+func TestMemoryDeposits(t *testing.T) {
+	store := seededMemory(t)
+
+	deposit, err := store.Deposits().Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(100000), deposit.Amount)
+	assert.Len(t, deposit.ProposedAllocation, 2)
+	assert.Equal(t, uint(1), deposit.ProposedAllocation[0].DepositID)
+
+	_, err = store.Deposits().Get(2)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	first := &models.Receipt{DepositID: 1, Amount: 40000, FundingDecision: models.FundingAccepted}
+	rejected := &models.Receipt{DepositID: 1, Amount: 90000, FundingDecision: models.FundingRejected}
+	suspense := &models.Receipt{DepositID: 1, Amount: 70000, FundingDecision: models.FundingSuspense, SuspenseAmount: 10000}
+	for _, receipt := range []*models.Receipt{first, rejected, suspense} {
+		assert.NoError(t, store.Receipts().Create(receipt))
+	}
+	assert.NoError(t, store.Receipts().CreateReversal(&models.Reversal{ReceiptID: first.ID, Amount: 5000}))
+
+	received, err := store.Deposits().Received(1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(105000), received, "rejected receipts and reversals don't count")
+
+	allocated, err := store.Deposits().AllocatedBefore(1, suspense.ID+1)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{35000, 60000}, allocated, "less what was reversed or is in suspense")
+
+	withReceipts, err := store.Deposits().GetWithReceipts(1)
+	assert.NoError(t, err)
+	assert.Len(t, withReceipts.Receipts, 3)
+	assert.Len(t, withReceipts.Receipts[0].Reversals, 1)
+}
+
+func TestMemoryReceipts(t *testing.T) {
+	store := seededMemory(t)
+
+	reference := "FP-123"
+	valueDate := time.Date(2024, time.September, 2, 10, 0, 0, 0, time.UTC)
+	receipt := &models.Receipt{DepositID: 1, Amount: 50000, BankReference: &reference, ValueDate: &valueDate, NeedsReview: true}
+	assert.NoError(t, store.Receipts().Create(receipt))
+	assert.Equal(t, uint(1), receipt.ID)
+	assert.False(t, receipt.CreatedAt.IsZero())
+
+	again := &models.Receipt{DepositID: 1, Amount: 50000, BankReference: &reference}
+	assert.Error(t, store.Receipts().Create(again), "bank references are unique")
+
+	found, err := store.Receipts().FindByBankReference(reference)
+	assert.NoError(t, err)
+	assert.Equal(t, receipt.ID, found.ID)
+
+	missing, err := store.Receipts().FindByBankReference("FP-456")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	similar, err := store.Receipts().FindSimilar(1, 50000, valueDate.Add(-time.Hour), valueDate.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, receipt.ID, similar.ID)
+
+	similar, err = store.Receipts().FindSimilar(1, 50000, valueDate.Add(time.Hour), valueDate.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Nil(t, similar, "received outside the window")
+
+	review, err := store.Receipts().ForReview()
+	assert.NoError(t, err)
+	assert.Len(t, review, 1)
+
+	reviewedAt := time.Now()
+	assert.NoError(t, store.Receipts().MarkReviewed(&review[0], reviewedAt))
+
+	stored, err := store.Receipts().Get(receipt.ID)
+	assert.NoError(t, err)
+	assert.False(t, stored.NeedsReview)
+	assert.Equal(t, reviewedAt, *stored.ReviewedAt)
+}
+
+func TestMemoryAllocations(t *testing.T) {
+	store := seededMemory(t)
+
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000}
+	assert.NoError(t, store.Receipts().Create(receipt))
+
+	isa := &models.Allocation{ReceiptID: receipt.ID, AccountID: 1, Amount: 50000, TaxYear: 2024}
+	sipp := &models.Allocation{ReceiptID: receipt.ID, AccountID: 2, Amount: 50000, TaxYear: 2024,
+		ReliefClaim: &models.ReliefClaim{GrossAmount: 62500, ReliefAmount: 12500, Status: models.ClaimStatusPending},
+		AllowanceUsed: []models.AllowanceUsage{
+			{TaxYear: 2024, Amount: 40000},
+			{TaxYear: 2021, Amount: 22500},
+		},
+	}
+	assert.NoError(t, store.Allocations().Create(isa))
+	assert.NoError(t, store.Allocations().Create(sipp))
+	assert.Equal(t, sipp.ID, sipp.ReliefClaim.AllocationID)
+
+	allocations, err := store.Allocations().ForReceipt(receipt.ID)
+	assert.NoError(t, err)
+	assert.Len(t, allocations, 2)
+	assert.Nil(t, allocations[0].ReliefClaim)
+	assert.Equal(t, int64(12500), allocations[1].ReliefClaim.ReliefAmount)
+	assert.Len(t, allocations[1].AllowanceUsed, 2)
+
+	allocated, err := store.Allocations().Allocated(models.WrapperISA, 1, 2024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50000), allocated)
+
+	allocated, err = store.Allocations().Allocated(models.WrapperISA, 2, 2024)
+	assert.NoError(t, err)
+	assert.Zero(t, allocated, "the allocation is another client's")
+
+	used, err := store.Allocations().AllowanceUsed(models.WrapperSIPP, 1, 2021)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(22500), used)
+}
+
+func TestMemoryAccountsAndLimits(t *testing.T) {
+	store := seededMemory(t)
+	assert.NoError(t, store.Seed(
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2030, Amount: 2500000},
+	))
+
+	_, err := store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	gia := &models.Account{PotID: 1, Wrapper: models.WrapperGIA}
+	assert.NoError(t, store.Accounts().Create(gia))
+	assert.Equal(t, uint(3), gia.ID, "IDs carry on from the seeded accounts")
+
+	open, err := store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.NoError(t, err)
+	assert.Equal(t, gia.ID, open.ID)
+
+	accounts, err := store.Accounts().Find([]uint{3, 1})
+	assert.NoError(t, err)
+	assert.Len(t, accounts, 2)
+	assert.Equal(t, uint(1), accounts[0].ID)
+
+	limit, err := store.Limits().InForce(models.WrapperISA, 2024)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2000000), limit.Amount)
+
+	_, err = store.Limits().InForce(models.WrapperISA, 2016)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryClientsAndPots(t *testing.T) {
+	store := seededMemory(t)
+
+	contact := uint(9)
+	err := store.Clients().Create(&models.Client{Name: "Jane", RegisteredContactID: &contact})
+	assert.ErrorIs(t, err, ErrMissingReference)
+
+	client, err := store.Clients().GetWithPots(1)
+	assert.NoError(t, err)
+	if assert.Len(t, client.Pots, 1) {
+		assert.Len(t, client.Pots[0].Accounts, 2)
+	}
+
+	// a second open ISA in the pot is allowed, a second open GIA isn't
+	sipp := &models.Account{Model: client.Pots[0].Accounts[1].Model, PotID: 1}
+	assert.NoError(t, store.Accounts().ChangeWrapper(sipp, models.WrapperISA))
+	assert.NoError(t, store.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperGIA}))
+	err = store.Accounts().ChangeWrapper(sipp, models.WrapperGIA)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	isa, _ := store.Accounts().Get(1)
+	assert.NoError(t, store.Accounts().Close(isa, time.Now()))
+	open, err := store.Pots().CountOpenAccounts(1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), open, "the second ISA and the GIA")
+}
+
+func TestMemoryTaperedAllowanceRollsBack(t *testing.T) {
+	store := seededMemory(t)
+	amount := uint(2500000)
+	assert.NoError(t, store.Clients().SetTaperedAllowance(1, 2023, &amount))
+
+	failed := errors.New("failed")
+	err := store.Transaction(func(tx Repositories) error {
+		changed := uint(1000000)
+		if err := tx.Clients().SetTaperedAllowance(1, 2023, &changed); err != nil {
+			return err
+		}
+		if err := tx.Clients().SetTaperedAllowance(1, 2024, &changed); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+
+	client, _ := store.Clients().Get(1)
+	if assert.Len(t, client.TaperedAllowances, 1) {
+		assert.Equal(t, uint(2500000), client.TaperedAllowances[0].Amount)
+	}
+
+	assert.NoError(t, store.Clients().SetTaperedAllowance(1, 2023, nil))
+	client, _ = store.Clients().Get(1)
+	assert.Empty(t, client.TaperedAllowances)
+}
+
+func TestMemoryTransactionRollsBack(t *testing.T) {
+	store := seededMemory(t)
+	failed := errors.New("failed")
+
+	err := store.Transaction(func(tx Repositories) error {
+		if err := tx.Receipts().Create(&models.Receipt{DepositID: 1, Amount: 100}); err != nil {
+			return err
+		}
+		if err := tx.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperGIA}); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+
+	received, _ := store.Deposits().Received(1)
+	assert.Zero(t, received, "the receipt is rolled back")
+	_, err = store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.ErrorIs(t, err, ErrNotFound, "the account is rolled back")
+
+	// IDs handed out in the rolled back transaction are given out again
+	receipt := &models.Receipt{DepositID: 1, Amount: 100}
+	assert.NoError(t, store.Transaction(func(tx Repositories) error {
+		return tx.Receipts().Create(receipt)
+	}))
+	assert.Equal(t, uint(1), receipt.ID)
+}
+
+func TestMemoryClientLockHeldUntilTransactionEnds(t *testing.T) {
+	store := seededMemory(t)
+	locked, release := make(chan struct{}), make(chan struct{})
+
+	go store.Transaction(func(tx Repositories) error {
+		err := tx.Clients().Lock(1, nil)
+		close(locked)
+		<-release
+		return err
+	})
+	<-locked
+
+	waited := make(chan error)
+	go func() {
+		waited <- store.Transaction(func(tx Repositories) error {
+			return tx.Clients().Lock(2, []uint{1}) // the ISA is in client 1's pot
+		})
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("the second transaction locked client 1 while the first held it")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// the store is only locked by the row lock, not the whole transaction
+	_, err := store.Deposits().Get(1)
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-waited)
+}
+
+func TestMemoryReturnsCopies(t *testing.T) {
+	store := seededMemory(t)
+
+	account, err := store.Accounts().Get(1)
+	assert.NoError(t, err)
+	account.Wrapper = models.WrapperGIA
+
+	stored, _ := store.Accounts().Get(1)
+	assert.Equal(t, models.WrapperISA, stored.Wrapper)
+}
+
+func TestMemorySeedUnknownRecord(t *testing.T) {
+	assert.Error(t, NewMemory().Seed(&models.IdempotencyKey{Key: "key"}))
+}
+
+func TestMemoryConstraints(t *testing.T) {
+	store := seededMemory(t)
+
+	err := store.Deposits().Create(&models.Deposit{ClientID: 2, Amount: 100})
+	assert.ErrorIs(t, err, ErrMissingReference, "client 2 doesn't exist")
+
+	err = store.Deposits().Create(&models.Deposit{ClientID: 1, Amount: 100, ProposedAllocation: []models.ProposedAllocation{{AccountID: 9, Split: models.WholeSplit}}})
+	assert.ErrorIs(t, err, ErrMissingReference, "account 9 doesn't exist")
+
+	err = store.Deposits().Create(&models.Deposit{ClientID: 1})
+	assert.ErrorIs(t, err, ErrInvalidValue)
+
+	err = store.Receipts().Create(&models.Receipt{DepositID: 2, Amount: 100})
+	assert.ErrorIs(t, err, ErrMissingReference)
+
+	err = store.Receipts().Create(&models.Receipt{DepositID: 1, Amount: 100, SuspenseAmount: 200})
+	assert.ErrorIs(t, err, ErrInvalidValue, "more in suspense than was received")
+
+	err = store.Allocations().Create(&models.Allocation{ReceiptID: 5, AccountID: 1, Amount: 100})
+	assert.ErrorIs(t, err, ErrMissingReference)
+
+	assert.NoError(t, store.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperISA}), "a pot can have two open ISAs")
+	assert.NoError(t, store.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperGIA}))
+	err = store.Accounts().Create(&models.Account{PotID: 1, Wrapper: models.WrapperGIA})
+	assert.ErrorIs(t, err, ErrConflict, "the pot already has an open GIA")
+
+	err = store.Accounts().Create(&models.Account{PotID: 2, Wrapper: models.WrapperISA})
+	assert.ErrorIs(t, err, ErrMissingReference)
+
+	reference := "FP-1"
+	assert.NoError(t, store.Receipts().Create(&models.Receipt{DepositID: 1, Amount: 100, BankReference: &reference}))
+	err = store.Receipts().Create(&models.Receipt{DepositID: 1, Amount: 100, BankReference: &reference})
+	assert.ErrorIs(t, err, ErrConflict)
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ErrNotFound is returned when a record doesn't exist. It is gorm.ErrRecordNotFound, so callers
+// checking for either work with every implementation.
+var ErrNotFound = gorm.ErrRecordNotFound
+
+// ErrConflict is returned when a write would duplicate a record that must be unique, e.g. a second
+// open GIA in a pot
+var ErrConflict = errors.New("conflicts with an existing record")
+
+// ErrMissingReference is returned when a write refers to a record that doesn't exist
+var ErrMissingReference = errors.New("refers to a record that does not exist")
+
+// ErrInvalidValue is returned when a write breaks a check on its values, e.g. an amount that isn't positive
+var ErrInvalidValue = errors.New("value is not allowed")
+
+// Store is where clients, pots, accounts, deposits, receipts and allocations are kept. Gorm keeps them in
+// Postgres and Memory keeps them in memory, e.g. for tests.
+type Store interface {
+	Repositories
+	// Transaction runs fn against repositories that are committed when fn returns nil and rolled
+	// back when it returns an error
+	Transaction(fn func(tx Repositories) error) error
+}
+
+// Repositories are the repositories of a store, or of a transaction in it
+type Repositories interface {
+	Deposits() DepositRepository
+	Receipts() ReceiptRepository
+	Accounts() AccountRepository
+	Allocations() AllocationRepository
+	Clients() ClientRepository
+	Pots() PotRepository
+	Limits() LimitRepository
+	ReliefClaims() ReliefClaimRepository
+}
+
+type DepositRepository interface {
+	// Create records the deposit with its proposed allocations
+	Create(deposit *models.Deposit) error
+	// Get returns the deposit with its proposed allocations
+	Get(id uint) (*models.Deposit, error)
+	// GetWithReceipts returns the deposit with its receipts and their allocations and reversals
+	GetWithReceipts(id uint) (*models.Deposit, error)
+	// Received totals the deposit's receipts, leaving out rejected receipts and anything reversed
+	Received(id uint) (int64, error)
+	// AllocatedBefore is what was allocated with the split from each of the deposit's receipts
+	// before the receipt, oldest first, net of what was reversed from them as Received is, so a
+	// receipt replacing reversed money is split as if that money had never been received.
+	AllocatedBefore(id uint, receiptID uint) ([]uint, error)
+}
+
+type ReceiptRepository interface {
+	Create(receipt *models.Receipt) error
+	// Get returns the receipt with its allocations
+	Get(id uint) (*models.Receipt, error)
+	// Lock returns the receipt, locked until the transaction ends
+	Lock(id uint) (*models.Receipt, error)
+	// FindByBankReference returns the receipt with the bank reference, or nil if there isn't one
+	FindByBankReference(reference string) (*models.Receipt, error)
+	// FindSimilar returns the oldest receipt for the amount against the deposit that wasn't rejected
+	// and was received from from until to, by value date or when it was recorded, or nil if there isn't one
+	FindSimilar(depositID uint, amount uint, from time.Time, to time.Time) (*models.Receipt, error)
+	// ForReview lists the receipts flagged for review, oldest first
+	ForReview() ([]models.Receipt, error)
+	// MarkReviewed clears the receipt's review flag, recording when it was reviewed
+	MarkReviewed(receipt *models.Receipt, at time.Time) error
+	// CreateReversal records the reversal with its compensating allocations
+	CreateReversal(reversal *models.Reversal) error
+	// Balances totals what was reversed and allocated from every receipt, oldest first
+	Balances() ([]ReceiptBalance, error)
+}
+
+// ReceiptBalance is a receipt with the totals reversed and allocated from it
+type ReceiptBalance struct {
+	ReceiptID       uint
+	DepositID       uint
+	Amount          int64
+	FundingDecision string
+	SuspenseAmount  int64
+	Reversed        int64
+	Allocated       int64 // net of the compensating allocations made by reversals
+}
+
+type AccountRepository interface {
+	Get(id uint) (*models.Account, error)
+	// Find returns the accounts with the IDs
+	Find(ids []uint) ([]models.Account, error)
+	// FindOpen returns the pot's open account for the wrapper
+	FindOpen(potID uint, wrapper string) (*models.Account, error)
+	Create(account *models.Account) error
+	// ChangeWrapper changes the account's wrapper, refusing a second open GIA in the pot
+	ChangeWrapper(account *models.Account, wrapper string) error
+	// Close records when the account was closed
+	Close(account *models.Account, at time.Time) error
+	// CountAllocations counts the allocations made to the account, only those not yet settled when unsettled
+	CountAllocations(id uint, unsettled bool) (int64, error)
+}
+
+type AllocationRepository interface {
+	// Create records the allocation with its bonus claim, relief claim and the allowance it used
+	Create(allocation *models.Allocation) error
+	// ForReceipt lists the receipt's allocations, oldest first, with their claims and the allowance they used
+	ForReceipt(receiptID uint) ([]models.Allocation, error)
+	// Allocated sums the client's allocations into the wrapper for a single tax year
+	Allocated(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error)
+	// AllowanceUsed sums how much of a single tax year's allowance for the wrapper the client's
+	// allocations have used, wherever those allocations were made
+	AllowanceUsed(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error)
+	Get(id uint) (*models.Allocation, error)
+	// Settle records when the allocation's money was invested
+	Settle(allocation *models.Allocation, at time.Time) error
+}
+
+type ClientRepository interface {
+	Create(client *models.Client) error
+	// Get returns the client with their tapered allowances
+	Get(id uint) (*models.Client, error)
+	// GetWithPots returns the client with their pots and the pots' accounts
+	GetWithPots(id uint) (*models.Client, error)
+	GetPot(id uint) (*models.Pot, error)
+	// Lock locks the client and the clients whose pots hold the accounts until the transaction ends
+	Lock(clientID uint, accountIDs []uint) error
+	// Update saves the client's name, date of birth and registered contact
+	Update(client *models.Client) error
+	// Close records when the client was closed
+	Close(client *models.Client, at time.Time) error
+	// CountOpenPots counts the client's pots that haven't been closed
+	CountOpenPots(id uint) (int64, error)
+	// SetMpaa records when the client triggered the MPAA, nil when they haven't
+	SetMpaa(client *models.Client, at *time.Time) error
+	// SetTaperedAllowance sets the client's tapered allowance for the tax year, removing it when amount is nil
+	SetTaperedAllowance(clientID uint, taxYear models.TaxYear, amount *uint) error
+	// Audit lists the changes made to the client's pension allowance, oldest first
+	Audit(clientID uint) ([]models.PensionAllowanceAudit, error)
+	// RecordAudit records changes made to clients' pension allowances
+	RecordAudit(audit []models.PensionAllowanceAudit) error
+}
+
+type PotRepository interface {
+	Create(pot *models.Pot) error
+	// Get returns the pot with its accounts
+	Get(id uint) (*models.Pot, error)
+	Rename(pot *models.Pot, name string) error
+	// Close records when the pot was closed
+	Close(pot *models.Pot, at time.Time) error
+	// CountOpenAccounts counts the pot's accounts that haven't been closed
+	CountOpenAccounts(id uint) (int64, error)
+}
+
+type LimitRepository interface {
+	// InForce returns the wrapper limit in force for the tax year, i.e. the most recent one that
+	// took effect in or before it
+	InForce(wrapper string, taxYear models.TaxYear) (*models.WrapperLimit, error)
+}
+
+type ReliefClaimRepository interface {
+	// List returns the claims with the status on contributions received from from until to, by the
+	// receipt's value date, oldest first
+	List(status string, from time.Time, to time.Time) ([]models.ReliefClaim, error)
+	// CountInPeriod counts the claims made in the "2006-01" claim period
+	CountInPeriod(period string) (int64, error)
+	// Claim marks the pending claims on contributions received before before, by the receipt's value
+	// date, as claimed in the period at at, returning how many it marked
+	Claim(period string, before time.Time, at time.Time) (int64, error)
+	// Totals totals each client's claims made in the period, in client order
+	Totals(period string) ([]ReliefTotal, error)
+}
+
+// ReliefTotal is one client's relief at source claimed in a period
+type ReliefTotal struct {
+	ClientID      uint
+	ClientName    string
+	Contributions int
+	NetAmount     int64 // what the client paid, from their SIPP allocations
+	ReliefAmount  int64
+	GrossAmount   int64
+}
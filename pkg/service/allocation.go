@@ -1,254 +1,412 @@
 package service
 
 import (
-	"ajbell.co.uk/app"
 	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
-	"gorm.io/gorm"
 	"log"
+	"time"
 )
 
-const yearlyIsaLimit = 2000000 // 20 thousand pounds in pence
+// ErrNoLimit is returned when no wrapper limit is in force for the tax year being allocated
+var ErrNoLimit = errors.New("no wrapper limit configured")
 
-const yearlyPensionLimit = 6000000 // 60 thousand pounds in pence
+// ErrLimitExceeded is returned when a wrapper without an overflow target is asked to take more than its limit
+var ErrLimitExceeded = errors.New("wrapper limit exceeded")
+
+// ErrNotEligible is returned when the client may not pay into the wrapper at all
+var ErrNotEligible = errors.New("client is not eligible for wrapper")
+
+// ErrAccountClosed is returned when money is allocated to an account that has been closed
+var ErrAccountClosed = errors.New("account is closed")
+
+// ErrOverFunded is returned when a receipt would take its deposit over the deposit amount and the
+// over-funding policy is to reject it
+var ErrOverFunded = errors.New("receipt exceeds the deposit amount")
+
+// over-funding policies for receipts that would take a deposit over its amount
+const (
+	OverFundingReject   = "reject"
+	OverFundingSuspense = "suspense"
+	OverFundingAllocate = "allocate"
+)
+
+// ErrUnknownOverFunding is returned when the config names an over-funding policy that doesn't exist
+var ErrUnknownOverFunding = errors.New("unknown over-funding policy")
 
 type AllocationService struct {
-	GiaAllocations map[uint]*decimal.Decimal
-	AlOps          AllocateOperations
-	DbOps          DatabaseOperations
+	Store   repository.Store
+	Rules   *RuleRegistry
+	Options Options
 }
 
-type AllocateOperations interface {
-	processGiaAllocation(tx *gorm.DB, receipt *models.Receipt, amount *decimal.Decimal, account *models.Account, db DatabaseOperations) error
-	processSIPPAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error
-	processIsaAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error
+// Options set how receipts and reversals are handled, the zero value uses the defaults
+type Options struct {
+	// OverFunding is what to do with a receipt that would take a deposit over its amount,
+	// OverFundingReject, OverFundingSuspense or OverFundingAllocate, which is the default
+	OverFunding string
+	// Apportionment is the strategy for the pennies lost rounding a split down, for deposits that
+	// don't choose one, ApportionLargestRemainder by default
+	Apportionment string
+	// ReversalOrder lists tiers of wrappers reversals take money back out of, DefaultReversalOrder when empty
+	ReversalOrder [][]string
 }
-type DatabaseOperations interface {
-	getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error)
-	saveAllocation(tx *gorm.DB, allocation models.Allocation) error
+
+// Validate checks the over-funding policy and apportionment strategy are ones that exist
+func (o Options) Validate() error {
+	switch o.OverFunding {
+	case "", OverFundingReject, OverFundingSuspense, OverFundingAllocate:
+	default:
+		return errors.Wrapf(ErrUnknownOverFunding, "%q", o.OverFunding)
+	}
+	if _, ok := apportioners[o.Apportionment]; o.Apportionment != "" && !ok {
+		return errors.Wrapf(ErrUnknownApportionment, "%q", o.Apportionment)
+	}
+	return nil
 }
 
 type Allocate interface {
-	AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) error
+	// AllocateReceipt records the receipt and allocates it to the deposit's accounts
+	AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*AllocationResult, error)
+	// PreviewReceipt works out where AllocateReceipt would put the receipt without recording anything
+	PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*AllocationResult, error)
 }
 
-type DbOps struct {
+// errPreview rolls back the transaction a preview runs in
+var errPreview = errors.New("preview is rolled back")
+
+// NewAllocationService returns the service allocating receipts in the store with the default rules
+func NewAllocationService(store repository.Store, opts Options) *AllocationService {
+	return &AllocationService{
+		Store:   store,
+		Rules:   DefaultRules(),
+		Options: opts,
+	}
 }
 
-type AllocateOps struct {
+func (c *AllocationService) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*AllocationResult, error) {
+	return c.run(receipt, deposit, false)
 }
 
-func NewAllocationService() *AllocationService {
-	return &AllocationService{
-		GiaAllocations: make(map[uint]*decimal.Decimal),
-		AlOps:          &AllocateOps{},
-		DbOps:          &DbOps{},
-	}
+func (c *AllocationService) PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*AllocationResult, error) {
+	return c.run(receipt, deposit, true)
 }
 
-func (c *AllocationService) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) error {
-	tx := app.Http.Database.DB.Begin()
+// run allocates the receipt in a transaction that is committed, or always rolled back for a preview
+func (c *AllocationService) run(receipt *models.Receipt, deposit *models.Deposit, preview bool) (result *AllocationResult, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panic recovered: %v\n", r)
-			tx.Rollback()
+			result, err = nil, errors.Errorf("failed allocating receipt: %v", r)
 		}
 	}()
-	if err := tx.Create(&receipt).Error; err != nil {
-		log.Printf("Error creating receipt: %v\n", err)
-		tx.Rollback()
-		return errors.Wrap(err, "failed to create receipt")
-	}
 
-	giaAllocationAmounts := make(map[uint]*decimal.Decimal)
+	var allocErr error
+	err = c.Store.Transaction(func(tx repository.Repositories) error {
+		result, allocErr = c.allocate(tx, receipt, deposit)
+		// a rejected receipt is kept to record the decision, but nothing is allocated from it
+		if allocErr != nil && !errors.Is(allocErr, ErrOverFunded) {
+			return allocErr
+		}
+		if preview {
+			return errPreview
+		}
+		return nil
+	})
 
-	leftOverFromRemainder := decimal.NewFromInt(0)
+	if allocErr != nil && !errors.Is(allocErr, ErrOverFunded) {
+		return nil, allocErr
+	}
 
-	for i, allocation := range deposit.ProposedAllocation {
-		account := &models.Account{}
-		if err := tx.First(&account, allocation.AccountID).Error; err != nil {
-			log.Printf("Error fetching account: %v\n", err)
-			tx.Rollback()
-			return err
+	if preview {
+		if !errors.Is(err, errPreview) {
+			return nil, errors.Wrap(err, "failed rolling back the preview")
 		}
+		receipt.ID = 0
+		result.forPreview()
+		return result, allocErr
+	}
+
+	if err != nil {
+		log.Printf("Error committing transaction: %v\n", err)
+		return nil, errors.Wrap(err, "failed during committing db transaction")
+	}
 
-		allocate, remainder := calculateAllocation(receipt.Amount, allocation.Split)
+	return result, allocErr
+}
 
-		leftOverFromRemainder = leftOverFromRemainder.Add(remainder)
+// allocate records the receipt and allocates it within the transaction, returning where the money went.
+// The caller commits or rolls back the transaction.
+func (c *AllocationService) allocate(tx repository.Repositories, receipt *models.Receipt, deposit *models.Deposit) (*AllocationResult, error) {
+	accountIDs := make([]uint, 0, len(deposit.ProposedAllocation))
+	for _, allocation := range deposit.ProposedAllocation {
+		accountIDs = append(accountIDs, allocation.AccountID)
+	}
+	// overflow stays within the pot, so these are all the clients whose allowances the receipt can use
+	if err := tx.Clients().Lock(deposit.ClientID, accountIDs); err != nil {
+		log.Printf("Error locking clients:%v\n", err)
+		return nil, errors.Wrap(err, "failed to lock clients")
+	}
 
-		if i == len(deposit.ProposedAllocation)-1 && !leftOverFromRemainder.IsZero() {
-			allocate = allocate.Add(leftOverFromRemainder.Round(0))
-		}
+	now := receipt.CreatedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if err := checkDuplicate(tx, receipt, now); err != nil {
+		return nil, err
+	}
 
-		switch account.Wrapper {
-		case "SIPP":
-			err := c.AlOps.processSIPPAllocation(tx, receipt, deposit, account, allocate, giaAllocationAmounts, c.DbOps)
-			if err != nil {
-				log.Printf("Error processing SIPP allocations: %v\n", err)
-				tx.Rollback()
-				return errors.Wrap(err, "failed processing SIPP allocation")
-			}
-			break
-		case "ISA":
-			err := c.AlOps.processIsaAllocation(tx, receipt, deposit, account, allocate, giaAllocationAmounts, c.DbOps)
+	received, err := tx.Deposits().Received(deposit.ID)
+	if err != nil {
+		log.Printf("Error totalling deposit receipts: %v\n", err)
+		return nil, errors.Wrap(err, "failed to total deposit receipts")
+	}
+
+	toAllocate, err := applyFundingPolicy(receipt, deposit, received, c.Options.OverFunding)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Receipts().Create(receipt); err != nil {
+		log.Printf("Error creating receipt: %v\n", err)
+		return nil, errors.Wrap(err, "failed to create receipt")
+	}
+
+	result := newAllocationResult(receipt)
+
+	if receipt.FundingDecision == models.FundingRejected {
+		return result, errors.Wrapf(ErrOverFunded, "receipt of %d is %d over deposit %d", receipt.Amount, receipt.ExcessAmount, deposit.ID)
+	}
+
+	overflowAmounts := make(overflows)
+
+	// nothing is allocated when everything went to suspense
+	if toAllocate > 0 {
+		accounts := make([]*models.Account, len(deposit.ProposedAllocation))
+		for i, allocation := range deposit.ProposedAllocation {
+			account, err := tx.Accounts().Get(allocation.AccountID)
 			if err != nil {
-				log.Printf("Error processing ISA allocations: %v\n", err)
-				tx.Rollback()
-				return errors.Wrap(err, "failed processing ISA allocation")
+				log.Printf("Error fetching account: %v\n", err)
+				return nil, err
 			}
-			break
-		default:
-			addOrCreateAllocationToGiaPot(allocate, account.PotID, giaAllocationAmounts)
+			accounts[i] = account
 		}
-	}
 
-	for k, v := range giaAllocationAmounts {
-		gia, err := safeCreateGia(tx, k)
+		earlier, err := tx.Deposits().AllocatedBefore(deposit.ID, receipt.ID)
 		if err != nil {
-			log.Printf("Error creating GIA: %v\n", err)
-			tx.Rollback()
-			return errors.Wrap(err, "Error creating GIA")
+			log.Printf("Error loading earlier deposit receipts: %v\n", err)
+			return nil, errors.Wrap(err, "failed to load earlier deposit receipts")
 		}
 
-		log.Printf("Debug: GIA Allocation Amounts: %v\n", v)
-		err = c.AlOps.processGiaAllocation(tx, receipt, v, &gia, c.DbOps)
+		strategy := apportionment(deposit, c.Options.Apportionment)
+		amounts, err := splitReceipt(toAllocate, earlier, deposit, accounts, strategy)
 		if err != nil {
-			log.Printf("Error processing GIA allocations: %v\n", err)
-			tx.Rollback()
-			return errors.Wrap(err, "failed processing GIA allocations")
+			return nil, errors.Wrapf(err, "failed splitting receipt for deposit %d", deposit.ID)
 		}
 
+		for i, account := range accounts {
+			planned, err := c.allocateToAccount(tx, receipt, deposit, account, amounts[i], overflowAmounts)
+			if err != nil {
+				log.Printf("Error processing %s allocations: %v\n", account.Wrapper, err)
+				return nil, errors.Wrapf(err, "failed processing %s allocation", account.Wrapper)
+			}
+			result.Allocations = append(result.Allocations, planned)
+		}
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		fmt.Printf("Error committing transaction: %v\n", err)
-		tx.Rollback()
-		return errors.Wrap(err, "failed during committing db transaction")
-	}
-
-	return nil
-
-}
+	// overflow is paid into another wrapper in the same pot, which may overflow in turn
+	settled := make(map[overflowKey]bool)
+	for len(overflowAmounts) > 0 {
+		key, amount := overflowAmounts.pop()
+		if settled[key] {
+			return nil, errors.Errorf("overflow into %s for pot %d loops back on itself", key.Wrapper, key.PotID)
+		}
+		settled[key] = true
 
-func safeCreateGia(tx *gorm.DB, potId uint) (models.Account, error) {
-	giaAccount := models.Account{}
+		account, created, err := overflowAccount(tx, key)
+		if err != nil {
+			log.Printf("Error loading %s for overflow: %v\n", key.Wrapper, err)
+			return nil, errors.Wrapf(err, "Error creating %s", key.Wrapper)
+		}
 
-	err := tx.First(&giaAccount, "pot_id = ? and wrapper = ?", potId, "GIA").Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			giaAccount.PotID = potId
-			giaAccount.Wrapper = "GIA"
-			if err := tx.Create(&giaAccount).Error; err != nil {
-				return giaAccount, err
-			}
-		} else { // another error occurred
-			return models.Account{}, err
+		planned, err := c.allocateToAccount(tx, receipt, deposit, account, amount, overflowAmounts)
+		if err != nil {
+			log.Printf("Error processing %s overflow allocations: %v\n", key.Wrapper, err)
+			return nil, errors.Wrapf(err, "failed processing %s overflow allocations", key.Wrapper)
 		}
+		planned.FromOverflow = true
+		planned.NewAccount = created
+		result.Allocations = append(result.Allocations, planned)
 	}
-	return giaAccount, nil
-}
 
-func (c *AllocateOps) processGiaAllocation(tx *gorm.DB, receipt *models.Receipt, amount *decimal.Decimal, account *models.Account, db DatabaseOperations) error {
-	allocation := models.Allocation{Amount: uint(amount.IntPart()), ReceiptID: receipt.ID, AccountID: account.ID}
-	return db.saveAllocation(tx, allocation)
+	return result, nil
 }
 
-func (c *AllocateOps) processSIPPAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
-	currentAmountAllocated, err := db.getCurrentAmountAllocated(tx, account.Wrapper, deposit.ClientID)
-	if err != nil {
-		return err
+// applyFundingPolicy compares the receipt with what is left to fund of the deposit, records the
+// decision on the receipt and returns how much of the receipt to allocate
+func applyFundingPolicy(receipt *models.Receipt, deposit *models.Deposit, received int64, policy string) (uint, error) {
+	receipt.ExcessAmount, receipt.SuspenseAmount = 0, 0
+
+	outstanding := int64(deposit.Amount) - received
+	if outstanding < 0 {
+		outstanding = 0
 	}
 
-	amountAfterAllocation := decimal.NewFromInt(currentAmountAllocated).Add(allocation)
+	excess := int64(receipt.Amount) - outstanding
+	if excess <= 0 {
+		receipt.FundingDecision = models.FundingAccepted
+		return receipt.Amount, nil
+	}
+	receipt.ExcessAmount = excess
+
+	switch policy {
+	case OverFundingReject:
+		receipt.FundingDecision = models.FundingRejected
+		return 0, nil
+	case OverFundingSuspense:
+		receipt.FundingDecision = models.FundingSuspense
+		receipt.SuspenseAmount = excess
+		return uint(outstanding), nil
+	case OverFundingAllocate, "":
+		receipt.FundingDecision = models.FundingAllocated
+		return receipt.Amount, nil
+	}
+	return 0, errors.Wrapf(ErrUnknownOverFunding, "%q", policy)
+}
 
-	isUnderSubscribed := amountAfterAllocation.LessThanOrEqual(decimal.NewFromInt(yearlyPensionLimit))
+// allocateToAccount pays as much of the amount into the account as its wrapper rule accepts
+// and queues the rest against the rule's overflow wrapper
+func (c *AllocationService) allocateToAccount(tx repository.Repositories, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, amount decimal.Decimal, overflowAmounts overflows) (PlannedAllocation, error) {
+	planned := PlannedAllocation{AccountID: account.ID, PotID: account.PotID, Wrapper: account.Wrapper}
 
-	if isUnderSubscribed {
-		allocation := models.Allocation{Amount: uint(allocation.IntPart()), ReceiptID: receipt.ID, AccountID: account.ID}
-		return db.saveAllocation(tx, allocation)
+	if account.ClosedAt != nil {
+		return planned, errors.Wrapf(ErrAccountClosed, "%s account %d", account.Wrapper, account.ID)
 	}
-	toBeAllocatedToGia := amountAfterAllocation.Sub(decimal.NewFromInt(yearlyPensionLimit))
-	addOrCreateAllocationToGiaPot(toBeAllocatedToGia, account.PotID, giaAllocationAmounts)
-	allocate := allocation.Sub(toBeAllocatedToGia)
-	if !allocate.IsZero() {
-		allocation := models.Allocation{Amount: uint(allocate.IntPart()), ReceiptID: receipt.ID, AccountID: account.ID}
-		return db.saveAllocation(tx, allocation)
 
+	rule, ok := c.Rules.Lookup(account.Wrapper)
+	if !ok { // unknown wrappers have always been paid into the pot's GIA
+		overflowAmounts.add(account.PotID, models.WrapperGIA, amount)
+		planned.overflow(amount, models.WrapperGIA, fmt.Sprintf("no rule for %s accounts", account.Wrapper))
+		return planned, nil
 	}
-	return nil
-}
 
-func (c *DbOps) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	if err := tx.Create(&allocation).Error; err != nil {
-		tx.Rollback()
-		return err
+	req := AllocationRequest{
+		Receipt: receipt,
+		Deposit: deposit,
+		Account: account,
+		TaxYear: models.TaxYearOf(receipt.ReceivedOn()), // the year the bank credited it, not when it was keyed in
 	}
-	return nil
-}
-
-func (c *AllocateOps) processIsaAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
 
-	currentAmountAllocated, err := db.getCurrentAmountAllocated(tx, account.Wrapper, deposit.ClientID)
+	accepted := amount
+	headroom, err := rule.Headroom(tx, req)
+	if errors.Is(err, ErrNotEligible) && rule.Overflow() != "" { // all of it goes to the overflow wrapper instead
+		overflowAmounts.add(account.PotID, rule.Overflow(), amount)
+		planned.overflow(amount, rule.Overflow(), err.Error())
+		return planned, nil
+	}
 	if err != nil {
-		return err
+		return planned, err
+	}
+	if headroom != nil && accepted.GreaterThan(*headroom) {
+		accepted = decimal.Max(*headroom, decimal.Zero)
 	}
 
-	amountAfterAllocation := decimal.NewFromInt(currentAmountAllocated).Add(allocation)
-
-	isUnderSubscribed := amountAfterAllocation.LessThanOrEqual(decimal.NewFromInt(yearlyIsaLimit))
+	if accepted.IsPositive() {
+		if err := rule.Allocate(tx, req, accepted); err != nil {
+			return planned, err
+		}
+	}
+	planned.Amount = accepted.IntPart()
 
-	if isUnderSubscribed {
-		allocation := models.Allocation{Amount: uint(allocation.IntPart()), ReceiptID: receipt.ID, AccountID: account.ID}
-		return db.saveAllocation(tx, allocation)
+	excess := amount.Sub(accepted)
+	if !excess.IsPositive() {
+		return planned, nil
 	}
-	toBeAllocatedToGia := amountAfterAllocation.Sub(decimal.NewFromInt(yearlyIsaLimit))
-	addOrCreateAllocationToGiaPot(toBeAllocatedToGia, account.PotID, giaAllocationAmounts)
-	allocate := allocation.Sub(toBeAllocatedToGia)
-	if !allocate.IsZero() {
-		allocation := models.Allocation{Amount: uint(allocate.IntPart()), ReceiptID: receipt.ID, AccountID: account.ID}
-		return db.saveAllocation(tx, allocation)
+	if rule.Overflow() == "" {
+		return planned, errors.Wrapf(ErrLimitExceeded, "%s account %d cannot take a further %s", account.Wrapper, account.ID, excess)
 	}
+	overflowAmounts.add(account.PotID, rule.Overflow(), excess)
+	planned.overflow(excess, rule.Overflow(), fmt.Sprintf("%s limit for %s only had room for %s", account.Wrapper, req.TaxYear, accepted))
+	return planned, nil
+}
 
-	return nil
+// overflowAccount finds the pot's open account for the overflow wrapper, creating a GIA if the pot has none
+func overflowAccount(tx repository.Repositories, key overflowKey) (*models.Account, bool, error) {
+	if key.Wrapper == models.WrapperGIA {
+		return safeCreateGia(tx, key.PotID)
+	}
 
+	account, err := tx.Accounts().FindOpen(key.PotID, key.Wrapper)
+	return account, false, err
 }
 
-func (c *DbOps) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	var currentAmountAllocated int64
-	result := tx.Raw("SELECT COALESCE(SUM(al.amount), 0) FROM clients c "+
-		"LEFT JOIN pots p ON p.client_id = c.id "+
-		"LEFT JOIN accounts a ON a.pot_id = p.id "+
-		"LEFT JOIN allocations al ON al.account_id = a.id "+
-		"WHERE a.wrapper = ? AND a.deleted_at IS NULL "+
-		"AND al.deleted_at IS NULL AND p.deleted_at IS NULL"+
-		" AND c.id = ?", wrapper, clientID)
-
-	if err := result.Scan(&currentAmountAllocated).Error; err != nil {
-		log.Printf("Error scanning current amount allocation result:%v\n", err)
+// safeCreateGia finds the pot's open GIA, creating one if it has none, and reports whether it was created
+func safeCreateGia(tx repository.Repositories, potId uint) (*models.Account, bool, error) {
+	giaAccount, err := tx.Accounts().FindOpen(potId, models.WrapperGIA)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			giaAccount = &models.Account{PotID: potId, Wrapper: models.WrapperGIA}
+			// the pot can only have one open GIA, so this is a repository.ErrConflict if another
+			// request opened one since it was looked for
+			if err := tx.Accounts().Create(giaAccount); err != nil {
+				return giaAccount, false, errors.Wrapf(err, "pot %d", potId)
+			}
+			return giaAccount, true, nil
+		} else { // another error occurred
+			return nil, false, err
+		}
+	}
+	return giaAccount, false, nil
+}
+
+// getLimit returns the wrapper limit in force for the tax year, i.e. the most recent one
+// that took effect in or before it, so historic receipts keep their original limit
+func getLimit(tx repository.Repositories, wrapper string, taxYear models.TaxYear) (int64, error) {
+	limit, err := tx.Limits().InForce(wrapper, taxYear)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return 0, errors.Wrapf(ErrNoLimit, "%s in tax year %s", wrapper, taxYear)
+		}
+		log.Printf("Error loading wrapper limit:%v\n", err)
 		return 0, err
 	}
 
-	return currentAmountAllocated, nil
+	return int64(limit.Amount), nil
+}
 
+type overflowKey struct {
+	PotID   uint
+	Wrapper string
 }
 
-func addOrCreateAllocationToGiaPot(amount decimal.Decimal, potID uint, giaAllocations map[uint]*decimal.Decimal) {
-	val, ok := giaAllocations[potID]
-	// If the key exists
-	if ok {
-		sum := val.Add(amount)
-		giaAllocations[potID] = &sum
-	} else {
-		giaAllocations[potID] = &amount
-	}
+// overflows totals the amounts waiting to be paid into each pot's overflow wrappers
+type overflows map[overflowKey]decimal.Decimal
+
+func (o overflows) add(potID uint, wrapper string, amount decimal.Decimal) {
+	key := overflowKey{PotID: potID, Wrapper: wrapper}
+	o[key] = o[key].Add(amount)
+}
 
+// pop removes and returns the lowest pot and wrapper so overflow is settled in a stable order
+func (o overflows) pop() (overflowKey, decimal.Decimal) {
+	var first overflowKey
+	found := false
+	for key := range o {
+		if !found || key.PotID < first.PotID || (key.PotID == first.PotID && key.Wrapper < first.Wrapper) {
+			first = key
+			found = true
+		}
+	}
+	amount := o[first]
+	delete(o, first)
+	return first, amount
 }
 
-func calculateAllocation(amount uint, split float32) (allocation decimal.Decimal, remainder decimal.Decimal) {
+func calculateAllocation(amount uint, split models.BasisPoints) (allocation decimal.Decimal, remainder decimal.Decimal) {
 	amountDecimal := decimal.NewFromInt(int64(amount))
-	splitDecimal := decimal.NewFromFloat(float64(split))
+	splitDecimal := split.Fraction()
 
 	toBeAllocated := amountDecimal.Mul(splitDecimal)
 	roundedAllocation := toBeAllocated.Floor()
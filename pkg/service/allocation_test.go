@@ -1,21 +1,24 @@
 package service
 
 import (
-	"ajbell.co.uk/app"
 	"ajbell.co.uk/config"
+	"ajbell.co.uk/migrations"
 	"ajbell.co.uk/pkg/models"
-	"github.com/DATA-DOG/go-sqlmock"
+	"ajbell.co.uk/pkg/repository"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestCalculateAllocationNiceEvenNum(t *testing.T) {
-	split, remainder := calculateAllocation(100, 0.50)
+	split, remainder := calculateAllocation(100, 5000)
 
 	if !split.Equal(decimal.NewFromInt(50)) {
 		t.Fatalf("Calculating split is incorrect")
@@ -26,7 +29,7 @@ func TestCalculateAllocationNiceEvenNum(t *testing.T) {
 }
 
 func TestCalculateAllocationRoundUp(t *testing.T) {
-	split, remainder := calculateAllocation(33, 0.30)
+	split, remainder := calculateAllocation(33, 3000)
 
 	if !split.Equal(decimal.NewFromInt(9)) {
 		t.Fatalf("Calculating split is incorrect %s %v", split, 10)
@@ -37,7 +40,7 @@ func TestCalculateAllocationRoundUp(t *testing.T) {
 }
 
 func TestCalculateAllocationRoundDown(t *testing.T) {
-	split, remainder := calculateAllocation(11, 0.13)
+	split, remainder := calculateAllocation(11, 1300)
 
 	if !split.Equal(decimal.NewFromInt(1)) {
 		t.Fatalf("Error calculating split is incorrect %s %v", split, 1)
@@ -48,20 +51,18 @@ func TestCalculateAllocationRoundDown(t *testing.T) {
 	}
 }
 
-func TestAddOrCreateAllocationToGiaPot(t *testing.T) {
-	mockMapData := decimal.NewFromFloat(10.0)
-
+func TestOverflowsAdd(t *testing.T) {
 	tests := []struct {
 		name        string
-		initialData map[uint]*decimal.Decimal
+		initialData overflows
 		amount      decimal.Decimal
 		potID       uint
 		expected    decimal.Decimal
 	}{
 		{
 			name: "KeyExists",
-			initialData: map[uint]*decimal.Decimal{
-				1: &mockMapData,
+			initialData: overflows{
+				overflowKey{PotID: 1, Wrapper: models.WrapperGIA}: decimal.NewFromFloat(10.0),
 			},
 			amount:   decimal.NewFromFloat(5.0),
 			potID:    1,
@@ -69,7 +70,7 @@ func TestAddOrCreateAllocationToGiaPot(t *testing.T) {
 		},
 		{
 			name:        "KeyDoesNotExist",
-			initialData: map[uint]*decimal.Decimal{},
+			initialData: overflows{},
 			amount:      decimal.NewFromFloat(5.0),
 			potID:       2,
 			expected:    decimal.NewFromFloat(5.0),
@@ -79,659 +80,808 @@ func TestAddOrCreateAllocationToGiaPot(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			giaAllocations := cloneMap(tt.initialData)
-
-			addOrCreateAllocationToGiaPot(tt.amount, tt.potID, giaAllocations)
+			tt.initialData.add(tt.potID, models.WrapperGIA, tt.amount)
 
-			actual, ok := giaAllocations[tt.potID]
+			actual, ok := tt.initialData[overflowKey{PotID: tt.potID, Wrapper: models.WrapperGIA}]
 			if !ok {
 				t.Error("Expected key to exist in the map")
 			}
 
-			if !tt.expected.Equal(*actual) {
+			if !tt.expected.Equal(actual) {
 				t.Errorf("Expected value: %s, Actual value: %s", tt.expected.String(), actual.String())
 			}
 		})
 	}
 }
 
-func cloneMap(originalMap map[uint]*decimal.Decimal) map[uint]*decimal.Decimal {
-	clonedMap := make(map[uint]*decimal.Decimal, len(originalMap))
-	for k, v := range originalMap {
-		clonedMap[k] = v
-	}
-	return clonedMap
-}
-
-func TestGetCurrentAmountAllocated(t *testing.T) {
+func TestOverflowsPop(t *testing.T) {
+	overflowAmounts := overflows{}
+	overflowAmounts.add(2, models.WrapperGIA, decimal.NewFromInt(3))
+	overflowAmounts.add(1, models.WrapperISA, decimal.NewFromInt(2))
+	overflowAmounts.add(1, models.WrapperGIA, decimal.NewFromInt(1))
 
-	testDB, mock, _ := sqlmock.New()
+	expected := []overflowKey{
+		{PotID: 1, Wrapper: models.WrapperGIA},
+		{PotID: 1, Wrapper: models.WrapperISA},
+		{PotID: 2, Wrapper: models.WrapperGIA},
+	}
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+	for i, expectedKey := range expected {
+		key, amount := overflowAmounts.pop()
+		assert.Equal(t, expectedKey, key)
+		assert.True(t, amount.Equal(decimal.NewFromInt(int64(i+1))))
+	}
+	assert.Empty(t, overflowAmounts)
+}
 
-	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
+// memoryStore returns an in-memory store holding the records
+func memoryStore(t *testing.T, records ...interface{}) *repository.Memory {
+	store := repository.NewMemory()
+	if err := store.Seed(records...); err != nil {
+		t.Fatalf("Unable to seed memory store: %v", err)
 	}
+	return store
+}
 
-	allocService := NewAllocationService()
+// clientPot is client 2 with pot 1 holding account 1 in the wrapper, followed by any other records
+func clientPot(wrapper string, records ...interface{}) []interface{} {
+	client := &models.Client{Name: "Client"}
+	client.ID = 2
+	return append([]interface{}{client, testPot(1, 2), testAccount(1, 1, wrapper)}, records...)
+}
 
-	mock.ExpectBegin()
+func testPot(id uint, clientID uint) *models.Pot {
+	pot := &models.Pot{ClientID: clientID, Name: "Pot"}
+	pot.ID = id
+	return pot
+}
 
-	mock.ExpectQuery("^SELECT COALESCE\\(SUM\\(al\\.amount\\), 0\\) FROM clients c .*").
-		WithArgs("SIPP", 1).
-		WillReturnRows(sqlmock.NewRows([]string{"COALESCE"}).AddRow(0))
+func testAccount(id uint, potID uint, wrapper string) *models.Account {
+	account := &models.Account{PotID: potID, Wrapper: wrapper}
+	account.ID = id
+	return account
+}
 
-	tx := db.Begin()
+// seededReceipt is a receipt to seed, so allocations made against it can be saved
+func seededReceipt(id uint) *models.Receipt {
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000}
+	receipt.ID = id
+	return receipt
+}
 
-	result, err := allocService.DbOps.getCurrentAmountAllocated(tx, "SIPP", 1)
+// prior is an earlier allocation into the account
+func prior(accountID uint, amount int64, taxYear models.TaxYear, used ...models.AllowanceUsage) *models.Allocation {
+	return &models.Allocation{ReceiptID: 99, AccountID: accountID, Amount: amount, TaxYear: taxYear, AllowanceUsed: used}
+}
 
-	assert.NoError(t, err)
+// savedAllocations are the allocations the store holds for the receipt
+func savedAllocations(t *testing.T, store repository.Repositories, receiptID uint) []models.Allocation {
+	saved, err := store.Allocations().ForReceipt(receiptID)
+	if err != nil {
+		t.Fatalf("Unable to load allocations: %v", err)
+	}
+	return saved
+}
+
+// allowanceUsed is the allowance the allocation used, by tax year
+func allowanceUsed(allocation models.Allocation) []models.AllowanceUsage {
+	used := make([]models.AllowanceUsage, 0, len(allocation.AllowanceUsed))
+	for _, usage := range allocation.AllowanceUsed {
+		used = append(used, models.AllowanceUsage{TaxYear: usage.TaxYear, Amount: usage.Amount})
+	}
+	return used
+}
 
-	assert.Equal(t, int64(0), result)
+func TestGetLimit(t *testing.T) {
+	store := memoryStore(t,
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2016, Amount: 4000000},
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2023, Amount: 6000000},
+	)
 
-	assert.NoError(t, mock.ExpectationsWereMet())
+	t.Run("Limit in force", func(t *testing.T) {
+		limit, err := getLimit(store, models.WrapperSIPP, models.TaxYear(2024))
 
-}
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6000000), limit)
+	})
 
-var getCurrentAmountAllocatedClientIdSipp uint
-var getCurrentAmountAllocatedWrapperSipp string
+	t.Run("Historic limit", func(t *testing.T) {
+		limit, err := getLimit(store, models.WrapperSIPP, models.TaxYear(2022))
 
-var allocationInMockSipp models.Allocation
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4000000), limit)
+	})
 
-func TestProcessSIPPAllocation(t *testing.T) {
-	testDB, _, _ := sqlmock.New()
+	t.Run("No limit in force", func(t *testing.T) {
+		_, err := getLimit(store, models.WrapperISA, models.TaxYear(2010))
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
+		assert.ErrorIs(t, err, ErrNoLimit)
 	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+}
 
-	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
+// receiptInTaxYear2024 is receipt 1 received in the 2024/25 tax year, seeded into the store so its
+// allocations can be saved
+func receiptInTaxYear2024(t *testing.T, store *repository.Memory) models.Receipt {
+	receipt := models.Receipt{DepositID: 1, Amount: 100000}
+	receipt.ID = 1
+	receipt.CreatedAt = time.Date(2025, time.March, 1, 9, 0, 0, 0, time.UTC)
+	if err := store.Seed(&receipt); err != nil {
+		t.Fatalf("Unable to seed receipt: %v", err)
 	}
+	return receipt
+}
 
-	allocService := NewAllocationService()
-	allocService.DbOps = &MockDBOperations{}
+func TestProcessSIPPAllocation(t *testing.T) {
+	store := memoryStore(t, clientPot(models.WrapperSIPP,
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2016, Amount: 6000000})...)
+	allocService := NewAllocationService(store, Options{})
 
-	receipt := models.Receipt{}
-	receipt.ID = 1
+	receipt := receiptInTaxYear2024(t, store)
 	deposit := models.Deposit{}
 	deposit.ID = 1
 	deposit.ClientID = 2
-	account := models.Account{}
-	account.ID = 1
-	account.Wrapper = "SIPP"
-	account.PotID = 1
-
-	tx := db.Begin()
-
-	err = allocService.AlOps.processSIPPAllocation(
-		tx,
-		&receipt,
-		&deposit,
-		&account,
-		decimal.NewFromInt(1000),
-		make(map[uint]*decimal.Decimal),
-		allocService.DbOps,
-	)
-
-	assert.NoError(t, err)
-	assert.Equal(t, "SIPP", getCurrentAmountAllocatedWrapperSipp, "wrapper name does not match")
-	assert.Equal(t, uint(2), getCurrentAmountAllocatedClientIdSipp, "client id does not match")
-	amount := decimal.NewFromInt(int64(allocationInMockSipp.Amount))
-	assert.Equal(t, decimal.NewFromInt(1000), amount, "Values do not match")
+	account, _ := store.Accounts().Get(1)
 
-}
+	overflowAmounts := make(overflows)
 
-type MockDBOperations struct{}
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(1000), overflowAmounts)
 
-func (m *MockDBOperations) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	getCurrentAmountAllocatedClientIdSipp = clientID
-	getCurrentAmountAllocatedWrapperSipp = wrapper
-	return 0, nil
-}
+	assert.NoError(t, err)
+	assert.Empty(t, overflowAmounts, "nothing should overflow")
 
-func (m *MockDBOperations) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	allocationInMockSipp = allocation
-	return nil
+	saved := savedAllocations(t, store, 1)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, int64(1000), saved[0].Amount, "Values do not match")
+	assert.Equal(t, models.TaxYear(2024), saved[0].TaxYear, "allocation tax year does not match")
+	// £10 net is £12.50 gross once basic rate relief is added
+	assert.Equal(t, []models.AllowanceUsage{{TaxYear: 2024, Amount: 1250}}, allowanceUsed(saved[0]), "allowance should come from the current tax year")
+	assert.Equal(t, int64(1250), saved[0].ReliefClaim.GrossAmount)
+	assert.Equal(t, int64(250), saved[0].ReliefClaim.ReliefAmount)
+	assert.Equal(t, models.ClaimStatusPending, saved[0].ReliefClaim.Status)
 }
 
-var prevGetCurrentAmountAllocatedClientIdSipp uint
-var prevGetCurrentAmountAllocatedWrapperSipp string
-
-var prevallocationInMockSipp models.Allocation
-
 func TestProcessSIPPAllocationWithPrevAllocationOverSub(t *testing.T) {
-	testDB, _, _ := sqlmock.New()
-
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
-
-	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
-	}
-
-	allocService := NewAllocationService()
-	allocService.DbOps = &MockDBOperationsPrevAllocation{}
-
-	receipt := models.Receipt{}
-	receipt.ID = 1
+	// the current year and every carry forward year is used up
+	store := memoryStore(t, clientPot(models.WrapperSIPP,
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2016, Amount: 6000000},
+		prior(1, 19200000, 2024,
+			models.AllowanceUsage{TaxYear: 2024, Amount: 6000000},
+			models.AllowanceUsage{TaxYear: 2021, Amount: 6000000},
+			models.AllowanceUsage{TaxYear: 2022, Amount: 6000000},
+			models.AllowanceUsage{TaxYear: 2023, Amount: 6000000}))...)
+	allocService := NewAllocationService(store, Options{})
+
+	receipt := receiptInTaxYear2024(t, store)
 	deposit := models.Deposit{}
 	deposit.ID = 1
 	deposit.ClientID = 2
-	account := models.Account{}
-	account.ID = 1
-	account.Wrapper = "SIPP"
-	account.PotID = 1
-
-	tx := db.Begin()
-
-	err = allocService.AlOps.processSIPPAllocation(
-		tx,
-		&receipt,
-		&deposit,
-		&account,
-		decimal.NewFromInt(1000),
-		make(map[uint]*decimal.Decimal),
-		allocService.DbOps,
-	)
+	account, _ := store.Accounts().Get(1)
 
-	assert.NoError(t, err)
-	assert.Equal(t, "SIPP", prevGetCurrentAmountAllocatedWrapperSipp, "wrapper name does not match")
-	assert.Equal(t, uint(2), prevGetCurrentAmountAllocatedClientIdSipp, "client id does not match")
+	overflowAmounts := make(overflows)
 
-	assert.Equal(t, models.Allocation{}, prevallocationInMockSipp) // should be empty as there is nothing to allocate
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(1000), overflowAmounts)
 
+	assert.NoError(t, err)
+	assert.Empty(t, savedAllocations(t, store, 1), "there is nothing to allocate")
+	assert.True(t, decimal.NewFromInt(1000).Equal(overflowAmounts[overflowKey{PotID: 1, Wrapper: models.WrapperGIA}]), "overflow should go to the GIA")
 }
 
-// Mocked database operations for testing
-type MockDBOperationsPrevAllocation struct{}
-
-func (m *MockDBOperationsPrevAllocation) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	prevGetCurrentAmountAllocatedClientIdSipp = clientID
-	prevGetCurrentAmountAllocatedWrapperSipp = wrapper
-	return 6000000, nil // oversub
-}
-
-func (m *MockDBOperationsPrevAllocation) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	prevallocationInMockSipp = allocation
-	return nil
-}
-
-var prevGetCurrentAmountAllocatedClientIdIsa uint
-var prevGetCurrentAmountAllocatedWrapperIsa string
-
-var prevallocationInMockIsa models.Allocation
-
 func TestProcessIsaAllocationWithPrevAllocationOverSub(t *testing.T) {
-	testDB, _, _ := sqlmock.New()
-
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
-
-	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
-	}
-
-	allocService := NewAllocationService()
-	allocService.DbOps = &MockDBOperationsPrevAllocationIsaOverAllocate{}
-
-	receipt := models.Receipt{}
-	receipt.ID = 1
+	// ISA and LISA subscriptions both count toward the ISA allowance
+	store := memoryStore(t, clientPot(models.WrapperISA,
+		testAccount(2, 1, models.WrapperLISA),
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		prior(1, 1600000, 2024),
+		prior(2, 400000, 2024))...)
+	allocService := NewAllocationService(store, Options{})
+
+	receipt := receiptInTaxYear2024(t, store)
 	deposit := models.Deposit{}
 	deposit.ID = 1
 	deposit.ClientID = 2
-	account := models.Account{}
-	account.ID = 1
-	account.Wrapper = "ISA"
-	account.PotID = 1
-
-	tx := db.Begin()
-
-	err = allocService.AlOps.processIsaAllocation(
-		tx,
-		&receipt,
-		&deposit,
-		&account,
-		decimal.NewFromInt(1000),
-		make(map[uint]*decimal.Decimal),
-		allocService.DbOps,
-	)
+	account, _ := store.Accounts().Get(1)
 
-	assert.NoError(t, err)
-	assert.Equal(t, "ISA", prevGetCurrentAmountAllocatedWrapperIsa, "wrapper name does not match")
-	assert.Equal(t, uint(2), prevGetCurrentAmountAllocatedClientIdIsa, "client id does not match")
-
-	assert.Equal(t, models.Allocation{}, prevallocationInMockIsa) // should be empty as there is nothing to allocate
-
-}
+	overflowAmounts := make(overflows)
 
-// Mocked database operations for testing
-type MockDBOperationsPrevAllocationIsaOverAllocate struct{}
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(1000), overflowAmounts)
 
-func (m *MockDBOperationsPrevAllocationIsaOverAllocate) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	prevGetCurrentAmountAllocatedClientIdIsa = clientID
-	prevGetCurrentAmountAllocatedWrapperIsa = wrapper
-	return 2000000, nil // oversub
-}
-
-func (m *MockDBOperationsPrevAllocationIsaOverAllocate) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	prevallocationInMockIsa = allocation
-	return nil
+	assert.NoError(t, err)
+	assert.Empty(t, savedAllocations(t, store, 1), "there is nothing to allocate")
+	assert.True(t, decimal.NewFromInt(1000).Equal(overflowAmounts[overflowKey{PotID: 1, Wrapper: models.WrapperGIA}]), "overflow should go to the GIA")
 }
 
-// Test ISA with no previous allocation
-var getCurrentAmountAllocatedClientIdIsa uint
-var getCurrentAmountAllocatedWrapperIsa string
+func TestProcessIsaAllocationWithPrevAllocation(t *testing.T) {
+	store := memoryStore(t, clientPot(models.WrapperISA,
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		prior(1, 500000, 2024),
+		prior(1, 2000000, 2023))...)
+	allocService := NewAllocationService(store, Options{})
 
-var allocationInMockIsa models.Allocation
+	receipt := receiptInTaxYear2024(t, store)
+	deposit := models.Deposit{}
+	deposit.ID = 1
+	deposit.ClientID = 2
+	account, _ := store.Accounts().Get(1)
 
-func TestProcessIsaAllocationWithPrevAllocation(t *testing.T) {
-	testDB, _, _ := sqlmock.New()
+	overflowAmounts := make(overflows)
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(100000), overflowAmounts)
 
-	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
-	}
+	assert.NoError(t, err)
+	assert.Empty(t, overflowAmounts, "nothing should overflow")
+	saved := savedAllocations(t, store, 1)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, int64(100000), saved[0].Amount, "Values do not match")
+}
 
-	allocService := NewAllocationService()
-	allocService.DbOps = &MockDBOperationsIsa{}
+func TestSaveGiaAllocation(t *testing.T) {
+	store := memoryStore(t, clientPot(models.WrapperGIA)...)
+	allocService := NewAllocationService(store, Options{})
 
-	// Create sample data for testing
-	receipt := models.Receipt{}
-	receipt.ID = 1
+	receipt := receiptInTaxYear2024(t, store)
 	deposit := models.Deposit{}
 	deposit.ID = 1
 	deposit.ClientID = 2
-	account := models.Account{}
-	account.ID = 1
-	account.Wrapper = "ISA"
-	account.PotID = 1
-
-	tx := db.Begin()
-
-	err = allocService.AlOps.processIsaAllocation(
-		tx,
-		&receipt,
-		&deposit,
-		&account,
-		decimal.NewFromInt(100000),
-		make(map[uint]*decimal.Decimal),
-		allocService.DbOps,
-	)
+	account, _ := store.Accounts().Get(1)
 
-	assert.NoError(t, err)
-	assert.Equal(t, "ISA", getCurrentAmountAllocatedWrapperIsa, "wrapper name does not match")
-	assert.Equal(t, uint(2), getCurrentAmountAllocatedClientIdIsa, "client id does not match")
-	amount := decimal.NewFromInt(int64(allocationInMockIsa.Amount))
-	assert.Equal(t, decimal.NewFromInt(100000), amount, "Values do not match")
+	amount := decimal.NewFromInt(100000)
+
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, amount, overflowAmounts)
 
+	assert.NoError(t, err)
+	saved := savedAllocations(t, store, 1)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, int64(100000), saved[0].Amount, "Values do not match")
+	assert.Empty(t, overflowAmounts, "GIA should never overflow")
 }
 
-// Mocked database operations for testing
-type MockDBOperationsIsa struct{}
+// MockRule accepts up to its headroom without touching the store
+type MockRule struct {
+	wrapper  string
+	overflow string
+	headroom *decimal.Decimal
+	accepted decimal.Decimal
+}
 
-func (m *MockDBOperationsIsa) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	getCurrentAmountAllocatedClientIdIsa = clientID
-	getCurrentAmountAllocatedWrapperIsa = wrapper
-	return 0, nil
+func (m *MockRule) Wrapper() string {
+	return m.wrapper
 }
 
-func (m *MockDBOperationsIsa) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	allocationInMockIsa = allocation
-	return nil
+func (m *MockRule) Overflow() string {
+	return m.overflow
 }
 
-// test process allocation
+func (m *MockRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	return m.headroom, nil
+}
 
-var allocationInMockGia models.Allocation
+func (m *MockRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	m.accepted = m.accepted.Add(amount)
+	return nil
+}
 
-func TestSaveGiaAllocation(t *testing.T) {
-	testDB, _, _ := sqlmock.New()
+func mockRules() *RuleRegistry {
+	return NewRuleRegistry(
+		&MockRule{wrapper: models.WrapperSIPP, overflow: models.WrapperGIA},
+		&MockRule{wrapper: models.WrapperISA, overflow: models.WrapperGIA},
+		&MockRule{wrapper: models.WrapperGIA},
+	)
+}
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+// mockedDeposit holds client 2's pot 1 with a SIPP (account 1) and any other accounts, and deposit 1
+// of amount split as proposed, for allocating with rules that don't record anything themselves
+func mockedDeposit(t *testing.T, amount uint, proposed []models.ProposedAllocation, records ...interface{}) (*repository.Memory, *models.Deposit) {
+	records = append(records, &models.Deposit{ClientID: 2, Amount: amount, ProposedAllocation: proposed})
+	store := memoryStore(t, clientPot(models.WrapperSIPP, records...)...)
 
+	deposit, err := store.Deposits().Get(1)
 	if err != nil {
-		t.Fatalf("Unable to create mock db: %v", err)
+		t.Fatalf("Unable to load deposit: %v", err)
 	}
+	return store, deposit
+}
 
-	allocService := NewAllocationService()
-	allocService.DbOps = &MockDBOperationsGia{}
+// test happy path that all the allocation funcs are called
+func TestAllocateReceipt(t *testing.T) {
+	store, deposit := mockedDeposit(t, 5000000, []models.ProposedAllocation{
+		{AccountID: 1, Split: 2500},
+		{AccountID: 2, Split: 2500},
+		{AccountID: 3, Split: 5000},
+	}, testAccount(2, 1, models.WrapperISA), testAccount(3, 1, models.WrapperGIA))
 
-	receipt := models.Receipt{}
-	receipt.ID = 1
-	deposit := models.Deposit{}
-	deposit.ID = 1
-	deposit.ClientID = 2
-	account := models.Account{}
-	account.ID = 1
-	account.Wrapper = "ISA"
-	account.PotID = 1
+	service := NewAllocationService(store, Options{})
+	service.Rules = mockRules()
 
-	tx := db.Begin()
+	result, err := service.AllocateReceipt(&models.Receipt{DepositID: 1, Amount: 5000000}, deposit)
+	if err != nil {
+		t.Fatalf("AllocateReceipt failed: %v", err)
+	}
 
-	amount := decimal.NewFromInt(100000)
+	assert.Equal(t, []PlannedAllocation{
+		{AccountID: 1, PotID: 1, Wrapper: models.WrapperSIPP, Amount: 1250000},
+		{AccountID: 2, PotID: 1, Wrapper: models.WrapperISA, Amount: 1250000},
+		{AccountID: 3, PotID: 1, Wrapper: models.WrapperGIA, Amount: 2500000},
+	}, result.Allocations)
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Equal(t, int64(5000000), received)
+}
 
-	// Perform the test
-	err = allocService.AlOps.processGiaAllocation(
-		tx,
-		&receipt,
-		&amount,
-		&account,
-		allocService.DbOps,
+// test over allocate so then a GIA needs to be created
+func TestAllocateReceiptOverAllocate(t *testing.T) {
+	store, deposit := mockedDeposit(t, 50000000, []models.ProposedAllocation{
+		{AccountID: 1, Split: 5000},
+		{AccountID: 2, Split: 5000},
+	}, testAccount(2, 1, models.WrapperISA))
+
+	service := NewAllocationService(store, Options{})
+
+	noHeadroom := decimal.NewFromInt(20000)
+	sipp := &MockRule{wrapper: models.WrapperSIPP, overflow: models.WrapperGIA, headroom: &noHeadroom}
+	gia := &MockRule{wrapper: models.WrapperGIA}
+	service.Rules = NewRuleRegistry(
+		sipp,
+		&MockRule{wrapper: models.WrapperISA, overflow: models.WrapperGIA},
+		gia,
 	)
 
-	// Check for the expected errors or success
-	assert.NoError(t, err)
-	amountTest := decimal.NewFromInt(int64(allocationInMockGia.Amount))
-	assert.Equal(t, decimal.NewFromInt(100000), amountTest, "Values do not match")
+	_, err := service.AllocateReceipt(&models.Receipt{DepositID: 1, Amount: 5000000}, deposit)
+	if err != nil {
+		t.Errorf("AllocateReceipt failed: %v", err)
+	}
 
+	assert.True(t, decimal.NewFromInt(20000).Equal(sipp.accepted), "SIPP should only take its headroom")
+	assert.True(t, decimal.NewFromInt(2480000).Equal(gia.accepted), "SIPP excess should be paid into the GIA")
+	_, err = store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.NoError(t, err, "the pot's GIA is opened for the excess")
 }
 
-// Mocked database operations for testing
-type MockDBOperationsGia struct{}
-
-func (m *MockDBOperationsGia) getCurrentAmountAllocated(tx *gorm.DB, wrapper string, clientID uint) (int64, error) {
-	return 0, nil
+// failingReceipts is a store whose transactions can't record receipts
+type failingReceipts struct {
+	repository.Store
 }
 
-func (m *MockDBOperationsGia) saveAllocation(tx *gorm.DB, allocation models.Allocation) error {
-	allocationInMockGia = allocation
-	return nil
+func (s failingReceipts) Transaction(fn func(tx repository.Repositories) error) error {
+	return s.Store.Transaction(func(tx repository.Repositories) error {
+		return fn(failingReceiptRepos{tx})
+	})
 }
 
-type MockAllocationService struct {
+type failingReceiptRepos struct {
+	repository.Repositories
 }
 
-func (m MockAllocationService) processGiaAllocation(tx *gorm.DB, receipt *models.Receipt, amount *decimal.Decimal, account *models.Account, db DatabaseOperations) error {
-
-	return nil
+func (r failingReceiptRepos) Receipts() repository.ReceiptRepository {
+	return failingReceiptRepository{r.Repositories.Receipts()}
 }
 
-func (m MockAllocationService) processSIPPAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
-	return nil
+type failingReceiptRepository struct {
+	repository.ReceiptRepository
 }
 
-func (m MockAllocationService) processIsaAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
-	return nil
+func (r failingReceiptRepository) Create(receipt *models.Receipt) error {
+	return errors.New("Error creating receipt")
 }
 
-// test happy path that all the allocation funcs are called
-func TestAllocateReceipt(t *testing.T) {
-
-	// mock the db
-	testDB, mock, _ := sqlmock.New()
-
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+func TestAllocateReceiptExceptionCreatingReceipt(t *testing.T) {
+	store, deposit := mockedDeposit(t, 5000000, []models.ProposedAllocation{
+		{AccountID: 1, Split: 2500},
+		{AccountID: 2, Split: 2500},
+		{AccountID: 3, Split: 5000},
+	}, testAccount(2, 1, models.WrapperISA), testAccount(3, 1, models.WrapperGIA))
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
-	mock.ExpectBegin()
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
+	service := NewAllocationService(failingReceipts{store}, Options{})
+	service.Rules = mockRules()
 
-	mock.ExpectQuery("INSERT INTO \"receipts\"(.*)").WillReturnRows(idRow)
+	_, err := service.AllocateReceipt(&models.Receipt{DepositID: 1, Amount: 5000000}, deposit)
 
-	now, _ := time.Parse(time.RFC3339, "2020-06-20T22:08:41Z")
+	assert.ErrorContains(t, err, "Error creating receipt")
+}
 
-	accountSipp := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "pot_id", "wrapper"}).AddRow("1", now, now, nil, "1", "SIPP")
+func TestAllocateReceiptExceptionLoadingAccount(t *testing.T) {
+	// account 3 doesn't exist
+	store, deposit := mockedDeposit(t, 5000000, []models.ProposedAllocation{
+		{AccountID: 1, Split: 2500},
+		{AccountID: 2, Split: 2500},
+		{AccountID: 3, Split: 5000},
+	}, testAccount(2, 1, models.WrapperISA))
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(1), int64(1)).WillReturnRows(accountSipp)
+	service := NewAllocationService(store, Options{})
+	service.Rules = mockRules()
 
-	accountIsa := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "pot_id", "wrapper"}).AddRow("2", now, now, nil, "1", "ISA")
+	_, err := service.AllocateReceipt(&models.Receipt{DepositID: 1, Amount: 5000000}, deposit)
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(2), int64(1)).WillReturnRows(accountIsa)
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Zero(t, received, "the receipt is rolled back")
+}
 
-	accountGia := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "pot_id", "wrapper"}).AddRow("3", now, now, nil, "1", "ISA")
+func TestApplyFundingPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		received   int64
+		amount     uint
+		policy     string
+		toAllocate uint
+		decision   string
+		excess     int64
+		suspense   int64
+	}{
+		{name: "WithinDeposit", received: 2000, amount: 3000, policy: OverFundingReject, toAllocate: 3000, decision: models.FundingAccepted},
+		{name: "Reject", received: 2000, amount: 4000, policy: OverFundingReject, toAllocate: 0, decision: models.FundingRejected, excess: 1000},
+		{name: "Suspense", received: 2000, amount: 4000, policy: OverFundingSuspense, toAllocate: 3000, decision: models.FundingSuspense, excess: 1000, suspense: 1000},
+		{name: "SuspenseAlreadyFunded", received: 6000, amount: 4000, policy: OverFundingSuspense, toAllocate: 0, decision: models.FundingSuspense, excess: 4000, suspense: 4000},
+		{name: "Allocate", received: 2000, amount: 4000, policy: OverFundingAllocate, toAllocate: 4000, decision: models.FundingAllocated, excess: 1000},
+		{name: "AllocateByDefault", received: 2000, amount: 4000, toAllocate: 4000, decision: models.FundingAllocated, excess: 1000},
+	}
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(3), int64(1)).WillReturnRows(accountGia)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// whatever the receipt came with is decided afresh
+			receipt := &models.Receipt{Amount: tt.amount, ExcessAmount: 700, SuspenseAmount: 700}
+			deposit := &models.Deposit{Amount: 5000}
 
-	mock.ExpectCommit()
+			toAllocate, err := applyFundingPolicy(receipt, deposit, tt.received, tt.policy)
 
-	// Create instances and dependencies needed for testing
-	service := NewAllocationService()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.toAllocate, toAllocate)
+			assert.Equal(t, tt.decision, receipt.FundingDecision)
+			assert.Equal(t, tt.excess, receipt.ExcessAmount)
+			assert.Equal(t, tt.suspense, receipt.SuspenseAmount)
+		})
+	}
 
-	service.AlOps = MockAllocationService{}
+	_, err := applyFundingPolicy(&models.Receipt{Amount: 6000}, &models.Deposit{Amount: 5000}, 0, "refund")
+	assert.Error(t, err)
+}
 
-	receipt := &models.Receipt{}
-	receipt.ID = 1
-	receipt.Amount = 5000000
-	deposit := &models.Deposit{}
-	deposit.Amount = 5000000
-	deposit.ID = 1
+func TestAllocateReceiptOverFundedRejected(t *testing.T) {
+	earlier := &models.Receipt{DepositID: 1, Amount: 4000000, FundingDecision: models.FundingAccepted}
+	store, deposit := mockedDeposit(t, 5000000, []models.ProposedAllocation{{AccountID: 1, Split: 10000}}, earlier)
 
-	allocations := []models.ProposedAllocation{
-		models.ProposedAllocation{AccountID: 1, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 2, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 3, Split: 0.50, DepositID: 1},
-	}
+	service := NewAllocationService(store, Options{OverFunding: OverFundingReject})
+	service.Rules = mockRules()
 
-	deposit.ProposedAllocation = allocations
-	err = service.AllocateReceipt(receipt, deposit)
-	if err != nil {
-		t.Errorf("AllocateReceipt failed: %v", err)
-	}
+	receipt := &models.Receipt{DepositID: 1, Amount: 2000000}
+	_, err := service.AllocateReceipt(receipt, deposit)
 
-}
+	assert.ErrorIs(t, err, ErrOverFunded)
+	assert.Equal(t, models.FundingRejected, receipt.FundingDecision)
+	assert.Equal(t, int64(1000000), receipt.ExcessAmount)
 
-type MockAllocationServiceOverAllocate struct {
+	// the receipt is recorded with the decision, but nothing is allocated from it
+	saved, err := store.Receipts().Get(receipt.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FundingRejected, saved.FundingDecision)
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Equal(t, int64(4000000), received)
+}
+
+// overAllocateService has a SIPP with 20000 of headroom and an ISA sharing a receipt, with the
+// SIPP's excess overflowing into a GIA the pot doesn't have yet
+func overAllocateService(t *testing.T) *AllocationService {
+	store, _ := mockedDeposit(t, 100000, []models.ProposedAllocation{
+		{AccountID: 1, Split: 5000},
+		{AccountID: 2, Split: 5000},
+	}, testAccount(2, 1, models.WrapperISA))
+
+	service := NewAllocationService(store, Options{})
+	headroom := decimal.NewFromInt(20000)
+	service.Rules = NewRuleRegistry(
+		&MockRule{wrapper: models.WrapperSIPP, overflow: models.WrapperGIA, headroom: &headroom},
+		&MockRule{wrapper: models.WrapperISA, overflow: models.WrapperGIA},
+		&MockRule{wrapper: models.WrapperGIA},
+	)
+	return service
 }
 
-func (m MockAllocationServiceOverAllocate) processGiaAllocation(tx *gorm.DB, receipt *models.Receipt, amount *decimal.Decimal, account *models.Account, db DatabaseOperations) error {
-
-	return nil
+func overAllocateReceipt() (*models.Receipt, *models.Deposit) {
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000}
+	receipt.CreatedAt = time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	deposit := &models.Deposit{ClientID: 2, Amount: 100000}
+	deposit.ID = 1
+	deposit.ProposedAllocation = []models.ProposedAllocation{
+		{AccountID: 1, Split: 5000, DepositID: 1},
+		{AccountID: 2, Split: 5000, DepositID: 1},
+	}
+	return receipt, deposit
 }
 
-func (m MockAllocationServiceOverAllocate) processSIPPAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
-	amount := decimal.NewFromInt(20000)
-	addOrCreateAllocationToGiaPot(amount, account.PotID, giaAllocationAmounts) // will cause the oversub block to be run
-	return nil
-}
+func TestPreviewReceipt(t *testing.T) {
+	service := overAllocateService(t)
+	receipt, deposit := overAllocateReceipt()
 
-func (m MockAllocationServiceOverAllocate) processIsaAllocation(tx *gorm.DB, receipt *models.Receipt, deposit *models.Deposit, account *models.Account, allocation decimal.Decimal, giaAllocationAmounts map[uint]*decimal.Decimal, db DatabaseOperations) error {
-	return nil
-}
+	result, err := service.PreviewReceipt(receipt, deposit)
 
-// test over allocate so then a GIA needs to be created
-func TestAllocateReceiptOverAllocate(t *testing.T) {
+	assert.NoError(t, err)
+	assert.Zero(t, result.ReceiptID, "nothing is recorded by a preview")
+	assert.Zero(t, receipt.ID)
+	assert.Equal(t, []PlannedAllocation{
+		{AccountID: 1, PotID: 1, Wrapper: models.WrapperSIPP, Amount: 20000, Overflow: 30000, OverflowTo: models.WrapperGIA,
+			Reason: "SIPP limit for 2024/25 only had room for 20000"},
+		{AccountID: 2, PotID: 1, Wrapper: models.WrapperISA, Amount: 50000},
+		{PotID: 1, Wrapper: models.WrapperGIA, Amount: 30000, FromOverflow: true, NewAccount: true},
+	}, result.Allocations)
+}
+
+func TestPreviewReceiptMatchesAllocateReceipt(t *testing.T) {
+	receipt, deposit := overAllocateReceipt()
+	preview, err := overAllocateService(t).PreviewReceipt(receipt, deposit)
+	assert.NoError(t, err)
 
-	testDB, mock, _ := sqlmock.New()
+	receipt, deposit = overAllocateReceipt()
+	allocated, err := overAllocateService(t).AllocateReceipt(receipt, deposit)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), allocated.ReceiptID)
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+	// only the IDs of what the preview didn't record differ
+	allocated.forPreview()
+	assert.Equal(t, allocated, preview)
+}
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
-	mock.ExpectBegin()
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
+// TestAllocateReceiptConcurrently fires receipts for the same client at once, each allocating in its
+// own transaction. The memory store runs the transactions side by side and each one pauses after
+// reading how much allowance is used, so only the client lock keeps them from all seeing room.
+func TestAllocateReceiptConcurrently(t *testing.T) {
+	store := memoryStore(t, &models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000})
 
-	mock.ExpectQuery("INSERT INTO \"receipts\"(.*)").WillReturnRows(idRow)
+	allocateConcurrently(t, slowStore{store})
+}
 
-	now, _ := time.Parse(time.RFC3339, "2020-06-20T22:08:41Z")
+// slowStore pauses transactions after they read how much of an allowance is used
+type slowStore struct {
+	repository.Store
+}
 
-	accountSipp := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "pot_id", "wrapper"}).AddRow("1", now, now, nil, "1", "SIPP")
+func (s slowStore) Transaction(fn func(tx repository.Repositories) error) error {
+	return s.Store.Transaction(func(tx repository.Repositories) error {
+		return fn(slowRepos{tx})
+	})
+}
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(1), int64(1)).WillReturnRows(accountSipp)
+type slowRepos struct {
+	repository.Repositories
+}
 
-	accountIsa := sqlmock.NewRows([]string{"id", "created_at", "updated_at", "deleted_at", "pot_id", "wrapper"}).AddRow("2", now, now, nil, "1", "ISA")
+func (r slowRepos) Allocations() repository.AllocationRepository {
+	return slowAllocations{r.Repositories.Allocations()}
+}
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(2), int64(1)).WillReturnRows(accountIsa)
+type slowAllocations struct {
+	repository.AllocationRepository
+}
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(1), "GIA", int64(1)).WillReturnError(gorm.ErrRecordNotFound)
+func (a slowAllocations) Allocated(wrapper string, clientID uint, taxYear models.TaxYear) (int64, error) {
+	allocated, err := a.AllocationRepository.Allocated(wrapper, clientID, taxYear)
+	time.Sleep(2 * time.Millisecond)
+	return allocated, err
+}
 
-	mock.ExpectQuery("INSERT INTO \"accounts\"(.*)").WillReturnRows(idRow)
+// TestAllocateReceiptConcurrentlyInPostgres fires the receipts against a real database, which it
+// writes to, so it only runs with a disposable one, e.g.
+// TEST_DATABASE_DSN="host=localhost port=5432 user=postgres password=postgres dbname=breezy_test"
+func TestAllocateReceiptConcurrentlyInPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
 
-	mock.ExpectCommit()
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Error connecting to %s: %v", dsn, err)
+	}
+	embedded, err := migrations.Embedded()
+	assert.NoError(t, err)
+	_, err = migrations.NewMigrator(db, embedded).Up()
+	assert.NoError(t, err)
+	if err := migrations.SyncLimits(db, []config.LimitConfig{{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000}}); err != nil {
+		t.Fatalf("Error syncing limits: %v", err)
+	}
 
-	// Create instances and dependencies needed for testing
-	service := NewAllocationService()
+	allocateConcurrently(t, repository.NewGorm(db))
+}
+
+// allocateConcurrently allocates ten receipts of £3,000 into a new client's ISA at once, checking
+// the £20,000 ISA allowance isn't breached by receipts that each saw room for their £3,000
+func allocateConcurrently(t *testing.T, store repository.Store) {
+	client := models.Client{Name: "Concurrent receipts"}
+	assert.NoError(t, store.Clients().Create(&client))
+	pot := models.Pot{ClientID: client.ID, Name: "ISA"}
+	assert.NoError(t, store.Pots().Create(&pot))
+	isa := models.Account{PotID: pot.ID, Wrapper: models.WrapperISA}
+	assert.NoError(t, store.Accounts().Create(&isa))
+	deposit := models.Deposit{ClientID: client.ID, Amount: 3000000}
+	deposit.ProposedAllocation = []models.ProposedAllocation{{AccountID: isa.ID, Split: models.WholeSplit}}
+	assert.NoError(t, store.Deposits().Create(&deposit))
+
+	service := NewAllocationService(store, Options{})
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.AllocateReceipt(&models.Receipt{DepositID: deposit.ID, Amount: 300000}, &deposit)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
 
-	service.AlOps = MockAllocationServiceOverAllocate{}
+	for err := range errs {
+		assert.NoError(t, err)
+	}
 
-	receipt := &models.Receipt{}
-	receipt.ID = 1
-	receipt.Amount = 5000000
-	deposit := &models.Deposit{}
-	deposit.Amount = 50000000
-	deposit.ID = 1
+	funded, err := store.Deposits().GetWithReceipts(deposit.ID)
+	assert.NoError(t, err)
+	totals := make(map[string]int64)
+	for _, receipt := range funded.Receipts {
+		for _, allocation := range receipt.Allocations {
+			account, err := store.Accounts().Get(allocation.AccountID)
+			assert.NoError(t, err)
+			totals[account.Wrapper] += allocation.Amount
+		}
+	}
 
-	allocations := []models.ProposedAllocation{
-		models.ProposedAllocation{AccountID: 1, Split: 0.50, DepositID: 1},
-		models.ProposedAllocation{AccountID: 2, Split: 0.50, DepositID: 1},
+	assert.Len(t, funded.Receipts, 10)
+	assert.Equal(t, int64(2000000), totals[models.WrapperISA], "the ISA allowance must not be breached")
+	assert.Equal(t, int64(1000000), totals[models.WrapperGIA])
+}
+
+// memoryDeposit holds client 2 with pot 1 holding a SIPP (account 1) and an ISA (account 2), the
+// SIPP and ISA limits, and deposit 1 of £1,000 split evenly between them. The client has already
+// subscribed isaUsed to the ISA this tax year.
+func memoryDeposit(t *testing.T, isaUsed int64) (*repository.Memory, *models.Deposit) {
+	records := clientPot(models.WrapperSIPP,
+		testAccount(2, 1, models.WrapperISA),
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2016, Amount: 6000000},
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		&models.Deposit{ClientID: 2, Amount: 100000, ProposedAllocation: []models.ProposedAllocation{
+			{AccountID: 1, Split: 5000},
+			{AccountID: 2, Split: 5000},
+		}},
+	)
+	if isaUsed > 0 {
+		records = append(records, prior(2, isaUsed, 2024))
 	}
+	store := memoryStore(t, records...)
 
-	deposit.ProposedAllocation = allocations
-	err = service.AllocateReceipt(receipt, deposit)
+	deposit, err := store.Deposits().Get(1)
 	if err != nil {
-		t.Errorf("AllocateReceipt failed: %v", err)
+		t.Fatalf("Unable to load deposit: %v", err)
 	}
+	return store, deposit
+}
 
+func memoryReceipt(amount uint) *models.Receipt {
+	receipt := &models.Receipt{DepositID: 1, Amount: amount}
+	receipt.CreatedAt = time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	return receipt
 }
 
-func TestAllocateReceiptExceptionCreatingReceipt(t *testing.T) {
+func TestAllocateReceiptInMemory(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(store, Options{})
 
-	// mock the db
-	testDB, mock, _ := sqlmock.New()
+	result, err := service.AllocateReceipt(memoryReceipt(100000), deposit)
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), result.ReceiptID)
+	assert.Equal(t, models.FundingAccepted, result.FundingDecision)
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
-	mock.ExpectBegin()
+	saved := savedAllocations(t, store, result.ReceiptID)
+	assert.Len(t, saved, 2)
+	assert.Equal(t, int64(50000), saved[0].Amount)
+	assert.Equal(t, int64(62500), saved[0].ReliefClaim.GrossAmount, "the SIPP contribution has relief claimed on it")
+	assert.Equal(t, int64(50000), saved[1].Amount)
 
-	errMsg := "Error creating receipt"
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Equal(t, int64(100000), received)
+}
 
-	mock.ExpectQuery("INSERT INTO \"receipts\"(.*)").WillReturnError(errors.New(errMsg))
+func TestAllocateReceiptInMemoryOverflowsToNewGia(t *testing.T) {
+	store, deposit := memoryDeposit(t, 1990000)
+	service := NewAllocationService(store, Options{})
 
-	// Create instances and dependencies needed for testing
-	service := NewAllocationService()
+	result, err := service.AllocateReceipt(memoryReceipt(100000), deposit)
 
-	service.AlOps = MockAllocationService{}
+	assert.NoError(t, err)
+	assert.Len(t, result.Allocations, 3)
+	assert.Equal(t, PlannedAllocation{AccountID: 3, PotID: 1, Wrapper: models.WrapperGIA, Amount: 40000, FromOverflow: true, NewAccount: true}, result.Allocations[2])
 
-	receipt := &models.Receipt{}
-	receipt.ID = 1
-	receipt.Amount = 5000000
-	deposit := &models.Deposit{}
-	deposit.Amount = 5000000
-	deposit.ID = 1
+	gia, err := store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(3), gia.ID)
 
-	allocations := []models.ProposedAllocation{
-		models.ProposedAllocation{AccountID: 1, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 2, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 3, Split: 0.50, DepositID: 1},
-	}
+	allocated, _ := store.Allocations().Allocated(models.WrapperISA, 2, 2024)
+	assert.Equal(t, int64(2000000), allocated, "the ISA allowance must not be breached")
+}
 
-	deposit.ProposedAllocation = allocations
-	err = service.AllocateReceipt(receipt, deposit)
+func TestPreviewReceiptInMemoryRecordsNothing(t *testing.T) {
+	store, deposit := memoryDeposit(t, 1990000)
+	service := NewAllocationService(store, Options{})
 
-	assert.Error(t, err, errMsg)
+	receipt := memoryReceipt(100000)
+	preview, err := service.PreviewReceipt(receipt, deposit)
 
-}
+	assert.NoError(t, err)
+	assert.Zero(t, preview.ReceiptID)
+	assert.Zero(t, receipt.ID)
+	assert.Len(t, preview.Allocations, 3)
 
-func TestAllocateReceiptExceptionLoadingAccount(t *testing.T) {
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Zero(t, received, "a preview records no receipt")
+	_, err = store.Accounts().FindOpen(1, models.WrapperGIA)
+	assert.ErrorIs(t, err, repository.ErrNotFound, "a preview opens no GIA")
 
-	// mock the db
-	testDB, mock, _ := sqlmock.New()
+	// allocating afterwards goes the way the preview said
+	allocated, err := service.AllocateReceipt(memoryReceipt(100000), deposit)
+	assert.NoError(t, err)
+	allocated.forPreview()
+	assert.Equal(t, allocated, preview)
+}
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
+// failingRollback is a store whose rollbacks fail, as when the connection drops mid transaction
+type failingRollback struct {
+	*repository.Memory
+}
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
+func (s failingRollback) Transaction(fn func(tx repository.Repositories) error) error {
+	if err := s.Memory.Transaction(fn); !errors.Is(err, errPreview) {
+		return err
 	}
-	mock.ExpectBegin()
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
+	return errors.New("connection reset")
+}
+
+func TestPreviewReceiptRollbackFails(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(failingRollback{store}, Options{})
 
-	mock.ExpectQuery("INSERT INTO \"receipts\"(.*)").WillReturnRows(idRow)
+	preview, err := service.PreviewReceipt(memoryReceipt(100000), deposit)
 
-	errMsg := "Error loading account"
+	assert.ErrorContains(t, err, "connection reset")
+	assert.Nil(t, preview)
+}
 
-	mock.ExpectQuery("SELECT \\* FROM \"accounts\"(.*)").WithArgs(int64(1), int64(1)).WillReturnError(errors.New("Error loading account"))
+func TestAllocateReceiptInMemoryDuplicate(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(store, Options{})
 
-	// Create instances and dependencies needed for testing
-	service := NewAllocationService()
+	reference := "FP-123"
+	first := memoryReceipt(100000)
+	first.BankReference = &reference
+	_, err := service.AllocateReceipt(first, deposit)
+	assert.NoError(t, err)
 
-	service.AlOps = MockAllocationService{}
+	again := memoryReceipt(100000)
+	again.BankReference = &reference
+	_, err = service.AllocateReceipt(again, deposit)
 
-	receipt := &models.Receipt{}
-	receipt.ID = 1
-	receipt.Amount = 5000000
-	deposit := &models.Deposit{}
-	deposit.Amount = 5000000
-	deposit.ID = 1
+	assert.ErrorIs(t, err, ErrDuplicateReceipt)
+	assert.Equal(t, first.ID, again.ID)
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Equal(t, int64(100000), received, "the duplicate isn't recorded")
+}
 
-	allocations := []models.ProposedAllocation{
-		models.ProposedAllocation{AccountID: 1, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 2, Split: 0.25, DepositID: 1},
-		models.ProposedAllocation{AccountID: 3, Split: 0.50, DepositID: 1},
-	}
+func TestAllocateReceiptInMemoryTaxYearOfValueDate(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(store, Options{})
 
-	deposit.ProposedAllocation = allocations
-	err = service.AllocateReceipt(receipt, deposit)
+	// credited on the last day of the 2023/24 tax year, keyed in on the first of the next
+	receipt := memoryReceipt(100000)
+	receipt.CreatedAt = time.Date(2024, time.April, 6, 9, 0, 0, 0, time.UTC)
+	valueDate := time.Date(2024, time.April, 5, 0, 0, 0, 0, time.UTC)
+	receipt.ValueDate = &valueDate
 
-	assert.Error(t, err, errMsg)
+	result, err := service.AllocateReceipt(receipt, deposit)
 
+	assert.NoError(t, err)
+	for _, saved := range savedAllocations(t, store, result.ReceiptID) {
+		assert.Equal(t, models.TaxYear(2023), saved.TaxYear)
+	}
+	allocated, _ := store.Allocations().Allocated(models.WrapperISA, 2, 2023)
+	assert.Equal(t, int64(50000), allocated)
 }
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// WrapperAllowance is how much of a wrapper's yearly limit a client has used in a tax year
+type WrapperAllowance struct {
+	Wrapper   string `json:"wrapper"`
+	Limit     int64  `json:"limit"` // pennies, after any tapered allowance or MPAA for a SIPP
+	Used      int64  `json:"used"`
+	Remaining int64  `json:"remaining"`       // never less than zero
+	Basis     string `json:"basis,omitempty"` // why the limit differs from the wrapper limit, e.g. "MPAA"
+}
+
+// AllowanceStatement is what a client has left to pay into each wrapper with a limit in a tax year
+type AllowanceStatement struct {
+	ClientID   uint               `json:"client_id"`
+	TaxYear    models.TaxYear     `json:"tax_year"`
+	Allowances []WrapperAllowance `json:"allowances"`
+}
+
+// ClientAllowances returns the client's allowances for the tax year as they stood at now, or at the
+// end of the year once it has ended. Wrappers without a limit in force for the year are left out, and
+// the SIPP allowance is the year's own, without what could be carried forward from earlier years.
+func ClientAllowances(tx repository.Repositories, clientID uint, taxYear models.TaxYear, now time.Time) (*AllowanceStatement, error) {
+	client, err := tx.Clients().Get(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	at := now
+	if taxYear.End().Before(now) {
+		at = taxYear.End()
+	}
+
+	statement := &AllowanceStatement{ClientID: client.ID, TaxYear: taxYear, Allowances: make([]WrapperAllowance, 0)}
+
+	yearly := []struct {
+		wrapper string
+		counts  []string
+	}{
+		{models.WrapperISA, isaWrappers},
+		{models.WrapperLISA, []string{models.WrapperLISA}},
+		{models.WrapperJISA, []string{models.WrapperJISA}},
+	}
+	for _, limited := range yearly {
+		limit, err := getLimit(tx, limited.wrapper, taxYear)
+		if errors.Is(err, ErrNoLimit) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var used int64
+		for _, counted := range limited.counts {
+			allocated, err := tx.Allocations().Allocated(counted, client.ID, taxYear)
+			if err != nil {
+				return nil, err
+			}
+			used += allocated
+		}
+		statement.Allowances = append(statement.Allowances, newWrapperAllowance(limited.wrapper, limit, used, ""))
+	}
+
+	sipp, err := sippAllowance(tx, client, taxYear, at)
+	if err != nil && !errors.Is(err, ErrNoLimit) {
+		return nil, err
+	}
+	if sipp != nil {
+		statement.Allowances = append(statement.Allowances, *sipp)
+	}
+	return statement, nil
+}
+
+// sippAllowance is the client's pension annual allowance for the tax year, used by the gross
+// contributions counted against it
+func sippAllowance(tx repository.Repositories, client *models.Client, taxYear models.TaxYear, at time.Time) (*WrapperAllowance, error) {
+	limit, err := getLimit(tx, models.WrapperSIPP, taxYear)
+	if err != nil {
+		return nil, err
+	}
+
+	basis := ""
+	if tapered, ok := client.TaperedAllowanceFor(taxYear); ok && int64(tapered) < limit {
+		limit = int64(tapered)
+		basis = "tapered"
+	}
+	if client.MpaaAppliesAt(at) {
+		mpaaLimit, err := getLimit(tx, models.LimitMPAA, taxYear)
+		if err != nil {
+			return nil, err
+		}
+		if mpaaLimit < limit {
+			limit = mpaaLimit
+			basis = "MPAA"
+		}
+	}
+
+	used, err := tx.Allocations().AllowanceUsed(models.WrapperSIPP, client.ID, taxYear)
+	if err != nil {
+		return nil, err
+	}
+
+	allowance := newWrapperAllowance(models.WrapperSIPP, limit, used, basis)
+	return &allowance, nil
+}
+
+func newWrapperAllowance(wrapper string, limit int64, used int64, basis string) WrapperAllowance {
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return WrapperAllowance{Wrapper: wrapper, Limit: limit, Used: used, Remaining: remaining, Basis: basis}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// allowanceStore holds the client (id 2) with ISA, LISA and SIPP accounts 1 to 3 in pot 1, the limits
+// without a JISA limit, and what they have paid into the accounts in 2024/25
+func allowanceStore(t *testing.T, client models.Client) *repository.Memory {
+	client.ID = 2
+	client.Name = "Client"
+	return memoryStore(t,
+		&client,
+		testPot(1, 2),
+		testAccount(1, 1, models.WrapperISA),
+		testAccount(2, 1, models.WrapperLISA),
+		testAccount(3, 1, models.WrapperSIPP),
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		&models.WrapperLimit{Wrapper: models.WrapperLISA, EffectiveFrom: 2017, Amount: 400000},
+		&models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: 2023, Amount: 6000000},
+		&models.WrapperLimit{Wrapper: models.LimitMPAA, EffectiveFrom: 2023, Amount: 1000000},
+		prior(1, 500000, 2024),
+		prior(2, 100000, 2024),
+		prior(3, 1000000, 2024, models.AllowanceUsage{TaxYear: 2024, Amount: 1250000}),
+		prior(1, 300000, 2023),
+	)
+}
+
+func TestClientAllowances(t *testing.T) {
+	now := time.Date(2024, time.October, 1, 9, 0, 0, 0, time.UTC)
+	triggered := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		client models.Client
+		sipp   WrapperAllowance
+	}{
+		{
+			name: "AnnualAllowance",
+			sipp: WrapperAllowance{Wrapper: models.WrapperSIPP, Limit: 6000000, Used: 1250000, Remaining: 4750000},
+		},
+		{
+			name:   "TaperedAllowance",
+			client: models.Client{TaperedAllowances: []models.TaperedAllowance{{TaxYear: 2024, Amount: 1000000}}},
+			sipp:   WrapperAllowance{Wrapper: models.WrapperSIPP, Limit: 1000000, Used: 1250000, Remaining: 0, Basis: "tapered"},
+		},
+		{
+			name:   "MpaaTriggered",
+			client: models.Client{MpaaTriggeredAt: &triggered},
+			sipp:   WrapperAllowance{Wrapper: models.WrapperSIPP, Limit: 1000000, Used: 1250000, Remaining: 0, Basis: "MPAA"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := allowanceStore(t, tt.client)
+
+			statement, err := ClientAllowances(store, 2, 2024, now)
+
+			assert.NoError(t, err)
+			assert.Equal(t, models.TaxYear(2024), statement.TaxYear)
+			// LISA subscriptions count toward the ISA allowance, and there is no JISA limit
+			assert.Equal(t, []WrapperAllowance{
+				{Wrapper: models.WrapperISA, Limit: 2000000, Used: 600000, Remaining: 1400000},
+				{Wrapper: models.WrapperLISA, Limit: 400000, Used: 100000, Remaining: 300000},
+				tt.sipp,
+			}, statement.Allowances)
+		})
+	}
+}
+
+func TestClientAllowancesMpaaTriggeredAfterTheYear(t *testing.T) {
+	triggered := time.Date(2025, time.May, 1, 0, 0, 0, 0, time.UTC)
+	store := allowanceStore(t, models.Client{MpaaTriggeredAt: &triggered})
+
+	statement, err := ClientAllowances(store, 2, 2024, time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6000000), statement.Allowances[2].Limit)
+}
+
+func TestClientAllowancesUnknownClient(t *testing.T) {
+	store := allowanceStore(t, models.Client{})
+
+	_, err := ClientAllowances(store, 9, 2024, time.Now())
+
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"sort"
+)
+
+// strategies for handing out the pennies lost when a receipt's split is rounded down to the penny
+const (
+	ApportionLargestRemainder = "largest_remainder" // to the shares that lost the most rounding down, the default
+	ApportionToGIA            = "gia"               // to the GIA, which has no limit to push over
+	ApportionToLargestSplit   = "largest_split"     // to the share with the largest split
+	ApportionToFirstAccount   = "first_account"     // to the first proposed allocation
+)
+
+// ErrUnknownApportionment is returned when a deposit or config names a strategy that doesn't exist
+var ErrUnknownApportionment = errors.New("unknown apportionment strategy")
+
+// splitShare is one proposed allocation's share of a receipt
+type splitShare struct {
+	Split    models.BasisPoints
+	Wrapper  string
+	Amount   int64           // the share rounded down to the penny
+	Fraction decimal.Decimal // the part of a penny lost rounding the share down
+}
+
+// apportioner adds the pennies lost rounding down to the shares
+type apportioner func(shares []splitShare, pennies int64)
+
+var apportioners = map[string]apportioner{
+	ApportionLargestRemainder: largestRemainder,
+	ApportionToGIA:            toGIA,
+	ApportionToLargestSplit:   toLargestSplit,
+	ApportionToFirstAccount:   toFirstAccount,
+}
+
+// apportionment is the deposit's strategy, or the configured one when the deposit doesn't have one
+func apportionment(deposit *models.Deposit, configured string) string {
+	if deposit.Apportionment != "" {
+		return deposit.Apportionment
+	}
+	if configured != "" {
+		return configured
+	}
+	return ApportionLargestRemainder
+}
+
+// splitDeposit splits the amount between the accounts by the proposed allocations' splits. The
+// shares always add up to the amount, with the pennies lost rounding down handed out by the strategy.
+func splitDeposit(amount uint, proposed []models.ProposedAllocation, accounts []*models.Account, strategy string) ([]int64, error) {
+	apportion, ok := apportioners[strategy]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownApportionment, "%q", strategy)
+	}
+
+	shares := make([]splitShare, len(proposed))
+	pennies := int64(amount)
+	for i, allocation := range proposed {
+		rounded, fraction := calculateAllocation(amount, allocation.Split)
+		shares[i] = splitShare{Split: allocation.Split, Wrapper: accounts[i].Wrapper, Amount: rounded.IntPart(), Fraction: fraction}
+		pennies -= shares[i].Amount
+	}
+	if pennies < 0 {
+		return nil, errors.New("proposed allocation splits add up to more than 100%")
+	}
+
+	if pennies > 0 && len(shares) > 0 {
+		apportion(shares, pennies)
+	}
+
+	amounts := make([]int64, len(shares))
+	for i, share := range shares {
+		amounts[i] = share.Amount
+	}
+	return amounts, nil
+}
+
+// splitReceipt splits the amount being allocated from a receipt between the accounts. Rather than
+// splitting each receipt on its own, each account's target is its share of the whole deposit scaled
+// to everything allocated from the deposit so far, and the receipt makes up the difference from what
+// earlier receipts gave it. Once the deposit is funded the accounts hold their share of the deposit
+// however it was paid in. earlier is what was allocated from each of the deposit's earlier receipts,
+// oldest first. The strategy decides which account a receipt's odd pennies go to first.
+func splitReceipt(amount uint, earlier []uint, deposit *models.Deposit, accounts []*models.Account, strategy string) ([]decimal.Decimal, error) {
+	whole, err := splitDeposit(deposit.Amount, deposit.ProposedAllocation, accounts, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	favoured := favouredShare(strategy, deposit.ProposedAllocation, accounts)
+
+	// what each account was given by the earlier receipts is worked out again rather than stored
+	given := make([]int64, len(whole))
+	var cumulative int64
+	for _, allocated := range earlier {
+		cumulative += int64(allocated)
+		fillShares(given, whole, int64(deposit.Amount), cumulative, int64(allocated), favoured)
+	}
+
+	before := make([]int64, len(given))
+	copy(before, given)
+	fillShares(given, whole, int64(deposit.Amount), cumulative+int64(amount), int64(amount), favoured)
+
+	amounts := make([]decimal.Decimal, len(given))
+	for i := range given {
+		amounts[i] = decimal.NewFromInt(given[i] - before[i])
+	}
+	return amounts, nil
+}
+
+// favouredShare is the share the strategy gives a receipt's odd pennies to first, or -1 when they go
+// to the shares closest to their next penny
+func favouredShare(strategy string, proposed []models.ProposedAllocation, accounts []*models.Account) int {
+	switch strategy {
+	case ApportionToGIA:
+		for i, account := range accounts {
+			if account.Wrapper == models.WrapperGIA {
+				return i
+			}
+		}
+	case ApportionToLargestSplit:
+		largest := 0
+		for i := range proposed {
+			if proposed[i].Split > proposed[largest].Split {
+				largest = i
+			}
+		}
+		return largest
+	case ApportionToFirstAccount:
+		return 0
+	}
+	return -1
+}
+
+// fillShares hands out the amount so each share moves toward its part of the cumulative amount,
+// i.e. whole[i] * cumulative / total. Shares furthest behind are filled first, then whatever is left
+// goes a penny at a time to the favoured share and then the shares closest to their next penny, never
+// taking a share past its part rounded up. Given never goes past a share of the whole, so the shares
+// are exact once the cumulative amount reaches the total.
+func fillShares(given []int64, whole []int64, total int64, cumulative int64, amount int64, favoured int) {
+	if len(given) == 0 {
+		return
+	}
+
+	floor := make([]int64, len(whole))
+	rem := make([]decimal.Decimal, len(whole))
+	for i := range whole {
+		floor[i], rem[i] = part(whole[i], cumulative, total)
+	}
+
+	behind := make([]int, len(given))
+	for i := range behind {
+		behind[i] = i
+	}
+	sort.SliceStable(behind, func(a, b int) bool {
+		return floor[behind[a]]-given[behind[a]] > floor[behind[b]]-given[behind[b]]
+	})
+	for _, i := range behind {
+		deficit := floor[i] - given[i]
+		if deficit <= 0 || amount == 0 {
+			break
+		}
+		if deficit > amount {
+			deficit = amount
+		}
+		given[i] += deficit
+		amount -= deficit
+	}
+
+	closest := make([]int, len(given))
+	copy(closest, behind)
+	sort.SliceStable(closest, func(a, b int) bool {
+		if (closest[a] == favoured) != (closest[b] == favoured) {
+			return closest[a] == favoured
+		}
+		return rem[closest[a]].GreaterThan(rem[closest[b]])
+	})
+	for _, i := range closest {
+		if amount == 0 {
+			break
+		}
+		if given[i] <= floor[i] && rem[i].IsPositive() {
+			given[i]++
+			amount--
+		}
+	}
+
+	// only reached for a deposit without an amount to scale the shares by
+	if amount > 0 {
+		given[closest[0]] += amount
+	}
+}
+
+// part is whole * cumulative / total rounded down, with the remainder of the division
+func part(whole, cumulative, total int64) (int64, decimal.Decimal) {
+	if total == 0 {
+		return 0, decimal.Zero
+	}
+	quotient, remainder := decimal.NewFromInt(whole).Mul(decimal.NewFromInt(cumulative)).QuoRem(decimal.NewFromInt(total), 0)
+	return quotient.IntPart(), remainder
+}
+
+// largestRemainder is the Hamilton method, a penny each to the shares that lost the most rounding
+// down, earlier allocations first on a tie
+func largestRemainder(shares []splitShare, pennies int64) {
+	order := make([]int, len(shares))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return shares[order[a]].Fraction.GreaterThan(shares[order[b]].Fraction)
+	})
+
+	for i := 0; pennies > 0; i = (i + 1) % len(order) {
+		shares[order[i]].Amount++
+		pennies--
+	}
+}
+
+// toGIA gives the pennies to the first GIA share, falling back to the largest remainder when
+// the split doesn't include a GIA
+func toGIA(shares []splitShare, pennies int64) {
+	for i := range shares {
+		if shares[i].Wrapper == models.WrapperGIA {
+			shares[i].Amount += pennies
+			return
+		}
+	}
+	largestRemainder(shares, pennies)
+}
+
+// toLargestSplit gives the pennies to the share with the largest split, the earliest on a tie
+func toLargestSplit(shares []splitShare, pennies int64) {
+	largest := 0
+	for i := range shares {
+		if shares[i].Split > shares[largest].Split {
+			largest = i
+		}
+	}
+	shares[largest].Amount += pennies
+}
+
+func toFirstAccount(shares []splitShare, pennies int64) {
+	shares[0].Amount += pennies
+}
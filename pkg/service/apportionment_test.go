@@ -0,0 +1,203 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func splitAccounts(wrappers ...string) []*models.Account {
+	accounts := make([]*models.Account, len(wrappers))
+	for i, wrapper := range wrappers {
+		accounts[i] = &models.Account{Wrapper: wrapper}
+	}
+	return accounts
+}
+
+func pennies(t *testing.T, amount uint, proposed []models.ProposedAllocation, accounts []*models.Account, strategy string) []int64 {
+	amounts, err := splitDeposit(amount, proposed, accounts, strategy)
+	assert.NoError(t, err)
+	return amounts
+}
+
+func TestSplitDepositStrategies(t *testing.T) {
+	// 100 split 33.33/33.33/33.34 leaves 33, 33 and 33 after rounding down, with a penny to hand out
+	proposed := []models.ProposedAllocation{{AccountID: 1, Split: 3333}, {AccountID: 2, Split: 3333}, {AccountID: 3, Split: 3334}}
+	accounts := splitAccounts(models.WrapperISA, models.WrapperGIA, models.WrapperSIPP)
+
+	tests := []struct {
+		strategy string
+		expected []int64
+	}{
+		{ApportionLargestRemainder, []int64{33, 33, 34}},
+		{ApportionToGIA, []int64{33, 34, 33}},
+		{ApportionToLargestSplit, []int64{33, 33, 34}},
+		{ApportionToFirstAccount, []int64{34, 33, 33}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			assert.Equal(t, tt.expected, pennies(t, 100, proposed, accounts, tt.strategy))
+		})
+	}
+}
+
+func TestLargestRemainderAcrossShares(t *testing.T) {
+	// 1001 split 0.1/0.2/0.7 is 100.1, 200.2 and 700.7, so the penny goes to the 0.7 share
+	proposed := []models.ProposedAllocation{{Split: 1000}, {Split: 2000}, {Split: 7000}}
+	accounts := splitAccounts(models.WrapperISA, models.WrapperLISA, models.WrapperGIA)
+
+	assert.Equal(t, []int64{100, 200, 701}, pennies(t, 1001, proposed, accounts, ApportionLargestRemainder))
+}
+
+func TestToGIAWithoutGIAFallsBack(t *testing.T) {
+	proposed := []models.ProposedAllocation{{Split: 5000}, {Split: 5000}}
+	accounts := splitAccounts(models.WrapperISA, models.WrapperSIPP)
+
+	assert.Equal(t, []int64{1, 0}, pennies(t, 1, proposed, accounts, ApportionToGIA))
+}
+
+func TestSplitDepositUnknownStrategy(t *testing.T) {
+	_, err := splitDeposit(100, []models.ProposedAllocation{{Split: 10000}}, splitAccounts(models.WrapperGIA), "round_robin")
+
+	assert.ErrorIs(t, err, ErrUnknownApportionment)
+}
+
+func TestSplitDepositAddsUpToAmount(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for n := 0; n < 500; n++ {
+		proposed, accounts := randomSplit(random)
+		amount := uint(random.Intn(10000000))
+
+		for strategy := range apportioners {
+			var total int64
+			for _, share := range pennies(t, amount, proposed, accounts, strategy) {
+				total += share
+			}
+			assert.Equal(t, int64(amount), total, "%s split of %d", strategy, amount)
+		}
+	}
+}
+
+func randomSplit(random *rand.Rand) ([]models.ProposedAllocation, []*models.Account) {
+	wrappers := []string{models.WrapperSIPP, models.WrapperISA, models.WrapperLISA, models.WrapperJISA, models.WrapperGIA}
+
+	count := 1 + random.Intn(5)
+	proposed := make([]models.ProposedAllocation, count)
+	accounts := make([]*models.Account, count)
+	left := models.WholeSplit
+	for i := range proposed {
+		split := left
+		if i < count-1 {
+			split = models.BasisPoints(random.Intn(int(left) + 1))
+		}
+		left -= split
+		proposed[i] = models.ProposedAllocation{Split: split}
+		accounts[i] = &models.Account{Wrapper: wrappers[random.Intn(len(wrappers))]}
+	}
+	return proposed, accounts
+}
+
+// receiptTotals pays the deposit in with the receipts and totals what each account was given,
+// checking no account is ever given more than its share of what has been paid in, rounded up
+func receiptTotals(t *testing.T, deposit *models.Deposit, accounts []*models.Account, receipts []uint, strategy string) []int64 {
+	whole := pennies(t, deposit.Amount, deposit.ProposedAllocation, accounts, strategy)
+
+	totals := make([]int64, len(accounts))
+	var cumulative int64
+	for n, amount := range receipts {
+		amounts, err := splitReceipt(amount, receipts[:n], deposit, accounts, strategy)
+		assert.NoError(t, err)
+
+		cumulative += int64(amount)
+		var given int64
+		for i, a := range amounts {
+			assert.False(t, a.IsNegative())
+			totals[i] += a.IntPart()
+			given += a.IntPart()
+
+			share, rem := part(whole[i], cumulative, int64(deposit.Amount))
+			if rem.IsPositive() {
+				share++
+			}
+			assert.LessOrEqual(t, totals[i], share, "account %d after %d of %d", i, cumulative, deposit.Amount)
+		}
+		assert.Equal(t, int64(amount), given)
+	}
+	return totals
+}
+
+func TestSplitReceiptPennyDrift(t *testing.T) {
+	// split on their own, each receipt of 1 gives its penny to the 0.34 share, so after 100 of them
+	// the accounts would hold 0, 0 and 100 rather than 33, 33 and 34
+	deposit := &models.Deposit{Amount: 100}
+	deposit.ProposedAllocation = []models.ProposedAllocation{{Split: 3300}, {Split: 3300}, {Split: 3400}}
+	accounts := splitAccounts(models.WrapperISA, models.WrapperSIPP, models.WrapperGIA)
+
+	receipts := make([]uint, 100)
+	for i := range receipts {
+		receipts[i] = 1
+	}
+
+	assert.Equal(t, []int64{33, 33, 34}, receiptTotals(t, deposit, accounts, receipts, ApportionLargestRemainder))
+}
+
+func TestSplitReceiptSameTotalsHoweverChunked(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+
+	for n := 0; n < 300; n++ {
+		proposed, accounts := randomSplit(random)
+		deposit := &models.Deposit{Amount: uint(1 + random.Intn(100000)), ProposedAllocation: proposed}
+
+		var receipts []uint
+		for left := deposit.Amount; left > 0; {
+			amount := uint(1 + random.Intn(int(left)))
+			receipts = append(receipts, amount)
+			left -= amount
+		}
+
+		for _, strategy := range []string{ApportionLargestRemainder, ApportionToGIA, ApportionToLargestSplit, ApportionToFirstAccount} {
+			whole := pennies(t, deposit.Amount, proposed, accounts, strategy)
+			assert.Equal(t, whole, receiptTotals(t, deposit, accounts, receipts, strategy), "%s deposit of %d in %v", strategy, deposit.Amount, receipts)
+		}
+	}
+}
+
+func TestSplitReceiptStrategies(t *testing.T) {
+	// 10001 split 33.33%, 33.33% and 33.34% rounds down to 3333, 3333 and 3334, a penny short
+	deposit := &models.Deposit{Amount: 10001}
+	deposit.ProposedAllocation = []models.ProposedAllocation{{Split: 3333}, {Split: 3333}, {Split: 3334}}
+	accounts := splitAccounts(models.WrapperISA, models.WrapperGIA, models.WrapperSIPP)
+	receipts := []uint{3001, 2999, 4001}
+
+	tests := []struct {
+		strategy string
+		first    []int64 // what the first receipt gives each account
+		totals   []int64
+	}{
+		// the first receipt's odd penny goes to the share closest to its next penny, the SIPP's
+		{ApportionLargestRemainder, []int64{1000, 1000, 1001}, []int64{3333, 3333, 3335}},
+		{ApportionToGIA, []int64{1000, 1001, 1000}, []int64{3333, 3334, 3334}},
+		{ApportionToLargestSplit, []int64{1000, 1000, 1001}, []int64{3333, 3333, 3335}},
+		{ApportionToFirstAccount, []int64{1001, 1000, 1000}, []int64{3334, 3333, 3334}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			first := receiptTotals(t, deposit, accounts, receipts[:1], test.strategy)
+			assert.Equal(t, test.first, first)
+
+			totals := receiptTotals(t, deposit, accounts, receipts, test.strategy)
+			assert.Equal(t, test.totals, totals)
+			assert.Equal(t, pennies(t, deposit.Amount, deposit.ProposedAllocation, accounts, test.strategy), totals)
+		})
+	}
+}
+
+func TestApportionment(t *testing.T) {
+	assert.Equal(t, ApportionToGIA, apportionment(&models.Deposit{Apportionment: ApportionToGIA}, ApportionToFirstAccount))
+	assert.Equal(t, ApportionToFirstAccount, apportionment(&models.Deposit{}, ApportionToFirstAccount))
+	assert.Equal(t, ApportionLargestRemainder, apportionment(&models.Deposit{}, ""))
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ErrDuplicateReceipt is returned when the receipt's bank reference has already been receipted
+// against the deposit for the same amount. The receipt's ID is set to the existing receipt's.
+var ErrDuplicateReceipt = errors.New("payment has already been receipted")
+
+// ErrBankReferenceInUse is returned when the receipt's bank reference belongs to a receipt for a
+// different deposit or amount
+var ErrBankReferenceInUse = errors.New("bank reference belongs to another receipt")
+
+// checkDuplicate looks for an earlier receipt of the same payment, which may have come in through
+// another channel. A receipt with the same bank reference is the same payment. One for the same
+// amount against the same deposit on the same day may be, so the receipt is flagged for review.
+func checkDuplicate(tx repository.Repositories, receipt *models.Receipt, now time.Time) error {
+	receipt.NeedsReview = false
+	receipt.ReviewReason = ""
+	receipt.ReviewedAt = nil
+
+	if receipt.BankReference != nil {
+		existing, err := tx.Receipts().FindByBankReference(*receipt.BankReference)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if existing.DepositID != receipt.DepositID || existing.Amount != receipt.Amount {
+				return errors.Wrapf(ErrBankReferenceInUse, "%s is receipt %d", *receipt.BankReference, existing.ID)
+			}
+			receipt.ID = existing.ID
+			return errors.Wrapf(ErrDuplicateReceipt, "%s is receipt %d", *receipt.BankReference, existing.ID)
+		}
+	}
+
+	received := now
+	if receipt.ValueDate != nil {
+		received = *receipt.ValueDate
+	}
+	start, end := models.DayOf(received)
+
+	similar, err := tx.Receipts().FindSimilar(receipt.DepositID, receipt.Amount, start, end)
+	if err != nil {
+		return err
+	}
+	if similar != nil {
+		receipt.NeedsReview = true
+		receipt.ReviewReason = fmt.Sprintf("possible duplicate of receipt %d, same amount and deposit on %s", similar.ID, start.Format("2006-01-02"))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// existingReceipt is receipt 7 of 100000 into the deposit, with the bank reference, received at receivedAt
+func existingReceipt(depositID uint, reference string, receivedAt time.Time) *models.Receipt {
+	receipt := &models.Receipt{DepositID: depositID, Amount: 100000, BankReference: &reference, ValueDate: &receivedAt}
+	receipt.ID = 7
+	return receipt
+}
+
+func TestCheckDuplicateSameReference(t *testing.T) {
+	store := memoryStore(t, existingReceipt(1, "FP-123", time.Now()))
+
+	reference := "FP-123"
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000, BankReference: &reference}
+
+	err := checkDuplicate(store, receipt, time.Now())
+
+	assert.ErrorIs(t, err, ErrDuplicateReceipt)
+	assert.Equal(t, uint(7), receipt.ID)
+}
+
+func TestCheckDuplicateReferenceInUse(t *testing.T) {
+	store := memoryStore(t, existingReceipt(2, "FP-123", time.Now()))
+
+	reference := "FP-123"
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000, BankReference: &reference}
+
+	err := checkDuplicate(store, receipt, time.Now())
+
+	assert.ErrorIs(t, err, ErrBankReferenceInUse)
+	assert.Zero(t, receipt.ID)
+}
+
+func TestCheckDuplicateNearDuplicate(t *testing.T) {
+	// 23:30 UTC on 1 September is 00:30 on 2 September in British Summer Time
+	valueDate := time.Date(2024, time.September, 1, 23, 30, 0, 0, time.UTC)
+	// the existing receipt was received later the same day in London
+	store := memoryStore(t, existingReceipt(1, "FP-123", time.Date(2024, time.September, 2, 9, 0, 0, 0, time.UTC)))
+
+	reference := "FP-456"
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000, BankReference: &reference, ValueDate: &valueDate, NeedsReview: false}
+
+	assert.NoError(t, checkDuplicate(store, receipt, time.Now()))
+	assert.True(t, receipt.NeedsReview)
+	assert.Equal(t, "possible duplicate of receipt 7, same amount and deposit on 2024-09-02", receipt.ReviewReason)
+}
+
+func TestCheckDuplicateNothingSimilar(t *testing.T) {
+	// the same amount into the deposit, but the day before
+	store := memoryStore(t, existingReceipt(1, "FP-123", time.Now().AddDate(0, 0, -1)))
+
+	// a client can't flag or clear a review themselves
+	receipt := &models.Receipt{DepositID: 1, Amount: 100000, NeedsReview: true, ReviewReason: "set by the client"}
+
+	assert.NoError(t, checkDuplicate(store, receipt, time.Now()))
+	assert.False(t, receipt.NeedsReview)
+	assert.Empty(t, receipt.ReviewReason)
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+const jisaMaxAge = 17 // the account becomes an adult ISA on the child's 18th birthday
+
+// jisaRule allocates Junior ISA subscriptions. The allowance belongs to the child who owns the
+// pot rather than whoever made the deposit, and there is no overflow within the child's pot, so
+// anything over the allowance is rejected.
+type jisaRule struct{}
+
+func (r *jisaRule) Wrapper() string {
+	return models.WrapperJISA
+}
+
+func (r *jisaRule) Overflow() string {
+	return ""
+}
+
+func (r *jisaRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	pot, err := tx.Clients().GetPot(req.Account.PotID)
+	if err != nil {
+		return nil, err
+	}
+
+	child, err := tx.Clients().Get(pot.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if child.RegisteredContactID == nil {
+		return nil, errors.Wrapf(ErrNotEligible, "client %d has no registered contact for JISA account %d", child.ID, req.Account.ID)
+	}
+	if req.Deposit.ClientID != child.ID && req.Deposit.ClientID != *child.RegisteredContactID {
+		return nil, errors.Wrapf(ErrNotEligible, "client %d is not the registered contact for JISA account %d", req.Deposit.ClientID, req.Account.ID)
+	}
+	if age, ok := child.AgeAt(req.Receipt.ReceivedOn()); ok && age > jisaMaxAge {
+		return nil, errors.Wrapf(ErrNotEligible, "client %d is too old for JISA account %d", child.ID, req.Account.ID)
+	}
+
+	headroom, err := limitHeadroom(tx, child.ID, req.TaxYear, models.WrapperJISA, models.WrapperJISA)
+	if err != nil {
+		return nil, err
+	}
+	return &headroom, nil
+}
+
+func (r *jisaRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	return saveAccepted(tx, req, amount)
+}
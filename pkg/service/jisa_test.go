@@ -0,0 +1,127 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// jisaStore holds the child (id 5) with pot 1 holding JISA account 1, receipt 1, and what has
+// already been allocated into the account this tax year
+func jisaStore(t *testing.T, child models.Client, allocated int64) *repository.Memory {
+	records := []interface{}{
+		&child,
+		testPot(1, child.ID),
+		testAccount(1, 1, models.WrapperJISA),
+		&models.WrapperLimit{Wrapper: models.WrapperJISA, EffectiveFrom: 2020, Amount: 900000},
+		seededReceipt(1),
+	}
+	if allocated > 0 {
+		records = append(records, prior(1, allocated, 2025))
+	}
+	return memoryStore(t, records...)
+}
+
+func jisaChild(dob *time.Time) models.Client {
+	parent := uint(2)
+	child := models.Client{Name: "Child", RegisteredContactID: &parent, DateOfBirth: dob}
+	child.ID = 5
+	return child
+}
+
+func TestJisaAllocation(t *testing.T) {
+	store := jisaStore(t, jisaChild(dateOfBirth(2015)), 800000)
+
+	allocService := NewAllocationService(store, Options{})
+
+	receipt := models.Receipt{}
+	receipt.ID = 1
+	receipt.CreatedAt = time.Date(2025, time.May, 1, 9, 0, 0, 0, time.UTC)
+	deposit := models.Deposit{ClientID: 2} // paid in by the registered contact
+	account, _ := store.Accounts().Get(1)
+
+	overflowAmounts := make(overflows)
+
+	// the allowance is the child's, so only the £1,000 left of it is free
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(50000), overflowAmounts)
+
+	assert.NoError(t, err)
+	saved := savedAllocations(t, store, 1)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, int64(50000), saved[0].Amount)
+	assert.Empty(t, overflowAmounts)
+}
+
+func TestJisaAllocationOverAllowanceIsRejected(t *testing.T) {
+	store := jisaStore(t, jisaChild(nil), 880000)
+
+	allocService := NewAllocationService(store, Options{})
+
+	receipt := models.Receipt{}
+	receipt.ID = 1
+	receipt.CreatedAt = time.Date(2025, time.May, 1, 9, 0, 0, 0, time.UTC)
+	deposit := models.Deposit{ClientID: 2}
+	account, _ := store.Accounts().Get(1)
+
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(50000), overflowAmounts)
+
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Empty(t, overflowAmounts, "nothing should overflow out of a JISA")
+}
+
+func TestJisaAgeOnTheValueDate(t *testing.T) {
+	dob := time.Date(2007, time.April, 6, 0, 0, 0, 0, time.UTC) // 18 on the first day of 2025/26
+	store := jisaStore(t, jisaChild(&dob), 0)
+
+	allocService := NewAllocationService(store, Options{})
+	deposit := models.Deposit{ClientID: 2}
+	account, _ := store.Accounts().Get(1)
+
+	// received while the child was 17, though keyed in after they turned 18
+	_, err := allocService.allocateToAccount(store, keyedInAfterYearEnd(), &deposit, account, decimal.NewFromInt(50000), make(overflows))
+
+	assert.NoError(t, err)
+	saved := savedAllocations(t, store, 1)
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, models.TaxYear(2024), saved[0].TaxYear)
+	}
+}
+
+func TestJisaEligibility(t *testing.T) {
+	receivedAt := time.Date(2025, time.May, 1, 9, 0, 0, 0, time.UTC)
+
+	adult := models.Client{Name: "Adult", DateOfBirth: dateOfBirth(1990)}
+	adult.ID = 5
+
+	tests := []struct {
+		name      string
+		child     models.Client
+		depositor uint
+	}{
+		{name: "NoRegisteredContact", child: adult, depositor: 5},
+		{name: "DepositorIsNotTheContact", child: jisaChild(nil), depositor: 3},
+		{name: "ChildHasTurnedEighteen", child: jisaChild(dateOfBirth(2006)), depositor: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := jisaStore(t, tt.child, 0)
+
+			allocService := NewAllocationService(store, Options{})
+
+			receipt := models.Receipt{}
+			receipt.CreatedAt = receivedAt
+			deposit := models.Deposit{ClientID: tt.depositor}
+			account, _ := store.Accounts().Get(1)
+
+			_, err := allocService.allocateToAccount(store, &receipt, &deposit, account, decimal.NewFromInt(100), make(overflows))
+
+			assert.ErrorIs(t, err, ErrNotEligible)
+		})
+	}
+}
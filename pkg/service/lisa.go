@@ -0,0 +1,81 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// lisaBonusRate is the government bonus paid on Lifetime ISA contributions
+var lisaBonusRate = decimal.NewFromFloat(0.25)
+
+const (
+	lisaMinOpeningAge      = 18
+	lisaMaxOpeningAge      = 39
+	lisaLastContributionAt = 50 // no contributions from the client's 50th birthday
+)
+
+// lisaRule allocates Lifetime ISA subscriptions. They are capped by the LISA limit and also count
+// toward the overall ISA allowance, so whichever has the least headroom applies. Each allocation
+// records the government bonus expected on it.
+type lisaRule struct{}
+
+func (r *lisaRule) Wrapper() string {
+	return models.WrapperLISA
+}
+
+func (r *lisaRule) Overflow() string {
+	return models.WrapperGIA
+}
+
+func (r *lisaRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	client, err := tx.Clients().Get(req.Deposit.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := lisaEligible(client, req); err != nil {
+		return nil, err
+	}
+
+	lisaHeadroom, err := limitHeadroom(tx, req.Deposit.ClientID, req.TaxYear, models.WrapperLISA, models.WrapperLISA)
+	if err != nil {
+		return nil, err
+	}
+
+	isaHeadroom, err := limitHeadroom(tx, req.Deposit.ClientID, req.TaxYear, models.WrapperISA, isaWrappers...)
+	if err != nil {
+		return nil, err
+	}
+
+	headroom := decimal.Min(lisaHeadroom, isaHeadroom)
+	return &headroom, nil
+}
+
+func (r *lisaRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	allocation := models.Allocation{
+		Amount:    amount.IntPart(),
+		ReceiptID: req.Receipt.ID,
+		AccountID: req.Account.ID,
+		TaxYear:   req.TaxYear,
+		BonusClaim: &models.BonusClaim{
+			Amount: amount.Mul(lisaBonusRate).Floor().IntPart(),
+			Status: models.ClaimStatusPending,
+		},
+	}
+	return tx.Allocations().Create(&allocation)
+}
+
+// lisaEligible checks the account was opened between 18 and 39 and the client is under 50, returning
+// ErrNotEligible when not. Clients without a date of birth on record are assumed eligible.
+func lisaEligible(client *models.Client, req AllocationRequest) error {
+	if ageAtOpening, ok := client.AgeAt(req.Account.CreatedAt); ok && !req.Account.CreatedAt.IsZero() {
+		if ageAtOpening < lisaMinOpeningAge || ageAtOpening > lisaMaxOpeningAge {
+			return errors.Wrapf(ErrNotEligible, "client %d was %d when LISA account %d was opened", client.ID, ageAtOpening, req.Account.ID)
+		}
+	}
+	if age, ok := client.AgeAt(req.Receipt.ReceivedOn()); ok && age >= lisaLastContributionAt {
+		return errors.Wrapf(ErrNotEligible, "client %d is too old to pay into LISA account %d", client.ID, req.Account.ID)
+	}
+	return nil
+}
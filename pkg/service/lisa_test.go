@@ -0,0 +1,161 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func dateOfBirth(year int) *time.Time {
+	dob := time.Date(year, time.June, 1, 0, 0, 0, 0, time.UTC)
+	return &dob
+}
+
+func TestLisaAllocation(t *testing.T) {
+	receivedAt := time.Date(2025, time.May, 1, 9, 0, 0, 0, time.UTC)
+	openedAt := time.Date(2020, time.January, 1, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		allocated map[string]int64
+		dob       *time.Time
+		amount    int64
+		accepted  int64
+		bonus     int64
+		reason    string // why it overflowed, if it did
+	}{
+		{
+			name:     "UnderBothLimits",
+			amount:   100000,
+			accepted: 100000,
+			bonus:    25000,
+		},
+		{
+			name:      "LisaLimitApplies",
+			allocated: map[string]int64{models.WrapperLISA: 350000},
+			amount:    100000,
+			accepted:  50000,
+			bonus:     12500,
+		},
+		{
+			name:      "SharedIsaLimitApplies",
+			allocated: map[string]int64{models.WrapperISA: 1980000},
+			amount:    100000,
+			accepted:  20000,
+			bonus:     5000,
+		},
+		{
+			name:      "SharedIsaLimitUsed",
+			allocated: map[string]int64{models.WrapperISA: 1700000, models.WrapperLISA: 300000},
+			amount:    100000,
+			accepted:  0,
+		},
+		{
+			name:     "BonusRoundsDown",
+			amount:   333,
+			accepted: 333,
+			bonus:    83,
+		},
+		{
+			name:     "EligibleAge",
+			dob:      dateOfBirth(1990),
+			amount:   100000,
+			accepted: 100000,
+			bonus:    25000,
+		},
+		{
+			name:     "OpenedUnder18",
+			dob:      dateOfBirth(2005),
+			amount:   100000,
+			accepted: 0,
+			reason:   "client 2 was 14 when LISA account 3 was opened: client is not eligible for wrapper",
+		},
+		{
+			name:     "OpenedOver39",
+			dob:      dateOfBirth(1975),
+			amount:   100000,
+			accepted: 0,
+			reason:   "client 2 was 44 when LISA account 3 was opened: client is not eligible for wrapper",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &models.Client{Name: "Client", DateOfBirth: tt.dob}
+			client.ID = 2
+			records := []interface{}{
+				client,
+				testPot(1, 2),
+				testAccount(3, 1, models.WrapperLISA),
+				testAccount(4, 1, models.WrapperISA),
+				&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+				&models.WrapperLimit{Wrapper: models.WrapperLISA, EffectiveFrom: 2017, Amount: 400000},
+				seededReceipt(1),
+			}
+			for accountID, wrapper := range map[uint]string{3: models.WrapperLISA, 4: models.WrapperISA} {
+				if tt.allocated[wrapper] > 0 {
+					records = append(records, prior(accountID, tt.allocated[wrapper], 2025))
+				}
+			}
+			store := memoryStore(t, records...)
+
+			allocService := NewAllocationService(store, Options{})
+
+			receipt := models.Receipt{}
+			receipt.ID = 1
+			receipt.CreatedAt = receivedAt
+			deposit := models.Deposit{ClientID: 2}
+			account := models.Account{PotID: 1, Wrapper: models.WrapperLISA}
+			account.ID = 3
+			account.CreatedAt = openedAt
+
+			overflowAmounts := make(overflows)
+
+			planned, err := allocService.allocateToAccount(store, &receipt, &deposit, &account, decimal.NewFromInt(tt.amount), overflowAmounts)
+			assert.NoError(t, err)
+
+			saved := savedAllocations(t, store, 1)
+			if tt.accepted == 0 {
+				assert.Empty(t, saved)
+			} else {
+				assert.Len(t, saved, 1)
+				assert.Equal(t, int64(tt.accepted), saved[0].Amount)
+				assert.Equal(t, uint(3), saved[0].AccountID)
+				assert.Equal(t, tt.bonus, saved[0].BonusClaim.Amount)
+				assert.Equal(t, models.ClaimStatusPending, saved[0].BonusClaim.Status)
+			}
+
+			overflow := overflowAmounts[overflowKey{PotID: 1, Wrapper: models.WrapperGIA}]
+			assert.True(t, decimal.NewFromInt(tt.amount-tt.accepted).Equal(overflow), "expected %d to overflow got %s", tt.amount-tt.accepted, overflow)
+			if tt.reason != "" {
+				assert.Equal(t, tt.reason, planned.Reason)
+			}
+		})
+	}
+}
+
+func TestLisaEligibleUntilFifty(t *testing.T) {
+	account := &models.Account{}
+	account.CreatedAt = time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	client := &models.Client{DateOfBirth: dateOfBirth(1975)} // opened aged 38
+
+	dayBefore := &models.Receipt{}
+	dayBefore.CreatedAt = time.Date(2025, time.May, 31, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, lisaEligible(client, AllocationRequest{Account: account, Receipt: dayBefore}))
+
+	birthday := &models.Receipt{}
+	birthday.CreatedAt = time.Date(2025, time.June, 1, 12, 0, 0, 0, time.UTC)
+	assert.ErrorIs(t, lisaEligible(client, AllocationRequest{Account: account, Receipt: birthday}), ErrNotEligible)
+}
+
+func TestLisaEligibleOnTheValueDate(t *testing.T) {
+	account := &models.Account{}
+	account.CreatedAt = time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dob := time.Date(1975, time.April, 6, 0, 0, 0, 0, time.UTC) // 50 on the first day of 2025/26
+	client := &models.Client{DateOfBirth: &dob}
+
+	// received the day before their birthday, though keyed in after it
+	assert.NoError(t, lisaEligible(client, AllocationRequest{Account: account, Receipt: keyedInAfterYearEnd()}))
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+)
+
+// ReceiptBalance is what was allocated from a receipt against what should have been
+type ReceiptBalance struct {
+	ReceiptID       uint   `json:"receipt_id"`
+	DepositID       uint   `json:"deposit_id"`
+	Amount          int64  `json:"amount"`
+	FundingDecision string `json:"funding_decision"`
+	SuspenseAmount  int64  `json:"suspense_amount"`
+	Reversed        int64  `json:"reversed"`
+	Allocated       int64  `json:"allocated"` // net of the compensating allocations made by reversals
+}
+
+// Expected is what should be allocated from the receipt: nothing once it was rejected, otherwise
+// its amount less anything held in suspense or reversed
+func (b ReceiptBalance) Expected() int64 {
+	if b.FundingDecision == models.FundingRejected {
+		return 0
+	}
+	return b.Amount - b.SuspenseAmount - b.Reversed
+}
+
+// Difference is how much more was allocated from the receipt than expected, negative when less was
+func (b ReceiptBalance) Difference() int64 {
+	return b.Allocated - b.Expected()
+}
+
+// Reconciliation checks that every receipt's allocations add up to what was received
+type Reconciliation struct {
+	Receipts      int              `json:"receipts"` // how many receipts were checked
+	Discrepancies []ReceiptBalance `json:"discrepancies"`
+}
+
+// Reconciled is whether every receipt's allocations added up
+func (r *Reconciliation) Reconciled() bool {
+	return len(r.Discrepancies) == 0
+}
+
+// Reconcile checks the allocations of every receipt against its amount, suspense and reversals
+func Reconcile(repos repository.Repositories) (*Reconciliation, error) {
+	balances, err := repos.Receipts().Balances()
+	if err != nil {
+		return nil, err
+	}
+
+	reconciliation := &Reconciliation{Receipts: len(balances), Discrepancies: make([]ReceiptBalance, 0)}
+	for _, row := range balances {
+		if balance := ReceiptBalance(row); balance.Difference() != 0 {
+			reconciliation.Discrepancies = append(reconciliation.Discrepancies, balance)
+		}
+	}
+	return reconciliation, nil
+}
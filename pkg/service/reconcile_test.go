@@ -0,0 +1,51 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// decidedReceipt is a receipt to seed with the funding decision made on it
+func decidedReceipt(id uint, depositID uint, amount uint, decision string, suspense int64) *models.Receipt {
+	receipt := &models.Receipt{DepositID: depositID, Amount: amount, FundingDecision: decision, SuspenseAmount: suspense}
+	receipt.ID = id
+	return receipt
+}
+
+func TestReconcile(t *testing.T) {
+	store := memoryStore(t,
+		decidedReceipt(1, 1, 100000, models.FundingAccepted, 0),
+		decidedReceipt(2, 1, 50000, models.FundingSuspense, 20000),
+		decidedReceipt(3, 2, 70000, models.FundingRejected, 0),
+		decidedReceipt(4, 2, 30000, models.FundingAccepted, 0),
+		decidedReceipt(5, 3, 10000, models.FundingRejected, 0),
+		&models.Allocation{ReceiptID: 1, AccountID: 1, Amount: 100000},
+		&models.Allocation{ReceiptID: 2, AccountID: 1, Amount: 20000},
+		&models.Allocation{ReceiptID: 4, AccountID: 1, Amount: 29999},
+		&models.Allocation{ReceiptID: 5, AccountID: 1, Amount: 10000},
+	)
+	assert.NoError(t, store.Receipts().CreateReversal(&models.Reversal{ReceiptID: 2, Amount: 10000}))
+
+	reconciliation, err := Reconcile(store)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 5, reconciliation.Receipts)
+	assert.False(t, reconciliation.Reconciled())
+	if assert.Len(t, reconciliation.Discrepancies, 2) {
+		assert.Equal(t, uint(4), reconciliation.Discrepancies[0].ReceiptID)
+		assert.Equal(t, int64(-1), reconciliation.Discrepancies[0].Difference())
+		// nothing should be allocated from a rejected receipt
+		assert.Equal(t, uint(5), reconciliation.Discrepancies[1].ReceiptID)
+		assert.Equal(t, int64(10000), reconciliation.Discrepancies[1].Difference())
+	}
+}
+
+func TestReconcileNothingReceived(t *testing.T) {
+	reconciliation, err := Reconcile(repository.NewMemory())
+
+	assert.NoError(t, err)
+	assert.True(t, reconciliation.Reconciled())
+	assert.Empty(t, reconciliation.Discrepancies)
+}
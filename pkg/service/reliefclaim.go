@@ -0,0 +1,142 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"encoding/csv"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ErrClaimPeriodOpen is returned when asked for the claim of a month that has not finished yet
+var ErrClaimPeriodOpen = errors.New("claim period has not ended")
+
+// ReliefClaimLine totals one client's relief at source claimed in a period
+type ReliefClaimLine struct {
+	ClientID      uint   `json:"client_id,omitempty"`
+	ClientName    string `json:"client_name,omitempty"`
+	Contributions int    `json:"contributions"`
+	NetAmount     int64  `json:"net_amount"` // what the client paid, from their SIPP allocations
+	ReliefAmount  int64  `json:"relief_amount"`
+	GrossAmount   int64  `json:"gross_amount"`
+}
+
+// Reconciled is whether the client's net contributions and the relief claimed add up to the gross
+func (l ReliefClaimLine) Reconciled() bool {
+	return l.NetAmount+l.ReliefAmount == l.GrossAmount
+}
+
+// ReliefClaimFile is the monthly relief at source interim claim made to HMRC
+type ReliefClaimFile struct {
+	Period       string            `json:"period"`
+	Lines        []ReliefClaimLine `json:"lines"`
+	NewlyClaimed int64             `json:"newly_claimed"` // relief claims marked as claimed by this run, 0 when the claim is regenerated
+}
+
+// GenerateReliefClaim claims every pending SIPP relief claim on contributions received up to the end
+// of the month, including any missed by earlier claims, and returns the month's claim. Once a month has
+// been claimed, running it again returns the same claim and leaves later contributions to the next one.
+// The claim is written by write before it is committed, so nothing is marked claimed unless it is written.
+func GenerateReliefClaim(store repository.Store, month string, now time.Time, write func(file *ReliefClaimFile) error) (*ReliefClaimFile, error) {
+	_, end, err := models.ParseMonth(month)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid claim month %q", month)
+	}
+	if now.Before(end) {
+		return nil, errors.Wrapf(ErrClaimPeriodOpen, "%s", month)
+	}
+
+	file := &ReliefClaimFile{Period: month}
+
+	err = store.Transaction(func(tx repository.Repositories) error {
+		alreadyClaimed, err := tx.ReliefClaims().CountInPeriod(month)
+		if err != nil {
+			return err
+		}
+
+		if alreadyClaimed == 0 {
+			file.NewlyClaimed, err = tx.ReliefClaims().Claim(month, end, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		totals, err := tx.ReliefClaims().Totals(month)
+		if err != nil {
+			return err
+		}
+		for _, total := range totals {
+			file.Lines = append(file.Lines, ReliefClaimLine(total))
+		}
+		return errors.Wrap(write(file), "writing the relief claim")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Totals adds up every client's line
+func (f *ReliefClaimFile) Totals() ReliefClaimLine {
+	var totals ReliefClaimLine
+	for _, line := range f.Lines {
+		totals.Contributions += line.Contributions
+		totals.NetAmount += line.NetAmount
+		totals.ReliefAmount += line.ReliefAmount
+		totals.GrossAmount += line.GrossAmount
+	}
+	return totals
+}
+
+// Unreconciled lists the clients whose net contributions and relief do not add up to the gross
+func (f *ReliefClaimFile) Unreconciled() []ReliefClaimLine {
+	var lines []ReliefClaimLine
+	for _, line := range f.Lines {
+		if !line.Reconciled() {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// WriteCSV writes the claim as a "detail" row per client followed by a "total" row and the
+// "summary" rows ops reconcile against before uploading it. Amounts are in pounds.
+func (f *ReliefClaimFile) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+
+	totals := f.Totals()
+
+	rows := [][]string{{"record", "client_id", "client_name", "contributions", "net_amount", "relief_amount", "gross_amount"}}
+	for _, line := range f.Lines {
+		rows = append(rows, []string{
+			"detail",
+			strconv.FormatUint(uint64(line.ClientID), 10),
+			line.ClientName,
+			strconv.Itoa(line.Contributions),
+			pounds(line.NetAmount),
+			pounds(line.ReliefAmount),
+			pounds(line.GrossAmount),
+		})
+	}
+	rows = append(rows,
+		[]string{"total", "", "", strconv.Itoa(totals.Contributions), pounds(totals.NetAmount), pounds(totals.ReliefAmount), pounds(totals.GrossAmount)},
+		[]string{"summary", "period", f.Period},
+		[]string{"summary", "clients", strconv.Itoa(len(f.Lines))},
+		[]string{"summary", "contributions", strconv.Itoa(totals.Contributions)},
+		[]string{"summary", "relief_claimed", pounds(totals.ReliefAmount)},
+		[]string{"summary", "unreconciled_clients", strconv.Itoa(len(f.Unreconciled()))},
+	)
+
+	if err := out.WriteAll(rows); err != nil {
+		return err
+	}
+	return out.Error()
+}
+
+func pounds(pennies int64) string {
+	return decimal.New(pennies, -2).StringFixed(2)
+}
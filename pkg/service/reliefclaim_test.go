@@ -0,0 +1,155 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// sippContribution is receipt id, which the bank received at receivedAt but which was keyed in and
+// allocated into the SIPP account at keyedIn, and its allocation's relief claim
+func sippContribution(id uint, accountID uint, net int64, status string, period string, receivedAt time.Time, keyedIn time.Time) []interface{} {
+	valueDate := receivedAt
+	receipt := &models.Receipt{DepositID: 1, Amount: uint(net), ValueDate: &valueDate}
+	receipt.ID = id
+	receipt.CreatedAt = keyedIn
+	claim := &models.ReliefClaim{GrossAmount: net * 5 / 4, ReliefAmount: net / 4, Status: status, ClaimPeriod: period}
+	claim.CreatedAt = keyedIn
+	return []interface{}{receipt, &models.Allocation{ReceiptID: id, AccountID: accountID, Amount: net, ReliefClaim: claim}}
+}
+
+// reliefClaimStore holds Jane's and John's SIPP contributions, two from Jane and one from John
+// received in September 2024, one from Jane received in October and one from John already claimed in
+// August. Jane's second September contribution wasn't keyed in until October.
+func reliefClaimStore(t *testing.T) *repository.Memory {
+	jane, john := &models.Client{Name: "Jane"}, &models.Client{Name: "John"}
+	jane.ID, john.ID = 1, 2
+
+	september := time.Date(2024, time.September, 10, 12, 0, 0, 0, time.UTC)
+	october := time.Date(2024, time.October, 1, 9, 0, 0, 0, time.UTC)
+	august := time.Date(2024, time.August, 5, 0, 0, 0, 0, time.UTC)
+	records := []interface{}{
+		jane, john,
+		testPot(1, 1), testPot(2, 2),
+		testAccount(1, 1, models.WrapperSIPP), testAccount(2, 2, models.WrapperSIPP),
+	}
+	records = append(records, sippContribution(1, 1, 1000, models.ClaimStatusPending, "", september, september)...)
+	records = append(records, sippContribution(2, 1, 1000, models.ClaimStatusPending, "", september.AddDate(0, 0, 20), october)...)
+	records = append(records, sippContribution(3, 2, 8000, models.ClaimStatusPending, "", september, september)...)
+	records = append(records, sippContribution(4, 1, 4000, models.ClaimStatusPending, "", october, october)...)
+	records = append(records, sippContribution(5, 2, 400, models.ClaimStatusClaimed, "2024-08", august, august)...)
+	return memoryStore(t, records...)
+}
+
+func noWrite(*ReliefClaimFile) error {
+	return nil
+}
+
+func TestGenerateReliefClaim(t *testing.T) {
+	store := reliefClaimStore(t)
+
+	now := time.Date(2024, time.October, 3, 9, 0, 0, 0, time.UTC)
+
+	claim, err := GenerateReliefClaim(store, "2024-09", now, noWrite)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), claim.NewlyClaimed)
+	assert.Equal(t, []ReliefClaimLine{
+		{ClientID: 1, ClientName: "Jane", Contributions: 2, NetAmount: 2000, ReliefAmount: 500, GrossAmount: 2500},
+		{ClientID: 2, ClientName: "John", Contributions: 1, NetAmount: 8000, ReliefAmount: 2000, GrossAmount: 10000},
+	}, claim.Lines)
+	assert.Equal(t, ReliefClaimLine{Contributions: 3, NetAmount: 10000, ReliefAmount: 2500, GrossAmount: 12500}, claim.Totals())
+	assert.Empty(t, claim.Unreconciled())
+
+	// October's contribution is left for October's claim
+	pending, err := store.ReliefClaims().List(models.ClaimStatusPending, time.Time{}, now)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, int64(1000), pending[0].ReliefAmount)
+	}
+	claimed, err := store.ReliefClaims().List(models.ClaimStatusClaimed, time.Time{}, now)
+	assert.NoError(t, err)
+	for _, claim := range claimed {
+		if claim.ClaimPeriod == "2024-09" {
+			assert.Equal(t, now, *claim.ClaimedAt)
+		}
+	}
+}
+
+func TestGenerateReliefClaimAgain(t *testing.T) {
+	store := reliefClaimStore(t)
+
+	first, err := GenerateReliefClaim(store, "2024-09", time.Date(2024, time.October, 3, 9, 0, 0, 0, time.UTC), noWrite)
+	assert.NoError(t, err)
+
+	// nothing new is claimed, the month's claim is read back as it was
+	claim, err := GenerateReliefClaim(store, "2024-09", time.Date(2024, time.November, 1, 0, 0, 0, 0, time.UTC), noWrite)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), claim.NewlyClaimed)
+	assert.Equal(t, first.Lines, claim.Lines)
+}
+
+func TestGenerateReliefClaimWriteFails(t *testing.T) {
+	store := reliefClaimStore(t)
+	now := time.Date(2024, time.October, 3, 9, 0, 0, 0, time.UTC)
+
+	_, err := GenerateReliefClaim(store, "2024-09", now, func(*ReliefClaimFile) error {
+		return errors.New("disk full")
+	})
+
+	assert.EqualError(t, err, "writing the relief claim: disk full")
+	// nothing is claimed without the file, so the next run claims it all
+	count, _ := store.ReliefClaims().CountInPeriod("2024-09")
+	assert.Zero(t, count)
+
+	var written *ReliefClaimFile
+	claim, err := GenerateReliefClaim(store, "2024-09", now, func(file *ReliefClaimFile) error {
+		written = file
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), claim.NewlyClaimed)
+	assert.Same(t, claim, written)
+}
+
+func TestGenerateReliefClaimMonthNotEnded(t *testing.T) {
+	store := reliefClaimStore(t)
+
+	_, err := GenerateReliefClaim(store, "2024-09", time.Date(2024, time.September, 30, 12, 0, 0, 0, time.UTC), noWrite)
+
+	assert.ErrorIs(t, err, ErrClaimPeriodOpen)
+	count, _ := store.ReliefClaims().CountInPeriod("2024-09")
+	assert.Zero(t, count)
+
+	_, err = GenerateReliefClaim(store, "September", time.Now(), noWrite)
+	assert.Error(t, err)
+}
+
+func TestReliefClaimFileWriteCSV(t *testing.T) {
+	claim := &ReliefClaimFile{
+		Period: "2024-09",
+		Lines: []ReliefClaimLine{
+			{ClientID: 1, ClientName: "Jane", Contributions: 2, NetAmount: 2000, ReliefAmount: 500, GrossAmount: 2500},
+			{ClientID: 2, ClientName: "Smith, John", Contributions: 1, NetAmount: 8000, ReliefAmount: 2000, GrossAmount: 10001},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, claim.WriteCSV(&buf))
+
+	expected := "record,client_id,client_name,contributions,net_amount,relief_amount,gross_amount\n" +
+		"detail,1,Jane,2,20.00,5.00,25.00\n" +
+		"detail,2,\"Smith, John\",1,80.00,20.00,100.01\n" +
+		"total,,,3,100.00,25.00,125.01\n" +
+		"summary,period,2024-09\n" +
+		"summary,clients,2\n" +
+		"summary,contributions,3\n" +
+		"summary,relief_claimed,25.00\n" +
+		"summary,unreconciled_clients,1\n"
+	assert.Equal(t, expected, buf.String())
+}
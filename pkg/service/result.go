@@ -0,0 +1,64 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/shopspring/decimal"
+)
+
+// AllocationResult is where the money from a receipt went, or would go for a preview
+type AllocationResult struct {
+	ReceiptID       uint                `json:"receipt_id,omitempty"` // not set for a preview, nothing is recorded
+	Amount          uint                `json:"amount"`
+	FundingDecision string              `json:"funding_decision"`
+	ExcessAmount    int64               `json:"excess_amount"`
+	SuspenseAmount  int64               `json:"suspense_amount"`
+	NeedsReview     bool                `json:"needs_review"` // e.g. a possible duplicate of another receipt
+	ReviewReason    string              `json:"review_reason,omitempty"`
+	Allocations     []PlannedAllocation `json:"allocations"`
+}
+
+// PlannedAllocation is the part of a receipt paid into one account, in the order accounts were
+// paid. An account appears again when it also takes overflow from another account.
+type PlannedAllocation struct {
+	AccountID    uint   `json:"account_id,omitempty"` // not set for a preview of an account that would be opened
+	PotID        uint   `json:"pot_id"`
+	Wrapper      string `json:"wrapper"`
+	Amount       int64  `json:"amount"`        // pennies paid into the account, before any SIPP relief
+	FromOverflow bool   `json:"from_overflow"` // paid in as another account's overflow
+	NewAccount   bool   `json:"new_account"`   // the account was opened to take the overflow
+	Overflow     int64  `json:"overflow"`      // pennies the account couldn't take
+	OverflowTo   string `json:"overflow_to,omitempty"`
+	Reason       string `json:"reason,omitempty"` // why the account couldn't take all of it
+}
+
+func newAllocationResult(receipt *models.Receipt) *AllocationResult {
+	return &AllocationResult{
+		ReceiptID:       receipt.ID,
+		Amount:          receipt.Amount,
+		FundingDecision: receipt.FundingDecision,
+		ExcessAmount:    receipt.ExcessAmount,
+		SuspenseAmount:  receipt.SuspenseAmount,
+		NeedsReview:     receipt.NeedsReview,
+		ReviewReason:    receipt.ReviewReason,
+		Allocations:     make([]PlannedAllocation, 0),
+	}
+}
+
+func (p *PlannedAllocation) overflow(amount decimal.Decimal, to string, reason string) {
+	p.Overflow = amount.IntPart()
+	p.OverflowTo = to
+	p.Reason = reason
+}
+
+// forPreview clears the IDs of anything that was only recorded in the rolled back transaction
+func (r *AllocationResult) forPreview() {
+	if r == nil {
+		return
+	}
+	r.ReceiptID = 0
+	for i := range r.Allocations {
+		if r.Allocations[i].NewAccount {
+			r.Allocations[i].AccountID = 0
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// ErrReversalTooLarge is returned when a reversal asks for more than is still allocated from the receipt
+var ErrReversalTooLarge = errors.New("reversal exceeds the amount still allocated from the receipt")
+
+// DefaultReversalOrder takes money back out of the GIA before the tax wrappers
+var DefaultReversalOrder = [][]string{{models.WrapperGIA}}
+
+type Reverse interface {
+	// ReverseReceipt takes the amount back out of the receipt's allocations, or everything left
+	// allocated from it when amount is nil
+	ReverseReceipt(receiptID uint, amount *int64, reason string) (*models.Reversal, error)
+}
+
+func (c *AllocationService) ReverseReceipt(receiptID uint, amount *int64, reason string) (*models.Reversal, error) {
+	order := DefaultReversalOrder
+	if len(c.Options.ReversalOrder) > 0 {
+		order = c.Options.ReversalOrder
+	}
+
+	reversal := &models.Reversal{ReceiptID: receiptID, Reason: reason}
+
+	err := c.Store.Transaction(func(tx repository.Repositories) error {
+		// lock the receipt so concurrent reversals can't both take back the same money
+		receipt, err := tx.Receipts().Lock(receiptID)
+		if err != nil {
+			return err
+		}
+
+		allocations, err := tx.Allocations().ForReceipt(receipt.ID)
+		if err != nil {
+			return err
+		}
+
+		wrappers, err := accountWrappers(tx, allocations)
+		if err != nil {
+			return err
+		}
+
+		compensating, err := planReversal(allocations, wrappers, order, amount)
+		if err != nil {
+			return errors.Wrapf(err, "receipt %d", receipt.ID)
+		}
+
+		for _, allocation := range compensating {
+			reversal.Amount -= allocation.Amount
+		}
+		reversal.Allocations = compensating
+
+		return tx.Receipts().CreateReversal(reversal)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reversal, nil
+}
+
+// accountWrappers maps the allocations' account IDs to the accounts' wrappers
+func accountWrappers(tx repository.Repositories, allocations []models.Allocation) (map[uint]string, error) {
+	wrappers := make(map[uint]string)
+	if len(allocations) == 0 {
+		return wrappers, nil
+	}
+
+	ids := make([]uint, 0, len(allocations))
+	for _, allocation := range allocations {
+		ids = append(ids, allocation.AccountID)
+	}
+
+	accounts, err := tx.Accounts().Find(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		wrappers[account.ID] = account.Wrapper
+	}
+	return wrappers, nil
+}
+
+// planReversal works out the compensating allocations that take the amount back out of a receipt's
+// allocations, emptying one tier of wrappers before the next and in proportion to what is left of each
+// allocation within a tier. Allocations already reversed, in part or in full, are taken into account.
+func planReversal(allocations []models.Allocation, wrappers map[uint]string, order [][]string, amount *int64) ([]models.Allocation, error) {
+	reversed := make(map[uint]int64)
+	var originals []models.Allocation
+	for _, allocation := range allocations {
+		if allocation.ReversesID != nil {
+			reversed[*allocation.ReversesID] -= allocation.Amount
+			continue
+		}
+		originals = append(originals, allocation)
+	}
+
+	var left int64
+	for _, original := range originals {
+		left += original.Amount - reversed[original.ID]
+	}
+
+	toReverse := left
+	if amount != nil {
+		toReverse = *amount
+	}
+	if toReverse <= 0 || toReverse > left {
+		return nil, errors.Wrapf(ErrReversalTooLarge, "cannot reverse %d with %d left allocated", toReverse, left)
+	}
+
+	var compensating []models.Allocation
+	for _, tier := range reversalTiers(originals, wrappers, order) {
+		if toReverse == 0 {
+			break
+		}
+
+		remaining := make([]int64, len(tier))
+		var tierRemaining int64
+		for i, original := range tier {
+			remaining[i] = original.Amount - reversed[original.ID]
+			tierRemaining += remaining[i]
+		}
+		if tierRemaining <= 0 {
+			continue
+		}
+
+		take := toReverse
+		if take > tierRemaining {
+			take = tierRemaining
+		}
+
+		for i, share := range apportion(take, remaining) {
+			if share > 0 {
+				compensating = append(compensating, reverseAllocation(tier[i], reversed[tier[i].ID], share))
+			}
+		}
+		toReverse -= take
+	}
+
+	return compensating, nil
+}
+
+// reversalTiers groups the allocations by the tier of their account's wrapper, with wrappers that
+// aren't in the order in a final tier
+func reversalTiers(allocations []models.Allocation, wrappers map[uint]string, order [][]string) [][]models.Allocation {
+	tierOf := make(map[string]int)
+	for i, tier := range order {
+		for _, wrapper := range tier {
+			tierOf[wrapper] = i
+		}
+	}
+
+	tiers := make([][]models.Allocation, len(order)+1)
+	for _, allocation := range allocations {
+		tier, ok := tierOf[wrappers[allocation.AccountID]]
+		if !ok {
+			tier = len(order)
+		}
+		tiers[tier] = append(tiers[tier], allocation)
+	}
+	return tiers
+}
+
+// apportion splits the amount in proportion to what is left of each allocation, handing out the
+// pennies lost to rounding in order without taking more than is left of any allocation
+func apportion(amount int64, remaining []int64) []int64 {
+	var total int64
+	for _, r := range remaining {
+		total += r
+	}
+
+	shares := make([]int64, len(remaining))
+	var given int64
+	for i, r := range remaining {
+		shares[i] = proportion(amount, r, total)
+		given += shares[i]
+	}
+	for i := 0; given < amount; i = (i + 1) % len(shares) {
+		if shares[i] < remaining[i] {
+			shares[i]++
+			given++
+		}
+	}
+	return shares
+}
+
+// reverseAllocation makes the compensating allocation for the amount of the original, where before is
+// how much of it earlier reversals took back. Bonus and relief claims are reversed in proportion, and
+// allowance is restored starting with the tax year the original used last.
+func reverseAllocation(original models.Allocation, before int64, amount int64) models.Allocation {
+	after := before + amount
+	// the part of a total that belongs to the amount being reversed, which adds up to the whole total
+	// once the original is fully reversed
+	share := func(total int64) int64 {
+		return proportion(total, after, original.Amount) - proportion(total, before, original.Amount)
+	}
+
+	compensating := models.Allocation{
+		ReceiptID:  original.ReceiptID,
+		AccountID:  original.AccountID,
+		Amount:     -amount,
+		TaxYear:    original.TaxYear,
+		ReversesID: &original.ID,
+	}
+
+	if original.BonusClaim != nil {
+		compensating.BonusClaim = &models.BonusClaim{
+			Amount: -share(original.BonusClaim.Amount),
+			Status: models.ClaimStatusPending,
+		}
+	}
+
+	if original.ReliefClaim != nil {
+		relief := share(original.ReliefClaim.ReliefAmount)
+		compensating.ReliefClaim = &models.ReliefClaim{
+			GrossAmount:  -(amount + relief),
+			ReliefAmount: -relief,
+			Status:       models.ClaimStatusPending,
+		}
+	}
+
+	var used int64
+	for _, usage := range original.AllowanceUsed {
+		used += usage.Amount
+	}
+	from, to := proportion(used, before, original.Amount), proportion(used, after, original.Amount)
+
+	var position int64
+	for i := len(original.AllowanceUsed) - 1; i >= 0 && position < to; i-- {
+		usage := original.AllowanceUsed[i]
+		start, end := position, position+usage.Amount
+		position = end
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if end > start {
+			compensating.AllowanceUsed = append(compensating.AllowanceUsed, models.AllowanceUsage{
+				TaxYear: usage.TaxYear,
+				Amount:  -(end - start),
+			})
+		}
+	}
+
+	return compensating
+}
+
+// proportion is total * part / whole rounded down
+func proportion(total, part, whole int64) int64 {
+	if whole == 0 {
+		return 0
+	}
+	quotient, _ := decimal.NewFromInt(total).Mul(decimal.NewFromInt(part)).QuoRem(decimal.NewFromInt(whole), 0)
+	return quotient.IntPart()
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func allocation(id uint, accountID uint, amount int64) models.Allocation {
+	a := models.Allocation{ReceiptID: 1, AccountID: accountID, Amount: amount, TaxYear: 2024}
+	a.ID = id
+	return a
+}
+
+func amounts(allocations []models.Allocation) map[uint]int64 {
+	byAccount := make(map[uint]int64)
+	for _, a := range allocations {
+		byAccount[a.AccountID] += a.Amount
+	}
+	return byAccount
+}
+
+var reversalWrappers = map[uint]string{1: models.WrapperGIA, 2: models.WrapperISA, 3: models.WrapperSIPP, 4: models.WrapperLISA}
+
+func TestPlanReversalGiaFirst(t *testing.T) {
+	allocations := []models.Allocation{allocation(1, 1, 20000), allocation(2, 2, 60000), allocation(3, 3, 20000)}
+
+	amount := int64(50000)
+	compensating, err := planReversal(allocations, reversalWrappers, DefaultReversalOrder, &amount)
+
+	assert.NoError(t, err)
+	// the GIA is emptied, then the rest is taken from the tax wrappers in proportion
+	assert.Equal(t, map[uint]int64{1: -20000, 2: -22500, 3: -7500}, amounts(compensating))
+	for _, c := range compensating {
+		assert.Equal(t, models.TaxYear(2024), c.TaxYear)
+		assert.NotNil(t, c.ReversesID)
+	}
+}
+
+func TestPlanReversalConfiguredOrder(t *testing.T) {
+	allocations := []models.Allocation{allocation(1, 1, 20000), allocation(2, 2, 60000), allocation(3, 3, 20000)}
+
+	amount := int64(50000)
+	order := [][]string{{models.WrapperGIA, models.WrapperISA, models.WrapperSIPP}}
+	compensating, err := planReversal(allocations, reversalWrappers, order, &amount)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]int64{1: -10000, 2: -30000, 3: -10000}, amounts(compensating))
+}
+
+func TestPlanReversalRoundingPennies(t *testing.T) {
+	allocations := []models.Allocation{allocation(1, 2, 1), allocation(2, 3, 1), allocation(3, 4, 1)}
+
+	amount := int64(2)
+	compensating, err := planReversal(allocations, reversalWrappers, DefaultReversalOrder, &amount)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]int64{2: -1, 3: -1}, amounts(compensating))
+}
+
+func TestPlanReversalFullAfterPartial(t *testing.T) {
+	allocations := []models.Allocation{allocation(1, 1, 20000), allocation(2, 2, 60000)}
+
+	amount := int64(30000)
+	first, err := planReversal(allocations, reversalWrappers, DefaultReversalOrder, &amount)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]int64{1: -20000, 2: -10000}, amounts(first))
+
+	// the rest of the receipt, taking the first reversal into account
+	rest, err := planReversal(append(allocations, first...), reversalWrappers, DefaultReversalOrder, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint]int64{2: -50000}, amounts(rest))
+
+	// and nothing is left to reverse
+	_, err = planReversal(append(append(allocations, first...), rest...), reversalWrappers, DefaultReversalOrder, nil)
+	assert.ErrorIs(t, err, ErrReversalTooLarge)
+}
+
+func TestPlanReversalTooLarge(t *testing.T) {
+	allocations := []models.Allocation{allocation(1, 1, 20000)}
+
+	amount := int64(20001)
+	_, err := planReversal(allocations, reversalWrappers, DefaultReversalOrder, &amount)
+
+	assert.ErrorIs(t, err, ErrReversalTooLarge)
+}
+
+func TestReverseAllocationSipp(t *testing.T) {
+	// £1,000 net with £250 relief, using the last of 2024's allowance and then 2021's
+	original := allocation(1, 3, 100000)
+	original.ReliefClaim = &models.ReliefClaim{GrossAmount: 125000, ReliefAmount: 25000, Status: models.ClaimStatusClaimed}
+	original.AllowanceUsed = []models.AllowanceUsage{{TaxYear: 2024, Amount: 100000}, {TaxYear: 2021, Amount: 25000}}
+
+	first := reverseAllocation(original, 0, 33333)
+
+	assert.Equal(t, int64(-33333), first.Amount)
+	assert.Equal(t, &models.ReliefClaim{GrossAmount: -41666, ReliefAmount: -8333, Status: models.ClaimStatusPending}, first.ReliefClaim)
+	// the carried forward year is given back first
+	assert.Equal(t, []models.AllowanceUsage{{TaxYear: 2021, Amount: -25000}, {TaxYear: 2024, Amount: -16666}}, first.AllowanceUsed)
+
+	rest := reverseAllocation(original, 33333, 66667)
+
+	assert.Equal(t, &models.ReliefClaim{GrossAmount: -83334, ReliefAmount: -16667, Status: models.ClaimStatusPending}, rest.ReliefClaim)
+	assert.Equal(t, []models.AllowanceUsage{{TaxYear: 2024, Amount: -83334}}, rest.AllowanceUsed)
+}
+
+func TestReverseAllocationLisa(t *testing.T) {
+	original := allocation(1, 4, 10001)
+	original.BonusClaim = &models.BonusClaim{Amount: 2500, Status: models.ClaimStatusPending}
+
+	first := reverseAllocation(original, 0, 5000)
+	rest := reverseAllocation(original, 5000, 5001)
+
+	assert.Equal(t, int64(-1249), first.BonusClaim.Amount)
+	assert.Equal(t, int64(-1251), rest.BonusClaim.Amount)
+	assert.Equal(t, uint(1), *rest.ReversesID)
+}
+
+func TestReverseReceiptInMemory(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(store, Options{})
+
+	result, err := service.AllocateReceipt(memoryReceipt(100000), deposit)
+	assert.NoError(t, err)
+
+	partial := int64(30000)
+	reversal, err := service.ReverseReceipt(result.ReceiptID, &partial, "bank recall")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30000), reversal.Amount)
+
+	received, _ := store.Deposits().Received(deposit.ID)
+	assert.Equal(t, int64(70000), received)
+
+	// the rest comes back out, after which there is nothing left to reverse
+	_, err = service.ReverseReceipt(result.ReceiptID, nil, "bank recall")
+	assert.NoError(t, err)
+
+	allocated, _ := store.Allocations().Allocated(models.WrapperSIPP, 2, 2024)
+	assert.Zero(t, allocated)
+	used, _ := store.Allocations().AllowanceUsed(models.WrapperSIPP, 2, 2024)
+	assert.Zero(t, used, "the SIPP allowance is restored")
+
+	_, err = service.ReverseReceipt(result.ReceiptID, nil, "bank recall")
+	assert.ErrorIs(t, err, ErrReversalTooLarge)
+
+	_, err = service.ReverseReceipt(99, nil, "bank recall")
+	assert.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+func TestReceiptAfterReversalSplitsAfresh(t *testing.T) {
+	store, deposit := memoryDeposit(t, 0)
+	service := NewAllocationService(store, Options{})
+
+	// an odd amount, so the first receipt's split leaves a penny over
+	first, err := service.AllocateReceipt(memoryReceipt(33301), deposit)
+	assert.NoError(t, err)
+	_, err = service.ReverseReceipt(first.ReceiptID, nil, "bank recall")
+	assert.NoError(t, err)
+
+	// the reversed money was never received, so the whole deposit is split evenly
+	replacement, err := service.AllocateReceipt(memoryReceipt(100000), deposit)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FundingAccepted, replacement.FundingDecision)
+	assert.Len(t, replacement.Allocations, 2)
+	assert.Equal(t, int64(50000), replacement.Allocations[0].Amount)
+	assert.Equal(t, int64(50000), replacement.Allocations[1].Amount)
+
+	sipp, _ := store.Allocations().Allocated(models.WrapperSIPP, 2, 2024)
+	isa, _ := store.Allocations().Allocated(models.WrapperISA, 2, 2024)
+	assert.Equal(t, int64(50000), sipp)
+	assert.Equal(t, int64(50000), isa)
+}
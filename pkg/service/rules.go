@@ -0,0 +1,168 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/shopspring/decimal"
+	"sort"
+	"sync"
+)
+
+// AllocationRequest is everything a WrapperRule needs to know about the money being allocated
+type AllocationRequest struct {
+	Receipt *models.Receipt
+	Deposit *models.Deposit
+	Account *models.Account
+	TaxYear models.TaxYear
+}
+
+// WrapperRule describes how money paid into one account wrapper is allocated.
+type WrapperRule interface {
+	// Wrapper is the models.Account wrapper the rule applies to, e.g. "ISA"
+	Wrapper() string
+	// Overflow is the wrapper in the same pot that receives anything over the limit,
+	// or "" when the excess must be rejected
+	Overflow() string
+	// Headroom is how much more the client may pay into the wrapper, or nil when it has no limit
+	Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error)
+	// Allocate records the part of the request the wrapper has accepted
+	Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error
+}
+
+// RuleRegistry holds the wrapper rules AllocateReceipt allocates with, keyed by wrapper.
+type RuleRegistry struct {
+	mu    sync.RWMutex
+	rules map[string]WrapperRule
+}
+
+func NewRuleRegistry(rules ...WrapperRule) *RuleRegistry {
+	registry := &RuleRegistry{rules: make(map[string]WrapperRule)}
+	for _, rule := range rules {
+		registry.Register(rule)
+	}
+	return registry
+}
+
+// isaWrappers are the wrappers whose subscriptions count toward the overall ISA allowance
+var isaWrappers = []string{models.WrapperISA, models.WrapperLISA}
+
+// DefaultRules returns a registry with the SIPP, ISA, LISA, JISA and GIA rules
+func DefaultRules() *RuleRegistry {
+	return NewRuleRegistry(
+		&sippRule{},
+		&yearlyLimitRule{wrapper: models.WrapperISA, overflow: models.WrapperGIA, counts: isaWrappers},
+		&lisaRule{},
+		&jisaRule{},
+		&unlimitedRule{wrapper: models.WrapperGIA},
+	)
+}
+
+// Register adds the rule, replacing any rule already registered for its wrapper
+func (r *RuleRegistry) Register(rule WrapperRule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules[rule.Wrapper()] = rule
+}
+
+func (r *RuleRegistry) Lookup(wrapper string) (WrapperRule, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rule, ok := r.rules[wrapper]
+	return rule, ok
+}
+
+// Wrappers lists the registered wrappers in alphabetical order
+func (r *RuleRegistry) Wrappers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	wrappers := make([]string, 0, len(r.rules))
+	for wrapper := range r.rules {
+		wrappers = append(wrappers, wrapper)
+	}
+	sort.Strings(wrappers)
+	return wrappers
+}
+
+// yearlyLimitRule caps what a client can pay into the wrapper each tax year at the
+// wrapper limit in force for that year.
+type yearlyLimitRule struct {
+	wrapper  string
+	overflow string
+	counts   []string // wrappers whose subscriptions use up the limit, just the wrapper itself when empty
+}
+
+func (r *yearlyLimitRule) Wrapper() string {
+	return r.wrapper
+}
+
+func (r *yearlyLimitRule) Overflow() string {
+	return r.overflow
+}
+
+func (r *yearlyLimitRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	counts := r.counts
+	if len(counts) == 0 {
+		counts = []string{r.wrapper}
+	}
+
+	headroom, err := limitHeadroom(tx, req.Deposit.ClientID, req.TaxYear, r.wrapper, counts...)
+	if err != nil {
+		return nil, err
+	}
+	return &headroom, nil
+}
+
+func (r *yearlyLimitRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	return saveAccepted(tx, req, amount)
+}
+
+// unlimitedRule accepts everything paid into the wrapper.
+type unlimitedRule struct {
+	wrapper string
+}
+
+func (r *unlimitedRule) Wrapper() string {
+	return r.wrapper
+}
+
+func (r *unlimitedRule) Overflow() string {
+	return ""
+}
+
+func (r *unlimitedRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	return nil, nil
+}
+
+func (r *unlimitedRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	return saveAccepted(tx, req, amount)
+}
+
+// limitHeadroom is the limit in force for the wrapper less the client's subscriptions in the tax year
+// to the wrappers that count toward it
+func limitHeadroom(tx repository.Repositories, clientID uint, taxYear models.TaxYear, wrapper string, counts ...string) (decimal.Decimal, error) {
+	limit, err := getLimit(tx, wrapper, taxYear)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	var currentAmountAllocated int64
+	for _, counted := range counts {
+		allocated, err := tx.Allocations().Allocated(counted, clientID, taxYear)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		currentAmountAllocated += allocated
+	}
+
+	return decimal.NewFromInt(limit - currentAmountAllocated), nil
+}
+
+func saveAccepted(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	allocation := models.Allocation{
+		Amount:    amount.IntPart(),
+		ReceiptID: req.Receipt.ID,
+		AccountID: req.Account.ID,
+		TaxYear:   req.TaxYear,
+	}
+	return tx.Allocations().Create(&allocation)
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDefaultRules(t *testing.T) {
+	rules := DefaultRules()
+
+	assert.Equal(t, []string{models.WrapperGIA, models.WrapperISA, models.WrapperJISA, models.WrapperLISA, models.WrapperSIPP}, rules.Wrappers())
+
+	for _, wrapper := range []string{models.WrapperISA, models.WrapperLISA, models.WrapperSIPP} {
+		rule, ok := rules.Lookup(wrapper)
+		assert.True(t, ok)
+		assert.Equal(t, models.WrapperGIA, rule.Overflow(), "%s should overflow into the GIA", wrapper)
+	}
+
+	jisa, ok := rules.Lookup(models.WrapperJISA)
+	assert.True(t, ok)
+	assert.Empty(t, jisa.Overflow(), "JISA excess should be rejected")
+
+	gia, ok := rules.Lookup(models.WrapperGIA)
+	assert.True(t, ok)
+	headroom, err := gia.Headroom(nil, AllocationRequest{})
+	assert.NoError(t, err)
+	assert.Nil(t, headroom, "GIA should have no limit")
+}
+
+func TestRuleRegistryRegister(t *testing.T) {
+	rules := DefaultRules()
+
+	_, ok := rules.Lookup("NEW")
+	assert.False(t, ok)
+
+	newRule := &MockRule{wrapper: "NEW", overflow: models.WrapperGIA}
+	rules.Register(newRule)
+
+	rule, ok := rules.Lookup("NEW")
+	assert.True(t, ok)
+	assert.Same(t, newRule, rule)
+
+	// registering again replaces the rule
+	replacement := &MockRule{wrapper: "NEW", overflow: models.WrapperISA}
+	rules.Register(replacement)
+
+	rule, _ = rules.Lookup("NEW")
+	assert.Same(t, replacement, rule)
+}
+
+func TestYearlyLimitRuleHeadroom(t *testing.T) {
+	rule := &yearlyLimitRule{wrapper: models.WrapperISA, overflow: models.WrapperGIA}
+
+	store := memoryStore(t, clientPot(models.WrapperISA,
+		&models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000},
+		prior(1, 1500000, 2024))...)
+
+	req := AllocationRequest{Deposit: &models.Deposit{ClientID: 2}, TaxYear: 2024}
+
+	headroom, err := rule.Headroom(store, req)
+
+	assert.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(500000).Equal(*headroom), "expected headroom of 500000 got %s", headroom)
+}
+
+func TestAllocateToAccountUnknownWrapper(t *testing.T) {
+	allocService := NewAllocationService(nil, Options{})
+	allocService.Rules = mockRules()
+
+	receipt := models.Receipt{}
+	deposit := models.Deposit{}
+	account := models.Account{PotID: 4, Wrapper: "UNKNOWN"}
+
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(nil, &receipt, &deposit, &account, decimal.NewFromInt(100), overflowAmounts)
+
+	assert.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(100).Equal(overflowAmounts[overflowKey{PotID: 4, Wrapper: models.WrapperGIA}]))
+}
+
+func TestAllocateToAccountWithoutOverflow(t *testing.T) {
+	headroom := decimal.NewFromInt(60)
+	capped := &MockRule{wrapper: "CAPPED", headroom: &headroom}
+
+	allocService := NewAllocationService(nil, Options{})
+	allocService.Rules = NewRuleRegistry(capped)
+
+	receipt := models.Receipt{}
+	deposit := models.Deposit{}
+	account := models.Account{PotID: 4, Wrapper: "CAPPED"}
+
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(nil, &receipt, &deposit, &account, decimal.NewFromInt(100), overflowAmounts)
+
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Empty(t, overflowAmounts)
+}
+
+func TestAllocateToAccountClosed(t *testing.T) {
+	allocService := NewAllocationService(nil, Options{})
+	allocService.Rules = mockRules()
+
+	closedAt := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+	receipt := models.Receipt{}
+	deposit := models.Deposit{}
+	account := models.Account{PotID: 4, Wrapper: models.WrapperGIA, ClosedAt: &closedAt}
+
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(nil, &receipt, &deposit, &account, decimal.NewFromInt(100), overflowAmounts)
+
+	assert.ErrorIs(t, err, ErrAccountClosed)
+	assert.Empty(t, overflowAmounts)
+}
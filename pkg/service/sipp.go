@@ -0,0 +1,158 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// sippCarryForwardYears is how many previous tax years' unused annual allowance can be carried forward
+const sippCarryForwardYears = 3
+
+// reliefAtSourceRate is the basic rate relief claimed from HMRC as a share of the net contribution,
+// 20% of the gross contribution being 25% of the net
+var reliefAtSourceRate = decimal.NewFromFloat(0.25)
+
+// netOfRelief is the share of a gross contribution the client pays themselves
+var netOfRelief = decimal.NewFromFloat(0.8)
+
+// sippRule allocates SIPP contributions against the client's annual allowance, which is reduced
+// by any tapered allowance for the year and capped at the MPAA once that has been triggered.
+// Unused allowance from the previous three tax years is carried forward, except under the MPAA,
+// and each allocation records which years it used. Contributions are paid net of basic rate
+// relief, so each allocation has a relief claim and the allowance is tested on the gross amount.
+type sippRule struct{}
+
+// yearAllowance is the allowance left to use from a single tax year
+type yearAllowance struct {
+	TaxYear   models.TaxYear
+	Available decimal.Decimal
+}
+
+func (r *sippRule) Wrapper() string {
+	return models.WrapperSIPP
+}
+
+func (r *sippRule) Overflow() string {
+	return models.WrapperGIA
+}
+
+func (r *sippRule) Headroom(tx repository.Repositories, req AllocationRequest) (*decimal.Decimal, error) {
+	available, err := r.availableAllowance(tx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	gross := decimal.Zero
+	for _, year := range available {
+		gross = gross.Add(year.Available)
+	}
+
+	headroom := gross.Mul(netOfRelief).Floor()
+	return &headroom, nil
+}
+
+func (r *sippRule) Allocate(tx repository.Repositories, req AllocationRequest, amount decimal.Decimal) error {
+	available, err := r.availableAllowance(tx, req)
+	if err != nil {
+		return err
+	}
+
+	relief := amount.Mul(reliefAtSourceRate).Floor()
+	gross := amount.Add(relief)
+
+	allocation := models.Allocation{
+		Amount:    amount.IntPart(),
+		ReceiptID: req.Receipt.ID,
+		AccountID: req.Account.ID,
+		TaxYear:   req.TaxYear,
+		ReliefClaim: &models.ReliefClaim{
+			GrossAmount:  gross.IntPart(),
+			ReliefAmount: relief.IntPart(),
+			Status:       models.ClaimStatusPending,
+		},
+	}
+
+	remaining := gross
+	for _, year := range available {
+		if !remaining.IsPositive() {
+			break
+		}
+		used := decimal.Min(remaining, year.Available)
+		allocation.AllowanceUsed = append(allocation.AllowanceUsed, models.AllowanceUsage{
+			TaxYear: year.TaxYear,
+			Amount:  used.IntPart(),
+		})
+		remaining = remaining.Sub(used)
+	}
+	if remaining.IsPositive() {
+		return errors.Wrapf(ErrLimitExceeded, "SIPP account %d has no allowance left for %s", req.Account.ID, remaining)
+	}
+
+	return tx.Allocations().Create(&allocation)
+}
+
+// availableAllowance lists the unused gross allowance in the order it is used up: the current tax year
+// first and then the oldest carried-forward year. Allowance is only carried forward from years
+// the SIPP was open in.
+func (r *sippRule) availableAllowance(tx repository.Repositories, req AllocationRequest) ([]yearAllowance, error) {
+	client, err := tx.Clients().Get(req.Deposit.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	mpaa := client.MpaaAppliesAt(req.Receipt.ReceivedOn())
+
+	years := []models.TaxYear{req.TaxYear}
+	for year := req.TaxYear - sippCarryForwardYears; year < req.TaxYear && !mpaa; year++ {
+		if !req.Account.CreatedAt.IsZero() && !req.Account.CreatedAt.Before(year.End()) {
+			continue
+		}
+		years = append(years, year)
+	}
+
+	var available []yearAllowance
+	for _, year := range years {
+		limit, err := annualAllowance(tx, client, year)
+		if errors.Is(err, ErrNoLimit) && year != req.TaxYear {
+			continue // nothing to carry forward from before limits were recorded
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if mpaa {
+			mpaaLimit, err := getLimit(tx, models.LimitMPAA, year)
+			if err != nil {
+				return nil, err
+			}
+			if mpaaLimit < limit {
+				limit = mpaaLimit
+			}
+		}
+
+		used, err := tx.Allocations().AllowanceUsed(models.WrapperSIPP, req.Deposit.ClientID, year)
+		if err != nil {
+			return nil, err
+		}
+
+		if unused := decimal.NewFromInt(limit - used); unused.IsPositive() {
+			available = append(available, yearAllowance{TaxYear: year, Available: unused})
+		}
+	}
+	return available, nil
+}
+
+// annualAllowance is the client's pension annual allowance for the tax year, which is the SIPP
+// limit unless they have a lower tapered allowance for the year
+func annualAllowance(tx repository.Repositories, client *models.Client, year models.TaxYear) (int64, error) {
+	limit, err := getLimit(tx, models.WrapperSIPP, year)
+	if err != nil {
+		return 0, err
+	}
+
+	if tapered, ok := client.TaperedAllowanceFor(year); ok && int64(tapered) < limit {
+		return int64(tapered), nil
+	}
+	return limit, nil
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// sippStore holds client 2 with pot 1 holding SIPP account 1, receipt 1, the SIPP limits and an MPAA of £10k
+// by tax year, and the allowance already used in each tax year
+func sippStore(t *testing.T, client models.Client, limits map[models.TaxYear]int64, used map[models.TaxYear]int64) *repository.Memory {
+	client.ID = 2
+	client.Name = "Client"
+	records := []interface{}{
+		&client,
+		testPot(1, 2),
+		testAccount(1, 1, models.WrapperSIPP),
+		&models.WrapperLimit{Wrapper: models.LimitMPAA, EffectiveFrom: 2016, Amount: 1000000},
+		seededReceipt(1),
+	}
+	for year, limit := range limits {
+		records = append(records, &models.WrapperLimit{Wrapper: models.WrapperSIPP, EffectiveFrom: year, Amount: uint(limit)})
+	}
+
+	var usages []models.AllowanceUsage
+	for year, amount := range used {
+		if amount > 0 {
+			usages = append(usages, models.AllowanceUsage{TaxYear: year, Amount: amount})
+		}
+	}
+	if len(usages) > 0 {
+		records = append(records, prior(1, 0, 2024, usages...))
+	}
+	return memoryStore(t, records...)
+}
+
+func TestSippCarryForward(t *testing.T) {
+	limits := map[models.TaxYear]int64{2021: 4000000, 2022: 4000000, 2023: 6000000, 2024: 6000000}
+
+	receivedAt := time.Date(2025, time.January, 10, 9, 0, 0, 0, time.UTC)
+	triggeredBefore := receivedAt.AddDate(0, -1, 0)
+	triggeredAfter := receivedAt.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name     string
+		limits   map[models.TaxYear]int64
+		used     map[models.TaxYear]int64
+		client   models.Client
+		openedAt time.Time
+		amount   int64
+		usage    []models.AllowanceUsage
+		overflow int64
+	}{
+		{
+			name:   "CurrentYearOnly",
+			amount: 1000000,
+			usage:  []models.AllowanceUsage{{TaxYear: 2024, Amount: 1250000}},
+		},
+		{
+			name:   "CurrentYearFirstThenOldest",
+			used:   map[models.TaxYear]int64{2024: 5900000, 2021: 3980000},
+			amount: 150000,
+			usage: []models.AllowanceUsage{
+				{TaxYear: 2024, Amount: 100000},
+				{TaxYear: 2021, Amount: 20000},
+				{TaxYear: 2022, Amount: 67500},
+			},
+		},
+		{
+			name:   "SkipsUsedYears",
+			used:   map[models.TaxYear]int64{2024: 6000000, 2021: 4000000, 2022: 4000000},
+			amount: 500000,
+			usage:  []models.AllowanceUsage{{TaxYear: 2023, Amount: 625000}},
+		},
+		{
+			name:     "OverAllCarryForward",
+			used:     map[models.TaxYear]int64{2024: 6000000, 2021: 4000000, 2022: 4000000, 2023: 5000000},
+			amount:   1500000,
+			usage:    []models.AllowanceUsage{{TaxYear: 2023, Amount: 1000000}},
+			overflow: 700000, // £10k gross is £8k net
+		},
+		{
+			name:     "OnlyYearsTheSippWasOpen",
+			used:     map[models.TaxYear]int64{2024: 6000000},
+			openedAt: time.Date(2023, time.May, 1, 0, 0, 0, 0, time.UTC),
+			amount:   7000000,
+			usage:    []models.AllowanceUsage{{TaxYear: 2023, Amount: 6000000}},
+			overflow: 2200000,
+		},
+		{
+			name:     "TaperedAllowance",
+			client:   models.Client{TaperedAllowances: []models.TaperedAllowance{{TaxYear: 2024, Amount: 1000000}}},
+			used:     map[models.TaxYear]int64{2024: 900000, 2021: 4000000, 2022: 4000000, 2023: 6000000},
+			amount:   500000,
+			usage:    []models.AllowanceUsage{{TaxYear: 2024, Amount: 100000}},
+			overflow: 420000,
+		},
+		{
+			name:   "TaperedAllowanceCarriedForward",
+			client: models.Client{TaperedAllowances: []models.TaperedAllowance{{TaxYear: 2022, Amount: 1000000}}},
+			used:   map[models.TaxYear]int64{2024: 6000000, 2021: 4000000, 2022: 0, 2023: 6000000},
+			amount: 2000000,
+			usage:  []models.AllowanceUsage{{TaxYear: 2022, Amount: 1000000}},
+			// tapered year only has £10k gross to carry forward
+			overflow: 1200000,
+		},
+		{
+			name:     "MpaaTriggered",
+			client:   models.Client{MpaaTriggeredAt: &triggeredBefore},
+			used:     map[models.TaxYear]int64{2024: 800000},
+			amount:   500000,
+			usage:    []models.AllowanceUsage{{TaxYear: 2024, Amount: 200000}},
+			overflow: 340000, // and no carry forward under the MPAA
+		},
+		{
+			name:   "MpaaTriggeredLater",
+			client: models.Client{MpaaTriggeredAt: &triggeredAfter},
+			used:   map[models.TaxYear]int64{2024: 800000},
+			amount: 500000,
+			usage:  []models.AllowanceUsage{{TaxYear: 2024, Amount: 625000}},
+		},
+		{
+			name:   "NoLimitRecordedForOlderYears",
+			limits: map[models.TaxYear]int64{2023: 6000000, 2024: 6000000},
+			used:   map[models.TaxYear]int64{2024: 6000000},
+			amount: 100000,
+			usage:  []models.AllowanceUsage{{TaxYear: 2023, Amount: 125000}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.limits == nil {
+				tt.limits = limits
+			}
+			store := sippStore(t, tt.client, tt.limits, tt.used)
+
+			allocService := NewAllocationService(store, Options{})
+
+			receipt := models.Receipt{}
+			receipt.ID = 1
+			receipt.CreatedAt = receivedAt
+			deposit := models.Deposit{ClientID: 2}
+			// the stored account is opened now, this one when the test says, if at all
+			account := models.Account{PotID: 1, Wrapper: models.WrapperSIPP}
+			account.ID = 1
+			account.CreatedAt = tt.openedAt
+
+			overflowAmounts := make(overflows)
+
+			_, err := allocService.allocateToAccount(store, &receipt, &deposit, &account, decimal.NewFromInt(tt.amount), overflowAmounts)
+			assert.NoError(t, err)
+
+			saved := savedAllocations(t, store, 1)
+			assert.Len(t, saved, 1)
+			assert.Equal(t, tt.amount-tt.overflow, saved[0].Amount)
+			assert.Equal(t, models.TaxYear(2024), saved[0].TaxYear)
+			assert.Equal(t, tt.usage, allowanceUsed(saved[0]))
+
+			// the allowance is used by the gross contribution, the relief being claimed from HMRC
+			var gross int64
+			for _, usage := range tt.usage {
+				gross += usage.Amount
+			}
+			claim := saved[0].ReliefClaim
+			if assert.NotNil(t, claim) {
+				assert.Equal(t, gross, claim.GrossAmount)
+				assert.Equal(t, gross-saved[0].Amount, claim.ReliefAmount)
+				assert.Equal(t, models.ClaimStatusPending, claim.Status)
+			}
+
+			overflow := overflowAmounts[overflowKey{PotID: 1, Wrapper: models.WrapperGIA}]
+			assert.True(t, decimal.NewFromInt(tt.overflow).Equal(overflow), "expected %d to overflow got %s", tt.overflow, overflow)
+		})
+	}
+}
+
+// keyedInAfterYearEnd is a receipt the bank credited on the last day of the 2024/25 tax year, which
+// wasn't keyed in until two days into 2025/26
+func keyedInAfterYearEnd() *models.Receipt {
+	valueDate := time.Date(2025, time.April, 5, 0, 0, 0, 0, time.UTC)
+	receipt := &models.Receipt{ValueDate: &valueDate}
+	receipt.ID = 1
+	receipt.CreatedAt = time.Date(2025, time.April, 7, 9, 0, 0, 0, time.UTC)
+	return receipt
+}
+
+func TestSippMpaaFromTheValueDate(t *testing.T) {
+	triggered := time.Date(2025, time.April, 6, 0, 0, 0, 0, time.UTC)
+	limits := map[models.TaxYear]int64{2021: 4000000, 2022: 4000000, 2023: 6000000, 2024: 6000000}
+	store := sippStore(t, models.Client{MpaaTriggeredAt: &triggered}, limits, map[models.TaxYear]int64{2024: 6000000})
+
+	allocService := NewAllocationService(store, Options{})
+	deposit := models.Deposit{ClientID: 2}
+	account := models.Account{PotID: 1, Wrapper: models.WrapperSIPP} // open long enough to carry forward
+	account.ID = 1
+	overflowAmounts := make(overflows)
+
+	_, err := allocService.allocateToAccount(store, keyedInAfterYearEnd(), &deposit, &account, decimal.NewFromInt(100000), overflowAmounts)
+
+	// received before the MPAA was triggered, so allowance is still carried forward into 2024/25
+	assert.NoError(t, err)
+	saved := savedAllocations(t, store, 1)
+	if assert.Len(t, saved, 1) {
+		assert.Equal(t, models.TaxYear(2024), saved[0].TaxYear)
+		assert.Equal(t, []models.AllowanceUsage{{TaxYear: 2021, Amount: 125000}}, allowanceUsed(saved[0]))
+	}
+	assert.Empty(t, overflowAmounts)
+}
+
+func TestSippReliefRoundsDown(t *testing.T) {
+	store := sippStore(t, models.Client{}, map[models.TaxYear]int64{2024: 6000000}, nil)
+
+	receipt := &models.Receipt{}
+	receipt.ID = 1
+	account, _ := store.Accounts().Get(1)
+	req := AllocationRequest{
+		Receipt: receipt,
+		Deposit: &models.Deposit{ClientID: 2},
+		Account: account,
+		TaxYear: 2024,
+	}
+
+	err := (&sippRule{}).Allocate(store, req, decimal.NewFromInt(1003))
+
+	assert.NoError(t, err)
+	saved := savedAllocations(t, store, 1)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, int64(250), saved[0].ReliefClaim.ReliefAmount)
+	assert.Equal(t, int64(1253), saved[0].ReliefClaim.GrossAmount)
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ErrLockTimeout is returned when an idempotency key can't be locked in time, either because every
+// connection the locks may hold is in use or because another request holds the key. It is a 503 so
+// the client retries later.
+var ErrLockTimeout = fiber.NewError(fiber.StatusServiceUnavailable, "timed out locking the idempotency key")
+
+// PostgresLock is an idempotency.Locker holding a Postgres advisory lock per key, so a retry sent
+// to another instance while the first request is still running waits for it rather than running
+// again. An advisory lock belongs to the session that took it, so each held lock keeps a connection
+// from the pool until it is unlocked. At most connections are held at once, so the locks can't take
+// the whole pool from the requests they guard.
+type PostgresLock struct {
+	db      *gorm.DB
+	slots   chan struct{} // one per connection a lock may hold
+	timeout time.Duration
+	mu      sync.Mutex
+	conns   map[string]*sql.Conn // the connection holding each key's lock
+}
+
+// NewPostgresLock returns the lock holding at most connections of the pool, waiting up to timeout
+// for one and for the key. A timeout of 0 waits for as long as it takes.
+func NewPostgresLock(db *gorm.DB, connections int, timeout time.Duration) *PostgresLock {
+	if connections < 1 {
+		connections = 1
+	}
+	return &PostgresLock{
+		db:      db,
+		slots:   make(chan struct{}, connections),
+		timeout: timeout,
+		conns:   make(map[string]*sql.Conn),
+	}
+}
+
+// Lock waits until no other request, on any instance, holds the key
+func (l *PostgresLock) Lock(key string) (err error) {
+	ctx, cancel := context.Background(), func() {}
+	if l.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+	}
+	defer cancel()
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return errors.Wrap(ErrLockTimeout, "waiting for a connection")
+	}
+	defer func() {
+		if err != nil {
+			<-l.slots
+		}
+	}()
+
+	sqlDB, err := l.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrap(ErrLockTimeout, "taking a connection")
+		}
+		return errors.Wrap(err, "taking a connection to lock the idempotency key")
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID(key)); err != nil {
+		defer conn.Close()
+		if ctx.Err() != nil {
+			// in case the lock was granted just as the wait timed out, as the connection goes back to the pool
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID(key))
+			return errors.Wrapf(ErrLockTimeout, "waiting for idempotency key %s", key)
+		}
+		return errors.Wrap(err, "locking the idempotency key")
+	}
+
+	l.mu.Lock()
+	l.conns[key] = conn
+	l.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the key and returns the connection that held it to the pool
+func (l *PostgresLock) Unlock(key string) error {
+	l.mu.Lock()
+	conn, ok := l.conns[key]
+	delete(l.conns, key)
+	l.mu.Unlock()
+	if !ok {
+		return errors.Errorf("idempotency key %s isn't locked", key)
+	}
+	defer func() { <-l.slots }()
+	defer conn.Close()
+
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockID(key))
+	return errors.Wrap(err, "unlocking the idempotency key")
+}
+
+// lockID hashes the key into the advisory lock's number. Keys sharing a number only wait on each other.
+func lockID(key string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return int64(hash.Sum64())
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func mockLock(t *testing.T) (*PostgresLock, sqlmock.Sqlmock) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Unable to create mock db: %v", err)
+	}
+	t.Cleanup(func() { assert.NoError(t, mock.ExpectationsWereMet()) })
+	return NewPostgresLock(db, 1, 50*time.Millisecond), mock
+}
+
+func TestLockAndUnlock(t *testing.T) {
+	l, mock := mockLock(t)
+
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID("a-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(\\$1\\)$").WithArgs(lockID("a-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, l.Lock("a-key"))
+	assert.NoError(t, l.Unlock("a-key"))
+	assert.Error(t, l.Unlock("a-key"), "it is no longer locked")
+}
+
+func TestLockHoldsBoundedConnections(t *testing.T) {
+	l, mock := mockLock(t)
+
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID("a-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(\\$1\\)$").WithArgs(lockID("a-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID("b-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(\\$1\\)$").WithArgs(lockID("b-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, l.Lock("a-key"))
+
+	// the one connection the locks may hold is taken, so b-key gives up without taking another
+	err := l.Lock("b-key")
+	assert.ErrorIs(t, err, ErrLockTimeout)
+	var fiberErr *fiber.Error
+	assert.ErrorAs(t, err, &fiberErr)
+	assert.Equal(t, fiber.StatusServiceUnavailable, fiberErr.Code)
+
+	assert.NoError(t, l.Unlock("a-key"))
+	assert.NoError(t, l.Lock("b-key"))
+	assert.NoError(t, l.Unlock("b-key"))
+}
+
+func TestLockTimesOutWaitingForTheKey(t *testing.T) {
+	l, mock := mockLock(t)
+
+	// another instance's request holds the key for longer than the timeout
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID("a-key")).
+		WillDelayFor(200 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_unlock\\(\\$1\\)$").WithArgs(lockID("a-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SELECT pg_advisory_lock\\(\\$1\\)$").WithArgs(lockID("b-key")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.ErrorIs(t, l.Lock("a-key"), ErrLockTimeout)
+
+	// giving up frees the connection for the next key
+	assert.NoError(t, l.Lock("b-key"))
+}
+
+func TestLockID(t *testing.T) {
+	assert.Equal(t, lockID("a-key"), lockID("a-key"))
+	assert.NotEqual(t, lockID("a-key"), lockID("b-key"))
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"time"
+)
+
+// Postgres is a fiber.Storage kept in the idempotency_keys table, so keys survive a restart and
+// are shared by every instance of the API
+type Postgres struct {
+	db   *gorm.DB
+	done chan struct{}
+}
+
+// NewPostgres returns the storage, deleting expired keys every gcInterval until it is closed.
+// Expired keys are never returned, so a gcInterval of 0 only leaves them in the table.
+func NewPostgres(db *gorm.DB, gcInterval time.Duration) *Postgres {
+	s := &Postgres{db: db, done: make(chan struct{})}
+	if gcInterval > 0 {
+		go s.gc(gcInterval)
+	}
+	return s
+}
+
+// Get returns the value stored against the key, or nil if there isn't one or it has expired
+func (s *Postgres) Get(key string) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	var entries []models.IdempotencyKey
+	err := s.db.Where("key = ? AND (expires_at IS NULL OR expires_at > ?)", key, time.Now()).
+		Limit(1).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0].Value, nil
+}
+
+// Set stores the value against the key, replacing any value already there. A zero exp keeps it until deleted.
+func (s *Postgres) Set(key string, val []byte, exp time.Duration) error {
+	if len(key) == 0 || len(val) == 0 {
+		return nil
+	}
+
+	entry := models.IdempotencyKey{Key: key, Value: val}
+	if exp > 0 {
+		expiresAt := time.Now().Add(exp)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at", "updated_at"}),
+	}).Create(&entry).Error
+}
+
+// SetIfAbsent stores the value against the key unless it already holds one that hasn't expired,
+// reporting whether it stored it. It is a single statement, so of requests racing to store the
+// same key exactly one does.
+func (s *Postgres) SetIfAbsent(key string, val []byte, exp time.Duration) (bool, error) {
+	if len(key) == 0 || len(val) == 0 {
+		return false, nil
+	}
+
+	now := time.Now()
+	entry := models.IdempotencyKey{Key: key, Value: val}
+	if exp > 0 {
+		expiresAt := now.Add(exp)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	// an expired value may not have been deleted yet, it is replaced as if it had been
+	result := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "idempotency_keys.expires_at <= ?", Vars: []interface{}{now}},
+		}},
+	}).Create(&entry)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (s *Postgres) Delete(key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	return s.db.Where("key = ?", key).Delete(&models.IdempotencyKey{}).Error
+}
+
+// Reset deletes every key
+func (s *Postgres) Reset() error {
+	return s.db.Exec("DELETE FROM idempotency_keys").Error
+}
+
+// Close stops deleting expired keys, the database connection is left open
+func (s *Postgres) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *Postgres) gc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.deleteExpired(); err != nil {
+				log.Printf("Error deleting expired idempotency keys: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *Postgres) deleteExpired() error {
+	return s.db.Where("expires_at <= ?", time.Now()).Delete(&models.IdempotencyKey{}).Error
+}
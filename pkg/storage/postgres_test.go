@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func mockStorage(t *testing.T) (*Postgres, sqlmock.Sqlmock) {
+	testDB, mock, _ := sqlmock.New()
+
+	dialector := postgres.New(postgres.Config{
+		DSN:                  "sqlmock_db_0",
+		DriverName:           "postgres",
+		Conn:                 testDB,
+		PreferSimpleProtocol: true,
+	})
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Unable to create mock db: %v", err)
+	}
+	t.Cleanup(func() { assert.NoError(t, mock.ExpectationsWereMet()) })
+	return NewPostgres(db, 0), mock
+}
+
+func TestGet(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	mock.ExpectQuery("^SELECT \\* FROM \"idempotency_keys\" WHERE key = \\$1 AND \\(expires_at IS NULL OR expires_at > \\$2\\) LIMIT \\$3").
+		WithArgs("a-key", sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value"}).AddRow("a-key", []byte("response")))
+
+	value, err := s.Get("a-key")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("response"), value)
+}
+
+func TestGetMissingOrExpired(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	mock.ExpectQuery("^SELECT \\* FROM \"idempotency_keys\"(.*)").
+		WithArgs("a-key", sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value"}))
+
+	value, err := s.Get("a-key")
+
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestSet(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO \"idempotency_keys\" \\(\"key\",\"value\",\"expires_at\",\"created_at\",\"updated_at\"\\) VALUES (.*) "+
+		"ON CONFLICT \\(\"key\"\\) DO UPDATE SET \"value\"=\"excluded\".\"value\",\"expires_at\"=\"excluded\".\"expires_at\",\"updated_at\"=\"excluded\".\"updated_at\"").
+		WithArgs("a-key", []byte("response"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, s.Set("a-key", []byte("response"), time.Hour))
+}
+
+func TestSetNothing(t *testing.T) {
+	s, _ := mockStorage(t)
+
+	assert.NoError(t, s.Set("", []byte("response"), time.Hour))
+	assert.NoError(t, s.Set("a-key", nil, time.Hour))
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	insert := "^INSERT INTO \"idempotency_keys\" \\(\"key\",\"value\",\"expires_at\",\"created_at\",\"updated_at\"\\) VALUES (.*) " +
+		"ON CONFLICT \\(\"key\"\\) DO UPDATE SET \"value\"=\"excluded\".\"value\",\"expires_at\"=\"excluded\".\"expires_at\",\"updated_at\"=\"excluded\".\"updated_at\" " +
+		"WHERE idempotency_keys.expires_at <= \\$6"
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).
+		WithArgs("a-key", []byte("fingerprint"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// the key holds a value that hasn't expired, so nothing is stored
+	mock.ExpectBegin()
+	mock.ExpectExec(insert).
+		WithArgs("a-key", []byte("other"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	stored, err := s.SetIfAbsent("a-key", []byte("fingerprint"), time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, stored)
+
+	stored, err = s.SetIfAbsent("a-key", []byte("other"), time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, stored)
+}
+
+func TestDelete(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"idempotency_keys\" WHERE key = \\$1").
+		WithArgs("a-key").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, s.Delete("a-key"))
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s, mock := mockStorage(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM \"idempotency_keys\" WHERE expires_at <= \\$1").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	assert.NoError(t, s.deleteExpired())
+}
+
+func TestClose(t *testing.T) {
+	s, _ := mockStorage(t)
+
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const reconcileUsage = "reconcile [--json]"
+
+// errUnreconciled is returned when reconcile finds receipts whose allocations don't add up
+var errUnreconciled = errors.New("receipts do not reconcile")
+
+// reconcile runs `reconcile`, which checks every receipt's allocations add up to what was received
+// less anything held in suspense or reversed
+func reconcile(c *cli, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	asJSON := jsonFlag(flags)
+	rest, err := parseFlags(flags, args, reconcileUsage)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return usageError{usage: reconcileUsage}
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+
+	reconciliation, err := service.Reconcile(repository.NewGorm(cfg.Database.DB))
+	if err != nil {
+		return err
+	}
+
+	err = output(*asJSON, reconciliation, func() {
+		fmt.Printf("Receipts checked: %d, discrepancies: %d\n", reconciliation.Receipts, len(reconciliation.Discrepancies))
+		for _, balance := range reconciliation.Discrepancies {
+			fmt.Printf("  receipt %d of deposit %d: allocated %d, expected %d (%+d)\n",
+				balance.ReceiptID, balance.DepositID, balance.Allocated, balance.Expected(), balance.Difference())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if !reconciliation.Reconciled() {
+		return errors.Wrapf(errUnreconciled, "%d of %d receipts", len(reconciliation.Discrepancies), reconciliation.Receipts)
+	}
+	return nil
+}
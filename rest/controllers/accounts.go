@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// errDuplicateGIA is returned when opening a second GIA in a pot
+var errDuplicateGIA = errors.New("pot already has an open GIA")
+
+/**
+Example request:
+
+{
+	"wrapper": "ISA"
+}
+
+*/
+
+func (d *Dependencies) CreateAccount(c *fiber.Ctx) error {
+
+	var payload *models.Account
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	account := models.Account{Wrapper: payload.Wrapper}
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		var pot models.Pot
+		if err := getRecord(c, tx.Pots().Get, &pot); err != nil {
+			return err
+		}
+		if pot.ClosedAt != nil {
+			return errClosed
+		}
+		if err := checkGIAFree(tx, pot.ID, account.Wrapper); err != nil {
+			return err
+		}
+		account.PotID = pot.ID
+		return tx.Accounts().Create(&account)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Pot does not exist"})
+	}
+	if errors.Is(err, errClosed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": "Pot is closed"})
+	}
+	if errors.Is(err, errDuplicateGIA) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if status := constraintStatus(err); status != 0 { // another request opened the GIA first
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"account_id": account.ID})
+}
+
+func (d *Dependencies) GetPotAccounts(c *fiber.Ctx) error {
+
+	var pot models.Pot
+
+	err := getRecord(c, d.Store.Pots().Get, &pot)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Pot does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	// want an empty an array instead of null within the json
+	if pot.Accounts == nil {
+		pot.Accounts = make([]models.Account, 0)
+	}
+	return c.JSON(pot.Accounts)
+}
+
+func (d *Dependencies) GetAccount(c *fiber.Ctx) error {
+
+	var account models.Account
+
+	err := getRecord(c, d.Store.Accounts().Get, &account)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Account does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(account)
+}
+
+// UpdateAccount changes an account's wrapper, which is only allowed before anything has been allocated to it
+func (d *Dependencies) UpdateAccount(c *fiber.Ctx) error {
+
+	var payload *models.Account
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	var account models.Account
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Accounts().Get, &account); err != nil {
+			return err
+		}
+		if account.ClosedAt != nil {
+			return errClosed
+		}
+		if account.Wrapper == payload.Wrapper {
+			return nil
+		}
+
+		allocations, err := tx.Accounts().CountAllocations(account.ID, false)
+		if err != nil {
+			return err
+		}
+		if allocations > 0 {
+			return errors.Wrapf(errStillOpen, "account %d already has allocations", account.ID)
+		}
+		if err := checkGIAFree(tx, account.PotID, payload.Wrapper); err != nil {
+			return err
+		}
+
+		return tx.Accounts().ChangeWrapper(&account, payload.Wrapper)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Account does not exist"})
+	}
+	if errors.Is(err, errClosed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": "Account is closed"})
+	}
+	if errors.Is(err, errStillOpen) || errors.Is(err, errDuplicateGIA) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if status := constraintStatus(err); status != 0 { // another request opened the GIA first
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"account_id": account.ID})
+}
+
+// CloseAccount closes an account once everything allocated to it has settled. Closed accounts are
+// kept so their allocations still count toward the client's allowances.
+func (d *Dependencies) CloseAccount(c *fiber.Ctx) error {
+
+	var account models.Account
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Accounts().Get, &account); err != nil {
+			return err
+		}
+
+		unsettled, err := tx.Accounts().CountAllocations(account.ID, true)
+		if err != nil {
+			return err
+		}
+		if unsettled > 0 {
+			return errors.Wrapf(errStillOpen, "account %d has %d unsettled allocations", account.ID, unsettled)
+		}
+
+		return closeRecord(account.ClosedAt, func(at time.Time) error { return tx.Accounts().Close(&account, at) })
+	})
+
+	return closeResponse(c, err, "Account", fiber.Map{"account_id": account.ID, "closed_at": account.ClosedAt})
+}
+
+// SettleAllocation records that the money allocated has been invested in the account
+func (d *Dependencies) SettleAllocation(c *fiber.Ctx) error {
+
+	var allocation models.Allocation
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Allocations().Get, &allocation); err != nil {
+			return err
+		}
+		if allocation.SettledAt != nil {
+			return nil
+		}
+		return tx.Allocations().Settle(&allocation, time.Now())
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Allocation does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"allocation_id": allocation.ID, "settled_at": allocation.SettledAt})
+}
+
+// checkGIAFree makes sure a GIA isn't opened in a pot that already has one, as overflow is paid into
+// the pot's only GIA. A pot can hold several accounts of the other wrappers.
+func checkGIAFree(tx repository.Repositories, potID uint, wrapper string) error {
+	if wrapper != models.WrapperGIA {
+		return nil
+	}
+	_, err := tx.Accounts().FindOpen(potID, wrapper)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(errDuplicateGIA, "pot %d", potID)
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateAccount(t *testing.T) {
+	closedPot := testPot(6, 1, "Old")
+	closedPot.ClosedAt = &closedAt
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"), closedPot,
+		testAccount(6, 5, "GIA"))
+
+	app := fiber.New()
+
+	app.Post("/pots/:id/accounts", deps.CreateAccount)
+
+	t.Run("Successful creation of account", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/5/accounts", strings.NewReader(`{"wrapper":"SIPP"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 201, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"account_id":7}`, string(raw))
+
+		account, err := store.Accounts().Get(7)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(5), account.PotID)
+		assert.Equal(t, "SIPP", account.Wrapper)
+	})
+
+	t.Run("Pot already has a GIA", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/5/accounts", strings.NewReader(`{"wrapper":"GIA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Second account of a wrapper", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/5/accounts", strings.NewReader(`{"wrapper":"SIPP"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 201, resp.StatusCode)
+	})
+
+	t.Run("Pot is closed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/6/accounts", strings.NewReader(`{"wrapper":"ISA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Cant find pot", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/9/accounts", strings.NewReader(`{"wrapper":"ISA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Unknown wrapper", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/5/accounts", strings.NewReader(`{"wrapper":"PEP"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
+
+// staleStore's transactions don't see open accounts, as a check doesn't that runs before another
+// request's insert commits
+type staleStore struct {
+	repository.Store
+}
+
+func (s staleStore) Transaction(fn func(tx repository.Repositories) error) error {
+	return s.Store.Transaction(func(tx repository.Repositories) error {
+		return fn(staleRepos{tx})
+	})
+}
+
+type staleRepos struct {
+	repository.Repositories
+}
+
+func (r staleRepos) Accounts() repository.AccountRepository {
+	return staleAccounts{r.Repositories.Accounts()}
+}
+
+type staleAccounts struct {
+	repository.AccountRepository
+}
+
+func (a staleAccounts) FindOpen(potID uint, wrapper string) (*models.Account, error) {
+	return nil, repository.ErrNotFound
+}
+
+func TestCreateAccountOpenedByAnotherRequest(t *testing.T) {
+	// another request opens the GIA between the check and the insert
+	_, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"), testAccount(6, 5, "GIA"))
+	deps := NewStoreDependencies(staleStore{store}, service.Options{})
+
+	app := fiber.New()
+
+	app.Post("/pots/:id/accounts", deps.CreateAccount)
+
+	req := httptest.NewRequest("POST", "/pots/5/accounts", strings.NewReader(`{"wrapper":"GIA"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, 409, resp.StatusCode)
+
+	_, err := store.Accounts().Get(7)
+	assert.ErrorIs(t, err, repository.ErrNotFound, "the second GIA isn't opened")
+}
+
+func TestUpdateAccount(t *testing.T) {
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"),
+		testAccount(7, 5, "ISA"), testAccount(8, 5, "GIA"), testAccount(9, 5, "SIPP"),
+		&models.Allocation{ReceiptID: 1, AccountID: 7, Amount: 1000})
+
+	app := fiber.New()
+
+	app.Put("/accounts/:id", deps.UpdateAccount)
+
+	t.Run("Account already has allocations", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/accounts/7", strings.NewReader(`{"wrapper":"LISA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Pot already has a GIA", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/accounts/9", strings.NewReader(`{"wrapper":"GIA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Successful change of wrapper", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/accounts/8", strings.NewReader(`{"wrapper":"LISA"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		account, err := store.Accounts().Get(8)
+		assert.NoError(t, err)
+		assert.Equal(t, "LISA", account.Wrapper)
+	})
+}
+
+func TestCloseAccount(t *testing.T) {
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"),
+		testAccount(7, 5, "ISA"), testAccount(8, 5, "GIA"),
+		&models.Allocation{ReceiptID: 1, AccountID: 7, Amount: 1000, SettledAt: &closedAt},
+		&models.Allocation{ReceiptID: 1, AccountID: 8, Amount: 1000},
+		&models.Allocation{ReceiptID: 2, AccountID: 8, Amount: 1000})
+
+	app := fiber.New()
+
+	app.Post("/accounts/:id/close", deps.CloseAccount)
+
+	t.Run("Successful close of account", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/accounts/7/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		account, err := store.Accounts().Get(7)
+		assert.NoError(t, err)
+		assert.NotNil(t, account.ClosedAt)
+	})
+
+	t.Run("Account has unsettled allocations", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/accounts/8/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(raw), "account 8 has 2 unsettled allocations")
+	})
+}
+
+func TestSettleAllocation(t *testing.T) {
+	settledAt := time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+
+	unsettled := &models.Allocation{ReceiptID: 1, AccountID: 7, Amount: 1000}
+	unsettled.ID = 9
+	settled := &models.Allocation{ReceiptID: 1, AccountID: 7, Amount: 1000, SettledAt: &settledAt}
+	settled.ID = 10
+	deps, store := memoryDeps(t, unsettled, settled)
+
+	app := fiber.New()
+
+	app.Post("/allocations/:id/settle", deps.SettleAllocation)
+
+	req := httptest.NewRequest("POST", "/allocations/9/settle", nil)
+	resp, _ := app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	allocation, err := store.Allocations().Get(9)
+	assert.NoError(t, err)
+	assert.NotNil(t, allocation.SettledAt)
+
+	// settling again leaves the original settlement time
+	req = httptest.NewRequest("POST", "/allocations/10/settle", nil)
+	resp, _ = app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	raw, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"allocation_id":10,"settled_at":"2024-05-01T00:00:00Z"}`, string(raw))
+
+	resp, _ = app.Test(httptest.NewRequest("POST", "/allocations/11/settle", nil))
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+type PensionAllowance struct {
+	ClientID          uint                           `json:"client_id"`
+	MpaaTriggeredAt   *time.Time                     `json:"mpaa_triggered_at"`
+	TaperedAllowances []models.TaperedAllowance      `json:"tapered_allowances"`
+	Audit             []models.PensionAllowanceAudit `json:"audit"`
+}
+
+type PensionAllowanceUpdate struct {
+	MpaaTriggeredAt   *time.Time               `json:"mpaa_triggered_at"`
+	ClearMpaa         bool                     `json:"clear_mpaa"` // corrects an MPAA trigger recorded in error
+	TaperedAllowances []TaperedAllowanceUpdate `json:"tapered_allowances" validate:"dive"`
+	ChangedBy         string                   `json:"changed_by" validate:"required"`
+}
+
+type TaperedAllowanceUpdate struct {
+	TaxYear models.TaxYear `json:"tax_year" validate:"required"`
+	Amount  *uint          `json:"amount"` // null removes the tapered allowance for the year
+}
+
+func (d *Dependencies) GetPensionAllowance(c *fiber.Ctx) error {
+
+	var client models.Client
+
+	err := getRecord(c, d.Store.Clients().Get, &client)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	audit, err := d.Store.Clients().Audit(client.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(pensionAllowance(&client, audit))
+}
+
+/**
+Example request:
+
+{
+	"mpaa_triggered_at": "2024-09-01T00:00:00Z",
+	"tapered_allowances": [
+		{"tax_year": 2024, "amount": 2500000},
+		{"tax_year": 2023, "amount": null}
+	],
+	"changed_by": "j.smith"
+}
+
+*/
+
+func (d *Dependencies) UpdatePensionAllowance(c *fiber.Ctx) error {
+
+	var payload *PensionAllowanceUpdate
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	if payload.ClearMpaa && payload.MpaaTriggeredAt != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Cannot both set and clear the MPAA trigger date"})
+	}
+
+	var client models.Client
+	var audit []models.PensionAllowanceAudit
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Clients().Get, &client); err != nil {
+			return err
+		}
+
+		record := func(field, oldValue, newValue string) {
+			audit = append(audit, models.PensionAllowanceAudit{
+				ClientID:  client.ID,
+				Field:     field,
+				OldValue:  oldValue,
+				NewValue:  newValue,
+				ChangedBy: payload.ChangedBy,
+			})
+		}
+
+		if payload.ClearMpaa || payload.MpaaTriggeredAt != nil {
+			if formatTime(client.MpaaTriggeredAt) != formatTime(payload.MpaaTriggeredAt) {
+				oldValue := formatTime(client.MpaaTriggeredAt)
+				if err := tx.Clients().SetMpaa(&client, payload.MpaaTriggeredAt); err != nil {
+					return err
+				}
+				record("mpaa_triggered_at", oldValue, formatTime(payload.MpaaTriggeredAt))
+			}
+		}
+
+		for _, update := range payload.TaperedAllowances {
+			field := fmt.Sprintf("tapered_allowance[%s]", update.TaxYear)
+			current, exists := client.TaperedAllowanceFor(update.TaxYear)
+			oldValue := ""
+			if exists {
+				oldValue = strconv.FormatUint(uint64(current), 10)
+			}
+
+			newValue := ""
+			if update.Amount != nil {
+				newValue = strconv.FormatUint(uint64(*update.Amount), 10)
+			}
+			if newValue == oldValue {
+				continue
+			}
+			if err := tx.Clients().SetTaperedAllowance(client.ID, update.TaxYear, update.Amount); err != nil {
+				return err
+			}
+			record(field, oldValue, newValue)
+		}
+
+		if len(audit) == 0 {
+			return nil
+		}
+		return tx.Clients().RecordAudit(audit)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"client_id": client.ID, "changes": len(audit)})
+}
+
+func pensionAllowance(client *models.Client, audit []models.PensionAllowanceAudit) PensionAllowance {
+	tapered := client.TaperedAllowances
+	if tapered == nil {
+		tapered = make([]models.TaperedAllowance, 0)
+	}
+	return PensionAllowance{
+		ClientID:          client.ID,
+		MpaaTriggeredAt:   client.MpaaTriggeredAt,
+		TaperedAllowances: tapered,
+		Audit:             audit,
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetPensionAllowance(t *testing.T) {
+	jane := testClient(1, "Jane")
+	jane.TaperedAllowances = []models.TaperedAllowance{{ClientID: 1, TaxYear: 2024, Amount: 2500000}}
+	deps, store := memoryDeps(t, jane)
+	err := store.Clients().RecordAudit([]models.PensionAllowanceAudit{
+		{ClientID: 1, Field: "tapered_allowance[2024/25]", NewValue: "2500000", ChangedBy: "j.smith"},
+	})
+	assert.NoError(t, err)
+
+	app := fiber.New()
+
+	app.Get("/clients/:id/pension-allowance", deps.GetPensionAllowance)
+
+	t.Run("Successful retrieval of pension allowance", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/clients/1/pension-allowance", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body PensionAllowance
+		raw, _ := io.ReadAll(resp.Body)
+		assert.NoError(t, json.Unmarshal(raw, &body))
+		assert.Equal(t, uint(1), body.ClientID)
+		assert.Len(t, body.TaperedAllowances, 1)
+		assert.Equal(t, uint(2500000), body.TaperedAllowances[0].Amount)
+		assert.Len(t, body.Audit, 1)
+	})
+
+	t.Run("Cant find client", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/clients/2/pension-allowance", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestUpdatePensionAllowance(t *testing.T) {
+	jane := testClient(1, "Jane")
+	jane.TaperedAllowances = []models.TaperedAllowance{{ClientID: 1, TaxYear: 2023, Amount: 1000000}}
+	deps, store := memoryDeps(t, jane)
+
+	app := fiber.New()
+
+	app.Put("/clients/:id/pension-allowance", deps.UpdatePensionAllowance)
+
+	t.Run("Successful update of pension allowance", func(t *testing.T) {
+		body := `{"mpaa_triggered_at":"2024-09-01T00:00:00Z","tapered_allowances":[{"tax_year":2024,"amount":2500000},{"tax_year":2023,"amount":null}],"changed_by":"j.smith"}`
+
+		req := httptest.NewRequest("PUT", "/clients/1/pension-allowance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"client_id":1,"changes":3}`, string(raw))
+
+		client, err := store.Clients().Get(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "2024-09-01T00:00:00Z", formatTime(client.MpaaTriggeredAt))
+		if assert.Len(t, client.TaperedAllowances, 1) {
+			assert.Equal(t, models.TaxYear(2024), client.TaperedAllowances[0].TaxYear)
+			assert.Equal(t, uint(2500000), client.TaperedAllowances[0].Amount)
+		}
+
+		audit, err := store.Clients().Audit(1)
+		assert.NoError(t, err)
+		if assert.Len(t, audit, 3) {
+			assert.Equal(t, "mpaa_triggered_at", audit[0].Field)
+			assert.Equal(t, "1000000", audit[2].OldValue)
+			assert.Equal(t, "", audit[2].NewValue)
+		}
+	})
+
+	t.Run("Nothing changed", func(t *testing.T) {
+		body := `{"mpaa_triggered_at":"2024-09-01T00:00:00Z","tapered_allowances":[{"tax_year":2024,"amount":2500000},{"tax_year":2022,"amount":null}],"changed_by":"j.smith"}`
+
+		req := httptest.NewRequest("PUT", "/clients/1/pension-allowance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"client_id":1,"changes":0}`, string(raw))
+	})
+
+	t.Run("Cant find client", func(t *testing.T) {
+		body := `{"clear_mpaa":true,"changed_by":"j.smith"}`
+
+		req := httptest.NewRequest("PUT", "/clients/2/pension-allowance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Changes must be attributed", func(t *testing.T) {
+		body := `{"clear_mpaa":true}`
+
+		req := httptest.NewRequest("PUT", "/clients/1/pension-allowance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
+	t.Run("Cannot set and clear the MPAA", func(t *testing.T) {
+		body := `{"clear_mpaa":true,"mpaa_triggered_at":"2024-09-01T00:00:00Z","changed_by":"j.smith"}`
+
+		req := httptest.NewRequest("PUT", "/clients/1/pension-allowance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
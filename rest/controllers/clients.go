@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/**
+Example request:
+
+{
+	"name": "Jane Smith",
+	"date_of_birth": "1990-06-15T00:00:00Z",
+	"registered_contact_id": null
+}
+
+*/
+
+func (d *Dependencies) CreateClient(c *fiber.Ctx) error {
+
+	var payload *models.Client
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	client := models.Client{Name: payload.Name, DateOfBirth: payload.DateOfBirth, RegisteredContactID: payload.RegisteredContactID}
+
+	err := d.Store.Clients().Create(&client)
+
+	if status := constraintStatus(err); status != 0 { // the registered contact doesn't exist
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"client_id": client.ID})
+}
+
+func (d *Dependencies) GetClient(c *fiber.Ctx) error {
+
+	var client models.Client
+
+	err := getRecord(c, d.Store.Clients().GetWithPots, &client)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(client)
+}
+
+func (d *Dependencies) UpdateClient(c *fiber.Ctx) error {
+
+	var payload *models.Client
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	var client models.Client
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Clients().Get, &client); err != nil {
+			return err
+		}
+		if client.ClosedAt != nil {
+			return errClosed
+		}
+		// the MPAA and tapered allowances are changed through the audited pension allowance endpoint
+		client.Name, client.DateOfBirth, client.RegisteredContactID = payload.Name, payload.DateOfBirth, payload.RegisteredContactID
+		return tx.Clients().Update(&client)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if errors.Is(err, errClosed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": "Client is closed"})
+	}
+	if status := constraintStatus(err); status != 0 { // the registered contact doesn't exist
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"client_id": client.ID})
+}
+
+// CloseClient closes a client once all of their pots have been closed
+func (d *Dependencies) CloseClient(c *fiber.Ctx) error {
+
+	var client models.Client
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Clients().Get, &client); err != nil {
+			return err
+		}
+
+		openPots, err := tx.Clients().CountOpenPots(client.ID)
+		if err != nil {
+			return err
+		}
+		if openPots > 0 {
+			return errors.Wrapf(errStillOpen, "client %d has %d open pots", client.ID, openPots)
+		}
+
+		return closeRecord(client.ClosedAt, func(at time.Time) error { return tx.Clients().Close(&client, at) })
+	})
+
+	return closeResponse(c, err, "Client", fiber.Map{"client_id": client.ID, "closed_at": client.ClosedAt})
+}
+
+// errClosed is returned when changing a record that has already been closed
+var errClosed = errors.New("already closed")
+
+// errStillOpen is returned when closing a record that still has open or unsettled records under it
+var errStillOpen = errors.New("still has open records")
+
+// closeRecord closes the record now, leaving a record that is already closed as it was
+func closeRecord(closedAt *time.Time, close func(at time.Time) error) error {
+	if closedAt != nil {
+		return nil
+	}
+	return close(time.Now())
+}
+
+// getRecord reads the record with the ID in the path into record, a malformed ID being a record
+// that doesn't exist
+func getRecord[T any](c *fiber.Ctx, get func(id uint) (*T, error), record *T) error {
+	id, err := paramID(c)
+	if err != nil {
+		return err
+	}
+	found, err := get(id)
+	if err != nil {
+		return err
+	}
+	*record = *found
+	return nil
+}
+
+func closeResponse(c *fiber.Ctx, err error, record string, body fiber.Map) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": record + " does not exist"})
+	}
+	if errors.Is(err, errStillOpen) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(body)
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateClient(t *testing.T) {
+	deps, store := memoryDeps(t, testClient(2, "John"))
+
+	app := fiber.New()
+
+	app.Post("/clients", deps.CreateClient)
+
+	t.Run("Successful creation of client", func(t *testing.T) {
+		body := `{"name":"Jane Smith","date_of_birth":"1990-06-15T00:00:00Z","registered_contact_id":2}`
+
+		req := httptest.NewRequest("POST", "/clients", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 201, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"client_id":3}`, string(raw))
+
+		client, err := store.Clients().Get(3)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Smith", client.Name)
+		assert.Equal(t, uint(2), *client.RegisteredContactID)
+	})
+
+	t.Run("Name is required", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients", strings.NewReader(`{"name":""}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
+	t.Run("Registered contact does not exist", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients", strings.NewReader(`{"name":"Jane Smith","registered_contact_id":9}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 422, resp.StatusCode)
+	})
+}
+
+func TestGetClient(t *testing.T) {
+	deps, _ := memoryDeps(t, testClient(1, "Jane"), testPot(2, 1, "Retirement"), testAccount(4, 2, "SIPP"))
+
+	app := fiber.New()
+
+	app.Get("/clients/:id", deps.GetClient)
+
+	t.Run("Successful retrieval of client", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/clients/1", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(raw), `"name":"Jane"`)
+		assert.Contains(t, string(raw), `"wrapper":"SIPP"`)
+	})
+
+	t.Run("Cant find client", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/clients/2", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Malformed client ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/clients/jane", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestUpdateClient(t *testing.T) {
+	john := testClient(2, "John")
+	john.ClosedAt = &closedAt
+	deps, store := memoryDeps(t, testClient(1, "Jane"), john)
+
+	app := fiber.New()
+
+	app.Put("/clients/:id", deps.UpdateClient)
+
+	t.Run("Successful update of client", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/clients/1", strings.NewReader(`{"name":"Jane Jones"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		client, err := store.Clients().Get(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "Jane Jones", client.Name)
+	})
+
+	t.Run("Client is closed", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/clients/2", strings.NewReader(`{"name":"John Jones"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Cant find client", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/clients/3", strings.NewReader(`{"name":"Jim"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+func TestCloseClient(t *testing.T) {
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testClient(2, "John"), testPot(3, 2, "Retirement"))
+
+	app := fiber.New()
+
+	app.Post("/clients/:id/close", deps.CloseClient)
+
+	t.Run("Successful close of client", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/1/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		client, err := store.Clients().Get(1)
+		assert.NoError(t, err)
+		assert.NotNil(t, client.ClosedAt)
+	})
+
+	t.Run("Client still has open pots", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/2/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+
+		client, err := store.Clients().Get(2)
+		assert.NoError(t, err)
+		assert.Nil(t, client.ClosedAt)
+	})
+}
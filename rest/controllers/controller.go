@@ -1,27 +1,53 @@
 package controllers
 
 import (
-	"ajbell.co.uk/app"
 	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
 	"ajbell.co.uk/pkg/service"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strconv"
+	"time"
 )
 
+// Dependencies are what the handlers need, so each app can be given its own store and services
 type Dependencies struct {
+	Store             repository.Store
 	AllocationService service.Allocate
+	ReversalService   service.Reverse
 }
 
-func GetDeposits(c *fiber.Ctx) error {
+// NewDependencies returns the handlers' dependencies on the database, with an AllocationService on the same database
+func NewDependencies(db *gorm.DB, opts service.Options) *Dependencies {
+	return NewStoreDependencies(repository.NewGorm(db), opts)
+}
 
-	id := c.Params("id")
+// NewStoreDependencies returns the handlers' dependencies with an AllocationService on the store,
+// e.g. a repository.Memory to run them without a database
+func NewStoreDependencies(store repository.Store, opts service.Options) *Dependencies {
+	allocationService := service.NewAllocationService(store, opts)
+	return &Dependencies{
+		Store:             store,
+		AllocationService: allocationService,
+		ReversalService:   allocationService,
+	}
+}
 
-	var result *models.Deposit
+func (d *Dependencies) GetDeposits(c *fiber.Ctx) error {
 
-	app.Http.Database.DB.Preload("Receipts.Allocations").First(&result, "id = ?", id)
+	var result models.Deposit
 
-	if result.ID == 0 {
+	err := getRecord(c, d.Store.Deposits().GetWithReceipts, &result)
+
+	if errors.Is(err, repository.ErrNotFound) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Deposit does not exist"})
 	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	result.Received, result.Status = result.Funding()
 
 	// want an empty an array instead of null within the json
 	if result.Receipts == nil {
@@ -40,22 +66,22 @@ Example request:
 	"proposed_allocation":[
 		{
 		"account_id":1,
-		"split":0.56
+		"split_bps":5600
 	},
     {
 		"account_id":2,
-		"split":0.24
+		"split_bps":2400
 	},
 		{
 		"account_id":4,
-		"split":0.20
+		"split_bps":2000
 	}
 	]
 }
 
 */
 
-func CreateDeposit(c *fiber.Ctx) error {
+func (d *Dependencies) CreateDeposit(c *fiber.Ctx) error {
 
 	var payload *models.Deposit
 
@@ -69,21 +95,24 @@ func CreateDeposit(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(errors)
 	}
 
-	var count float32 = 0.00
+	var count models.BasisPoints
 
 	for _, allocation := range payload.ProposedAllocation {
 		count += allocation.Split
-		if count > 1 { // exceeded max percentage
+		if count > models.WholeSplit { // exceeded max percentage
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Allocation split exceeds 100%"})
 		}
 	}
 
-	if count != 1 {
+	if count != models.WholeSplit {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Allocation split requires 100% allocation"})
 	}
 
-	err := app.Http.Database.Create(&payload).Error
+	err := d.Store.Deposits().Create(payload)
 
+	if status := constraintStatus(err); status != 0 { // e.g. the client or an account doesn't exist
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
 	}
@@ -95,37 +124,149 @@ func CreateDeposit(c *fiber.Ctx) error {
 /**
 	Example request:
 {
-	"amount": 10000000
+	"amount": 10000000,
+	"bank_reference": "FP-20240902-000123",
+	"value_date": "2024-09-02T00:00:00Z"
 }
 
+A payment whose bank_reference has already been receipted is answered with the existing receipt
+
 
 */
 
 func (d *Dependencies) ReceiptHandler(c *fiber.Ctx) error {
 
-	var receipt *models.Receipt
+	receipt, depo, fail := d.receiptForDeposit(c)
+	if fail != nil {
+		return c.Status(fail.Code).JSON(fiber.Map{"status": "error", "message": fail.Message})
+	}
 
-	if err := c.BodyParser(&receipt); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	result, err := d.AllocationService.AllocateReceipt(receipt, depo)
+	if err != nil {
+		return d.receiptError(c, err, receipt.ID)
 	}
 
-	id := c.Params("id")
+	return c.Status(fiber.StatusCreated).JSON(result)
+}
 
-	var depo *models.Deposit
+/**
+	Example request:
+
+POST /api/v1/deposit/1/receipt/preview
+{
+	"amount": 10000000
+}
 
-	app.Http.Database.DB.Preload("ProposedAllocation").First(&depo, id)
+Returns where the receipt would be allocated, with the reason for any overflow, without recording anything
 
-	if depo.ID == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Deposit does not exist"})
+*/
+
+func (d *Dependencies) ReceiptPreviewHandler(c *fiber.Ctx) error {
+
+	receipt, depo, fail := d.receiptForDeposit(c)
+	if fail != nil {
+		return c.Status(fail.Code).JSON(fiber.Map{"status": "error", "message": fail.Message})
+	}
+
+	result, err := d.AllocationService.PreviewReceipt(receipt, depo)
+	if err != nil {
+		return d.receiptError(c, err, receipt.ID)
 	}
 
-	receipt.DepositID = depo.ID
+	return c.JSON(result)
+}
+
+// ReceiptRequest is what a client says about a payment, how it is handled is up to the service
+type ReceiptRequest struct {
+	Amount        uint       `json:"amount" validate:"required"` // amount is always in pennies
+	BankReference *string    `json:"bank_reference"`
+	ValueDate     *time.Time `json:"value_date"`
+}
 
-	err := d.AllocationService.AllocateReceipt(receipt, depo)
+// receiptForDeposit parses the receipt from the body and loads the deposit it is for
+func (d *Dependencies) receiptForDeposit(c *fiber.Ctx) (*models.Receipt, *models.Deposit, *fiber.Error) {
+	var payload *ReceiptRequest
 
+	if err := c.BodyParser(&payload); err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if payload == nil || models.ValidateStruct(payload) != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Receipt needs an amount")
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, "Deposit does not exist")
+	}
+
+	depo, err := d.Store.Deposits().Get(uint(id))
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, "Deposit does not exist")
+	}
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	receipt := &models.Receipt{
+		DepositID:     depo.ID,
+		Amount:        payload.Amount,
+		BankReference: payload.BankReference,
+		ValueDate:     payload.ValueDate,
+	}
+	return receipt, depo, nil
+}
+
+func (d *Dependencies) receiptError(c *fiber.Ctx, err error, receiptID uint) error {
+	if errors.Is(err, service.ErrDuplicateReceipt) { // the payment was already receipted, answer with that receipt
+		existing, getErr := d.Store.Receipts().Get(receiptID)
+		if getErr != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": getErr.Error()})
+		}
+		return c.JSON(fiber.Map{"status": "duplicate", "message": err.Error(), "receipt_id": existing.ID, "receipt": existing})
+	}
+
+	if errors.Is(err, service.ErrBankReferenceInUse) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	if errors.Is(err, service.ErrOverFunded) {
+		body := fiber.Map{"status": "error", "message": err.Error()}
+		if receiptID != 0 { // the rejected receipt is still recorded, a preview records nothing
+			body["receipt_id"] = receiptID
+		}
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(body)
+	}
+
+	if errors.Is(err, service.ErrLimitExceeded) || errors.Is(err, service.ErrNotEligible) || errors.Is(err, service.ErrAccountClosed) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	if status := constraintStatus(err); status != 0 {
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"receipt_id": receipt.ID})
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+}
+
+// paramID parses the ID in the path, returning repository.ErrNotFound for one that can't be a record's
+func paramID(c *fiber.Ctx) (uint, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return 0, repository.ErrNotFound
+	}
+	return uint(id), nil
+}
+
+// constraintStatus is the status to answer a write the database refused because of a constraint
+// with, 409 for a duplicate and 422 for a missing reference or a value out of range, or 0 for any
+// other error
+func constraintStatus(err error) int {
+	err = repository.TranslateError(err)
+	if errors.Is(err, repository.ErrConflict) {
+		return fiber.StatusConflict
+	}
+	if errors.Is(err, repository.ErrMissingReference) || errors.Is(err, repository.ErrInvalidValue) {
+		return fiber.StatusUnprocessableEntity
+	}
+	return 0
 }
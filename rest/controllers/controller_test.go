@@ -1,51 +1,63 @@
 package controllers
 
 import (
-	"ajbell.co.uk/app"
-	"ajbell.co.uk/config"
 	"ajbell.co.uk/pkg/models"
-	"github.com/DATA-DOG/go-sqlmock"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"encoding/json"
 	"github.com/gofiber/fiber/v2"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"io"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
-func TestGetDeposits(t *testing.T) {
+// memoryDeps returns the handlers' dependencies on a memory store holding the records
+func memoryDeps(t *testing.T, records ...interface{}) (*Dependencies, *repository.Memory) {
+	store := repository.NewMemory()
+	if err := store.Seed(records...); err != nil {
+		t.Fatalf("Unable to seed memory store: %v", err)
+	}
+	return NewStoreDependencies(store, service.Options{}), store
+}
 
-	// mock the db
-	testDB, mock, _ := sqlmock.New()
+func testClient(id uint, name string) *models.Client {
+	client := &models.Client{Name: name}
+	client.ID = id
+	return client
+}
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
-	if err != nil {
-		t.Fatalf("Error creating mock db")
-	}
+func testPot(id uint, clientID uint, name string) *models.Pot {
+	pot := &models.Pot{ClientID: clientID, Name: name}
+	pot.ID = id
+	return pot
+}
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
+func testAccount(id uint, potID uint, wrapper string) *models.Account {
+	account := &models.Account{PotID: potID, Wrapper: wrapper}
+	account.ID = id
+	return account
+}
 
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
+// closedAt is when the tests' closed clients, pots and accounts were closed
+var closedAt = time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
 
-	mock.ExpectQuery("SELECT \\* FROM \"deposits\"(.*)").WillReturnRows(idRow)
+// testDeposit is deposit 1 of £1,000 from client 1
+func testDeposit() *models.Deposit {
+	return &models.Deposit{ClientID: 1, Amount: 100000}
+}
 
-	mock.ExpectQuery("SELECT \\* FROM \"deposits\"(.*)").WithArgs("10", uint(1)).WillReturnError(gorm.ErrRecordNotFound)
+func TestGetDeposits(t *testing.T) {
+	deps, _ := memoryDeps(t, testDeposit())
 
 	app := fiber.New()
 
-	app.Get("/deposit/:id", GetDeposits)
+	app.Get("/deposit/:id", deps.GetDeposits)
 
 	t.Run("Successful retrieval of deposit with receipts and allocations", func(t *testing.T) {
 
@@ -70,36 +82,12 @@ func TestGetDeposits(t *testing.T) {
 }
 
 func TestCreateDeposits(t *testing.T) {
-
-	testDB, mock, _ := sqlmock.New()
-
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
-	if err != nil {
-		t.Fatalf("Error creating mock db")
-	}
-
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
-
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
-
-	mock.ExpectBegin()
-	mock.ExpectQuery("INSERT INTO \"deposits\"(.*)").WillReturnRows(idRow)
-	mock.ExpectQuery("INSERT INTO \"proposed_allocations\"(.*)").WillReturnRows(idRow)
-	mock.ExpectCommit()
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(1, 1, "Retirement"),
+		testAccount(1, 1, models.WrapperSIPP), testAccount(2, 1, models.WrapperISA), testAccount(4, 1, models.WrapperGIA))
 
 	app := fiber.New()
 
-	app.Post("/deposit", CreateDeposit)
+	app.Post("/deposit", deps.CreateDeposit)
 
 	t.Run("Successful creation of deposit", func(t *testing.T) {
 
@@ -112,6 +100,10 @@ func TestCreateDeposits(t *testing.T) {
 
 		assert.Equal(t, 201, resp.StatusCode)
 
+		deposit, err := store.Deposits().Get(1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(10000000), deposit.Amount)
+		assert.Len(t, deposit.ProposedAllocation, 3)
 	})
 	t.Run("Test unprocessable entity", func(t *testing.T) {
 
@@ -137,52 +129,62 @@ func TestCreateDeposits(t *testing.T) {
 
 	})
 
+	t.Run("Both split fields", func(t *testing.T) {
+
+		body := `{"client_id":1,"amount": 10000000,"proposed_allocation":[{"account_id":1,"split_bps":5600,"split":0.56},{"account_id":2,"split_bps":4400}]}`
+
+		req := httptest.NewRequest("POST", "/deposit", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+
+	})
+
 }
 
 type MockAllocationService struct {
 }
 
-func (s *MockAllocationService) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) error {
+func (s *MockAllocationService) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
 	if throwError {
-		return errors.New("Mock error")
+		return nil, errors.New("Mock error")
 	}
 
-	return nil
+	receipt.ID = 3
+	return mockAllocationResult(receipt), nil
 }
 
-var throwError = false
-
-func TestCreateAllocation(t *testing.T) {
+func (s *MockAllocationService) PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	if throwError {
+		return nil, errors.New("Mock error")
+	}
 
-	// mock the db
-	testDB, mock, _ := sqlmock.New()
+	return mockAllocationResult(receipt), nil
+}
 
-	dialector := postgres.New(postgres.Config{
-		DSN:                  "sqlmock_db_0",
-		DriverName:           "postgres",
-		Conn:                 testDB,
-		PreferSimpleProtocol: true,
-	})
-	db, err := gorm.Open(dialector, &gorm.Config{})
-	if err != nil {
-		t.Fatalf("Error creating mock db")
+func mockAllocationResult(receipt *models.Receipt) *service.AllocationResult {
+	return &service.AllocationResult{
+		ReceiptID:       receipt.ID,
+		Amount:          receipt.Amount,
+		FundingDecision: models.FundingAccepted,
+		Allocations: []service.PlannedAllocation{
+			{AccountID: 1, PotID: 1, Wrapper: models.WrapperISA, Amount: 60000, Overflow: 40000, OverflowTo: models.WrapperGIA, Reason: "ISA limit for 2024/25 only had room for 60000"},
+			{AccountID: 2, PotID: 1, Wrapper: models.WrapperGIA, Amount: 40000, FromOverflow: true},
+		},
 	}
+}
 
-	app.Http = &config.AppConfig{}
-	app.Http.Database = config.DatabaseConfig{
-		DB: db,
-	}
+var throwError = false
 
-	idRow := sqlmock.NewRows([]string{"id"}).
-		AddRow("1")
+func TestCreateAllocation(t *testing.T) {
 
-	mock.ExpectQuery("SELECT \\* FROM \"deposits\"(.*)").WillReturnRows(idRow)
+	deps, _ := memoryDeps(t, testDeposit())
 
 	app := fiber.New()
 
-	deps := Dependencies{
-		AllocationService: &MockAllocationService{},
-	}
+	deps.AllocationService = &MockAllocationService{}
 
 	app.Post("/deposit/:id/receipt", deps.ReceiptHandler)
 
@@ -212,3 +214,308 @@ func TestCreateAllocation(t *testing.T) {
 	})
 
 }
+
+type MockAllocationServiceOverLimit struct {
+}
+
+func (s *MockAllocationServiceOverLimit) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	return nil, errors.Wrap(service.ErrLimitExceeded, "JISA account 1 cannot take a further 100")
+}
+
+func (s *MockAllocationServiceOverLimit) PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	return s.AllocateReceipt(receipt, deposit)
+}
+
+func TestCreateAllocationOverLimit(t *testing.T) {
+
+	deps, _ := memoryDeps(t, testDeposit())
+
+	app := fiber.New()
+
+	deps.AllocationService = &MockAllocationServiceOverLimit{}
+
+	app.Post("/deposit/:id/receipt", deps.ReceiptHandler)
+
+	body := `{"amount":100000}`
+
+	req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, 422, resp.StatusCode)
+}
+
+type MockAllocationServiceOverFunded struct {
+}
+
+func (s *MockAllocationServiceOverFunded) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	receipt.ID = 7
+	receipt.FundingDecision = models.FundingRejected
+	return nil, errors.Wrap(service.ErrOverFunded, "receipt of 100000 is 5000 over deposit 1")
+}
+
+func (s *MockAllocationServiceOverFunded) PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	receipt.FundingDecision = models.FundingRejected
+	return nil, errors.Wrap(service.ErrOverFunded, "receipt of 100000 is 5000 over deposit 1")
+}
+
+func TestCreateAllocationOverFunded(t *testing.T) {
+	deps, _ := memoryDeps(t, testDeposit())
+
+	app := fiber.New()
+
+	deps.AllocationService = &MockAllocationServiceOverFunded{}
+
+	app.Post("/deposit/:id/receipt", deps.ReceiptHandler)
+
+	req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(`{"amount":100000}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, 422, resp.StatusCode)
+
+	raw, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(raw), `"receipt_id":7`)
+}
+
+func TestPreviewReceipt(t *testing.T) {
+	deps, _ := memoryDeps(t, testDeposit())
+
+	app := fiber.New()
+
+	deps.AllocationService = &MockAllocationService{}
+	overFunded := Dependencies{
+		Store:             deps.Store,
+		AllocationService: &MockAllocationServiceOverFunded{},
+	}
+
+	app.Post("/deposit/:id/receipt/preview", deps.ReceiptPreviewHandler)
+	app.Post("/overfunded/:id/receipt/preview", overFunded.ReceiptPreviewHandler)
+
+	t.Run("Planned allocations", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/deposit/1/receipt/preview", strings.NewReader(`{"amount":100000}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body service.AllocationResult
+		raw, _ := io.ReadAll(resp.Body)
+		assert.NoError(t, json.Unmarshal(raw, &body))
+		assert.Zero(t, body.ReceiptID)
+		assert.Len(t, body.Allocations, 2)
+		assert.Equal(t, models.WrapperGIA, body.Allocations[0].OverflowTo)
+		assert.NotEmpty(t, body.Allocations[0].Reason)
+	})
+
+	t.Run("Over-funded receipt", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/overfunded/1/receipt/preview", strings.NewReader(`{"amount":100000}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 422, resp.StatusCode)
+
+		// nothing is recorded by a preview, so there is no receipt to refer to
+		raw, _ := io.ReadAll(resp.Body)
+		assert.NotContains(t, string(raw), "receipt_id")
+	})
+
+	t.Run("Deposit does not exist", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/deposit/10/receipt/preview", strings.NewReader(`{"amount":100000}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
+
+type MockAllocationServiceDuplicate struct {
+	err error
+}
+
+func (s *MockAllocationServiceDuplicate) AllocateReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	if errors.Is(s.err, service.ErrDuplicateReceipt) {
+		receipt.ID = 3
+	}
+	return nil, errors.Wrapf(s.err, "%s is receipt 3", *receipt.BankReference)
+}
+
+func (s *MockAllocationServiceDuplicate) PreviewReceipt(receipt *models.Receipt, deposit *models.Deposit) (*service.AllocationResult, error) {
+	return s.AllocateReceipt(receipt, deposit)
+}
+
+func TestCreateAllocationDuplicate(t *testing.T) {
+	reference := "FP-1"
+	receipted := &models.Receipt{DepositID: 1, Amount: 100000, BankReference: &reference}
+	receipted.ID = 3
+	deps, _ := memoryDeps(t, testDeposit(), receipted, &models.Allocation{ReceiptID: 3, AccountID: 7, Amount: 100000})
+
+	app := fiber.New()
+
+	duplicate := Dependencies{
+		Store:             deps.Store,
+		AllocationService: &MockAllocationServiceDuplicate{err: service.ErrDuplicateReceipt},
+	}
+	inUse := Dependencies{
+		Store:             deps.Store,
+		AllocationService: &MockAllocationServiceDuplicate{err: service.ErrBankReferenceInUse},
+	}
+
+	app.Post("/deposit/:id/receipt", duplicate.ReceiptHandler)
+	app.Post("/inuse/:id/receipt", inUse.ReceiptHandler)
+
+	t.Run("Payment already receipted", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(`{"amount":100000,"bank_reference":"FP-1"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Status    string         `json:"status"`
+			ReceiptID uint           `json:"receipt_id"`
+			Receipt   models.Receipt `json:"receipt"`
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		assert.NoError(t, json.Unmarshal(raw, &body))
+		assert.Equal(t, "duplicate", body.Status)
+		assert.Equal(t, uint(3), body.ReceiptID)
+		assert.Len(t, body.Receipt.Allocations, 1)
+	})
+
+	t.Run("Bank reference belongs to another receipt", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/inuse/1/receipt", strings.NewReader(`{"amount":500,"bank_reference":"FP-1"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+}
+
+// unconnectedDB is a database handle that doesn't connect until it's used
+func unconnectedDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	return db
+}
+
+func TestNewDependencies(t *testing.T) {
+	first, second := unconnectedDB(t), unconnectedDB(t)
+
+	a := NewDependencies(first, service.Options{})
+	b := NewDependencies(second, service.Options{OverFunding: service.OverFundingReject})
+
+	// each set of handlers and its services share one database, and nothing with the other set
+	assert.Equal(t, repository.NewGorm(first), a.Store)
+	assert.Same(t, a.Store, a.AllocationService.(*service.AllocationService).Store)
+	assert.Same(t, b.Store, b.AllocationService.(*service.AllocationService).Store)
+	assert.NotSame(t, a.Store, b.Store)
+	assert.Equal(t, service.OverFundingReject, b.AllocationService.(*service.AllocationService).Options.OverFunding)
+	assert.Same(t, a.AllocationService, a.ReversalService)
+}
+
+func TestReceiptInMemory(t *testing.T) {
+	client := &models.Client{Name: "Client"}
+	client.ID = 1
+	pot := &models.Pot{ClientID: 1, Name: "Pot"}
+	pot.ID = 1
+	isa := &models.Account{PotID: 1, Wrapper: models.WrapperISA}
+	isa.ID = 1
+
+	store := repository.NewMemory()
+	if err := store.Seed(client, pot, isa, &models.WrapperLimit{Wrapper: models.WrapperISA, EffectiveFrom: 2017, Amount: 2000000}); err != nil {
+		t.Fatalf("Unable to seed memory store: %v", err)
+	}
+	deps := NewStoreDependencies(store, service.Options{})
+
+	app := fiber.New()
+
+	app.Post("/deposit", deps.CreateDeposit)
+	app.Get("/deposit/:id", deps.GetDeposits)
+	app.Post("/deposit/:id/receipt", deps.ReceiptHandler)
+
+	req := httptest.NewRequest("POST", "/deposit", strings.NewReader(`{"client_id":1,"amount":100000,"proposed_allocation":[{"account_id":1,"split":1}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	req = httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(`{"amount":100000,"bank_reference":"FP-1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	// the same payment again is answered with the first receipt
+	req = httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(`{"amount":100000,"bank_reference":"FP-1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = app.Test(httptest.NewRequest("GET", "/deposit/1", nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var deposit models.Deposit
+	raw, _ := io.ReadAll(resp.Body)
+	assert.NoError(t, json.Unmarshal(raw, &deposit))
+	assert.Len(t, deposit.Receipts, 1)
+	assert.Len(t, deposit.Receipts[0].Allocations, 1)
+	assert.Equal(t, int64(100000), deposit.Receipts[0].Allocations[0].Amount)
+
+	resp, _ = app.Test(httptest.NewRequest("GET", "/deposit/2", nil))
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// the account must exist for money to be split into it
+	req = httptest.NewRequest("POST", "/deposit", strings.NewReader(`{"client_id":1,"amount":100000,"proposed_allocation":[{"account_id":9,"split":1}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	assert.Equal(t, 422, resp.StatusCode)
+}
+
+func TestReceiptIgnoresDecisionFields(t *testing.T) {
+	client := &models.Client{Name: "Client"}
+	client.ID = 1
+	pot := &models.Pot{ClientID: 1, Name: "Pot"}
+	pot.ID = 1
+	gia := &models.Account{PotID: 1, Wrapper: models.WrapperGIA}
+	gia.ID = 1
+	deposit := &models.Deposit{ClientID: 1, Amount: 100000, ProposedAllocation: []models.ProposedAllocation{{AccountID: 1, Split: models.WholeSplit}}}
+	deposit.ID = 1
+
+	store := repository.NewMemory()
+	if err := store.Seed(client, pot, gia, deposit); err != nil {
+		t.Fatalf("Unable to seed memory store: %v", err)
+	}
+	deps := NewStoreDependencies(store, service.Options{})
+
+	app := fiber.New()
+	app.Post("/deposit/:id/receipt", deps.ReceiptHandler)
+
+	// only the amount, bank reference and value date are the client's to say
+	body := `{"amount":100000,"suspense_amount":100000,"excess_amount":5,"funding_decision":"rejected",
+		"needs_review":true,"CreatedAt":"2019-01-01T00:00:00Z","value_date":"2024-09-02T00:00:00Z"}`
+	req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	receipt, err := store.Receipts().Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FundingAccepted, receipt.FundingDecision)
+	assert.Equal(t, int64(0), receipt.SuspenseAmount)
+	assert.Equal(t, int64(0), receipt.ExcessAmount)
+	assert.False(t, receipt.NeedsReview)
+	assert.True(t, receipt.CreatedAt.After(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)))
+
+	req = httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(`{"bank_reference":"FP-2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ = app.Test(req)
+	assert.Equal(t, 400, resp.StatusCode)
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"time"
+)
+
+/**
+Example request:
+
+{
+	"name": "Retirement"
+}
+
+*/
+
+func (d *Dependencies) CreatePot(c *fiber.Ctx) error {
+
+	var payload *models.Pot
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	pot := models.Pot{Name: payload.Name}
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		var client models.Client
+		if err := getRecord(c, tx.Clients().Get, &client); err != nil {
+			return err
+		}
+		if client.ClosedAt != nil {
+			return errClosed
+		}
+		pot.ClientID = client.ID
+		return tx.Pots().Create(&pot)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if errors.Is(err, errClosed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": "Client is closed"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"pot_id": pot.ID})
+}
+
+func (d *Dependencies) GetClientPots(c *fiber.Ctx) error {
+
+	var client models.Client
+
+	err := getRecord(c, d.Store.Clients().GetWithPots, &client)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Client does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	// want an empty an array instead of null within the json
+	if client.Pots == nil {
+		client.Pots = make([]models.Pot, 0)
+	}
+	return c.JSON(client.Pots)
+}
+
+func (d *Dependencies) GetPot(c *fiber.Ctx) error {
+
+	var pot models.Pot
+
+	err := getRecord(c, d.Store.Pots().Get, &pot)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Pot does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(pot)
+}
+
+func (d *Dependencies) UpdatePot(c *fiber.Ctx) error {
+
+	var payload *models.Pot
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	var pot models.Pot
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Pots().Get, &pot); err != nil {
+			return err
+		}
+		if pot.ClosedAt != nil {
+			return errClosed
+		}
+		return tx.Pots().Rename(&pot, payload.Name)
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Pot does not exist"})
+	}
+	if errors.Is(err, errClosed) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"status": "error", "message": "Pot is closed"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"pot_id": pot.ID})
+}
+
+// ClosePot closes a pot once all of its accounts have been closed
+func (d *Dependencies) ClosePot(c *fiber.Ctx) error {
+
+	var pot models.Pot
+
+	err := d.Store.Transaction(func(tx repository.Repositories) error {
+		if err := getRecord(c, tx.Pots().Get, &pot); err != nil {
+			return err
+		}
+
+		openAccounts, err := tx.Pots().CountOpenAccounts(pot.ID)
+		if err != nil {
+			return err
+		}
+		if openAccounts > 0 {
+			return errors.Wrapf(errStillOpen, "pot %d has %d open accounts", pot.ID, openAccounts)
+		}
+
+		return closeRecord(pot.ClosedAt, func(at time.Time) error { return tx.Pots().Close(&pot, at) })
+	})
+
+	return closeResponse(c, err, "Pot", fiber.Map{"pot_id": pot.ID, "closed_at": pot.ClosedAt})
+}
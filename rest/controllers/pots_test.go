@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreatePot(t *testing.T) {
+	john := testClient(2, "John")
+	john.ClosedAt = &closedAt
+	deps, store := memoryDeps(t, testClient(1, "Jane"), john, testPot(4, 1, "Rainy day"))
+
+	app := fiber.New()
+
+	app.Post("/clients/:id/pots", deps.CreatePot)
+
+	t.Run("Successful creation of pot", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/1/pots", strings.NewReader(`{"name":"Retirement"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 201, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"pot_id":5}`, string(raw))
+
+		pot, err := store.Pots().Get(5)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(1), pot.ClientID)
+		assert.Equal(t, "Retirement", pot.Name)
+	})
+
+	t.Run("Client is closed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/2/pots", strings.NewReader(`{"name":"Retirement"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+
+	t.Run("Cant find client", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/3/pots", strings.NewReader(`{"name":"Retirement"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+
+	t.Run("Name is required", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/clients/1/pots", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
+
+func TestGetClientPots(t *testing.T) {
+	deps, _ := memoryDeps(t, testClient(1, "Jane"))
+
+	app := fiber.New()
+
+	app.Get("/clients/:id/pots", deps.GetClientPots)
+
+	req := httptest.NewRequest("GET", "/clients/1/pots", nil)
+
+	resp, _ := app.Test(req)
+
+	assert.Equal(t, 200, resp.StatusCode)
+
+	raw, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `[]`, string(raw))
+}
+
+func TestUpdatePot(t *testing.T) {
+	closedPot := testPot(6, 1, "Old")
+	closedPot.ClosedAt = &closedAt
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"), closedPot)
+
+	app := fiber.New()
+
+	app.Put("/pots/:id", deps.UpdatePot)
+
+	t.Run("Successful rename of pot", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/pots/5", strings.NewReader(`{"name":"Pension"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		pot, err := store.Pots().Get(5)
+		assert.NoError(t, err)
+		assert.Equal(t, "Pension", pot.Name)
+	})
+
+	t.Run("Pot is closed", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/pots/6", strings.NewReader(`{"name":"Pension"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+	})
+}
+
+func TestClosePot(t *testing.T) {
+	deps, store := memoryDeps(t, testClient(1, "Jane"), testPot(5, 1, "Retirement"), testPot(6, 1, "Rainy day"),
+		testAccount(1, 5, "ISA"), testAccount(2, 5, "SIPP"))
+
+	app := fiber.New()
+
+	app.Post("/pots/:id/close", deps.ClosePot)
+
+	t.Run("Pot still has open accounts", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/5/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 409, resp.StatusCode)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(raw), "pot 5 has 2 open accounts")
+	})
+
+	t.Run("Successful close of pot", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pots/6/close", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		pot, err := store.Pots().Get(6)
+		assert.NoError(t, err)
+		assert.NotNil(t, pot.ClosedAt)
+	})
+}
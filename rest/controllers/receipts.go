@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+/**
+Example request:
+
+GET /api/v1/receipts/review
+
+Lists the receipts flagged for review, e.g. possible duplicates of another receipt, oldest first
+
+*/
+
+func (d *Dependencies) GetReceiptsForReview(c *fiber.Ctx) error {
+
+	receipts, err := d.Store.Receipts().ForReview()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(receipts)
+}
+
+/**
+Example request:
+
+POST /api/v1/receipts/7/review
+
+Records that a flagged receipt has been checked, a receipt found to be a duplicate is taken back
+out with a reversal
+
+*/
+
+func (d *Dependencies) ReviewReceipt(c *fiber.Ctx) error {
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Receipt does not exist"})
+	}
+
+	var receipt *models.Receipt
+
+	err = d.Store.Transaction(func(tx repository.Repositories) error {
+		receipt, err = tx.Receipts().Lock(uint(id))
+		if err != nil {
+			return err
+		}
+		if !receipt.NeedsReview {
+			return nil
+		}
+		return tx.Receipts().MarkReviewed(receipt, time.Now())
+	})
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Receipt does not exist"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"receipt_id": receipt.ID, "needs_review": receipt.NeedsReview, "reviewed_at": receipt.ReviewedAt})
+}
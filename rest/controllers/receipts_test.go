@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// reviewReceipts is deposit 1 with receipt 4 waiting for review, receipt 5 reviewed on 3 September
+// 2024 and receipt 6 that never needed one
+func reviewReceipts(t *testing.T) (*Dependencies, *repository.Memory) {
+	reviewedAt := time.Date(2024, time.September, 3, 0, 0, 0, 0, time.UTC)
+
+	waiting := &models.Receipt{DepositID: 1, Amount: 5000, NeedsReview: true,
+		ReviewReason: "possible duplicate of receipt 3, same amount and deposit on 2024-09-02"}
+	waiting.ID = 4
+	reviewed := &models.Receipt{DepositID: 1, Amount: 5000, ReviewedAt: &reviewedAt}
+	reviewed.ID = 5
+	clear := &models.Receipt{DepositID: 1, Amount: 5000}
+	clear.ID = 6
+	return memoryDeps(t, &models.Deposit{ClientID: 1, Amount: 15000}, waiting, reviewed, clear)
+}
+
+func TestGetReceiptsForReview(t *testing.T) {
+	deps, _ := reviewReceipts(t)
+
+	app := fiber.New()
+
+	app.Get("/receipts/review", deps.GetReceiptsForReview)
+
+	req := httptest.NewRequest("GET", "/receipts/review", nil)
+	resp, _ := app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var receipts []models.Receipt
+	raw, _ := io.ReadAll(resp.Body)
+	assert.NoError(t, json.Unmarshal(raw, &receipts))
+	assert.Len(t, receipts, 1)
+	assert.Equal(t, uint(4), receipts[0].ID)
+	assert.True(t, receipts[0].NeedsReview)
+}
+
+func TestReviewReceipt(t *testing.T) {
+	deps, store := reviewReceipts(t)
+
+	app := fiber.New()
+
+	app.Get("/receipts/review", deps.GetReceiptsForReview)
+	app.Post("/receipts/:id/review", deps.ReviewReceipt)
+
+	req := httptest.NewRequest("POST", "/receipts/4/review", nil)
+	resp, _ := app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var body struct {
+		NeedsReview bool       `json:"needs_review"`
+		ReviewedAt  *time.Time `json:"reviewed_at"`
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	assert.NoError(t, json.Unmarshal(raw, &body))
+	assert.False(t, body.NeedsReview)
+	assert.NotNil(t, body.ReviewedAt)
+
+	receipt, err := store.Receipts().Get(4)
+	assert.NoError(t, err)
+	assert.NotNil(t, receipt.ReviewedAt)
+
+	resp, _ = app.Test(httptest.NewRequest("GET", "/receipts/review", nil))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	raw, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `[]`, string(raw), "nothing is left to review")
+
+	// reviewing again leaves the original review time
+	req = httptest.NewRequest("POST", "/receipts/5/review", nil)
+	resp, _ = app.Test(req)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	raw, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"receipt_id":5,"needs_review":false,"reviewed_at":"2024-09-03T00:00:00Z"}`, string(raw))
+
+	req = httptest.NewRequest("POST", "/receipts/7/review", nil)
+	resp, _ = app.Test(req)
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReliefClaims struct {
+	Month       string               `json:"month"`
+	Status      string               `json:"status"`
+	Claims      []models.ReliefClaim `json:"claims"`
+	TotalGross  int64                `json:"total_gross"`
+	TotalRelief int64                `json:"total_relief"`
+}
+
+/**
+Example request:
+
+GET /api/v1/relief-claims?month=2024-09
+
+Lists the SIPP relief at source claims made on contributions received in the month, pending
+claims unless another status is asked for with &status=claimed
+
+*/
+
+func (d *Dependencies) GetReliefClaims(c *fiber.Ctx) error {
+
+	month := c.Query("month")
+	status := c.Query("status", models.ClaimStatusPending)
+
+	if status != models.ClaimStatusPending && status != models.ClaimStatusClaimed {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "Unknown claim status"})
+	}
+
+	start, end, err := models.ParseMonth(month)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": "month must be given as YYYY-MM"})
+	}
+
+	claims, err := d.Store.ReliefClaims().List(status, start, end)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	response := ReliefClaims{Month: month, Status: status, Claims: claims}
+	for _, claim := range claims {
+		response.TotalGross += claim.GrossAmount
+		response.TotalRelief += claim.ReliefAmount
+	}
+
+	return c.JSON(response)
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetReliefClaims(t *testing.T) {
+	// reliefClaim is receipt id, received at receivedAt, and its allocation with a relief claim
+	reliefClaim := func(id uint, gross int64, relief int64, status string, receivedAt time.Time) []interface{} {
+		receipt := &models.Receipt{DepositID: 1, Amount: uint(gross - relief), ValueDate: &receivedAt}
+		receipt.ID = id
+		claim := &models.ReliefClaim{GrossAmount: gross, ReliefAmount: relief, Status: status}
+		return []interface{}{receipt, &models.Allocation{ReceiptID: id, AccountID: 1, Amount: gross - relief, ReliefClaim: claim}}
+	}
+	var records []interface{}
+	records = append(records, reliefClaim(1, 1250, 250, models.ClaimStatusPending, time.Date(2024, time.September, 2, 0, 0, 0, 0, time.UTC))...)
+	records = append(records, reliefClaim(2, 12500, 2500, models.ClaimStatusPending, time.Date(2024, time.September, 20, 0, 0, 0, 0, time.UTC))...)
+	records = append(records, reliefClaim(3, 500, 100, models.ClaimStatusClaimed, time.Date(2024, time.September, 21, 0, 0, 0, 0, time.UTC))...)
+	records = append(records, reliefClaim(4, 2500, 500, models.ClaimStatusPending, time.Date(2024, time.October, 1, 0, 0, 0, 0, time.UTC))...)
+	deps, _ := memoryDeps(t, records...)
+
+	app := fiber.New()
+
+	app.Get("/relief-claims", deps.GetReliefClaims)
+
+	t.Run("Pending claims for the month", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/relief-claims?month=2024-09", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body ReliefClaims
+		raw, _ := io.ReadAll(resp.Body)
+		assert.NoError(t, json.Unmarshal(raw, &body))
+		assert.Equal(t, "2024-09", body.Month)
+		assert.Equal(t, models.ClaimStatusPending, body.Status)
+		assert.Len(t, body.Claims, 2)
+		assert.Equal(t, int64(13750), body.TotalGross)
+		assert.Equal(t, int64(2750), body.TotalRelief)
+	})
+
+	t.Run("Month is required", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/relief-claims", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+
+	t.Run("Unknown status", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/relief-claims?month=2024-09&status=lost", nil)
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
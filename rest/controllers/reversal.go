@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/repository"
+	"ajbell.co.uk/pkg/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+type ReversalRequest struct {
+	Amount *int64 `json:"amount" validate:"omitempty,gt=0"` // leave out to reverse everything left of the receipt
+	Reason string `json:"reason" validate:"required"`
+}
+
+/**
+Example request:
+
+{
+	"amount": 250000,
+	"reason": "bank recall"
+}
+
+*/
+
+func (d *Dependencies) ReversalHandler(c *fiber.Ctx) error {
+
+	var payload *ReversalRequest
+
+	if err := c.BodyParser(&payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	validationErrors := models.ValidateStruct(payload)
+
+	if validationErrors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(validationErrors)
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Receipt does not exist"})
+	}
+
+	reversal, err := d.ReversalService.ReverseReceipt(uint(id), payload.Amount, payload.Reason)
+
+	if errors.Is(err, repository.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"status": "error", "message": "Receipt does not exist"})
+	}
+	if errors.Is(err, service.ErrReversalTooLarge) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if status := constraintStatus(err); status != 0 {
+		return c.Status(status).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(reversal)
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"ajbell.co.uk/pkg/models"
+	"ajbell.co.uk/pkg/service"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type MockReversalService struct {
+	amount *int64
+}
+
+func (s *MockReversalService) ReverseReceipt(receiptID uint, amount *int64, reason string) (*models.Reversal, error) {
+	s.amount = amount
+	switch receiptID {
+	case 2:
+		return nil, gorm.ErrRecordNotFound
+	case 3:
+		return nil, errors.Wrap(service.ErrReversalTooLarge, "receipt 3")
+	}
+	reversal := &models.Reversal{ReceiptID: receiptID, Amount: 250000, Reason: reason}
+	reversal.ID = 1
+	return reversal, nil
+}
+
+func TestReversal(t *testing.T) {
+	reversals := &MockReversalService{}
+
+	deps := Dependencies{
+		ReversalService: reversals,
+	}
+
+	app := fiber.New()
+
+	app.Post("/receipts/:id/reversal", deps.ReversalHandler)
+
+	post := func(path, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, _ := app.Test(req)
+		return resp.StatusCode
+	}
+
+	t.Run("Successful partial reversal", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/receipts/1/reversal", strings.NewReader(`{"amount":250000,"reason":"bank recall"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, _ := app.Test(req)
+
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, int64(250000), *reversals.amount)
+
+		raw, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(raw), `"reason":"bank recall"`)
+	})
+
+	t.Run("Full reversal", func(t *testing.T) {
+		assert.Equal(t, 201, post("/receipts/1/reversal", `{"reason":"refund"}`))
+		assert.Nil(t, reversals.amount)
+	})
+
+	t.Run("Reason is required", func(t *testing.T) {
+		assert.Equal(t, 400, post("/receipts/1/reversal", `{"amount":100}`))
+	})
+
+	t.Run("Amount must be positive", func(t *testing.T) {
+		assert.Equal(t, 400, post("/receipts/1/reversal", `{"amount":-100,"reason":"refund"}`))
+	})
+
+	t.Run("Cant find receipt", func(t *testing.T) {
+		assert.Equal(t, 404, post("/receipts/2/reversal", `{"reason":"refund"}`))
+	})
+
+	t.Run("More than is left to reverse", func(t *testing.T) {
+		assert.Equal(t, 422, post("/receipts/3/reversal", `{"amount":100,"reason":"refund"}`))
+	})
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/gofiber/fiber/v2"
+	"time"
+)
+
+// fingerprintPrefix keeps the fingerprints apart from the responses the idempotency middleware
+// stores against the same keys
+const fingerprintPrefix = "fingerprint:"
+
+// FingerprintStorage is a fiber.Storage that can store a value only when the key has none, in one
+// step, so two requests with the same key can't both record their fingerprint
+type FingerprintStorage interface {
+	fiber.Storage
+	SetIfAbsent(key string, val []byte, exp time.Duration) (bool, error)
+}
+
+type FingerprintConfig struct {
+	KeyHeader string
+	Lifetime  time.Duration
+	Storage   FingerprintStorage
+}
+
+// Fingerprint rejects an idempotency key reused for a different request with a 422. The idempotency
+// middleware would otherwise answer it with the response to the first request without running it,
+// so it has to come before the idempotency middleware.
+func Fingerprint(cfg FingerprintConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(cfg.KeyHeader)
+		if key == "" || fiber.IsMethodSafe(c.Method()) {
+			return c.Next()
+		}
+
+		fingerprint := fingerprintOf(c)
+
+		stored, err := cfg.Storage.SetIfAbsent(fingerprintPrefix+key, fingerprint, cfg.Lifetime)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+		}
+		if stored { // the first request with the key
+			return c.Next()
+		}
+
+		existing, err := cfg.Storage.Get(fingerprintPrefix + key)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"status": "error", "message": err.Error()})
+		}
+		if !bytes.Equal(existing, fingerprint) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"status": "error", "message": "Idempotency key " + key + " was already used for a different request"})
+		}
+
+		return c.Next()
+	}
+}
+
+// fingerprintOf hashes the method, path and body, which a retry must repeat exactly
+func fingerprintOf(c *fiber.Ctx) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(c.Method()))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.Path()))
+	hash.Write([]byte{0})
+	hash.Write(c.Body())
+	return hash.Sum(nil)
+}
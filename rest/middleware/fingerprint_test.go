@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/idempotency"
+	"github.com/gofiber/storage/memory/v2"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryStorage adds SetIfAbsent to fiber's memory storage
+type memoryStorage struct {
+	*memory.Storage
+	mu sync.Mutex
+}
+
+func (s *memoryStorage) SetIfAbsent(key string, val []byte, exp time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.Get(key)
+	if err != nil || existing != nil {
+		return false, err
+	}
+	return true, s.Set(key, val, exp)
+}
+
+func TestFingerprint(t *testing.T) {
+	store := &memoryStorage{Storage: memory.New()}
+	receipts := 0
+
+	app := fiber.New()
+	app.Use(Fingerprint(FingerprintConfig{KeyHeader: "X-Idempotency-Key", Lifetime: time.Hour, Storage: store}))
+	app.Use(idempotency.New(idempotency.Config{KeyHeader: "X-Idempotency-Key", Lifetime: time.Hour, Storage: store}))
+	app.Post("/deposit/:id/receipt", func(c *fiber.Ctx) error {
+		receipts++
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"receipt_id": receipts})
+	})
+
+	post := func(key, body string) int {
+		req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-Idempotency-Key", key)
+		}
+		resp, _ := app.Test(req)
+		return resp.StatusCode
+	}
+
+	key := "8d1c5a3e-2f4b-4c6d-9e7f-0a1b2c3d4e5f"
+
+	t.Run("Retry is answered without allocating again", func(t *testing.T) {
+		assert.Equal(t, 201, post(key, `{"amount":100000}`))
+		assert.Equal(t, 201, post(key, `{"amount":100000}`))
+		assert.Equal(t, 1, receipts)
+	})
+
+	t.Run("Key reused for a different request", func(t *testing.T) {
+		assert.Equal(t, 422, post(key, `{"amount":200000}`))
+		assert.Equal(t, 1, receipts)
+	})
+
+	t.Run("Requests without a key", func(t *testing.T) {
+		assert.Equal(t, 201, post("", `{"amount":100000}`))
+		assert.Equal(t, 2, receipts)
+	})
+}
+
+func TestFingerprintConcurrent(t *testing.T) {
+	store := &memoryStorage{Storage: memory.New()}
+	var receipts int32
+
+	app := fiber.New()
+	app.Use(Fingerprint(FingerprintConfig{KeyHeader: "X-Idempotency-Key", Lifetime: time.Hour, Storage: store}))
+	app.Post("/deposit/:id/receipt", func(c *fiber.Ctx) error {
+		atomic.AddInt32(&receipts, 1)
+		return c.SendStatus(fiber.StatusCreated)
+	})
+
+	// requests racing with the same key for different amounts, only one is let through
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/deposit/1/receipt", strings.NewReader(fmt.Sprintf(`{"amount":%d}`, 1000+i)))
+			req.Header.Set("X-Idempotency-Key", "same-key")
+			resp, err := app.Test(req)
+			if assert.NoError(t, err) {
+				statuses[i] = resp.StatusCode
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), receipts)
+	rejected := 0
+	for _, status := range statuses {
+		if status == 422 {
+			rejected++
+		}
+	}
+	assert.Equal(t, len(statuses)-1, rejected)
+}
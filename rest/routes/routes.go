@@ -1,25 +1,53 @@
 package routes
 
 import (
-	"ajbell.co.uk/pkg/service"
 	"ajbell.co.uk/rest/controllers"
 	"github.com/gofiber/fiber/v2"
 )
 
-func LoadRoutes(app *fiber.App) {
+func LoadRoutes(app *fiber.App, deps *controllers.Dependencies) {
 	api := app.Group("/api/v1")
 
 	// DEPOSIT CREATION
-	api.Post("/deposit", controllers.CreateDeposit)
-	api.Get("/deposit/:id", controllers.GetDeposits)
-
-	allocationService := service.NewAllocationService()
-
-	deps := controllers.Dependencies{
-		AllocationService: allocationService,
-	}
+	api.Post("/deposit", deps.CreateDeposit)
+	api.Get("/deposit/:id", deps.GetDeposits)
 
 	//// attach the receipt
 	api.Post("/deposit/:id/receipt", deps.ReceiptHandler)
+	// where a receipt would go, without recording anything
+	api.Post("/deposit/:id/receipt/preview", deps.ReceiptPreviewHandler)
+
+	// take a receipt's money back out, in full or in part
+	api.Post("/receipts/:id/reversal", deps.ReversalHandler)
+	// receipts flagged for review, e.g. possible duplicates
+	api.Get("/receipts/review", deps.GetReceiptsForReview)
+	api.Post("/receipts/:id/review", deps.ReviewReceipt)
+
+	// CLIENTS, POTS AND ACCOUNTS
+	api.Post("/clients", deps.CreateClient)
+	api.Get("/clients/:id", deps.GetClient)
+	api.Put("/clients/:id", deps.UpdateClient)
+	api.Post("/clients/:id/close", deps.CloseClient)
+
+	api.Post("/clients/:id/pots", deps.CreatePot)
+	api.Get("/clients/:id/pots", deps.GetClientPots)
+	api.Get("/pots/:id", deps.GetPot)
+	api.Put("/pots/:id", deps.UpdatePot)
+	api.Post("/pots/:id/close", deps.ClosePot)
+
+	api.Post("/pots/:id/accounts", deps.CreateAccount)
+	api.Get("/pots/:id/accounts", deps.GetPotAccounts)
+	api.Get("/accounts/:id", deps.GetAccount)
+	api.Put("/accounts/:id", deps.UpdateAccount)
+	api.Post("/accounts/:id/close", deps.CloseAccount)
+
+	api.Post("/allocations/:id/settle", deps.SettleAllocation)
+
+	// PENSION ALLOWANCE
+	api.Get("/clients/:id/pension-allowance", deps.GetPensionAllowance)
+	api.Put("/clients/:id/pension-allowance", deps.UpdatePensionAllowance)
+
+	// SIPP RELIEF AT SOURCE
+	api.Get("/relief-claims", deps.GetReliefClaims)
 
 }
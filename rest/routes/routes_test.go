@@ -1,6 +1,8 @@
 package routes
 
 import (
+	"ajbell.co.uk/pkg/service"
+	"ajbell.co.uk/rest/controllers"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -20,10 +22,32 @@ func TestLoadRoutes(t *testing.T) {
 	app := fiber.New()
 
 	// Call the LoadRoutes function
-	LoadRoutes(app)
+	LoadRoutes(app, controllers.NewDependencies(nil, service.Options{}))
 
 	// Assert that the app has the expected routes
 	assert.True(t, hasRoute(app, "POST", "/api/v1/deposit"))
 	assert.True(t, hasRoute(app, "GET", "/api/v1/deposit/:id"))
 	assert.True(t, hasRoute(app, "POST", "/api/v1/deposit/:id/receipt"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/deposit/:id/receipt/preview"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/receipts/review"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/receipts/:id/review"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/receipts/:id/reversal"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/clients"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/clients/:id"))
+	assert.True(t, hasRoute(app, "PUT", "/api/v1/clients/:id"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/clients/:id/close"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/clients/:id/pots"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/clients/:id/pots"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/pots/:id"))
+	assert.True(t, hasRoute(app, "PUT", "/api/v1/pots/:id"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/pots/:id/close"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/pots/:id/accounts"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/pots/:id/accounts"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/accounts/:id"))
+	assert.True(t, hasRoute(app, "PUT", "/api/v1/accounts/:id"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/accounts/:id/close"))
+	assert.True(t, hasRoute(app, "POST", "/api/v1/allocations/:id/settle"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/clients/:id/pension-allowance"))
+	assert.True(t, hasRoute(app, "PUT", "/api/v1/clients/:id/pension-allowance"))
+	assert.True(t, hasRoute(app, "GET", "/api/v1/relief-claims"))
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"ajbell.co.uk/pkg/storage"
+	"ajbell.co.uk/rest/controllers"
+	"ajbell.co.uk/rest/middleware"
+	"ajbell.co.uk/rest/routes"
+	"context"
+	"flag"
+	"github.com/gofiber/fiber/v2/middleware/idempotency"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const serveUsage = "serve"
+
+// serve starts the API, once the database has every migration applied, and serves until SIGTERM
+func serve(c *cli, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	rest, err := parseFlags(flags, args, serveUsage)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return usageError{usage: serveUsage}
+	}
+
+	cfg, err := c.loadCurrent()
+	if err != nil {
+		return err
+	}
+
+	// ensures idempotency, with keys kept in postgres so they survive restarts and are shared between
+	// instances. Keys are locked in postgres too, so a retry reaching another instance waits for the
+	// first request, on a bounded share of the pool. Expired keys are deleted as often as keys expire.
+	store := storage.NewPostgres(cfg.Database.DB, cfg.Idempotency.Lifetime)
+	defer store.Close()
+	cfg.Server.App.Use(middleware.Fingerprint(middleware.FingerprintConfig{
+		KeyHeader: cfg.Idempotency.KeyHeader,
+		Lifetime:  cfg.Idempotency.Lifetime,
+		Storage:   store,
+	}))
+	cfg.Server.App.Use(idempotency.New(idempotency.Config{
+		Lifetime:  cfg.Idempotency.Lifetime,
+		KeyHeader: cfg.Idempotency.KeyHeader,
+		Storage:   store,
+		Lock:      storage.NewPostgresLock(cfg.Database.DB, cfg.Idempotency.LockConnections, cfg.Idempotency.LockTimeout),
+	}))
+
+	deps := controllers.NewDependencies(cfg.Database.DB, serviceOptions(cfg))
+	routes.LoadRoutes(cfg.Server.App, deps)
+
+	cfg.Route404()
+
+	// a deploy sends SIGTERM, stop taking requests and let the ones in flight finish, so no
+	// allocation is cut off mid-transaction. The database pool is closed once serve returns.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	return cfg.Server.Serve(ctx)
+}